@@ -6,11 +6,18 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/pokemium/magia/pkg/emulator"
-	"github.com/pokemium/magia/pkg/emulator/audio"
+	viewer "github.com/pokemium/magia/pkg/emulator/debug"
+	"github.com/pokemium/magia/pkg/emulator/filter"
 	"github.com/pokemium/magia/pkg/emulator/joypad"
+	"github.com/pokemium/magia/pkg/emulator/record"
 	"github.com/pokemium/magia/pkg/gba"
+	"github.com/pokemium/magia/pkg/gba/apu"
+	"github.com/pokemium/magia/pkg/gba/sio"
+	"github.com/pokemium/magia/pkg/gba/video"
+	"github.com/pokemium/magia/pkg/m4a"
 
 	"github.com/hajimehoshi/ebiten/v2"
 )
@@ -45,6 +52,12 @@ Arguments:
 
 		fmt.Fprintf(os.Stderr, usage)
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, `
+Debug viewers:
+  F2 switches the window between the game and the BG map, tile, OBJ, palette and sound viewers.
+  ebiten v2.0.8 supports only one window, so the viewers replace the game screen instead of opening windows of their own.
+  -dump exports the same images as PNG without window.
+`)
 	}
 }
 
@@ -60,6 +73,32 @@ func Run() ExitCode {
 		showBIOSIntro = flag.Bool("b", false, "show BIOS intro")
 		showCartInfo  = flag.Bool("c", false, "show cartridge info")
 		mute          = flag.Bool("m", false, "mute sound")
+		audioRate     = flag.Int("audio-rate", apu.DefaultSampleRate, "output sample rate of the sound (e.g. 44100, 48000)")
+		deviceRate    = flag.Int("audio-device-rate", 0, "sample rate of the audio device (0: same as -audio-rate)")
+		pixelAccurate = flag.Bool("p", false, "pixel-accurate rendering (mid-scanline register writes)")
+		renderThreads = flag.Int("j", 0, "render scanlines on N threads (0: single-threaded)")
+		inputLine     = flag.Int("input-line", 160, "scanline (0-227) where the keys are read every frame")
+		keysPath      = flag.String("keys", "", "config file of the key bindings (default: magia/input.json in the user config directory)")
+		keysInit      = flag.Bool("keys-init", false, "write the default key bindings into the config file and exit")
+		dumpDir       = flag.String("dump", "", "run without window and export BG maps, tiles, OBJs and palettes into the directory as PNG")
+		dumpFrame     = flag.Int("dump-frame", 300, "frame to export with -dump")
+		dumpPalette   = flag.Int("dump-palette", 0, "palette of the exported tile sheets (0-15: BG, 16-31: OBJ)")
+		filters       = flag.String("filter", "", "comma separated post-processing filters ("+strings.Join(filter.Names, ", ")+")")
+		integerScale  = flag.Bool("integer", false, "scale the screen only by integers")
+		useShader     = flag.Bool("shader", false, "draw scanlines and LCD grid with a GPU shader")
+		colorProfile  = flag.String("color", "raw", "color correction ("+strings.Join(video.ColorProfileNames(), ", ")+")")
+		ghosting      = flag.String("ghost", "off", "LCD ghosting ("+strings.Join(video.GhostingModeNames(), ", ")+")")
+		recordPath    = flag.String("record", "", "record video and sound into the file ("+strings.Join(record.Formats, ", ")+"), F10 toggles recording")
+		recordFrames  = flag.Int("record-frames", 0, "run without window and record the frames with -record")
+		persistence   = flag.Float64("ghost-persistence", video.DefaultPersistence, "weight of the previous frames with -ghost decay (0-1)")
+		muteChannels  = flag.String("mute-ch", "", "comma separated sound channels to mute ("+strings.Join(apu.ChannelNames(), ", ")+")")
+		soloChannels  = flag.String("solo-ch", "", "comma separated sound channels to play alone")
+		recordChans   = flag.Bool("record-channels", false, "also record each sound channel into XXXX-<channel>.wav with -record and F10")
+		linkHost      = flag.String("link-host", "", "host a link cable session at the address (e.g. :5738) as the parent")
+		linkJoin      = flag.String("link", "", "join the link cable session hosted with -link-host at the address (e.g. 127.0.0.1:5738)")
+		dolphinHost   = flag.String("dolphin", "", "connect to the GBA (TCP) controller of Dolphin at the host (e.g. 127.0.0.1) as a JOY Bus device")
+		m4aList       = flag.Bool("m4a-list", false, "list the songs of the M4A sound engine")
+		m4aExport     = flag.String("m4a-export", "", "export the songs of the M4A sound engine into the directory as MIDI, and their samples as WAV")
 	)
 
 	flag.Parse()
@@ -68,6 +107,23 @@ func Run() ExitCode {
 		return ExitCodeOK
 	}
 
+	if *keysPath == "" {
+		p, err := joypad.ConfigPath()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to find config directory: %s\n", err)
+			return ExitCodeError
+		}
+		*keysPath = p
+	}
+	if *keysInit {
+		if err := joypad.DefaultConfig().Save(*keysPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write key bindings: %s\n", err)
+			return ExitCodeError
+		}
+		fmt.Println("key bindings:", *keysPath)
+		return ExitCodeOK
+	}
+
 	path := flag.Arg(0)
 	data, err := readROM(path)
 	if err != nil {
@@ -75,13 +131,116 @@ func Run() ExitCode {
 		return ExitCodeError
 	}
 
-	emu := emulator.New(gba.New(data, &audio.Stream, *debug, *mute), path)
+	if *dumpDir != "" {
+		if err := dumpVideo(data, *dumpDir, *dumpFrame, *dumpPalette); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export video state: %s\n", err)
+			return ExitCodeError
+		}
+		return ExitCodeOK
+	}
+
+	if *m4aList || *m4aExport != "" {
+		if err := exportSongs(data, *m4aList, *m4aExport); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export songs: %s\n", err)
+			return ExitCodeError
+		}
+		return ExitCodeOK
+	}
+
+	muted, err := parseChannels(*muteChannels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -mute-ch: %s\n", err)
+		return ExitCodeError
+	}
+	soloed, err := parseChannels(*soloChannels)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -solo-ch: %s\n", err)
+		return ExitCodeError
+	}
+
+	if *recordPath != "" && *recordFrames > 0 {
+		if err := recordHeadless(data, *recordPath, *recordFrames, *audioRate, *recordChans, muted, soloed); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to record: %s\n", err)
+			return ExitCodeError
+		}
+		return ExitCodeOK
+	}
+
+	emu := emulator.New(gba.New(data, *audioRate, *debug, *mute), path)
 	if *showCartInfo {
 		fmt.Println(emu.GBA.CartInfo())
 		return ExitCodeOK
 	}
+	if err := emu.StartAudio(*deviceRate); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: running without sound: %s\n", err)
+	}
+	defer emu.Close()
 
-	emu.GBA.SetJoypadHandler(joypad.Handler)
+	input, err := loadInput(*keysPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load key bindings: %s\n", err)
+		return ExitCodeError
+	}
+	emu.SetInput(input)
+	emu.GBA.SetInputScanline(*inputLine)
+	emu.GBA.SetPixelAccurate(*pixelAccurate)
+	if *renderThreads > 0 {
+		// the parallel renderer draws whole scanlines
+		if *pixelAccurate {
+			fmt.Fprintf(os.Stderr, "-p can't be used with -j\n")
+			return ExitCodeError
+		}
+		renderer := video.NewParallelRenderer(*renderThreads)
+		defer renderer.Close()
+		if err := emu.GBA.SetRenderer(renderer); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start renderer: %s\n", err)
+			return ExitCodeError
+		}
+	}
+	profile, err := video.ParseColorProfile(*colorProfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid color profile: %s\n", err)
+		return ExitCodeError
+	}
+	emu.GBA.SetColorProfile(profile)
+	ghostingMode, err := video.ParseGhostingMode(*ghosting)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid ghosting mode: %s\n", err)
+		return ExitCodeError
+	}
+	emu.GBA.SetGhosting(ghostingMode, *persistence)
+	var pipeline *filter.Pipeline
+	if *filters != "" {
+		pipeline, err = filter.Parse(*filters)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid filter: %s\n", err)
+			return ExitCodeError
+		}
+	}
+	if err := emu.SetFilter(pipeline, *useShader); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: -shader is ignored: %s\n", err)
+	}
+	emu.SetIntegerScale(*integerScale)
+	setChannels(emu.GBA, muted, soloed)
+	emu.SetRecordChannels(*recordChans)
+	if *recordPath != "" {
+		if err := emu.StartRecording(*recordPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to start recording: %s\n", err)
+			return ExitCodeError
+		}
+	}
+	if err := connectLink(emu.GBA, *linkHost, *linkJoin); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect link cable: %s\n", err)
+		return ExitCodeError
+	}
+	if *dolphinHost != "" {
+		d, err := sio.DialDolphin(*dolphinHost)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to connect to Dolphin: %s\n", err)
+			return ExitCodeError
+		}
+		emu.GBA.SetJOYDevice(d)
+	}
 	emu.LoadSav()
 	if *showBIOSIntro {
 		emu.GBA.Reset()
@@ -92,12 +251,148 @@ func Run() ExitCode {
 	ebiten.SetWindowResizable(true)
 	ebiten.SetWindowTitle(emu.GBA.CartHeader.Title)
 	ebiten.SetWindowSize(240*2, 160*2)
-	if err := ebiten.RunGame(emu); err != nil {
+	if err := ebiten.RunGame(emu); err != nil && !errors.Is(err, emulator.ErrQuit) {
 		fmt.Fprintf(os.Stderr, "crash in emulation: %s\n", err)
 	}
+	if err := emu.StopRecording(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to finish recording: %s\n", err)
+	}
+	if l := emu.GBA.Link(); l != nil {
+		l.Close()
+	}
+	if d := emu.GBA.JOYDevice(); d != nil {
+		d.Close()
+	}
 	return ExitCodeOK
 }
 
+// recordHeadless runs the game for the frames without window and records them
+func recordHeadless(rom []byte, path string, frames, rate int, channels bool, mute, solo []apu.Channel) (err error) {
+	g := gba.New(rom, rate, false, false)
+	setChannels(g, mute, solo)
+	r, err := record.New(path, g.SampleRate())
+	if err != nil {
+		return err
+	}
+	if channels {
+		chs, err := record.NewChannels(path, g.SampleRate())
+		if err != nil {
+			r.Close()
+			return err
+		}
+		defer func() {
+			if cerr := chs.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		for c, w := range chs {
+			g.SetChannelSink(apu.Channel(c), w)
+		}
+	}
+
+	sound := &apu.SampleBuffer{}
+	g.SetAudioSink(sound)
+	g.SoftReset()
+	for i := 0; i < frames; i++ {
+		g.Update()
+		if err := r.WriteFrame(g.Draw(), sound.Samples); err != nil {
+			r.Close()
+			return err
+		}
+	}
+	return r.Close()
+}
+
+// dumpVideo runs the game for the frames without window and sound, then exports the video state
+func dumpVideo(rom []byte, dir string, frames, palette int) error {
+	g := gba.New(rom, 0, false, true)
+	g.SoftReset()
+	for i := 0; i < frames; i++ {
+		g.Update()
+	}
+
+	s, err := viewer.Software(g.Renderer())
+	if err != nil {
+		return err
+	}
+	return viewer.Export(dir, s, palette)
+}
+
+// exportSongs lists the songs of the M4A sound engine and exports them into dir unless dir is empty
+func exportSongs(rom []byte, list bool, dir string) error {
+	e, err := m4a.Detect(rom)
+	if err != nil {
+		return err
+	}
+	if list {
+		fmt.Printf("SoundMain: 0x%08x, song table: 0x%08x, %d songs\n", e.SoundMain, e.SongTable, len(e.Songs))
+		for _, s := range e.Songs {
+			fmt.Println(s)
+		}
+	}
+	if dir == "" {
+		return nil
+	}
+	return e.Export(dir)
+}
+
+// connectLink hosts or joins a link cable session over TCP
+func connectLink(g *gba.GBA, host, join string) error {
+	switch {
+	case host != "" && join != "":
+		return errors.New("-link-host and -link can't be used together")
+	case host != "":
+		h, err := sio.ListenTCP(host)
+		if err != nil {
+			return err
+		}
+		fmt.Println("link cable: waiting for other GBAs at", h.Addr())
+		g.SetLink(h)
+	case join != "":
+		t, err := sio.DialTCP(join)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("link cable: joined %s as player %d\n", join, t.ID()+1)
+		g.SetLink(t)
+	}
+	return nil
+}
+
+// loadInput reads the key bindings from the config file
+func loadInput(path string) (*joypad.Input, error) {
+	c, err := joypad.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return joypad.New(c)
+}
+
+// parseChannels parses comma separated sound channels
+func parseChannels(s string) ([]apu.Channel, error) {
+	chs := []apu.Channel{}
+	for _, name := range strings.Split(s, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		c, err := apu.ParseChannel(name)
+		if err != nil {
+			return nil, err
+		}
+		chs = append(chs, c)
+	}
+	return chs, nil
+}
+
+func setChannels(g *gba.GBA, mute, solo []apu.Channel) {
+	for _, c := range mute {
+		g.SetChannelMute(c, true)
+	}
+	for _, c := range solo {
+		g.SetChannelSolo(c, true)
+	}
+}
+
 func readROM(path string) ([]byte, error) {
 	if path == "" {
 		return []byte{}, errors.New("please select gba file path")
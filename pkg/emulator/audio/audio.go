@@ -1,29 +1,123 @@
 package audio
 
 import (
+	"sync"
+
 	"github.com/hajimehoshi/oto"
-	"github.com/pokemium/magia/pkg/gba/apu"
 )
 
-var context *oto.Context
-var player *oto.Player
-var Stream []byte
+const (
+	// latency of the queue in seconds. The queue is kept half full.
+	latency = 0.1
+
+	// maxAdjust is how much dynamic rate control changes the pitch at most (0.5%)
+	maxAdjust = 0.005
+)
+
+// Player plays the samples from the APU on the host audio device.
+//
+// It implements apu.AudioSink. Samples are queued, and resampled from the sample rate of the APU into the rate of the device.
+// The rate is also adjusted slightly to keep the queue half full, so small differences between the emulation speed and the device rate don't cause crackling.
+// If the queue is full, WriteSamples blocks until the device plays it, which paces the emulation by audio.
+type Player struct {
+	context *oto.Context
+	player  *oto.Player
+
+	resampler *Resampler
+	out       []int16
 
-func Init() {
-	Stream = make([]byte, apu.STREAM_LEN)
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []int16
+	capacity int
+	closed   bool
+}
 
-	var err error
-	context, err = oto.NewContext(apu.SND_FREQUENCY, 2, 2, apu.STREAM_LEN)
+// NewPlayer opens the audio device at deviceRate for the samples at rate. If deviceRate is 0, the device is opened at rate.
+func NewPlayer(rate, deviceRate int) (*Player, error) {
+	if deviceRate <= 0 {
+		deviceRate = rate
+	}
+
+	// buffer of the device: 1/60 seconds
+	const bytesPerFrame = 2 * 2
+	bufferSize := deviceRate / 60 * bytesPerFrame
+	context, err := oto.NewContext(deviceRate, 2, 2, bufferSize)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	player = context.NewPlayer()
+	p := &Player{
+		context:   context,
+		player:    context.NewPlayer(),
+		resampler: NewResampler(rate, deviceRate),
+		capacity:  int(float64(deviceRate)*latency) * 2,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	go p.play(bufferSize / 2)
+	return p, nil
 }
 
-func Play() {
-	if player == nil {
+// WriteSamples resamples the samples of a frame and queues them.
+func (p *Player) WriteSamples(samples []int16) {
+	p.out = p.resampler.Resample(p.out[:0], samples)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// audio-driven sync: wait for the device if the emulation is too fast
+	for !p.closed && len(p.queue) > 0 && len(p.queue)+len(p.out) > p.capacity {
+		p.cond.Wait()
+	}
+	if p.closed {
 		return
 	}
-	player.Write(Stream)
+	p.queue = append(p.queue, p.out...)
+
+	// dynamic rate control: make fewer samples if the queue is over half full, more if under
+	fill := float64(len(p.queue)) / float64(p.capacity)
+	p.resampler.SetAdjust(1 + maxAdjust*(1-2*fill))
+	p.cond.Broadcast()
+}
+
+// play sends queued samples into the device
+func (p *Player) play(chunk int) {
+	buf := make([]byte, 0, chunk*2)
+	for {
+		p.mu.Lock()
+		for !p.closed && len(p.queue) == 0 {
+			p.cond.Wait()
+		}
+		if p.closed {
+			p.mu.Unlock()
+			return
+		}
+
+		n := len(p.queue)
+		if n > chunk {
+			n = chunk
+		}
+		buf = buf[:0]
+		for _, s := range p.queue[:n] {
+			buf = append(buf, byte(s), byte(s>>8))
+		}
+		p.queue = append(p.queue[:0], p.queue[n:]...)
+		p.cond.Broadcast()
+		p.mu.Unlock()
+
+		p.player.Write(buf)
+	}
+}
+
+// Close stops playing and releases the device.
+func (p *Player) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	if err := p.player.Close(); err != nil {
+		return err
+	}
+	return p.context.Close()
 }
@@ -0,0 +1,43 @@
+package audio
+
+// Resampler converts interleaved stereo samples from a rate into another by linear interpolation.
+type Resampler struct {
+	// input samples per output sample
+	step float64
+
+	// adjust scales the output rate slightly for dynamic rate control
+	adjust float64
+
+	// pos is the position of the next output sample between last and the next input sample (0-1)
+	pos  float64
+	last [2]float64
+}
+
+func NewResampler(inRate, outRate int) *Resampler {
+	return &Resampler{
+		step:   float64(inRate) / float64(outRate),
+		adjust: 1,
+	}
+}
+
+// SetAdjust makes (outRate * adjust) samples from inRate samples. 1 is the exact rate.
+func (r *Resampler) SetAdjust(adjust float64) {
+	r.adjust = adjust
+}
+
+// Resample appends the resampled src into dst and returns it.
+func (r *Resampler) Resample(dst, src []int16) []int16 {
+	step := r.step / r.adjust
+	for i := 0; i+1 < len(src); i += 2 {
+		cur := [2]float64{float64(src[i]), float64(src[i+1])}
+		for r.pos < 1 {
+			l := r.last[0] + (cur[0]-r.last[0])*r.pos
+			rr := r.last[1] + (cur[1]-r.last[1])*r.pos
+			dst = append(dst, int16(l), int16(rr))
+			r.pos += step
+		}
+		r.pos--
+		r.last = cur
+	}
+	return dst
+}
@@ -0,0 +1,50 @@
+package audio
+
+import "testing"
+
+func TestResampleRate(t *testing.T) {
+	tests := []struct {
+		in, out int
+		adjust  float64
+	}{
+		{32768, 48000, 1},
+		{32768, 44100, 1},
+		{32768, 32768, 1},
+		{32768, 22050, 1},
+		{32768, 48000, 1.005},
+		{32768, 48000, 0.995},
+	}
+
+	for _, tt := range tests {
+		r := NewResampler(tt.in, tt.out)
+		r.SetAdjust(tt.adjust)
+
+		// 1 second of sound in frames
+		src := make([]int16, tt.in/64*2)
+		n := 0
+		for i := 0; i < 64; i++ {
+			n += len(r.Resample(nil, src)) / 2
+		}
+
+		want := float64(tt.out) * tt.adjust
+		if d := float64(n) - want; d < -2 || d > 2 {
+			t.Errorf("%d -> %d (x%v): %d samples, want %v", tt.in, tt.out, tt.adjust, n, want)
+		}
+	}
+}
+
+func TestResampleInterpolation(t *testing.T) {
+	r := NewResampler(1, 2)
+	got := r.Resample(nil, []int16{100, -100, 200, -200})
+
+	// starts from silence, and a sample is put between input samples
+	want := []int16{0, 0, 50, -50, 100, -100, 150, -150}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
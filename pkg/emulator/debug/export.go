@@ -0,0 +1,58 @@
+package debug
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pokemium/magia/pkg/gba/video"
+)
+
+// Export writes BG maps, tile sheets, OBJs and palettes into dir as PNG.
+//
+// 16 color tiles are drawn with the palette bank `palette` (see TileSheet). OBJ attributes are written into obj.txt.
+func Export(dir string, s *video.SoftwareRenderer, palette int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	images := map[string]*image.RGBA{
+		"tiles4.png":  TileSheet(s, false, palette),
+		"tiles8.png":  TileSheet(s, true, palette),
+		"obj.png":     ObjSheet(s),
+		"palette.png": Palettes(s),
+	}
+	for i := 0; i < 4; i++ {
+		if img := BGMap(s, i); img != nil {
+			images[fmt.Sprintf("bg%d.png", i)] = img
+		}
+	}
+
+	for name, img := range images {
+		if err := writePNG(filepath.Join(dir, name), img); err != nil {
+			return err
+		}
+	}
+
+	lines := []string{}
+	for _, obj := range Objs(s) {
+		lines = append(lines, obj.String())
+	}
+	return os.WriteFile(filepath.Join(dir, "obj.txt"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := png.Encode(f, img); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,66 @@
+package debug
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	scopeWidth  = 512
+	scopeHeight = 64
+)
+
+var (
+	scopeColor      = color.RGBA{0x40, 0xff, 0x40, 0xff}
+	scopeBackground = color.RGBA{0x10, 0x10, 0x10, 0xff}
+	scopeMuted      = color.RGBA{0x40, 0x10, 0x10, 0xff}
+)
+
+// Oscilloscope draws the waveform of each channel in a row, from the top in the order of channels.
+//
+// A channel is interleaved stereo samples of a frame, and drawn as the average of left and right.
+// Muted channels have red background.
+func Oscilloscope(channels [][]int16, muted []bool) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, scopeWidth, scopeHeight*len(channels)))
+	for i, samples := range channels {
+		y0 := i * scopeHeight
+		bg := scopeBackground
+		if i < len(muted) && muted[i] {
+			bg = scopeMuted
+		}
+		for y := y0; y < y0+scopeHeight; y++ {
+			for x := 0; x < scopeWidth; x++ {
+				img.SetRGBA(x, y, bg)
+			}
+		}
+		for x := 0; x < scopeWidth; x++ {
+			img.SetRGBA(x, y0+scopeHeight/2, gridColor)
+			img.SetRGBA(x, y0+scopeHeight-1, gridColor)
+		}
+
+		frames := len(samples) / 2
+		if frames == 0 {
+			continue
+		}
+		prev := -1
+		for x := 0; x < scopeWidth; x++ {
+			n := x * frames / scopeWidth
+			v := (int(samples[2*n]) + int(samples[2*n+1])) / 2
+			y := y0 + scopeHeight/2 - v*(scopeHeight/2-1)/32768
+			if prev < 0 {
+				prev = y
+			}
+
+			// connect with the previous point
+			lo, hi := prev, y
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			for yy := lo; yy <= hi; yy++ {
+				img.SetRGBA(x, yy, scopeColor)
+			}
+			prev = y
+		}
+	}
+	return img
+}
@@ -0,0 +1,358 @@
+package debug
+
+import (
+	"errors"
+	"image"
+	"image/color"
+
+	"github.com/pokemium/magia/pkg/gba/video"
+)
+
+const (
+	objCharBase = 0x10000
+	vramSize    = 0x18000
+	tilesPerRow = 32
+)
+
+var (
+	viewportColor = color.RGBA{0xff, 0x00, 0x00, 0xff}
+	gridColor     = color.RGBA{0x40, 0x40, 0x40, 0xff}
+)
+
+// Software returns the SoftwareRenderer that holds the state of r
+func Software(r video.Renderer) (*video.SoftwareRenderer, error) {
+	switch r := r.(type) {
+	case *video.SoftwareRenderer:
+		return r, nil
+	case *video.ParallelRenderer:
+		return r.Front(), nil
+	}
+	return nil, errors.New("viewer needs SoftwareRenderer")
+}
+
+// rgb converts BGR555 color into RGBA
+func rgb(c uint16) color.RGBA {
+	return color.RGBA{expand5(c), expand5(c >> 5), expand5(c >> 10), 0xff}
+}
+
+// expand5 converts 5bit channel into 8bit so that 0x1f becomes 0xff
+func expand5(c uint16) byte {
+	c &= 0x1f
+	return byte(c<<3 | c>>2)
+}
+
+func vram8(s *video.SoftwareRenderer, offset uint32) byte {
+	if offset >= vramSize {
+		return 0
+	}
+	return s.VRAM.LoadU8(offset)
+}
+
+// tilePixel returns the palette index of pixel (x, y) in the tile at offset
+func tilePixel(s *video.SoftwareRenderer, offset uint32, x, y int, color256 bool) byte {
+	if color256 {
+		return vram8(s, offset+uint32(y*8+x))
+	}
+	b := vram8(s, offset+uint32(y*4+x/2))
+	if x&1 == 1 {
+		return b >> 4
+	}
+	return b & 0xf
+}
+
+// paletteColor returns color idx of BG palette (obj=false) or OBJ palette (obj=true)
+func paletteColor(s *video.SoftwareRenderer, obj bool, idx int) color.RGBA {
+	offset := uint32(idx) * 2
+	if obj {
+		offset += 0x200
+	}
+	return rgb(s.Palette.Load16(offset))
+}
+
+// BGKind is how the BG is drawn in the current BG Mode
+type BGKind int
+
+const (
+	BGUnused BGKind = iota
+	BGText
+	BGAffine
+	BGBitmap
+)
+
+// Kind returns how BG i is drawn in the current BG Mode
+func Kind(s *video.SoftwareRenderer, i int) BGKind {
+	switch mode := s.BGMode(); {
+	case mode == 0, mode == 1 && i < 2:
+		return BGText
+	case mode == 1 && i == 2, mode == 2 && i >= 2:
+		return BGAffine
+	case mode >= 3 && mode <= 5 && i == 2:
+		return BGBitmap
+	}
+	return BGUnused
+}
+
+// BGMap draws the whole map of BG i and outlines the area shown on the screen.
+//
+// It returns nil if BG i isn't used in the current BG Mode.
+func BGMap(s *video.SoftwareRenderer, i int) *image.RGBA {
+	bg := s.BG(i)
+
+	var img *image.RGBA
+	var project func(x, y int) (int, int, bool)
+	switch Kind(s, i) {
+	case BGText:
+		img = textMap(s, bg)
+		w, h := img.Rect.Dx(), img.Rect.Dy()
+		project = func(x, y int) (int, int, bool) {
+			return (int(bg.HOffset) + x) % w, (int(bg.VOffset) + y) % h, true
+		}
+	case BGAffine:
+		img = affineMap(s, bg)
+		size := img.Rect.Dx()
+		project = func(x, y int) (int, int, bool) {
+			mx := int(bg.RefX + bg.PA*float64(x) + bg.PB*float64(y))
+			my := int(bg.RefY + bg.PC*float64(x) + bg.PD*float64(y))
+			if bg.Wrap {
+				mx, my = ((mx%size)+size)%size, ((my%size)+size)%size
+			}
+			return mx, my, mx >= 0 && mx < size && my >= 0 && my < size
+		}
+	case BGBitmap:
+		return bitmap(s)
+	default:
+		return nil
+	}
+
+	// screen border
+	for x := 0; x < video.HORIZONTAL_PIXELS; x++ {
+		for _, y := range []int{0, video.VERTICAL_PIXELS - 1} {
+			if mx, my, ok := project(x, y); ok {
+				img.SetRGBA(mx, my, viewportColor)
+			}
+		}
+	}
+	for y := 0; y < video.VERTICAL_PIXELS; y++ {
+		for _, x := range []int{0, video.HORIZONTAL_PIXELS - 1} {
+			if mx, my, ok := project(x, y); ok {
+				img.SetRGBA(mx, my, viewportColor)
+			}
+		}
+	}
+	return img
+}
+
+func textMap(s *video.SoftwareRenderer, bg video.BGInfo) *image.RGBA {
+	w, h := 256, 256
+	if bg.Size&1 == 1 {
+		w = 512
+	}
+	if bg.Size&2 == 2 {
+		h = 512
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for ty := 0; ty < h/8; ty++ {
+		for tx := 0; tx < w/8; tx++ {
+			// 32x32 tiles per screen block
+			block := (ty/32)*(w/256) + tx/32
+			entryOfs := bg.ScreenBase + uint32(block*0x800+((ty%32)*32+tx%32)*2)
+			entry := uint16(vram8(s, entryOfs)) | uint16(vram8(s, entryOfs+1))<<8
+
+			tile := uint32(entry & 0x3ff)
+			hflip, vflip := entry&(1<<10) != 0, entry&(1<<11) != 0
+			pal := int(entry >> 12)
+
+			tileOfs := bg.CharBase + tile*32
+			if bg.Color256 {
+				tileOfs = bg.CharBase + tile*64
+			}
+
+			for py := 0; py < 8; py++ {
+				for px := 0; px < 8; px++ {
+					sx, sy := px, py
+					if hflip {
+						sx = 7 - px
+					}
+					if vflip {
+						sy = 7 - py
+					}
+
+					idx := int(tilePixel(s, tileOfs, sx, sy, bg.Color256))
+					if !bg.Color256 && idx != 0 {
+						idx += pal * 16
+					}
+					img.SetRGBA(tx*8+px, ty*8+py, paletteColor(s, false, idx))
+				}
+			}
+		}
+	}
+	return img
+}
+
+func affineMap(s *video.SoftwareRenderer, bg video.BGInfo) *image.RGBA {
+	size := 128 << bg.Size
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	for ty := 0; ty < size/8; ty++ {
+		for tx := 0; tx < size/8; tx++ {
+			tile := uint32(vram8(s, bg.ScreenBase+uint32(ty*(size/8)+tx)))
+			for py := 0; py < 8; py++ {
+				for px := 0; px < 8; px++ {
+					idx := tilePixel(s, bg.CharBase+tile*64, px, py, true)
+					img.SetRGBA(tx*8+px, ty*8+py, paletteColor(s, false, int(idx)))
+				}
+			}
+		}
+	}
+	return img
+}
+
+// bitmap draws the frame buffer of BG Mode 3, 4, 5
+func bitmap(s *video.SoftwareRenderer) *image.RGBA {
+	base := uint32(0)
+	if s.FrameSelect() && s.BGMode() != 3 {
+		base = 0xa000
+	}
+
+	w, h := video.HORIZONTAL_PIXELS, video.VERTICAL_PIXELS
+	if s.BGMode() == 5 {
+		w, h = 160, 128
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			switch s.BGMode() {
+			case 4:
+				img.SetRGBA(x, y, paletteColor(s, false, int(vram8(s, base+uint32(y*w+x)))))
+			default:
+				ofs := base + uint32(y*w+x)*2
+				img.SetRGBA(x, y, rgb(s.VRAM.Load16(ofs)))
+			}
+		}
+	}
+	return img
+}
+
+// TileSheet draws all tiles in VRAM.
+//
+// 16 color tiles use the palette bank `palette` (0-15: BG, 16-31: OBJ).
+// 256 color tiles use BG palette if palette is 0, otherwise OBJ palette.
+func TileSheet(s *video.SoftwareRenderer, color256 bool, palette int) *image.RGBA {
+	tileSize := 32
+	if color256 {
+		tileSize = 64
+	}
+	tiles := vramSize / tileSize
+	img := image.NewRGBA(image.Rect(0, 0, tilesPerRow*8, tiles/tilesPerRow*8))
+
+	obj, bank := palette >= 16, palette%16
+	if color256 {
+		obj, bank = palette != 0, 0
+	}
+
+	for t := 0; t < tiles; t++ {
+		tx, ty := (t%tilesPerRow)*8, (t/tilesPerRow)*8
+		for py := 0; py < 8; py++ {
+			for px := 0; px < 8; px++ {
+				idx := int(tilePixel(s, uint32(t*tileSize), px, py, color256))
+				if !color256 && idx != 0 {
+					idx += bank * 16
+				}
+				img.SetRGBA(tx+px, ty+py, paletteColor(s, obj, idx))
+			}
+		}
+	}
+	return img
+}
+
+const (
+	objCell    = 64
+	objColumns = 16
+	objCount   = 128
+)
+
+// Objs returns the attributes of all OBJs
+func Objs(s *video.SoftwareRenderer) []video.ObjInfo {
+	objs := make([]video.ObjInfo, objCount)
+	for i := range objs {
+		objs[i] = s.OAM.Obj(i)
+	}
+	return objs
+}
+
+// ObjSheet draws all 128 OBJs in 64x64 cells, 16 OBJs per row.
+//
+// OBJs are drawn without rotation/scaling, and transparent pixels are left transparent.
+func ObjSheet(s *video.SoftwareRenderer) *image.RGBA {
+	rows := objCount / objColumns
+	img := image.NewRGBA(image.Rect(0, 0, objColumns*objCell, rows*objCell))
+
+	for i, obj := range Objs(s) {
+		cx, cy := (i%objColumns)*objCell, (i/objColumns)*objCell
+		for x := 0; x < objCell; x++ {
+			img.SetRGBA(cx+x, cy+objCell-1, gridColor)
+		}
+		for y := 0; y < objCell; y++ {
+			img.SetRGBA(cx+objCell-1, cy+y, gridColor)
+		}
+		drawObj(s, img, obj, cx, cy)
+	}
+	return img
+}
+
+func drawObj(s *video.SoftwareRenderer, img *image.RGBA, obj video.ObjInfo, cx, cy int) {
+	// 256 color tiles take two tile numbers
+	step := uint32(1)
+	if obj.Color256 {
+		step = 2
+	}
+
+	w, h := int(obj.Width), int(obj.Height)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			lx, ly := x, y
+			if obj.HFlip {
+				lx = w - 1 - x
+			}
+			if obj.VFlip {
+				ly = h - 1 - y
+			}
+
+			tx, ty := uint32(lx/8), uint32(ly/8)
+			tile := obj.Tile + tx*step + ty*tilesPerRow
+			if s.ObjCharacterMapping() {
+				tile = obj.Tile + (ty*uint32(w/8)+tx)*step
+			}
+
+			idx := int(tilePixel(s, objCharBase+(tile&0x3ff)*32, lx%8, ly%8, obj.Color256))
+			if idx == 0 {
+				continue
+			}
+			if !obj.Color256 {
+				idx += obj.Palette * 16
+			}
+			img.SetRGBA(cx+x, cy+y, paletteColor(s, true, idx))
+		}
+	}
+}
+
+const swatch = 8
+
+// Palettes draws the BG palette (left) and OBJ palette (right) as 16x16 swatches.
+func Palettes(s *video.SoftwareRenderer) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 2*16*swatch, 16*swatch))
+	for p, obj := range []bool{false, true} {
+		for i := 0; i < 256; i++ {
+			c := paletteColor(s, obj, i)
+			x0, y0 := p*16*swatch+(i%16)*swatch, (i/16)*swatch
+			for y := 0; y < swatch; y++ {
+				for x := 0; x < swatch; x++ {
+					img.SetRGBA(x0+x, y0+y, c)
+				}
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,115 @@
+package emulator
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/pokemium/magia/pkg/emulator/filter"
+)
+
+// crt.kage draws scanlines and LCD grid on the GPU
+//
+//go:embed crt.kage
+var crtShader []byte
+
+// display post-processes frames between GBA.Draw() and the screen
+type display struct {
+	filters *filter.Pipeline
+	integer bool
+
+	// scanlines and LCD grid on the GPU (nil: not used)
+	shader         *ebiten.Shader
+	scanline, grid float64
+
+	frame *ebiten.Image
+}
+
+// SetFilter sets the CPU filters applied to every frame. nil disables filters.
+//
+// If shader is true, scanlines and LCD grid at the end of the filters are drawn by a Kage shader instead.
+// It falls back to the CPU filters when the shader can't be used, and returns the reason.
+func (e *Emulator) SetFilter(p *filter.Pipeline, shader bool) error {
+	e.display.filters, e.display.shader = p, nil
+	if !shader {
+		return nil
+	}
+	if p == nil {
+		return errors.New("shader needs scanlines or lcd filter")
+	}
+
+	fs := p.Filters()
+	scanline, grid := 0.0, 0.0
+	n := len(fs)
+	for ; n > 0; n-- {
+		switch f := fs[n-1].(type) {
+		case filter.Scanlines:
+			scanline = f.Intensity
+			continue
+		case filter.LCDGrid:
+			grid = f.Intensity
+			continue
+		}
+		break
+	}
+	if n == len(fs) {
+		return errors.New("shader needs scanlines or lcd at the end of the filters")
+	}
+
+	s, err := ebiten.NewShader(crtShader)
+	if err != nil {
+		return fmt.Errorf("failed to compile shader: %w", err)
+	}
+	e.display.filters = filter.NewPipeline(fs[:n]...)
+	e.display.shader, e.display.scanline, e.display.grid = s, scanline, grid
+	return nil
+}
+
+// SetIntegerScale scales the screen only by integers so that every GBA pixel has the same size.
+func (e *Emulator) SetIntegerScale(on bool) { e.display.integer = on }
+
+// enabled reports whether frames are drawn on the screen of the window size instead of 240x160.
+func (d *display) enabled() bool {
+	return d.filters != nil || d.integer || d.shader != nil
+}
+
+func (d *display) draw(screen *ebiten.Image, pixels []byte) {
+	out := &image.RGBA{Pix: pixels, Stride: 240 * 4, Rect: image.Rect(0, 0, 240, 160)}
+	cell := 1
+	if d.filters != nil {
+		out = d.filters.Apply(out)
+		cell = d.filters.Scale()
+	}
+
+	w, h := out.Rect.Dx(), out.Rect.Dy()
+	if d.frame == nil {
+		d.frame = ebiten.NewImage(w, h)
+	} else if fw, fh := d.frame.Size(); fw != w || fh != h {
+		d.frame.Dispose()
+		d.frame = ebiten.NewImage(w, h)
+	}
+	d.frame.ReplacePixels(out.Pix)
+
+	// fit 240x160 so that integer scale is the size of a GBA pixel
+	sw, sh := screen.Size()
+	scale, x, y := filter.Fit(240, 160, sw, sh, d.integer)
+	geoM := ebiten.GeoM{}
+	geoM.Scale(scale/float64(cell), scale/float64(cell))
+	geoM.Translate(x, y)
+
+	if d.shader != nil {
+		screen.DrawRectShader(w, h, d.shader, &ebiten.DrawRectShaderOptions{
+			GeoM: geoM,
+			Uniforms: map[string]interface{}{
+				"Cell":     float32(cell),
+				"Scanline": float32(d.scanline),
+				"Grid":     float32(d.grid),
+			},
+			Images: [4]*ebiten.Image{d.frame},
+		})
+		return
+	}
+	screen.DrawImage(d.frame, &ebiten.DrawImageOptions{GeoM: geoM, Filter: ebiten.FilterNearest})
+}
@@ -1,39 +1,119 @@
 package emulator
 
 import (
+	"errors"
+	"fmt"
+	"image"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/pokemium/magia/pkg/emulator/audio"
+	"github.com/pokemium/magia/pkg/emulator/joypad"
+	"github.com/pokemium/magia/pkg/emulator/screenshot"
 	"github.com/pokemium/magia/pkg/gba"
+	"github.com/pokemium/magia/pkg/gba/apu"
 )
 
 type Emulator struct {
 	GBA *gba.GBA
 	Rom string
+
+	input *joypad.Input
+
+	// debug viewers
+	view        viewer
+	tilePalette int
+	viewImage   *image.RGBA
+	taps        [apu.ChannelCount]*channelTap
+	songs       songPlayer
+
+	display   display
+	recording recording
+
+	// nil if the sound isn't played (see StartAudio)
+	audio *audio.Player
+
+	// Ctrl+C and SIGTERM
+	quit chan os.Signal
 }
 
+// ErrQuit is returned by Update when the emulator is interrupted by a signal
+var ErrQuit = errors.New("interrupted")
+
+// New makes the frontend of g. The sound isn't played until StartAudio.
 func New(g *gba.GBA, r string) *Emulator {
 	e := &Emulator{
 		GBA: g,
 		Rom: r,
 	}
 	e.setupCloseHandler()
+	e.SetInput(joypad.Default())
+	e.GBA.SetAudioSink(e)
+	return e
+}
 
-	// setup audio
-	audio.Init()
-	e.GBA.SetAudioBuffer(audio.Stream)
+// StartAudio plays the sound on the audio device opened at deviceRate (0: the sample rate of the GBA).
+// If it fails, the emulator keeps running without sound.
+func (e *Emulator) StartAudio(deviceRate int) error {
+	player, err := audio.NewPlayer(e.GBA.SampleRate(), deviceRate)
+	if err != nil {
+		return err
+	}
+	e.audio = player
+	return nil
+}
 
-	return e
+// Close releases the audio device.
+func (e *Emulator) Close() error {
+	if e.audio == nil {
+		return nil
+	}
+	err := e.audio.Close()
+	e.audio = nil
+	return err
+}
+
+// SetInput reads the GBA buttons and the hotkeys with in
+func (e *Emulator) SetInput(in *joypad.Input) {
+	e.input = in
+	e.GBA.SetJoypadHandler(in.Handler())
+}
+
+// WriteSamples receives the sound of a frame from GBA, and passes it to the audio device and the recorder.
+func (e *Emulator) WriteSamples(samples []int16) {
+	if e.audio != nil {
+		e.audio.WriteSamples(samples)
+	}
+	e.recordSamples(samples)
 }
 
 func (e *Emulator) Update() error {
 	defer e.GBA.PanicHandler("core", true)
+	select {
+	case <-e.quit:
+		return ErrQuit
+	default:
+	}
+
+	e.input.Update()
 	e.GBA.Update()
-	audio.Play()
+	if err := e.GBA.LinkError(); err != nil {
+		fmt.Fprintf(os.Stderr, "link cable: %s\n", err)
+	}
+	e.updateViewer()
+	if e.input.JustPressed(joypad.HotkeyScreenshot) {
+		if path, err := e.SaveScreenshot(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save screenshot: %s\n", err)
+		} else {
+			fmt.Println("screenshot:", path)
+		}
+	}
+	e.updateRecording()
 	if e.GBA.DoSav && e.GBA.Frame%60 == 0 {
 		e.WriteSav()
 	}
@@ -42,21 +122,47 @@ func (e *Emulator) Update() error {
 
 func (e *Emulator) Draw(screen *ebiten.Image) {
 	defer e.GBA.PanicHandler("gpu", true)
-	screen.ReplacePixels(e.GBA.Draw())
+	pixels := e.GBA.Draw()
+	if e.Recording() {
+		e.writeRecording(pixels)
+	}
+	switch {
+	case e.viewImage != nil:
+		screen.ReplacePixels(e.viewImage.Pix)
+	case e.display.enabled():
+		e.display.draw(screen, pixels)
+	default:
+		screen.ReplacePixels(pixels)
+	}
 }
 
 func (e *Emulator) Layout(outsideWidth, outsideHeight int) (screenWidth, screenHeight int) {
+	if e.viewImage != nil {
+		return e.viewImage.Rect.Dx(), e.viewImage.Rect.Dy()
+	}
+	if e.display.enabled() {
+		return outsideWidth, outsideHeight
+	}
 	return 240, 160
 }
 
+// setupCloseHandler makes Update stop the game on Ctrl+C, so that the caller of ebiten.RunGame cleans up as the window is closed
 func (e *Emulator) setupCloseHandler() {
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		e.GBA.Exit("Ctrl+C pressed in Terminal")
-		os.Exit(0)
-	}()
+	e.quit = make(chan os.Signal, 1)
+	signal.Notify(e.quit, os.Interrupt, syscall.SIGTERM)
+}
+
+// SaveScreenshot saves the current frame as <rom>-<frame>.png next to the ROM, and returns the path.
+func (e *Emulator) SaveScreenshot() (string, error) {
+	path := fmt.Sprintf("%s-%d.png", strings.TrimSuffix(e.Rom, filepath.Ext(e.Rom)), e.GBA.Frame)
+	h := e.GBA.CartHeader
+	texts := []screenshot.Text{
+		{Keyword: "Title", Value: strings.TrimRight(h.Title, "\x00 ")},
+		{Keyword: "Game Code", Value: strings.TrimRight(h.GameCode, "\x00 ")},
+		{Keyword: "Frame", Value: strconv.FormatUint(uint64(e.GBA.Frame), 10)},
+		{Keyword: "Software", Value: "Magia"},
+	}
+	return path, screenshot.Save(path, e.GBA.Screenshot(), texts)
 }
 
 func (e *Emulator) WriteSav() {
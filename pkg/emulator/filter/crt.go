@@ -0,0 +1,70 @@
+package filter
+
+import "image"
+
+const (
+	DefaultScanlineIntensity = 0.5
+	DefaultGridIntensity     = 0.25
+)
+
+// Scanlines darkens the last row of each source pixel.
+//
+// Cell is the size of a source pixel in the input (the scale of the preceding filters).
+type Scanlines struct {
+	Cell      int
+	Intensity float64
+}
+
+func (Scanlines) Size(w, h int) (int, int) { return w, h }
+
+func (s Scanlines) Apply(dst, src *image.RGBA) {
+	cell := maxInt(s.Cell, 1)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	for y := 0; y < h; y++ {
+		edge := y%cell == cell-1
+		for x := 0; x < w; x++ {
+			c := pixel(src, x, y)
+			if edge {
+				c = darken(c, s.Intensity)
+			}
+			setPixel(dst, x, y, c)
+		}
+	}
+}
+
+// LCDGrid darkens the last row and column of each source pixel, which looks like the gaps between LCD cells.
+type LCDGrid struct {
+	Cell      int
+	Intensity float64
+}
+
+func (LCDGrid) Size(w, h int) (int, int) { return w, h }
+
+func (g LCDGrid) Apply(dst, src *image.RGBA) {
+	cell := maxInt(g.Cell, 1)
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := pixel(src, x, y)
+			if x%cell == cell-1 || y%cell == cell-1 {
+				c = darken(c, g.Intensity)
+			}
+			setPixel(dst, x, y, c)
+		}
+	}
+}
+
+// darken multiplies RGB by (1 - intensity)
+func darken(c uint32, intensity float64) uint32 {
+	r, g, b, a := channels(c)
+	k := 1 - intensity
+	r, g, b = uint32(float64(r)*k), uint32(float64(g)*k), uint32(float64(b)*k)
+	return r<<24 | g<<16 | b<<8 | a
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,176 @@
+package filter
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Filter processes a frame on the CPU.
+type Filter interface {
+	// Size returns the output size for the input size.
+	Size(w, h int) (int, int)
+
+	// Apply writes filtered src into dst. dst has the size returned by Size.
+	Apply(dst, src *image.RGBA)
+}
+
+// Pipeline applies filters in order between GBA.Draw() and the screen.
+type Pipeline struct {
+	filters []Filter
+
+	// output buffer of each filter
+	bufs []*image.RGBA
+}
+
+func NewPipeline(filters ...Filter) *Pipeline {
+	return &Pipeline{
+		filters: filters,
+		bufs:    make([]*image.RGBA, len(filters)),
+	}
+}
+
+func (p *Pipeline) Filters() []Filter { return p.filters }
+
+// Scale returns how many output pixels a source pixel becomes in each direction.
+func (p *Pipeline) Scale() int {
+	w, _ := p.Size(1, 1)
+	return w
+}
+
+// Size returns the output size for the input size.
+func (p *Pipeline) Size(w, h int) (int, int) {
+	for _, f := range p.filters {
+		w, h = f.Size(w, h)
+	}
+	return w, h
+}
+
+// Apply runs all filters. The returned image is reused on the next call.
+func (p *Pipeline) Apply(src *image.RGBA) *image.RGBA {
+	for i, f := range p.filters {
+		w, h := f.Size(src.Rect.Dx(), src.Rect.Dy())
+		if p.bufs[i] == nil || p.bufs[i].Rect.Dx() != w || p.bufs[i].Rect.Dy() != h {
+			p.bufs[i] = image.NewRGBA(image.Rect(0, 0, w, h))
+		}
+		f.Apply(p.bufs[i], src)
+		src = p.bufs[i]
+	}
+	return src
+}
+
+// Names of the filters accepted by Parse
+var Names = []string{"nearest2x", "nearest3x", "nearest4x", "scale2x", "hq2x", "xbrz", "scanlines", "lcd"}
+
+// Parse makes a pipeline from comma separated filter names (e.g. "xbrz,scanlines").
+//
+// scanlines and lcd darken the edges of each source pixel, so the frame is scaled by nearest3x first if it isn't scaled yet.
+func Parse(spec string) (*Pipeline, error) {
+	filters := []Filter{}
+	scale := 1
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+
+		var f Filter
+		switch name {
+		case "":
+			continue
+		case "nearest2x":
+			f = Nearest{Scale: 2}
+		case "nearest3x":
+			f = Nearest{Scale: 3}
+		case "nearest4x":
+			f = Nearest{Scale: 4}
+		case "scale2x":
+			f = Scale2x{}
+		case "hq2x":
+			f = HQ2x{}
+		case "xbrz":
+			f = XBRZ{}
+		case "scanlines", "lcd":
+			if scale == 1 {
+				filters = append(filters, Nearest{Scale: 3})
+				scale = 3
+			}
+			if name == "lcd" {
+				f = LCDGrid{Cell: scale, Intensity: DefaultGridIntensity}
+			} else {
+				f = Scanlines{Cell: scale, Intensity: DefaultScanlineIntensity}
+			}
+		default:
+			return nil, fmt.Errorf("unknown filter %q (available: %s)", name, strings.Join(Names, ", "))
+		}
+
+		filters = append(filters, f)
+		scale, _ = f.Size(scale, scale)
+	}
+	return NewPipeline(filters...), nil
+}
+
+// Fit returns the scale and the position to draw a w x h frame at the center of a dstW x dstH screen keeping its aspect ratio.
+//
+// If integer is true, the scale is an integer (at least 1) so that every pixel has the same size.
+func Fit(w, h, dstW, dstH int, integer bool) (scale, x, y float64) {
+	scale = math.Min(float64(dstW)/float64(w), float64(dstH)/float64(h))
+	if integer {
+		scale = math.Max(1, math.Floor(scale))
+	}
+	x = math.Floor((float64(dstW) - float64(w)*scale) / 2)
+	y = math.Floor((float64(dstH) - float64(h)*scale) / 2)
+	return scale, x, y
+}
+
+// pixel returns the color at (x, y) as 0xRRGGBBAA. Coordinates out of src are clamped to the edge.
+func pixel(src *image.RGBA, x, y int) uint32 {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	if x < 0 {
+		x = 0
+	} else if x >= w {
+		x = w - 1
+	}
+	if y < 0 {
+		y = 0
+	} else if y >= h {
+		y = h - 1
+	}
+
+	i := y*src.Stride + x*4
+	p := src.Pix[i : i+4 : i+4]
+	return uint32(p[0])<<24 | uint32(p[1])<<16 | uint32(p[2])<<8 | uint32(p[3])
+}
+
+func setPixel(dst *image.RGBA, x, y int, c uint32) {
+	i := y*dst.Stride + x*4
+	p := dst.Pix[i : i+4 : i+4]
+	p[0], p[1], p[2], p[3] = byte(c>>24), byte(c>>16), byte(c>>8), byte(c)
+}
+
+func channels(c uint32) (r, g, b, a uint32) {
+	return c >> 24, (c >> 16) & 0xff, (c >> 8) & 0xff, c & 0xff
+}
+
+// mix returns (a*wa + b*wb) / (wa+wb) for each channel
+func mix(a uint32, wa uint32, b uint32, wb uint32) uint32 {
+	ar, ag, ab, aa := channels(a)
+	br, bg, bb, ba := channels(b)
+	sum := wa + wb
+	r := (ar*wa + br*wb) / sum
+	g := (ag*wa + bg*wb) / sum
+	bl := (ab*wa + bb*wb) / sum
+	al := (aa*wa + ba*wb) / sum
+	return r<<24 | g<<16 | bl<<8 | al
+}
+
+// mix3 returns (a*wa + b*wb + c*wc) / (wa+wb+wc) for each channel
+func mix3(a, wa, b, wb, c, wc uint32) uint32 {
+	ar, ag, ab, aa := channels(a)
+	br, bg, bb, ba := channels(b)
+	cr, cg, cb, ca := channels(c)
+	sum := wa + wb + wc
+	r := (ar*wa + br*wb + cr*wc) / sum
+	g := (ag*wa + bg*wb + cg*wc) / sum
+	bl := (ab*wa + bb*wb + cb*wc) / sum
+	al := (aa*wa + ba*wb + ca*wc) / sum
+	return r<<24 | g<<16 | bl<<8 | al
+}
@@ -0,0 +1,202 @@
+package filter
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// testFrame returns a small frame with diagonal lines, a circle and hard edges that the pixel art scalers smooth out.
+func testFrame() *image.RGBA {
+	const w, h = 32, 24
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := uint32(0x203040ff)
+			switch dx, dy := x-20, y-12; {
+			case dx*dx+dy*dy <= 36:
+				c = 0xf0d020ff
+			case x == y || x == y+1:
+				c = 0xe04040ff
+			case x+y == 24:
+				c = 0x40c0e0ff
+			case x < 8 && y >= 16:
+				c = uint32(x*32)<<24 | uint32(y*8)<<16 | 0x80ff
+			}
+			setPixel(img, x, y, c)
+		}
+	}
+	return img
+}
+
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+	}{
+		{"nearest3x", Nearest{Scale: 3}},
+		{"scale2x", Scale2x{}},
+		{"hq2x", HQ2x{}},
+		{"xbrz", XBRZ{}},
+		{"scanlines", Scanlines{Cell: 1, Intensity: DefaultScanlineIntensity}},
+		{"lcd", LCDGrid{Cell: 1, Intensity: DefaultGridIntensity}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := testFrame()
+			got := NewPipeline(tt.filter).Apply(src)
+
+			path := filepath.Join("testdata", tt.name+".png")
+			if *update {
+				buf := &bytes.Buffer{}
+				if err := png.Encode(buf, got); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create golden files)", err)
+			}
+			defer f.Close()
+			want, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("size = %v, want %v", got.Bounds(), want.Bounds())
+			}
+			for y := 0; y < got.Rect.Dy(); y++ {
+				for x := 0; x < got.Rect.Dx(); x++ {
+					if g, w := got.RGBAAt(x, y), want.At(x, y); !sameColor(g, w) {
+						t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func sameColor(a, b interface{ RGBA() (r, g, b, a uint32) }) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
+
+// a flat frame must stay flat after any filter except the darkening ones
+func TestFlat(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			setPixel(src, x, y, 0x336699ff)
+		}
+	}
+
+	for _, f := range []Filter{Nearest{Scale: 2}, Scale2x{}, HQ2x{}, XBRZ{}} {
+		got := NewPipeline(f).Apply(src)
+		for i := 0; i < len(got.Pix); i += 4 {
+			if c := pixel(got, (i/4)%got.Rect.Dx(), (i/4)/got.Rect.Dx()); c != 0x336699ff {
+				t.Fatalf("%T: got %08x", f, c)
+			}
+		}
+	}
+}
+
+// TestHQ2xCases checks patterns against the cases of the original hq2x table
+func TestHQ2xCases(t *testing.T) {
+	const c, e, red = 0xffffffff, 0x000000ff, 0xff0000ff
+	tests := []struct {
+		name string
+		win  [9]uint32 // 3x3 source around the center pixel
+		want [4]uint32 // top-left, top-right, bottom-left and bottom-right quarters of the center
+	}{
+		// case 255, the neighbors are the same: PIXEL00_100 (14:1:1 of the center, left and up) at all corners
+		{"isolated", [9]uint32{e, e, e, e, c, e, e, e, e}, [4]uint32{0xdfdfdfff, 0xdfdfdfff, 0xdfdfdfff, 0xdfdfdfff}},
+		// case 11, left and up are the same: PIXEL00_20 (2:1:1), PIXEL01_21, PIXEL10_22 and PIXEL11_20
+		{"corner", [9]uint32{e, e, c, e, c, c, c, c, c}, [4]uint32{0x7f7f7fff, c, c, c}},
+		// case 11, left and up differ: PIXEL00_0
+		{"corner of two colors", [9]uint32{e, red, c, e, c, c, c, c, c}, [4]uint32{c, c, c, c}},
+		// case 0: PIXEL00_20 which keeps the flat color
+		{"flat", [9]uint32{c, c, c, c, c, c, c, c, c}, [4]uint32{c, c, c, c}},
+	}
+
+	for _, tt := range tests {
+		src := image.NewRGBA(image.Rect(0, 0, 3, 3))
+		for i, col := range tt.win {
+			setPixel(src, i%3, i/3, col)
+		}
+		dst := NewPipeline(HQ2x{}).Apply(src)
+		got := [4]uint32{pixel(dst, 2, 2), pixel(dst, 3, 2), pixel(dst, 2, 3), pixel(dst, 3, 3)}
+		if got != tt.want {
+			t.Errorf("%s: got %08x, want %08x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		spec  string
+		scale int
+		n     int
+		err   bool
+	}{
+		{"", 1, 0, false},
+		{"nearest2x", 2, 1, false},
+		{"xbrz, scanlines", 2, 2, false},
+		{"scanlines", 3, 2, false},
+		{"HQ2x,nearest2x,lcd", 4, 3, false},
+		{"blur", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		p, err := Parse(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("Parse(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if p.Scale() != tt.scale || len(p.Filters()) != tt.n {
+			t.Errorf("Parse(%q) = scale %d, %d filters, want scale %d, %d filters", tt.spec, p.Scale(), len(p.Filters()), tt.scale, tt.n)
+		}
+	}
+
+	p, _ := Parse("xbrz,lcd")
+	if g, ok := p.Filters()[1].(LCDGrid); !ok || g.Cell != 2 {
+		t.Errorf("lcd after xbrz = %#v, want cell 2", p.Filters()[1])
+	}
+}
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		w, h, dstW, dstH int
+		integer          bool
+		scale, x, y      float64
+	}{
+		{240, 160, 480, 320, false, 2, 0, 0},
+		{240, 160, 1000, 320, false, 2, 260, 0},
+		{240, 160, 600, 600, false, 2.5, 0, 100},
+		{240, 160, 600, 600, true, 2, 60, 140},
+		{240, 160, 100, 100, true, 1, -70, -30},
+	}
+
+	for _, tt := range tests {
+		scale, x, y := Fit(tt.w, tt.h, tt.dstW, tt.dstH, tt.integer)
+		if scale != tt.scale || x != tt.x || y != tt.y {
+			t.Errorf("Fit(%d, %d, %d, %d, %v) = (%v, %v, %v), want (%v, %v, %v)", tt.w, tt.h, tt.dstW, tt.dstH, tt.integer, scale, x, y, tt.scale, tt.x, tt.y)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package filter
+
+import "image"
+
+// HQ2x is the hq2x scaler by Maxim Stepin.
+//
+// Each source pixel is compared with its 8 neighbors in YUV, and the pattern of the different ones picks how each quarter is interpolated.
+// The 256 cases of the original table are written as the rules of FFmpeg's hqx filter, which give the same output.
+type HQ2x struct{}
+
+func (HQ2x) Size(w, h int) (int, int) { return w * 2, h * 2 }
+
+// hq2xQuarters mirrors the 3x3 window around the source pixel, so that each quarter is computed as the top-left one.
+//
+// The window is indexed as
+//
+//	0 1 2
+//	3 4 5
+//	6 7 8
+var hq2xQuarters = [4][9]int{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8}, // top-left
+	{2, 1, 0, 5, 4, 3, 8, 7, 6}, // top-right
+	{6, 7, 8, 3, 4, 5, 0, 1, 2}, // bottom-left
+	{8, 7, 6, 5, 4, 3, 2, 1, 0}, // bottom-right
+}
+
+func (HQ2x) Apply(dst, src *image.RGBA) {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	var win [9]uint32
+	var diff [9]bool
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			for i := range win {
+				win[i] = pixel(src, x+i%3-1, y+i/3-1)
+			}
+			for i, c := range win {
+				diff[i] = yuvDiff(win[4], c)
+			}
+			for q := range hq2xQuarters {
+				setPixel(dst, x*2+q%2, y*2+q/2, hq2xQuarter(&win, &diff, &hq2xQuarters[q]))
+			}
+		}
+	}
+}
+
+// hq2xQuarter returns the top-left quarter of the center pixel of the window mirrored by p.
+// diff tells which pixels of the window differ from the center.
+func hq2xQuarter(win *[9]uint32, diff *[9]bool, p *[9]int) uint32 {
+	// pattern of the 8 neighbors, bit 0 is the top-left one
+	k := 0
+	for i, bit := 0, 0; i < 9; i++ {
+		if i == 4 {
+			continue
+		}
+		if diff[p[i]] {
+			k |= 1 << bit
+		}
+		bit++
+	}
+	// is reports whether the pattern matches any of the rules written as mask<<8 | bits
+	is := func(rules ...int) bool {
+		for _, r := range rules {
+			if k&(r>>8) == r&0xff {
+				return true
+			}
+		}
+		return false
+	}
+
+	w0, w1, w3, w4, w5, w7 := win[p[0]], win[p[1]], win[p[3]], win[p[4]], win[p[5]], win[p[7]]
+	switch {
+	case is(0xbf37, 0xdb13) && yuvDiff(w1, w5):
+		return mix(w4, 3, w3, 1)
+	case is(0xdb49, 0xef6d) && yuvDiff(w7, w3):
+		return mix(w4, 3, w1, 1)
+	case is(0x0b0b, 0xfe4a, 0xfe1a) && yuvDiff(w3, w1):
+		return w4
+	case is(0x6f2a, 0x5b0a, 0xbf3a, 0xdf5a, 0x9f8a, 0xcf8a, 0xef4e, 0x3f0e, 0xfb5a, 0xbb8a, 0x7f5a, 0xaf8a, 0xeb8a) && yuvDiff(w3, w1):
+		return mix(w4, 3, w0, 1)
+	case is(0x0b08):
+		return mix3(w4, 2, w0, 1, w1, 1)
+	case is(0x0b02):
+		return mix3(w4, 2, w0, 1, w3, 1)
+	case is(0x2f2f):
+		return mix3(w4, 14, w3, 1, w1, 1)
+	case is(0xbf37, 0xdb13):
+		return mix3(w4, 5, w1, 2, w3, 1)
+	case is(0xdb49, 0xef6d):
+		return mix3(w4, 5, w3, 2, w1, 1)
+	case is(0x1b03, 0x4f43, 0x8b83, 0x6b43):
+		return mix(w4, 3, w3, 1)
+	case is(0x4b09, 0x8b89, 0x1f19, 0x3b19):
+		return mix(w4, 3, w1, 1)
+	case is(0x7e2a, 0xefab, 0xbf8f, 0x7e0e):
+		return mix3(w4, 2, w3, 3, w1, 3)
+	case is(0xfb6a, 0x6f6e, 0x3f3e, 0xfbfa, 0xdfde, 0xdf1e):
+		return mix(w4, 3, w0, 1)
+	case is(0x0a00, 0x4f4b, 0x9f1b, 0x2f0b, 0xbe0a, 0xee0a, 0x7e0a, 0xeb4b, 0x3b1b):
+		return mix3(w4, 2, w3, 1, w1, 1)
+	}
+	return mix3(w4, 6, w3, 1, w1, 1)
+}
+
+// yuvDiff reports whether two colors look different by the hq2x thresholds (Y: 48, U: 7, V: 6).
+func yuvDiff(a, b uint32) bool {
+	if a == b {
+		return false
+	}
+	ay, au, av := yuv(a)
+	by, bu, bv := yuv(b)
+	return abs(ay-by) > 48 || abs(au-bu) > 7 || abs(av-bv) > 6
+}
+
+// yuv converts a color with the integer formula of hq2x
+func yuv(c uint32) (y, u, v int) {
+	r, g, b, _ := channels(c)
+	rg, bg := int(r)-int(g), int(b)-int(g)
+	y = (299*int(r) + 587*int(g) + 114*int(b)) / 1000
+	u = (-169*rg+500*bg)/1000 + 128
+	v = (500*rg-81*bg)/1000 + 128
+	return y, u, v
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
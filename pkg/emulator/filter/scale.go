@@ -0,0 +1,66 @@
+package filter
+
+import (
+	"image"
+)
+
+// Nearest scales the frame by an integer with nearest neighbor.
+type Nearest struct {
+	Scale int
+}
+
+func (n Nearest) Size(w, h int) (int, int) { return w * n.Scale, h * n.Scale }
+
+func (n Nearest) Apply(dst, src *image.RGBA) {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := pixel(src, x, y)
+			for dy := 0; dy < n.Scale; dy++ {
+				for dx := 0; dx < n.Scale; dx++ {
+					setPixel(dst, x*n.Scale+dx, y*n.Scale+dy, c)
+				}
+			}
+		}
+	}
+}
+
+// Scale2x is AdvMAME2x (EPX) pixel art scaler.
+type Scale2x struct{}
+
+func (Scale2x) Size(w, h int) (int, int) { return w * 2, h * 2 }
+
+// Neighbors of the source pixel E:
+//
+//	  B
+//	D E F
+//	  H
+func (Scale2x) Apply(dst, src *image.RGBA) {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			b, d, e, f, hh := pixel(src, x, y-1), pixel(src, x-1, y), pixel(src, x, y), pixel(src, x+1, y), pixel(src, x, y+1)
+
+			e0, e1, e2, e3 := e, e, e, e
+			if b != hh && d != f {
+				if d == b {
+					e0 = d
+				}
+				if b == f {
+					e1 = f
+				}
+				if d == hh {
+					e2 = d
+				}
+				if hh == f {
+					e3 = f
+				}
+			}
+
+			setPixel(dst, x*2, y*2, e0)
+			setPixel(dst, x*2+1, y*2, e1)
+			setPixel(dst, x*2, y*2+1, e2)
+			setPixel(dst, x*2+1, y*2+1, e3)
+		}
+	}
+}
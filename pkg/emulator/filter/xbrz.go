@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"image"
+	"math"
+)
+
+// XBRZ is the 2x scaler of xBRZ by Zenju.
+type XBRZ struct{}
+
+const (
+	xbrzDominantDirectionThreshold = 3.6
+	xbrzSteepDirectionThreshold    = 2.2
+	xbrzEqualColorTolerance        = 30
+)
+
+// blend type of a corner
+const (
+	blendNone = iota
+	blendNormal
+	blendDominant
+)
+
+// blend types of a pixel are packed in a byte: top-left, top-right, bottom-right, bottom-left (2bit each)
+const (
+	cornerTopL    = 0
+	cornerTopR    = 2
+	cornerBottomR = 4
+	cornerBottomL = 6
+)
+
+func (XBRZ) Size(w, h int) (int, int) { return w * 2, h * 2 }
+
+func (XBRZ) Apply(dst, src *image.RGBA) {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	blends := xbrzBlends(src)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var out [2][2]uint32
+			e := pixel(src, x, y)
+			out[0][0], out[0][1], out[1][0], out[1][1] = e, e, e, e
+
+			if b := blends[y*w+x]; b != 0 {
+				for rot := 0; rot < 4; rot++ {
+					xbrzScalePixel(src, x, y, rot, rotateBlend(b, rot), &out)
+				}
+			}
+
+			setPixel(dst, x*2, y*2, out[0][0])
+			setPixel(dst, x*2+1, y*2, out[0][1])
+			setPixel(dst, x*2, y*2+1, out[1][0])
+			setPixel(dst, x*2+1, y*2+1, out[1][1])
+		}
+	}
+}
+
+// xbrzBlends decides the blend type of every pixel corner.
+//
+//	A B C D
+//	E F G H
+//	I J K L
+//	M N O P
+//
+// Each 4x4 kernel decides the corners that touch the center of F, G, J and K.
+func xbrzBlends(src *image.RGBA) []byte {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	blends := make([]byte, w*h)
+	set := func(x, y int, corner uint, t byte) {
+		if x >= 0 && x < w && y >= 0 && y < h {
+			blends[y*w+x] |= t << corner
+		}
+	}
+
+	for y := -1; y < h; y++ {
+		for x := -1; x < w; x++ {
+			p := func(dx, dy int) uint32 { return pixel(src, x+dx, y+dy) }
+			b, c := p(0, -1), p(1, -1)
+			e, f, g, hh := p(-1, 0), p(0, 0), p(1, 0), p(2, 0)
+			i, j, k, l := p(-1, 1), p(0, 1), p(1, 1), p(2, 1)
+			n, o := p(0, 2), p(1, 2)
+
+			if (f == g && j == k) || (f == j && g == k) {
+				continue
+			}
+
+			jg := colorDist(i, f) + colorDist(f, c) + colorDist(n, k) + colorDist(k, hh) + 4*colorDist(j, g)
+			fk := colorDist(e, j) + colorDist(j, o) + colorDist(b, g) + colorDist(g, l) + 4*colorDist(f, k)
+
+			switch {
+			case jg < fk:
+				t := byte(blendNormal)
+				if xbrzDominantDirectionThreshold*jg < fk {
+					t = blendDominant
+				}
+				if f != g && f != j {
+					set(x, y, cornerBottomR, t)
+				}
+				if k != j && k != g {
+					set(x+1, y+1, cornerTopL, t)
+				}
+			case fk < jg:
+				t := byte(blendNormal)
+				if xbrzDominantDirectionThreshold*fk < jg {
+					t = blendDominant
+				}
+				if j != f && j != k {
+					set(x, y+1, cornerTopR, t)
+				}
+				if g != f && g != k {
+					set(x+1, y, cornerBottomL, t)
+				}
+			}
+		}
+	}
+	return blends
+}
+
+// rotateBlend rotates packed blend types by rot * 90 degrees clockwise.
+func rotateBlend(b byte, rot int) byte {
+	for ; rot > 0; rot-- {
+		b = b<<2 | b>>6
+	}
+	return b
+}
+
+// rotated returns the coordinate in the unrotated view of (r, c) seen after rotating rot times.
+//
+// r and c are relative to the center for the kernel, so n is 0 for 3x3 kernel and 1 for the 2x2 output.
+func rotated(r, c, rot, n int) (int, int) {
+	for ; rot > 0; rot-- {
+		r, c = n-c, r
+	}
+	return r, c
+}
+
+// xbrzScalePixel blends the bottom-right corner of the rotated view into out.
+//
+//	A B C
+//	D E F
+//	G H I
+func xbrzScalePixel(src *image.RGBA, x, y, rot int, blend byte, out *[2][2]uint32) {
+	if (blend>>cornerBottomR)&3 == blendNone {
+		return
+	}
+
+	p := func(dr, dc int) uint32 {
+		r, c := rotated(dr, dc, rot, 0)
+		return pixel(src, x+c, y+r)
+	}
+	b, c := p(-1, 0), p(-1, 1)
+	d, e, f := p(0, -1), p(0, 0), p(0, 1)
+	g, h, i := p(1, -1), p(1, 0), p(1, 1)
+
+	blendAt := func(r, cc int, col uint32, m, n uint32) {
+		rr, rc := rotated(r, cc, rot, 1)
+		out[rr][rc] = mix(col, m, out[rr][rc], n-m)
+	}
+
+	eq := func(a, b uint32) bool { return colorDist(a, b) < xbrzEqualColorTolerance }
+	doLineBlend := true
+	switch {
+	case (blend>>cornerBottomR)&3 >= blendDominant:
+	case (blend>>cornerTopR)&3 != blendNone && !eq(e, g):
+		doLineBlend = false
+	case (blend>>cornerBottomL)&3 != blendNone && !eq(e, c):
+		doLineBlend = false
+	case !eq(e, i) && eq(g, h) && eq(h, i) && eq(i, f) && eq(f, c):
+		doLineBlend = false
+	}
+
+	col := h
+	if colorDist(e, f) <= colorDist(e, h) {
+		col = f
+	}
+
+	if !doLineBlend {
+		blendAt(1, 1, col, 21, 100)
+		return
+	}
+
+	fg, hc := colorDist(f, g), colorDist(h, c)
+	shallow := xbrzSteepDirectionThreshold*fg <= hc && e != g && d != g
+	steep := xbrzSteepDirectionThreshold*hc <= fg && e != c && b != c
+	switch {
+	case shallow && steep:
+		blendAt(0, 1, col, 1, 4)
+		blendAt(1, 0, col, 1, 4)
+		blendAt(1, 1, col, 5, 6)
+	case shallow:
+		blendAt(1, 0, col, 1, 4)
+		blendAt(1, 1, col, 3, 4)
+	case steep:
+		blendAt(0, 1, col, 1, 4)
+		blendAt(1, 1, col, 3, 4)
+	default:
+		blendAt(1, 1, col, 1, 2)
+	}
+}
+
+// colorDist is the distance of two colors in YCbCr (ITU-R BT.2020).
+func colorDist(a, b uint32) float64 {
+	if a == b {
+		return 0
+	}
+	ar, ag, ab, _ := channels(a)
+	br, bg, bb, _ := channels(b)
+	rd, gd, bd := float64(ar)-float64(br), float64(ag)-float64(bg), float64(ab)-float64(bb)
+
+	const kb, kr = 0.0593, 0.2627
+	const kg = 1 - kb - kr
+	const scaleB, scaleR = 0.5 / (1 - kb), 0.5 / (1 - kr)
+
+	y := kr*rd + kg*gd + kb*bd
+	cb := scaleB * (bd - y)
+	cr := scaleR * (rd - y)
+	return math.Sqrt(y*y + cb*cb + cr*cr)
+}
@@ -0,0 +1,119 @@
+package joypad
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+// StandardButtons names the raw buttons after the standard gamepad layout (the names of StandardGamepadButton in later ebiten).
+//
+// ebiten v2.0.8 has no standard gamepad API and reports raw buttons only, so this is an approximation which assumes the
+// button order of XInput gamepads (Xbox controllers). On other gamepads the names may point at other buttons, and they
+// should be bound with "Gamepad.Button<N>" instead.
+var StandardButtons = map[string]ebiten.GamepadButton{
+	"RightBottom":   ebiten.GamepadButton0,
+	"RightRight":    ebiten.GamepadButton1,
+	"RightLeft":     ebiten.GamepadButton2,
+	"RightTop":      ebiten.GamepadButton3,
+	"FrontTopLeft":  ebiten.GamepadButton4,
+	"FrontTopRight": ebiten.GamepadButton5,
+	"CenterLeft":    ebiten.GamepadButton6,
+	"CenterRight":   ebiten.GamepadButton7,
+	"LeftStick":     ebiten.GamepadButton8,
+	"RightStick":    ebiten.GamepadButton9,
+	"LeftTop":       ebiten.GamepadButton10,
+	"LeftRight":     ebiten.GamepadButton11,
+	"LeftBottom":    ebiten.GamepadButton12,
+	"LeftLeft":      ebiten.GamepadButton13,
+}
+
+const gamepadPrefix = "Gamepad."
+
+// shiftPrefix makes a keyboard binding which is pressed with Shift held
+const shiftPrefix = "Shift+"
+
+type bindingType int
+
+const (
+	bindKey bindingType = iota
+	bindButton
+	bindAxis
+)
+
+type binding struct {
+	typ    bindingType
+	key    ebiten.Key
+	button ebiten.GamepadButton
+	axis   int
+	dir    float64 // 1 or -1
+	shift  bool    // the key is pressed with Shift held
+}
+
+// keyNames maps the names of the keyboard keys to ebiten.Key
+var keyNames = func() map[string]ebiten.Key {
+	m := map[string]ebiten.Key{}
+	for k := ebiten.Key(0); k <= ebiten.KeyMax; k++ {
+		m[k.String()] = k
+	}
+	return m
+}()
+
+func parseBinding(s string) (binding, error) {
+	if k := strings.TrimPrefix(s, shiftPrefix); k != s {
+		b, err := parseBinding(k)
+		if err != nil || b.typ != bindKey || b.shift {
+			return binding{}, fmt.Errorf("invalid key with Shift %q", s)
+		}
+		b.shift = true
+		return b, nil
+	}
+	if !strings.HasPrefix(s, gamepadPrefix) {
+		k, ok := keyNames[s]
+		if !ok {
+			return binding{}, fmt.Errorf("unknown key %q", s)
+		}
+		return binding{typ: bindKey, key: k}, nil
+	}
+
+	name := strings.TrimPrefix(s, gamepadPrefix)
+	if b, ok := StandardButtons[name]; ok {
+		return binding{typ: bindButton, button: b}, nil
+	}
+	if n := strings.TrimPrefix(name, "Button"); n != name {
+		b, err := strconv.Atoi(n)
+		if err != nil || b < 0 || b > int(ebiten.GamepadButtonMax) {
+			return binding{}, fmt.Errorf("invalid gamepad button %q", s)
+		}
+		return binding{typ: bindButton, button: ebiten.GamepadButton(b)}, nil
+	}
+	if n := strings.TrimPrefix(name, "Axis"); n != name && len(n) > 1 {
+		dir := 0.0
+		switch n[len(n)-1] {
+		case '+':
+			dir = 1
+		case '-':
+			dir = -1
+		}
+		a, err := strconv.Atoi(n[:len(n)-1])
+		if dir == 0 || err != nil || a < 0 {
+			return binding{}, fmt.Errorf("invalid gamepad axis %q", s)
+		}
+		return binding{typ: bindAxis, axis: a, dir: dir}, nil
+	}
+	return binding{}, fmt.Errorf("unknown gamepad button %q", s)
+}
+
+func parseBindings(ss []string) ([]binding, error) {
+	bs := make([]binding, 0, len(ss))
+	for _, s := range ss {
+		b, err := parseBinding(s)
+		if err != nil {
+			return nil, err
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
@@ -0,0 +1,58 @@
+package joypad
+
+import (
+	"testing"
+
+	"github.com/hajimehoshi/ebiten/v2"
+)
+
+func TestParseBinding(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    binding
+		wantErr bool
+	}{
+		{in: "X", want: binding{typ: bindKey, key: ebiten.KeyX}},
+		{in: "Enter", want: binding{typ: bindKey, key: ebiten.KeyEnter}},
+		{in: "KP0", want: binding{typ: bindKey, key: ebiten.KeyKP0}},
+		{in: "Gamepad.RightBottom", want: binding{typ: bindButton, button: ebiten.GamepadButton0}},
+		{in: "Gamepad.LeftLeft", want: binding{typ: bindButton, button: ebiten.GamepadButton13}},
+		{in: "Gamepad.Button0", want: binding{typ: bindButton, button: ebiten.GamepadButton0}},
+		{in: "Gamepad.Button12", want: binding{typ: bindButton, button: ebiten.GamepadButton12}},
+		{in: "Gamepad.Axis0+", want: binding{typ: bindAxis, axis: 0, dir: 1}},
+		{in: "Gamepad.Axis3-", want: binding{typ: bindAxis, axis: 3, dir: -1}},
+		{in: "Shift+1", want: binding{typ: bindKey, key: ebiten.Key1, shift: true}},
+
+		{in: "Foo", wantErr: true},
+		{in: "x", wantErr: true},
+		{in: "Gamepad.Foo", wantErr: true},
+		{in: "Gamepad.Button", wantErr: true},
+		{in: "Gamepad.ButtonA", wantErr: true},
+		{in: "Gamepad.Button-1", wantErr: true},
+		{in: "Gamepad.Button999", wantErr: true},
+		{in: "Gamepad.Axis0", wantErr: true},
+		{in: "Gamepad.Axis+", wantErr: true},
+		{in: "Gamepad.AxisA+", wantErr: true},
+		{in: "Gamepad.Axis-1+", wantErr: true},
+		{in: "Shift+", wantErr: true},
+		{in: "Shift+Shift+1", wantErr: true},
+		{in: "Shift+Gamepad.Button0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseBinding(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package joypad
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// ButtonNames are the GBA buttons in the order of gba.SetJoypadHandler
+var ButtonNames = [10]string{"A", "B", "Select", "Start", "Right", "Left", "Up", "Down", "R", "L"}
+
+// Hotkeys for emulator actions
+const (
+	HotkeyScreenshot = "screenshot"     // save a screenshot
+	HotkeyRecord     = "record"         // toggle recording
+	HotkeyViewer     = "viewer"         // switch the debug viewer
+	HotkeyPalette    = "viewer_palette" // switch the palette of the tile viewer
+	HotkeySongPrev   = "song_prev"      // select the previous song in the sound viewer
+	HotkeySongNext   = "song_next"      // select the next song in the sound viewer
+	HotkeySongPlay   = "song_play"      // play the selected song in the sound viewer
+	HotkeyShowLayers = "layer_show_all" // show all the layers hidden by the layer hotkeys
+)
+
+// LayerHotkeys toggle the layers in the order of video.LayerMask (BG0-3, OBJ, window and blend)
+var LayerHotkeys = [7]string{"layer_bg0", "layer_bg1", "layer_bg2", "layer_bg3", "layer_obj", "layer_window", "layer_blend"}
+
+// MuteHotkeys and SoloHotkeys toggle mute and solo of the sound channels in the sound viewer, in the order of apu.Channel
+var (
+	MuteHotkeys = [6]string{"mute_square1", "mute_square2", "mute_wave", "mute_noise", "mute_fifoa", "mute_fifob"}
+	SoloHotkeys = [6]string{"solo_square1", "solo_square2", "solo_wave", "solo_noise", "solo_fifoa", "solo_fifob"}
+)
+
+// HotkeyNames are the hotkeys in the config file
+var HotkeyNames = func() []string {
+	names := []string{HotkeyScreenshot, HotkeyRecord, HotkeyViewer, HotkeyPalette, HotkeySongPrev, HotkeySongNext, HotkeySongPlay, HotkeyShowLayers}
+	names = append(names, LayerHotkeys[:]...)
+	names = append(names, MuteHotkeys[:]...)
+	return append(names, SoloHotkeys[:]...)
+}()
+
+// Config maps the GBA buttons and the hotkeys to keyboard keys and gamepad buttons.
+//
+// A binding is one of:
+//   - keyboard key name of ebiten (e.g. "X", "Enter", "Up", "KP0")
+//   - "Gamepad.<button>" of the standard gamepad layout on XInput gamepads (e.g. "Gamepad.RightBottom", see StandardButtons)
+//   - "Gamepad.Button<N>" for the raw button N of the gamepad
+//   - "Gamepad.Axis<N>+" or "Gamepad.Axis<N>-" for the raw axis N tilted over AxisThreshold
+//   - "Shift+<key>" for the keyboard key pressed with Shift held
+type Config struct {
+	// Buttons and Turbo are indexed by ButtonNames. Turbo bindings press the button on and off while held.
+	Buttons map[string][]string `json:"buttons"`
+	Turbo   map[string][]string `json:"turbo"`
+
+	// TurboFrames is the number of frames the turbo button is pressed, and then released
+	TurboFrames int `json:"turbo_frames"`
+
+	// Hotkeys are indexed by HotkeyNames
+	Hotkeys map[string][]string `json:"hotkeys"`
+
+	AxisThreshold float64 `json:"axis_threshold"`
+}
+
+// DefaultConfig returns the default bindings for the keyboard and XInput gamepads
+func DefaultConfig() *Config {
+	c := &Config{
+		Buttons: map[string][]string{
+			"A":      {"X", "Gamepad.RightRight"},
+			"B":      {"Z", "Gamepad.RightBottom"},
+			"Select": {"Backspace", "Gamepad.CenterLeft"},
+			"Start":  {"Enter", "Gamepad.CenterRight"},
+			"Right":  {"Right", "Gamepad.LeftRight", "Gamepad.Axis0+"},
+			"Left":   {"Left", "Gamepad.LeftLeft", "Gamepad.Axis0-"},
+			"Up":     {"Up", "Gamepad.LeftTop", "Gamepad.Axis1-"},
+			"Down":   {"Down", "Gamepad.LeftBottom", "Gamepad.Axis1+"},
+			"R":      {"S", "Gamepad.FrontTopRight"},
+			"L":      {"A", "Gamepad.FrontTopLeft"},
+		},
+		Turbo: map[string][]string{
+			"A": {"C", "Gamepad.RightTop"},
+			"B": {"V", "Gamepad.RightLeft"},
+		},
+		TurboFrames: 2,
+		Hotkeys: map[string][]string{
+			HotkeyScreenshot: {"F12"},
+			HotkeyRecord:     {"F10"},
+			HotkeyViewer:     {"F2"},
+			HotkeyPalette:    {"F3"},
+			HotkeySongPrev:   {"LeftBracket"},
+			HotkeySongNext:   {"RightBracket"},
+			HotkeySongPlay:   {"P"},
+			HotkeyShowLayers: {"0"},
+		},
+		AxisThreshold: 0.5,
+	}
+	for i, h := range LayerHotkeys {
+		c.Hotkeys[h] = []string{strconv.Itoa(i + 1)}
+	}
+	for i := range MuteHotkeys {
+		c.Hotkeys[MuteHotkeys[i]] = []string{strconv.Itoa(i + 1)}
+		c.Hotkeys[SoloHotkeys[i]] = []string{shiftPrefix + strconv.Itoa(i+1)}
+	}
+	return c
+}
+
+// ConfigPath returns the default path of the config file, magia/input.json in the user config directory
+func ConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "magia", "input.json"), nil
+}
+
+// LoadConfig reads the config file on the default config.
+//
+// The buttons and the hotkeys in the file replace their default bindings, and the others are kept. If the file doesn't exist, it returns the default config.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the config file
+func (c *Config) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,166 @@
+package joypad
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.json")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestLoadConfigPartial checks that the bindings in the file replace the defaults, and the others are kept
+func TestLoadConfigPartial(t *testing.T) {
+	path := writeConfig(t, `{"buttons": {"A": ["K", "Gamepad.Button3"]}, "hotkeys": {"record": ["F9"]}, "turbo_frames": 4}`)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DefaultConfig()
+	want.Buttons["A"] = []string{"K", "Gamepad.Button3"}
+	want.Hotkeys[HotkeyRecord] = []string{"F9"}
+	want.TurboFrames = 4
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+	if _, err := New(c); err != nil {
+		t.Errorf("New: %s", err)
+	}
+}
+
+// TestLoadConfigViewerHotkeys checks that the layer and channel hotkeys of the viewers are merged as the others
+func TestLoadConfigViewerHotkeys(t *testing.T) {
+	path := writeConfig(t, `{"hotkeys": {"layer_bg2": ["F5"], "layer_show_all": ["KP0"], "mute_wave": ["M"], "solo_wave": ["Shift+M"]}}`)
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DefaultConfig()
+	want.Hotkeys["layer_bg2"] = []string{"F5"}
+	want.Hotkeys[HotkeyShowLayers] = []string{"KP0"}
+	want.Hotkeys["mute_wave"] = []string{"M"}
+	want.Hotkeys["solo_wave"] = []string{"Shift+M"}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+	if got := c.Hotkeys["layer_bg3"]; !reflect.DeepEqual(got, []string{"4"}) {
+		t.Errorf("layer_bg3 should keep the default 4, got %v", got)
+	}
+	if got := c.Hotkeys["solo_noise"]; !reflect.DeepEqual(got, []string{"Shift+4"}) {
+		t.Errorf("solo_noise should keep the default Shift+4, got %v", got)
+	}
+	if _, err := New(c); err != nil {
+		t.Errorf("New: %s", err)
+	}
+}
+
+// every hotkey has a default binding
+func TestDefaultHotkeys(t *testing.T) {
+	c := DefaultConfig()
+	for _, h := range HotkeyNames {
+		if len(c.Hotkeys[h]) == 0 {
+			t.Errorf("hotkey %s has no default binding", h)
+		}
+	}
+	if len(c.Hotkeys) != len(HotkeyNames) {
+		t.Errorf("%d default hotkeys, but %d hotkeys", len(c.Hotkeys), len(HotkeyNames))
+	}
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	c, err := LoadConfig(filepath.Join(t.TempDir(), "input.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, DefaultConfig()) {
+		t.Errorf("missing file should give the default config, got %+v", c)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	path := writeConfig(t, `{"buttons": {"A": "X"}}`)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("expected an error with the path, got %v", err)
+	}
+}
+
+func TestSaveConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "magia", "input.json")
+	c := DefaultConfig()
+	c.Turbo["R"] = []string{"Gamepad.Axis2+"}
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("got %+v, want %+v", got, c)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"unknown button", func(c *Config) { c.Buttons["C"] = []string{"C"} }},
+		{"unknown turbo button", func(c *Config) { c.Turbo["Home"] = []string{"H"} }},
+		{"unknown hotkey", func(c *Config) { c.Hotkeys["quit"] = []string{"Q"} }},
+		{"unknown key", func(c *Config) { c.Buttons["A"] = []string{"X", "NoSuchKey"} }},
+		{"invalid axis", func(c *Config) { c.Hotkeys[HotkeyViewer] = []string{"Gamepad.Axis1"} }},
+	}
+
+	for _, tt := range tests {
+		c := DefaultConfig()
+		tt.modify(c)
+		if _, err := New(c); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+func TestTurbo(t *testing.T) {
+	tests := []struct {
+		turboFrames int
+		want        string // pressed (1) or released (0) in frames 0, 1, 2, ...
+	}{
+		{1, "10101010"},
+		{2, "11001100"},
+		{3, "111000111000"},
+		{0, "10101010"}, // at least 1 frame
+	}
+
+	for _, tt := range tests {
+		c := DefaultConfig()
+		c.TurboFrames = tt.turboFrames
+		in, err := New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := ""
+		for frame := range tt.want {
+			in.frame = uint(frame)
+			if in.turboOn() {
+				got += "1"
+			} else {
+				got += "0"
+			}
+		}
+		if got != tt.want {
+			t.Errorf("turbo_frames %d: got %s, want %s", tt.turboFrames, got, tt.want)
+		}
+	}
+}
@@ -1,20 +1,153 @@
 package joypad
 
 import (
+	"fmt"
+
 	"github.com/hajimehoshi/ebiten/v2"
 )
 
-var Handler = [10](func() bool){
-	btnA, btnB, btnSelect, btnStart, btnRight, btnLeft, btnUp, btnDown, btnR, btnL,
+// Input reads the GBA buttons and the hotkeys from the keyboard and the gamepads with the bindings of Config
+type Input struct {
+	buttons, turbo [10][]binding
+	turboFrames    int
+	hotkeys        map[string][]binding
+	threshold      float64
+
+	frame    uint
+	gamepads []ebiten.GamepadID
+	held     map[string]bool
+	pressed  map[string]bool // hotkeys pressed in this frame
+}
+
+// New makes the input with the config
+func New(c *Config) (*Input, error) {
+	in := &Input{
+		turboFrames: c.TurboFrames,
+		hotkeys:     map[string][]binding{},
+		threshold:   c.AxisThreshold,
+		held:        map[string]bool{},
+		pressed:     map[string]bool{},
+	}
+	if in.turboFrames <= 0 {
+		in.turboFrames = 1
+	}
+
+	index := map[string]int{}
+	for i, name := range ButtonNames {
+		index[name] = i
+	}
+	for _, m := range []struct {
+		bindings map[string][]string
+		dst      *[10][]binding
+	}{{c.Buttons, &in.buttons}, {c.Turbo, &in.turbo}} {
+		for name, ss := range m.bindings {
+			i, ok := index[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown GBA button %q", name)
+			}
+			bs, err := parseBindings(ss)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			m.dst[i] = bs
+		}
+	}
+
+	for name, ss := range c.Hotkeys {
+		if !isHotkey(name) {
+			return nil, fmt.Errorf("unknown hotkey %q", name)
+		}
+		bs, err := parseBindings(ss)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		in.hotkeys[name] = bs
+	}
+	return in, nil
+}
+
+// Default returns the input with DefaultConfig
+func Default() *Input {
+	in, err := New(DefaultConfig())
+	if err != nil {
+		panic(err)
+	}
+	return in
+}
+
+func isHotkey(name string) bool {
+	for _, h := range HotkeyNames {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Update reads the gamepads and the hotkeys. It is called once per frame before the GBA runs.
+func (in *Input) Update() {
+	in.frame++
+	in.gamepads = ebiten.GamepadIDs()
+	for name, bs := range in.hotkeys {
+		held := in.anyHeld(bs)
+		in.pressed[name] = held && !in.held[name]
+		in.held[name] = held
+	}
 }
 
-func btnA() bool      { return ebiten.IsKeyPressed(ebiten.KeyX) }
-func btnB() bool      { return ebiten.IsKeyPressed(ebiten.KeyZ) }
-func btnSelect() bool { return ebiten.IsKeyPressed(ebiten.KeyBackspace) }
-func btnStart() bool  { return ebiten.IsKeyPressed(ebiten.KeyEnter) }
-func btnRight() bool  { return ebiten.IsKeyPressed(ebiten.KeyRight) }
-func btnLeft() bool   { return ebiten.IsKeyPressed(ebiten.KeyLeft) }
-func btnUp() bool     { return ebiten.IsKeyPressed(ebiten.KeyUp) }
-func btnDown() bool   { return ebiten.IsKeyPressed(ebiten.KeyDown) }
-func btnR() bool      { return ebiten.IsKeyPressed(ebiten.KeyS) }
-func btnL() bool      { return ebiten.IsKeyPressed(ebiten.KeyA) }
+// JustPressed returns true if the hotkey is pressed in this frame
+func (in *Input) JustPressed(hotkey string) bool {
+	return in.pressed[hotkey]
+}
+
+// Handler returns the handlers of the GBA buttons for gba.SetJoypadHandler
+func (in *Input) Handler() [10](func() bool) {
+	var h [10](func() bool)
+	for i := range h {
+		i := i
+		h[i] = func() bool { return in.button(i) }
+	}
+	return h
+}
+
+// button returns true if the button is held, or the turbo button is held and in the pressed phase
+func (in *Input) button(i int) bool {
+	if in.anyHeld(in.buttons[i]) {
+		return true
+	}
+	return in.turboOn() && in.anyHeld(in.turbo[i])
+}
+
+// turboOn returns true in the frames where the turbo buttons press the button: turboFrames frames on, and then turboFrames frames off
+func (in *Input) turboOn() bool {
+	return (in.frame/uint(in.turboFrames))%2 == 0
+}
+
+func (in *Input) anyHeld(bs []binding) bool {
+	for _, b := range bs {
+		if in.isHeld(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (in *Input) isHeld(b binding) bool {
+	switch b.typ {
+	case bindKey:
+		return ebiten.IsKeyPressed(b.key) && (!b.shift || ebiten.IsKeyPressed(ebiten.KeyShift))
+	case bindButton:
+		for _, id := range in.gamepads {
+			if ebiten.IsGamepadButtonPressed(id, b.button) {
+				return true
+			}
+		}
+	case bindAxis:
+		for _, id := range in.gamepads {
+			if b.axis < ebiten.GamepadAxisNum(id) && ebiten.GamepadAxis(id, b.axis)*b.dir > in.threshold {
+				return true
+			}
+		}
+	}
+	return false
+}
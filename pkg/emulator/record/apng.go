@@ -0,0 +1,171 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"os"
+)
+
+// APNG writes an animated PNG at the full frame rate. Sound is dropped.
+//
+// Each frame is compressed by image/png and its IDAT chunks are rewritten into APNG frame chunks.
+type APNG struct {
+	file *os.File
+	w    *bufio.Writer
+	enc  png.Encoder
+	buf  bytes.Buffer
+
+	frames uint32
+	seq    uint32
+
+	// offset of acTL chunk, which has the number of frames
+	actl int64
+}
+
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// frame delay written in fcTL (about 1/59.73 seconds)
+const (
+	apngDelayNum = 1005
+	apngDelayDen = 60000
+)
+
+func NewAPNG(path string) (*APNG, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &APNG{
+		file: f,
+		w:    bufio.NewWriter(f),
+		enc:  png.Encoder{CompressionLevel: png.BestSpeed},
+	}, nil
+}
+
+func (a *APNG) WriteFrame(pixels []byte, samples []int16) error {
+	a.buf.Reset()
+	src := &image.RGBA{Pix: pixels, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+	if err := a.enc.Encode(&a.buf, src); err != nil {
+		return err
+	}
+
+	chunks, err := pngChunks(a.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	first := a.frames == 0
+	if first {
+		if _, err := a.w.WriteString(pngSignature); err != nil {
+			return err
+		}
+		if err := writeChunk(a.w, "IHDR", chunks[0].data); err != nil {
+			return err
+		}
+		a.actl = int64(len(pngSignature) + 12 + len(chunks[0].data))
+		if err := writeChunk(a.w, "acTL", acTL(0)); err != nil {
+			return err
+		}
+	}
+
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:], a.seq)
+	binary.BigEndian.PutUint32(fctl[4:], width)
+	binary.BigEndian.PutUint32(fctl[8:], height)
+	binary.BigEndian.PutUint16(fctl[20:], apngDelayNum)
+	binary.BigEndian.PutUint16(fctl[22:], apngDelayDen)
+	a.seq++
+	if err := writeChunk(a.w, "fcTL", fctl); err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		if c.typ != "IDAT" {
+			continue
+		}
+		if first {
+			err = writeChunk(a.w, "IDAT", c.data)
+		} else {
+			fdat := make([]byte, 4+len(c.data))
+			binary.BigEndian.PutUint32(fdat, a.seq)
+			copy(fdat[4:], c.data)
+			a.seq++
+			err = writeChunk(a.w, "fdAT", fdat)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	a.frames++
+	return nil
+}
+
+// acTL is the animation control chunk (number of frames, loop forever)
+func acTL(frames uint32) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, frames)
+	return b
+}
+
+func (a *APNG) Close() error {
+	var err error
+	if a.frames > 0 {
+		err = writeChunk(a.w, "IEND", nil)
+	}
+	if ferr := a.w.Flush(); err == nil {
+		err = ferr
+	}
+	if err == nil && a.frames > 0 {
+		buf := &bytes.Buffer{}
+		writeChunk(buf, "acTL", acTL(a.frames))
+		_, err = a.file.WriteAt(buf.Bytes(), a.actl)
+	}
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type pngChunk struct {
+	typ  string
+	data []byte
+}
+
+// pngChunks splits a PNG file into chunks. The first chunk is IHDR.
+func pngChunks(b []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(b, []byte(pngSignature)) {
+		return nil, errors.New("invalid PNG")
+	}
+	b = b[len(pngSignature):]
+
+	chunks := []pngChunk{}
+	for len(b) >= 12 {
+		n := int(binary.BigEndian.Uint32(b))
+		if len(b) < 12+n {
+			return nil, errors.New("invalid PNG chunk")
+		}
+		chunks = append(chunks, pngChunk{string(b[4:8]), b[8 : 8+n]})
+		b = b[12+n:]
+	}
+	if len(chunks) == 0 || chunks[0].typ != "IHDR" {
+		return nil, errors.New("PNG has no IHDR")
+	}
+	return chunks, nil
+}
+
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	b := make([]byte, 8+len(data)+4)
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	copy(b[4:], typ)
+	copy(b[8:], data)
+	binary.BigEndian.PutUint32(b[8+len(data):], crc32.ChecksumIEEE(b[4:8+len(data)]))
+	_, err := w.Write(b)
+	return err
+}
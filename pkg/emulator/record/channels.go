@@ -0,0 +1,46 @@
+package record
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pokemium/magia/pkg/gba/apu"
+)
+
+// Channels writes each sound channel alone into a WAV file for ripping music.
+//
+// Give Channels[c] to GBA.SetChannelSink(c, ...).
+type Channels [apu.ChannelCount]*WAV
+
+// ChannelPath returns the WAV file of the channel recorded with path: "XXXX.y4m" -> "XXXX-square1.wav"
+func ChannelPath(path string, c apu.Channel) string {
+	return fmt.Sprintf("%s-%s.wav", strings.TrimSuffix(path, filepath.Ext(path)), c)
+}
+
+// NewChannels creates the WAV files of all channels for samples at rate Hz.
+func NewChannels(path string, rate int) (*Channels, error) {
+	chs := &Channels{}
+	for c := range chs {
+		w, err := NewWAV(ChannelPath(path, apu.Channel(c)), rate)
+		if err != nil {
+			chs.Close()
+			return nil, err
+		}
+		chs[c] = w
+	}
+	return chs, nil
+}
+
+func (chs *Channels) Close() error {
+	var err error
+	for _, w := range chs {
+		if w == nil {
+			continue
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
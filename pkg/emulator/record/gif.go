@@ -0,0 +1,80 @@
+package record
+
+import (
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"os"
+)
+
+// GIF writes an animated GIF for short clips.
+//
+// GIF delays are in 1/100 seconds, so every other frame is kept (about 30fps). Sound is dropped.
+// Frames are kept in memory until Close.
+type GIF struct {
+	path  string
+	anim  gif.GIF
+	count int
+}
+
+func NewGIF(path string) (*GIF, error) {
+	// fail early if the file can't be written
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return &GIF{path: path}, nil
+}
+
+func (g *GIF) WriteFrame(pixels []byte, samples []int16) error {
+	g.count++
+	if g.count%2 == 0 {
+		return nil
+	}
+
+	src := &image.RGBA{Pix: pixels, Stride: width * 4, Rect: image.Rect(0, 0, width, height)}
+	g.anim.Image = append(g.anim.Image, paletted(src))
+	g.anim.Delay = append(g.anim.Delay, 3)
+	return nil
+}
+
+// paletted converts the frame into 256 colors. Most GBA frames have less than 256 colors, so they are kept exactly.
+func paletted(src *image.RGBA) *image.Paletted {
+	colors := map[color.RGBA]uint8{}
+	p := color.Palette{}
+	for i := 0; i < len(src.Pix); i += 4 {
+		c := color.RGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], 0xff}
+		if _, ok := colors[c]; ok {
+			continue
+		}
+		if len(p) == 256 {
+			// too many colors
+			dst := image.NewPaletted(src.Rect, palette.Plan9)
+			draw.FloydSteinberg.Draw(dst, src.Rect, src, image.Point{})
+			return dst
+		}
+		colors[c] = uint8(len(p))
+		p = append(p, c)
+	}
+
+	dst := image.NewPaletted(src.Rect, p)
+	for i := 0; i < len(src.Pix); i += 4 {
+		dst.Pix[i/4] = colors[color.RGBA{src.Pix[i], src.Pix[i+1], src.Pix[i+2], 0xff}]
+	}
+	return dst
+}
+
+func (g *GIF) Close() error {
+	f, err := os.Create(g.path)
+	if err != nil {
+		return err
+	}
+	if err := gif.EncodeAll(f, &g.anim); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
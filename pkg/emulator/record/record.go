@@ -0,0 +1,50 @@
+// Package record writes the frames and sound of GBA into files.
+//
+// Frames are 240x160 RGBA from GBA.Draw(), and sound is interleaved 16bit stereo samples from apu.AudioSink.
+package record
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pokemium/magia/pkg/gba/video"
+)
+
+const (
+	width  = video.HORIZONTAL_PIXELS
+	height = video.VERTICAL_PIXELS
+
+	// GBA draws a frame every 280896 cycles at 16.78MHz (about 59.73fps)
+	frameRateNum = 16777216
+	frameRateDen = 280896
+)
+
+// Recorder receives every emulated frame.
+type Recorder interface {
+	// WriteFrame writes a frame and the sound played during it.
+	WriteFrame(pixels []byte, samples []int16) error
+
+	// Close finishes the files.
+	Close() error
+}
+
+// Formats are the file extensions accepted by New
+var Formats = []string{".y4m", ".gif", ".png", ".apng"}
+
+// New starts recording into the file. The format is chosen by the extension, and rate is the sample rate of the sound.
+//
+//   - .y4m: raw video, and sound into the .wav file with the same name
+//   - .gif: animated GIF at 30fps without sound
+//   - .png, .apng: animated PNG without sound
+func New(path string, rate int) (Recorder, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".y4m":
+		return NewY4M(path, strings.TrimSuffix(path, filepath.Ext(path))+".wav", rate)
+	case ".gif":
+		return NewGIF(path)
+	case ".png", ".apng":
+		return NewAPNG(path)
+	}
+	return nil, fmt.Errorf("unsupported format %q (available: %s)", filepath.Ext(path), strings.Join(Formats, ", "))
+}
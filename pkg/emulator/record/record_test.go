@@ -0,0 +1,198 @@
+package record
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/apu"
+)
+
+// testFrame fills the frame with a color that changes every frame
+func testFrame(n int) []byte {
+	pixels := make([]byte, width*height*4)
+	for i := 0; i < len(pixels); i += 4 {
+		x := (i / 4) % width
+		pixels[i], pixels[i+1], pixels[i+2], pixels[i+3] = byte(x+n*8), byte(n*16), 0x80, 0xff
+	}
+	return pixels
+}
+
+func record(t *testing.T, path string, frames int, samples []int16) {
+	r, err := New(path, 48000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		if err := r.WriteFrame(testFrame(i), samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestY4M(t *testing.T) {
+	dir := t.TempDir()
+	samples := make([]int16, 1098)
+	samples[0], samples[1] = 0x1234, -2
+	record(t, filepath.Join(dir, "out.y4m"), 3, samples)
+
+	data, err := os.ReadFile(filepath.Join(dir, "out.y4m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := "YUV4MPEG2 W240 H160 F16777216:280896 Ip A1:1 C420jpeg\n"
+	if !bytes.HasPrefix(data, []byte(header)) {
+		t.Fatalf("header = %q", data[:len(header)])
+	}
+	frameSize := len("FRAME\n") + width*height*3/2
+	if len(data) != len(header)+3*frameSize {
+		t.Errorf("size = %d, want %d", len(data), len(header)+3*frameSize)
+	}
+
+	wav, err := os.ReadFile(filepath.Join(dir, "out.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wav) != wavHeaderSize+3*2*len(samples) {
+		t.Fatalf("wav size = %d", len(wav))
+	}
+	if got := wav[wavHeaderSize : wavHeaderSize+4]; !bytes.Equal(got, []byte{0x34, 0x12, 0xfe, 0xff}) {
+		t.Errorf("first samples = % x", got)
+	}
+	if got := binary.LittleEndian.Uint32(wav[24:]); got != 48000 {
+		t.Errorf("wav sample rate = %d", got)
+	}
+	if got := binary.LittleEndian.Uint32(wav[40:]); got != uint32(3*2*len(samples)) {
+		t.Errorf("wav data size = %d", got)
+	}
+	if got := binary.LittleEndian.Uint32(wav[4:]); got != uint32(len(wav)-8) {
+		t.Errorf("RIFF size = %d", got)
+	}
+}
+
+func TestY4MColor(t *testing.T) {
+	y := &Y4M{y: make([]byte, width*height), cb: make([]byte, width*height/4), cr: make([]byte, width*height/4)}
+	for _, tt := range []struct {
+		r, g, b   byte
+		y, cb, cr byte
+	}{
+		{0, 0, 0, 16, 128, 128},
+		{0xff, 0xff, 0xff, 235, 128, 128},
+		{0xff, 0, 0, 81, 90, 240},
+	} {
+		pixels := make([]byte, width*height*4)
+		for i := 0; i < len(pixels); i += 4 {
+			pixels[i], pixels[i+1], pixels[i+2] = tt.r, tt.g, tt.b
+		}
+		y.convert(pixels)
+		if y.y[0] != tt.y || y.cb[0] != tt.cb || y.cr[0] != tt.cr {
+			t.Errorf("RGB(%d, %d, %d) = YCbCr(%d, %d, %d), want (%d, %d, %d)", tt.r, tt.g, tt.b, y.y[0], y.cb[0], y.cr[0], tt.y, tt.cb, tt.cr)
+		}
+	}
+}
+
+func TestGIF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.gif")
+	record(t, path, 5, nil)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("frames = %d, want 3", len(g.Image))
+	}
+	if r, gg, b, _ := g.Image[1].At(10, 0).RGBA(); r>>8 != 10+2*8 || gg>>8 != 2*16 || b>>8 != 0x80 {
+		t.Errorf("pixel = %v", g.Image[1].At(10, 0))
+	}
+}
+
+func TestAPNG(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.png")
+	record(t, path, 4, nil)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// viewers without APNG support show the first frame
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _, _, _ := img.At(3, 0).RGBA(); r>>8 != 3 {
+		t.Errorf("first frame pixel = %v", img.At(3, 0))
+	}
+
+	chunks, err := pngChunks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := map[string]int{}
+	seq := uint32(0)
+	for _, c := range chunks {
+		count[c.typ]++
+		switch c.typ {
+		case "acTL":
+			if n := binary.BigEndian.Uint32(c.data); n != 4 {
+				t.Errorf("acTL frames = %d, want 4", n)
+			}
+		case "fcTL", "fdAT":
+			if n := binary.BigEndian.Uint32(c.data); n != seq {
+				t.Errorf("%s sequence = %d, want %d", c.typ, n, seq)
+			}
+			seq++
+		}
+	}
+	if count["fcTL"] != 4 || count["fdAT"] < 3 || count["IEND"] != 1 {
+		t.Errorf("chunks = %v", count)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "out.mp4"), 48000); err == nil {
+		t.Error("New(.mp4) must fail")
+	}
+}
+
+func TestChannels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "song.y4m")
+	if got, want := ChannelPath(path, apu.ChannelFIFOA), strings.TrimSuffix(path, ".y4m")+"-fifoa.wav"; got != want {
+		t.Errorf("ChannelPath = %q, want %q", got, want)
+	}
+
+	chs, err := NewChannels(path, 32768)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c, w := range chs {
+		w.WriteSamples([]int16{int16(c), 0})
+	}
+	if err := chs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for c := apu.Channel(0); c < apu.ChannelCount; c++ {
+		wav, err := os.ReadFile(ChannelPath(path, c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(wav) != wavHeaderSize+4 || wav[wavHeaderSize] != byte(c) {
+			t.Errorf("%s: wav = % x", c, wav[wavHeaderSize:])
+		}
+	}
+}
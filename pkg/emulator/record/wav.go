@@ -0,0 +1,94 @@
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+)
+
+const wavHeaderSize = 44
+
+// WAV writes 16bit stereo PCM into a WAV file.
+//
+// It implements apu.AudioSink, and the first error of WriteSamples is returned by Close.
+type WAV struct {
+	file *os.File
+	w    *bufio.Writer
+	rate uint32
+	size uint32
+	err  error
+}
+
+// NewWAV creates the file for samples at rate Hz.
+func NewWAV(path string, rate int) (*WAV, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAV{file: f, w: bufio.NewWriter(f), rate: uint32(rate)}
+
+	// sizes are written on Close
+	if _, err := w.w.Write(wavHeader(w.rate, 0)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func wavHeader(rate, size uint32) []byte {
+	const (
+		channels   = 2
+		bits       = 16
+		blockAlign = channels * bits / 8
+	)
+
+	h := make([]byte, wavHeaderSize)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], wavHeaderSize-8+size)
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], channels)
+	binary.LittleEndian.PutUint32(h[24:], rate)
+	binary.LittleEndian.PutUint32(h[28:], rate*blockAlign)
+	binary.LittleEndian.PutUint16(h[32:], blockAlign)
+	binary.LittleEndian.PutUint16(h[34:], bits)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], size)
+	return h
+}
+
+// Write writes interleaved stereo samples
+func (w *WAV) Write(samples []int16) error {
+	for _, s := range samples {
+		if err := w.w.WriteByte(byte(s)); err != nil {
+			return err
+		}
+		if err := w.w.WriteByte(byte(s >> 8)); err != nil {
+			return err
+		}
+	}
+	w.size += uint32(len(samples) * 2)
+	return nil
+}
+
+// WriteSamples writes the samples from the APU
+func (w *WAV) WriteSamples(samples []int16) {
+	if w.err == nil {
+		w.err = w.Write(samples)
+	}
+}
+
+func (w *WAV) Close() error {
+	err := w.err
+	if ferr := w.w.Flush(); err == nil {
+		err = ferr
+	}
+	if err == nil {
+		_, err = w.file.WriteAt(wavHeader(w.rate, w.size), 0)
+	}
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
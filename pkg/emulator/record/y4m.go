@@ -0,0 +1,89 @@
+package record
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// Y4M writes frames into a YUV4MPEG2 file (4:2:0, BT.601) and sound into a WAV file.
+//
+// Both are uncompressed, so they are for encoding with other tools later.
+type Y4M struct {
+	file *os.File
+	w    *bufio.Writer
+	wav  *WAV
+
+	y, cb, cr []byte
+}
+
+func NewY4M(videoPath, audioPath string, rate int) (*Y4M, error) {
+	f, err := os.Create(videoPath)
+	if err != nil {
+		return nil, err
+	}
+	wav, err := NewWAV(audioPath, rate)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	y := &Y4M{
+		file: f,
+		w:    bufio.NewWriter(f),
+		wav:  wav,
+		y:    make([]byte, width*height),
+		cb:   make([]byte, width*height/4),
+		cr:   make([]byte, width*height/4),
+	}
+	if _, err := fmt.Fprintf(y.w, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C420jpeg\n", width, height, frameRateNum, frameRateDen); err != nil {
+		y.Close()
+		return nil, err
+	}
+	return y, nil
+}
+
+func (y *Y4M) WriteFrame(pixels []byte, samples []int16) error {
+	y.convert(pixels)
+	if _, err := y.w.WriteString("FRAME\n"); err != nil {
+		return err
+	}
+	for _, plane := range [][]byte{y.y, y.cb, y.cr} {
+		if _, err := y.w.Write(plane); err != nil {
+			return err
+		}
+	}
+	return y.wav.Write(samples)
+}
+
+// convert makes Y, Cb and Cr planes (BT.601 limited range) from RGBA. Cb and Cr are the average of 2x2 pixels.
+func (y *Y4M) convert(pixels []byte) {
+	for i := 0; i < width*height; i++ {
+		r, g, b := int(pixels[i*4]), int(pixels[i*4+1]), int(pixels[i*4+2])
+		y.y[i] = byte(16 + (16829*r+33039*g+6416*b+(1<<15))>>16)
+	}
+
+	for cy := 0; cy < height/2; cy++ {
+		for cx := 0; cx < width/2; cx++ {
+			r, g, b := 0, 0, 0
+			for _, o := range [4]int{0, 1, width, width + 1} {
+				i := ((cy*2)*width + cx*2 + o) * 4
+				r, g, b = r+int(pixels[i]), g+int(pixels[i+1]), b+int(pixels[i+2])
+			}
+			i := cy*(width/2) + cx
+			y.cb[i] = byte(128 + (-9714*r-19070*g+28784*b+(1<<17))>>18)
+			y.cr[i] = byte(128 + (28784*r-24103*g-4681*b+(1<<17))>>18)
+		}
+	}
+}
+
+func (y *Y4M) Close() error {
+	err := y.w.Flush()
+	if cerr := y.file.Close(); err == nil {
+		err = cerr
+	}
+	if werr := y.wav.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pokemium/magia/pkg/emulator/joypad"
+	"github.com/pokemium/magia/pkg/emulator/record"
+)
+
+// recording writes frames and sound into a file while the record hotkey (F10) is toggled on
+type recording struct {
+	recorder record.Recorder
+
+	// format of the files started by F10
+	ext string
+
+	// sound of the frames emulated since the last Draw
+	pending [][]int16
+
+	// each sound channel is also written into a WAV file (see SetRecordChannels)
+	channels    bool
+	channelWAVs *record.Channels
+}
+
+// SetRecordChannels makes recordings write each sound channel into "XXXX-<channel>.wav" too.
+func (e *Emulator) SetRecordChannels(b bool) {
+	e.recording.channels = b
+}
+
+// StartRecording records every frame and sound into the file. The format is chosen by the extension (see record.New).
+func (e *Emulator) StartRecording(path string) error {
+	if e.recording.recorder != nil {
+		return fmt.Errorf("already recording")
+	}
+	r, err := record.New(path, e.GBA.SampleRate())
+	if err != nil {
+		return err
+	}
+	if e.recording.channels {
+		chs, err := record.NewChannels(path, e.GBA.SampleRate())
+		if err != nil {
+			r.Close()
+			return err
+		}
+		e.recording.channelWAVs = chs
+		e.updateChannelTaps()
+	}
+
+	e.recording.recorder = r
+	e.recording.ext = filepath.Ext(path)
+	return nil
+}
+
+// StopRecording finishes the file. It does nothing if not recording.
+func (e *Emulator) StopRecording() error {
+	r := e.recording.recorder
+	if r == nil {
+		return nil
+	}
+	e.recording.recorder, e.recording.pending = nil, nil
+	err := r.Close()
+
+	if chs := e.recording.channelWAVs; chs != nil {
+		e.recording.channelWAVs = nil
+		e.updateChannelTaps()
+		if cerr := chs.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (e *Emulator) Recording() bool { return e.recording.recorder != nil }
+
+func (e *Emulator) updateRecording() {
+	if e.input.JustPressed(joypad.HotkeyRecord) {
+		if e.Recording() {
+			if err := e.StopRecording(); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to finish recording: %s\n", err)
+			}
+		} else {
+			ext := e.recording.ext
+			if ext == "" {
+				ext = ".y4m"
+			}
+			path := fmt.Sprintf("%s-%d%s", strings.TrimSuffix(e.Rom, filepath.Ext(e.Rom)), e.GBA.Frame, ext)
+			if err := e.StartRecording(path); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to start recording: %s\n", err)
+			} else {
+				fmt.Println("recording:", path)
+			}
+		}
+	}
+}
+
+// recordSamples keeps the sound of a frame until the frame is drawn
+func (e *Emulator) recordSamples(samples []int16) {
+	if e.Recording() {
+		e.recording.pending = append(e.recording.pending, append([]int16{}, samples...))
+	}
+}
+
+// writeRecording writes the frame once per emulated frame.
+//
+// ebiten may skip Draw when emulation is slow, so the frame is repeated to keep video and sound in sync.
+func (e *Emulator) writeRecording(pixels []byte) {
+	for _, samples := range e.recording.pending {
+		if err := e.recording.recorder.WriteFrame(pixels, samples); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to record: %s\n", err)
+			e.StopRecording()
+			return
+		}
+	}
+	e.recording.pending = e.recording.pending[:0]
+}
@@ -0,0 +1,79 @@
+// Package screenshot saves frames as PNG with text metadata.
+package screenshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"os"
+)
+
+// Text is a tEXt chunk of PNG
+type Text struct {
+	Keyword, Value string
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Encode writes img as PNG with the text chunks after the header.
+func Encode(w io.Writer, img image.Image, texts []Text) error {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	// signature + IHDR (length, type, 13 bytes data, crc)
+	ihdrEnd := len(pngSignature) + 4 + 4 + 13 + 4
+	if len(data) < ihdrEnd || !bytes.Equal(data[:len(pngSignature)], pngSignature) {
+		return errors.New("invalid PNG")
+	}
+
+	if _, err := w.Write(data[:ihdrEnd]); err != nil {
+		return err
+	}
+	for _, t := range texts {
+		if err := writeText(w, t); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(data[ihdrEnd:])
+	return err
+}
+
+func writeText(w io.Writer, t Text) error {
+	if len(t.Keyword) == 0 || len(t.Keyword) > 79 {
+		return errors.New("PNG text keyword must be 1-79 bytes")
+	}
+
+	chunk := make([]byte, 0, 8+len(t.Keyword)+1+len(t.Value)+4)
+	chunk = append(chunk, 0, 0, 0, 0)
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, t.Keyword...)
+	chunk = append(chunk, 0)
+	chunk = append(chunk, t.Value...)
+	binary.BigEndian.PutUint32(chunk[0:4], uint32(len(chunk)-8))
+	crc := [4]byte{}
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc[:]...)
+
+	_, err := w.Write(chunk)
+	return err
+}
+
+// Save writes img into the file as PNG with the text chunks.
+func Save(path string, img image.Image, texts []Text) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Encode(f, img, texts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,56 @@
+package screenshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	img.Set(1, 2, color.RGBA{0x12, 0x34, 0x56, 0xff})
+	texts := []Text{{"Title", "POKEMON FIRE"}, {"Game Code", "BPRJ"}, {"Frame", "1234"}}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, img, texts); err != nil {
+		t.Fatal(err)
+	}
+
+	// the image must still be decodable
+	got, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := got.At(1, 2).RGBA(); r>>8 != 0x12 || g>>8 != 0x34 || b>>8 != 0x56 {
+		t.Errorf("pixel = %v", got.At(1, 2))
+	}
+
+	// walk the chunks and collect tEXt
+	found := []Text{}
+	data := buf.Bytes()[len(pngSignature):]
+	for len(data) >= 12 {
+		n := binary.BigEndian.Uint32(data)
+		typ, body := string(data[4:8]), data[8:8+n]
+		if crc := binary.BigEndian.Uint32(data[8+n:]); crc != crc32.ChecksumIEEE(data[4:8+n]) {
+			t.Errorf("%s: bad CRC", typ)
+		}
+		if typ == "tEXt" {
+			i := bytes.IndexByte(body, 0)
+			found = append(found, Text{string(body[:i]), string(body[i+1:])})
+		}
+		data = data[12+n:]
+	}
+
+	if len(found) != len(texts) {
+		t.Fatalf("text chunks = %v, want %v", found, texts)
+	}
+	for i := range texts {
+		if found[i] != texts[i] {
+			t.Errorf("text chunk %d = %v, want %v", i, found[i], texts[i])
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package emulator
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pokemium/magia/pkg/emulator/joypad"
+	"github.com/pokemium/magia/pkg/m4a"
+)
+
+// songPlayer plays the songs of the M4A sound engine in the sound viewer.
+//
+// [ and ] select a song, and P plays it in the game (the song_* hotkeys).
+type songPlayer struct {
+	engine *m4a.Engine
+
+	// the ROM is scanned when the sound viewer is opened first
+	detected bool
+	song     int
+}
+
+// updateSongPlayer handles the keys of the song player, and returns true if the title is changed
+func (e *Emulator) updateSongPlayer() bool {
+	p := &e.songs
+	changed := false
+	if !p.detected {
+		changed = true
+		p.detected = true
+		engine, err := m4a.Detect(e.GBA.RAM.GamePak0[:e.GBA.RAM.ROMSize])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "song player: %s\n", err)
+		} else {
+			p.engine = engine
+		}
+	}
+	if p.engine == nil || len(p.engine.Songs) == 0 {
+		return false
+	}
+
+	n := len(p.engine.Songs)
+	if e.input.JustPressed(joypad.HotkeySongPrev) {
+		p.song = (p.song + n - 1) % n
+		changed = true
+	}
+	if e.input.JustPressed(joypad.HotkeySongNext) {
+		p.song = (p.song + 1) % n
+		changed = true
+	}
+	if e.input.JustPressed(joypad.HotkeySongPlay) {
+		if err := p.engine.Play(&e.GBA.RAM, p.song); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to play song %d: %s\n", p.song, err)
+		}
+	}
+	return changed
+}
+
+// songTitle returns the selected song for the window title
+func (e *Emulator) songTitle() string {
+	p := &e.songs
+	if e.view != viewSound || p.engine == nil || len(p.engine.Songs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" [song %d/%d]", p.song, len(p.engine.Songs)-1)
+}
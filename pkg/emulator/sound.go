@@ -0,0 +1,111 @@
+package emulator
+
+import (
+	"image"
+	"strings"
+
+	"github.com/pokemium/magia/pkg/emulator/debug"
+	"github.com/pokemium/magia/pkg/emulator/joypad"
+	"github.com/pokemium/magia/pkg/emulator/record"
+	"github.com/pokemium/magia/pkg/gba/apu"
+)
+
+// channelTap receives the sound of a channel alone for the oscilloscope and channel recording
+type channelTap struct {
+	// samples of the last frame
+	samples []int16
+	wav     *record.WAV
+}
+
+func (t *channelTap) WriteSamples(samples []int16) {
+	t.samples = append(t.samples[:0], samples...)
+	if t.wav != nil {
+		t.wav.WriteSamples(samples)
+	}
+}
+
+// updateSoundViewer handles the mute and solo hotkeys of the sound viewer, and returns true if mute or solo is changed.
+//
+// Solo wins over mute, so that Shift+1 (solo) doesn't also toggle 1 (mute) with the default bindings.
+func (e *Emulator) updateSoundViewer() bool {
+	changed := false
+	for i := range joypad.MuteHotkeys {
+		c := apu.Channel(i)
+		switch {
+		case e.input.JustPressed(joypad.SoloHotkeys[i]):
+			e.GBA.SetChannelSolo(c, !e.GBA.ChannelSolo(c))
+		case e.input.JustPressed(joypad.MuteHotkeys[i]):
+			e.GBA.SetChannelMute(c, !e.GBA.ChannelMuted(c))
+		default:
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+// updateChannelTaps connects the taps of the channels while the sound viewer or channel recording needs them
+func (e *Emulator) updateChannelTaps() {
+	need := e.view == viewSound || e.recording.channelWAVs != nil
+	for i := range e.taps {
+		c := apu.Channel(i)
+		switch {
+		case need && e.taps[i] == nil:
+			e.taps[i] = &channelTap{}
+			e.GBA.SetChannelSink(c, e.taps[i])
+		case !need && e.taps[i] != nil:
+			e.taps[i] = nil
+			e.GBA.SetChannelSink(c, nil)
+		}
+		if e.taps[i] != nil {
+			e.taps[i].wav = nil
+			if chs := e.recording.channelWAVs; chs != nil {
+				e.taps[i].wav = chs[i]
+			}
+		}
+	}
+}
+
+// soundImage draws the oscilloscopes of the channels
+func (e *Emulator) soundImage() *image.RGBA {
+	channels, muted := make([][]int16, apu.ChannelCount), make([]bool, apu.ChannelCount)
+	for i, t := range e.taps {
+		if t != nil {
+			channels[i] = t.samples
+		}
+		muted[i] = !e.channelAudible(apu.Channel(i))
+	}
+	return debug.Oscilloscope(channels, muted)
+}
+
+// channelAudible reports whether the channel is played with the current mute and solo
+func (e *Emulator) channelAudible(c apu.Channel) bool {
+	for i := apu.Channel(0); i < apu.ChannelCount; i++ {
+		if e.GBA.ChannelSolo(i) {
+			return e.GBA.ChannelSolo(c)
+		}
+	}
+	return !e.GBA.ChannelMuted(c)
+}
+
+// soundTitle returns the mute and solo channels for the window title
+func (e *Emulator) soundTitle() string {
+	mute, solo := []string{}, []string{}
+	for c := apu.Channel(0); c < apu.ChannelCount; c++ {
+		if e.GBA.ChannelMuted(c) {
+			mute = append(mute, c.String())
+		}
+		if e.GBA.ChannelSolo(c) {
+			solo = append(solo, c.String())
+		}
+	}
+
+	title := ""
+	if len(solo) > 0 {
+		title += " [solo " + strings.Join(solo, ",") + "]"
+	}
+	if len(mute) > 0 {
+		title += " [mute " + strings.Join(mute, ",") + "]"
+	}
+	return title
+}
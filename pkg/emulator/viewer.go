@@ -0,0 +1,146 @@
+package emulator
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/hajimehoshi/ebiten/v2"
+	"github.com/pokemium/magia/pkg/emulator/debug"
+	"github.com/pokemium/magia/pkg/emulator/joypad"
+	"github.com/pokemium/magia/pkg/gba/video"
+)
+
+// viewer shows BG maps, tiles, OBJs, palettes and sound channels instead of the game screen.
+//
+// ebiten has only one window, so F2 switches the window between the game and the viewers.
+// F3 changes the palette of the tile viewer, and 1-7 hide layers (the layer hotkeys, see layerMasks).
+// In the sound viewer, 1-6 mute the channels and Shift+1-6 solo them instead (the mute_* and solo_* hotkeys),
+// and [ and ] select a song of the game and P plays it (see songPlayer).
+type viewer int
+
+const (
+	viewGame viewer = iota
+	viewBG0
+	viewBG1
+	viewBG2
+	viewBG3
+	viewTiles
+	viewObj
+	viewPalette
+	viewSound
+	viewerCount
+)
+
+// tile viewer palettes: 0-31 for 16 color tiles, then BG and OBJ palette for 256 color tiles
+const tilePalettes = 32 + 2
+
+func (v viewer) String() string {
+	switch v {
+	case viewBG0, viewBG1, viewBG2, viewBG3:
+		return fmt.Sprintf("BG%d", v-viewBG0)
+	case viewTiles:
+		return "Tiles"
+	case viewObj:
+		return "OBJ"
+	case viewPalette:
+		return "Palette"
+	case viewSound:
+		return "Sound"
+	}
+	return ""
+}
+
+// layerMasks are the layers toggled by joypad.LayerHotkeys, and the layer_show_all hotkey shows all layers
+var layerMasks = [len(joypad.LayerHotkeys)]video.LayerMask{
+	video.HideBG0, video.HideBG1, video.HideBG2, video.HideBG3, video.HideOBJ, video.HideWindow, video.HideBlend,
+}
+
+func (e *Emulator) updateViewer() {
+	mask, changed := e.GBA.LayerMask(), false
+	if e.view == viewSound {
+		changed = e.updateSoundViewer()
+		changed = e.updateSongPlayer() || changed
+	} else {
+		for i, h := range joypad.LayerHotkeys {
+			if e.input.JustPressed(h) {
+				mask ^= layerMasks[i]
+			}
+		}
+		if e.input.JustPressed(joypad.HotkeyShowLayers) {
+			mask = 0
+		}
+		if mask != e.GBA.LayerMask() {
+			e.GBA.SetLayerMask(mask)
+			changed = true
+		}
+	}
+
+	if e.input.JustPressed(joypad.HotkeyViewer) {
+		e.view = (e.view + 1) % viewerCount
+		e.updateChannelTaps()
+		changed = true
+	}
+	if e.input.JustPressed(joypad.HotkeyPalette) {
+		e.tilePalette = (e.tilePalette + 1) % tilePalettes
+		changed = changed || e.view == viewTiles
+	}
+
+	e.viewImage = nil
+	if e.view != viewGame {
+		e.viewImage = e.viewerImage()
+	}
+
+	if changed {
+		title := e.GBA.CartHeader.Title
+		if e.view != viewGame {
+			title += " - " + e.view.String()
+			if e.view == viewTiles {
+				title += e.tilePaletteName()
+			}
+		}
+		if mask != 0 {
+			title += " [hide " + mask.String() + "]"
+		}
+		title += e.soundTitle() + e.songTitle()
+		ebiten.SetWindowTitle(title)
+	}
+}
+
+func (e *Emulator) tilePaletteName() string {
+	switch {
+	case e.tilePalette < 16:
+		return fmt.Sprintf(" (4bpp, BG palette %d)", e.tilePalette)
+	case e.tilePalette < 32:
+		return fmt.Sprintf(" (4bpp, OBJ palette %d)", e.tilePalette-16)
+	case e.tilePalette == 32:
+		return " (8bpp, BG palette)"
+	}
+	return " (8bpp, OBJ palette)"
+}
+
+// viewerImage returns the image of the current viewer, or nil if there is nothing to show
+func (e *Emulator) viewerImage() *image.RGBA {
+	if e.view == viewSound {
+		return e.soundImage()
+	}
+
+	s, err := debug.Software(e.GBA.Renderer())
+	if err != nil {
+		return nil
+	}
+
+	switch e.view {
+	case viewBG0, viewBG1, viewBG2, viewBG3:
+		return debug.BGMap(s, int(e.view-viewBG0))
+	case viewTiles:
+		if e.tilePalette >= 32 {
+			return debug.TileSheet(s, true, e.tilePalette-32)
+		}
+		return debug.TileSheet(s, false, e.tilePalette)
+	case viewObj:
+		return debug.ObjSheet(s)
+	case viewPalette:
+		return debug.Palettes(s)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package apu
+
+import "math"
+
+// blipBuffer makes band-limited stereo samples from the steps of the output level.
+//
+// The output is the sum of band-limited steps, so square waves don't alias like sampled square waves.
+// Each step adds a windowed-sinc step response into the buffer as differences, and reading integrates them.
+// It is based on the idea of blip_buf by Shay Green.
+type blipBuffer struct {
+	// output samples per CPU cycle
+	ratio float64
+
+	// position of cycle 0 of the current frame in the output samples (relative to buf[0])
+	offset float64
+
+	// differences of the output (left, right). Samples before int(offset) are complete.
+	buf [][2]float64
+
+	// integrated output
+	sum [2]float64
+}
+
+const (
+	// blipWidth is the length of the step response in output samples
+	blipWidth = 16
+
+	// blipPhases is the time resolution of a step in an output sample
+	blipPhases = 64
+
+	// blipCutoff is the cutoff frequency relative to the output sample rate
+	blipCutoff = 0.45
+)
+
+// blipKernel is the step response differences of each phase. The sum of each phase is 1.
+var blipKernel = newBlipKernel()
+
+func newBlipKernel() *[blipPhases][blipWidth]float64 {
+	// impulse response: windowed sinc
+	h := func(x float64) float64 {
+		const half = blipWidth / 2
+		if x <= -half || x >= half {
+			return 0
+		}
+		w := 0.42 + 0.5*math.Cos(math.Pi*x/half) + 0.08*math.Cos(2*math.Pi*x/half) // Blackman
+		if x == 0 {
+			return 2 * blipCutoff * w
+		}
+		return math.Sin(2*math.Pi*blipCutoff*x) / (math.Pi * x) * w
+	}
+
+	// integral of h over [a, a+1]
+	integrate := func(a float64) float64 {
+		const n = 64
+		sum := 0.0
+		for i := 0; i < n; i++ {
+			sum += h(a + (float64(i)+0.5)/n)
+		}
+		return sum / n
+	}
+
+	k := &[blipPhases][blipWidth]float64{}
+	for p := range k {
+		frac := float64(p) / blipPhases
+		total := 0.0
+		for i := range k[p] {
+			// the step at frac is in the middle of the kernel
+			k[p][i] = integrate(float64(i) - blipWidth/2 - frac)
+			total += k[p][i]
+		}
+		for i := range k[p] {
+			k[p][i] /= total
+		}
+	}
+	return k
+}
+
+func newBlipBuffer(clockRate, sampleRate int) *blipBuffer {
+	return &blipBuffer{
+		ratio: float64(sampleRate) / float64(clockRate),
+	}
+}
+
+// addDelta adds a step of the output at the cycle from the start of the frame.
+func (b *blipBuffer) addDelta(cycle int32, left, right float64) {
+	if left == 0 && right == 0 {
+		return
+	}
+
+	t := b.offset + float64(cycle)*b.ratio
+	pos := int(t)
+	phase := int((t - float64(pos)) * blipPhases)
+
+	for len(b.buf) < pos+blipWidth+1 {
+		b.buf = append(b.buf, [2]float64{})
+	}
+	for i, k := range blipKernel[phase] {
+		d := &b.buf[pos+1+i]
+		d[0] += left * k
+		d[1] += right * k
+	}
+}
+
+// endFrame finishes the frame of the cycles, and returns the number of samples that can be read.
+func (b *blipBuffer) endFrame(cycles int32) int {
+	b.offset += float64(cycles) * b.ratio
+	return int(b.offset)
+}
+
+// read appends n stereo samples into dst and returns it.
+func (b *blipBuffer) read(dst []int16, n int) []int16 {
+	for len(b.buf) < n {
+		b.buf = append(b.buf, [2]float64{})
+	}
+	for _, d := range b.buf[:n] {
+		b.sum[0] += d[0]
+		b.sum[1] += d[1]
+		dst = append(dst, clip16(b.sum[0]), clip16(b.sum[1]))
+	}
+
+	b.buf = append(b.buf[:0], b.buf[n:]...)
+	b.offset -= float64(n)
+	return dst
+}
+
+func clip16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
@@ -0,0 +1,110 @@
+package apu
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+func TestBlipKernel(t *testing.T) {
+	for p, k := range blipKernel {
+		sum := 0.0
+		for _, v := range k {
+			sum += v
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("sum of phase %d = %v, want 1", p, sum)
+		}
+	}
+}
+
+// fft returns the spectrum of x. len(x) must be a power of 2.
+func fft(x []complex128) []complex128 {
+	n := len(x)
+	if n == 1 {
+		return []complex128{x[0]}
+	}
+	even, odd := make([]complex128, n/2), make([]complex128, n/2)
+	for i := 0; i < n/2; i++ {
+		even[i], odd[i] = x[2*i], x[2*i+1]
+	}
+	e, o := fft(even), fft(odd)
+	y := make([]complex128, n)
+	for k := 0; k < n/2; k++ {
+		w := cmplx.Exp(complex(0, -2*math.Pi*float64(k)/float64(n))) * o[k]
+		y[k], y[k+n/2] = e[k]+w, e[k]-w
+	}
+	return y
+}
+
+// aliasRatio returns the power of the spectrum of samples outside of the odd harmonics of f0, relative to the total power.
+func aliasRatio(samples []float64, rate, f0 float64) float64 {
+	n := len(samples)
+	x := make([]complex128, n)
+	for i, v := range samples {
+		w := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n)) // Hann
+		x[i] = complex(v*w, 0)
+	}
+	spectrum := fft(x)
+
+	binWidth := rate / float64(n)
+	alias, total := 0.0, 0.0
+	for k := 1; k < n/2; k++ {
+		p := math.Pow(cmplx.Abs(spectrum[k]), 2)
+		total += p
+
+		f := float64(k) * binWidth
+		m := math.Round((f/f0-1)/2)*2 + 1 // nearest odd harmonic
+		if math.Abs(f-m*f0) > 4*binWidth {
+			alias += p
+		}
+	}
+	return alias / total
+}
+
+func TestBandLimitedSquare(t *testing.T) {
+	const (
+		rate = 48000
+		n    = 16384
+
+		// 131072 / (2048 - 1899) = 879.7Hz
+		freq = 1899
+		f0   = 131072.0 / (2048 - freq)
+	)
+
+	a := New(rate)
+	buf := &SampleBuffer{}
+	a.SetSink(buf)
+	a.Store8(SOUNDCNT_X, 0x80)
+	a.Store16(SOUNDCNT_L, 0x2277) // channel 2 on the left at full volume
+	a.Store16(SOUNDCNT_H, 0x0002)
+	a.Store8(SOUND2CNT_L, 0x80) // 50% duty
+	a.Store8(SOUND2CNT_L+1, 0xf0)
+	a.Store16(SOUND2CNT_H, 0x8000|freq)
+
+	blip := []float64{}
+	for len(blip) < n+rate/10 {
+		for i := 0; i < 280896/SAMP_CYCLES; i++ {
+			a.SoundClock(SAMP_CYCLES)
+		}
+		a.Play()
+		for i := 0; i < len(buf.Samples); i += 2 {
+			blip = append(blip, float64(buf.Samples[i]))
+		}
+	}
+
+	// the same square wave sampled without band-limiting
+	naive := make([]float64, n)
+	for i := range naive {
+		naive[i] = -1
+		if dutyTable[2][int(float64(i)/rate*f0*8)%8] {
+			naive[i] = 1
+		}
+	}
+
+	got, want := aliasRatio(blip[len(blip)-n:], rate, f0), aliasRatio(naive, rate, f0)
+	t.Logf("aliasing: %.1fdB (naive: %.1fdB)", 10*math.Log10(got), 10*math.Log10(want))
+	if got > 1e-4 || got > want/100 {
+		t.Errorf("aliasing of band-limited square wave = %.1fdB, want < -40dB and 20dB less than naive sampling (%.1fdB)", 10*math.Log10(got), 10*math.Log10(want))
+	}
+}
@@ -0,0 +1,137 @@
+package apu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Channel is a sound channel mixed into the output
+type Channel int
+
+const (
+	ChannelSquare1 Channel = iota
+	ChannelSquare2
+	ChannelWave
+	ChannelNoise
+	ChannelFIFOA
+	ChannelFIFOB
+	ChannelCount
+)
+
+var channelNames = [...]string{"square1", "square2", "wave", "noise", "fifoa", "fifob"}
+
+func (c Channel) String() string {
+	if c < 0 || c >= ChannelCount {
+		return fmt.Sprintf("Channel(%d)", int(c))
+	}
+	return channelNames[c]
+}
+
+// ChannelNames returns the names accepted by ParseChannel
+func ChannelNames() []string {
+	return channelNames[:]
+}
+
+func ParseChannel(name string) (Channel, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range channelNames {
+		if n == name {
+			return Channel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sound channel %q (available: %s)", name, strings.Join(channelNames[:], ", "))
+}
+
+// channelMask is a set of channels (bit n: Channel n)
+type channelMask uint8
+
+const allChannels channelMask = 1<<ChannelCount - 1
+
+func (m channelMask) has(c Channel) bool {
+	return m&(1<<c) != 0
+}
+
+// tap renders a channel alone for a sink
+type tap struct {
+	sink    AudioSink
+	blip    *blipBuffer
+	out     [2]int32
+	samples []int16
+}
+
+// Muted reports whether the channel is muted by SetMute
+func (a *APU) Muted(c Channel) bool { return a.muted.has(c) }
+
+// SetMute silences the channel in the output.
+func (a *APU) SetMute(c Channel, mute bool) {
+	if mute {
+		a.muted |= 1 << c
+	} else {
+		a.muted &^= 1 << c
+	}
+	a.updateOutput(a.time)
+}
+
+// Solo reports whether the channel is soloed by SetSolo
+func (a *APU) Solo(c Channel) bool { return a.solo.has(c) }
+
+// SetSolo plays only the soloed channels. If no channel is soloed, all channels except muted ones are played.
+func (a *APU) SetSolo(c Channel, solo bool) {
+	if solo {
+		a.solo |= 1 << c
+	} else {
+		a.solo &^= 1 << c
+	}
+	a.updateOutput(a.time)
+}
+
+// audible returns the channels mixed into the output
+func (a *APU) audible() channelMask {
+	if a.solo != 0 {
+		return a.solo
+	}
+	return allChannels &^ a.muted
+}
+
+// SetChannelSink sets where the samples of the channel alone go, which is regardless of mute and solo.
+//
+// The samples are stereo with the panning and volume of the channel at the output sample rate, and pushed once per frame like SetSink.
+// nil stops it.
+func (a *APU) SetChannelSink(c Channel, s AudioSink) {
+	if s == nil {
+		a.taps[c] = nil
+		return
+	}
+	if a.taps[c] == nil {
+		t := &tap{blip: newBlipBuffer(CPU_FREQ_HZ, a.rate)}
+		t.blip.offset = a.blip.offset
+		t.out[0], t.out[1] = a.mix(1 << c)
+		t.blip.addDelta(a.time, float64(t.out[0]), float64(t.out[1]))
+		a.taps[c] = t
+	}
+	a.taps[c].sink = s
+}
+
+// updateTaps adds the change of each tapped channel at the cycle
+func (a *APU) updateTaps(cycle int32) {
+	for c, t := range a.taps {
+		if t == nil {
+			continue
+		}
+		l, r := a.mix(1 << c)
+		t.blip.addDelta(cycle, float64(l-t.out[0]), float64(r-t.out[1]))
+		t.out = [2]int32{l, r}
+	}
+}
+
+// playTaps pushes the samples of the frame into the channel sinks
+func (a *APU) playTaps() {
+	for _, t := range a.taps {
+		if t == nil {
+			continue
+		}
+		n := t.blip.endFrame(a.time)
+		t.samples = t.blip.read(t.samples[:0], n)
+		t.sink.WriteSamples(t.samples)
+	}
+}
@@ -0,0 +1,75 @@
+package apu
+
+import "testing"
+
+// playFrame runs the APU for a frame and returns the peak of the left samples
+func playFrame(a *APU, buf *SampleBuffer) int16 {
+	for i := 0; i < 280896/SAMP_CYCLES; i++ {
+		a.SoundClock(SAMP_CYCLES)
+	}
+	a.Play()
+	peak := int16(0)
+	for i := 0; i < len(buf.Samples); i += 2 {
+		if s := buf.Samples[i]; s > peak {
+			peak = s
+		} else if -s > peak {
+			peak = -s
+		}
+	}
+	return peak
+}
+
+func TestMuteSolo(t *testing.T) {
+	a := New(0)
+	out, tapped := &SampleBuffer{}, &SampleBuffer{}
+	a.SetSink(out)
+	a.SetChannelSink(ChannelSquare2, tapped)
+
+	a.Store8(SOUNDCNT_X, 0x80)
+	a.Store16(SOUNDCNT_L, 0x2277)
+	a.Store16(SOUNDCNT_H, 0x0002)
+	a.Store8(SOUND2CNT_L, 0x80)
+	a.Store8(SOUND2CNT_L+1, 0xf0)
+	a.Store16(SOUND2CNT_H, 0x8000|1899)
+	playFrame(a, out)
+
+	if playFrame(a, out) == 0 {
+		t.Fatal("no sound from square 2")
+	}
+	if len(tapped.Samples) != len(out.Samples) {
+		t.Errorf("tap has %d samples, want %d", len(tapped.Samples), len(out.Samples))
+	}
+
+	a.SetMute(ChannelSquare2, true)
+	playFrame(a, out) // the first samples of the frame may have the tail of the sound before muted
+	if peak := playFrame(a, out); peak != 0 {
+		t.Errorf("peak = %d with square 2 muted", peak)
+	}
+	if playFrame(a, tapped) == 0 {
+		t.Errorf("tap of muted square 2 is silent")
+	}
+
+	a.SetMute(ChannelSquare2, false)
+	a.SetSolo(ChannelNoise, true)
+	playFrame(a, out)
+	if peak := playFrame(a, out); peak != 0 {
+		t.Errorf("peak = %d with noise soloed", peak)
+	}
+
+	a.SetSolo(ChannelSquare2, true)
+	playFrame(a, out)
+	if playFrame(a, out) == 0 {
+		t.Errorf("no sound with square 2 soloed")
+	}
+}
+
+func TestParseChannel(t *testing.T) {
+	for c := Channel(0); c < ChannelCount; c++ {
+		if got, err := ParseChannel(c.String()); err != nil || got != c {
+			t.Errorf("ParseChannel(%q) = %v, %v", c.String(), got, err)
+		}
+	}
+	if _, err := ParseChannel("pulse"); err == nil {
+		t.Error("ParseChannel(pulse) must fail")
+	}
+}
@@ -0,0 +1,92 @@
+package apu
+
+// Direct Sound channel A and B play 8bit samples from the FIFOs.
+//
+// A FIFO is a 32 bytes ring buffer written by the CPU or DMA via FIFO_A/FIFO_B.
+// Each overflow of the timer selected in SOUNDCNT_H latches a sample, and DMA is requested when 16 bytes or less are left.
+
+const (
+	fifoSize = 32
+
+	// FIFO requests DMA when the number of bytes is at most this
+	fifoDMAThreshold = 16
+)
+
+// SOUNDCNT_H bits of Direct Sound
+const (
+	soundATimer = 10
+	soundAReset = 11
+	soundBTimer = 14
+	soundBReset = 15
+)
+
+type fifo struct {
+	buf   [fifoSize]int8
+	read  byte
+	count byte
+
+	// sample is played until the next timer overflow
+	sample int8
+}
+
+// write pushes a byte. Writing into the full FIFO resets it first.
+func (f *fifo) write(val int8) {
+	if f.count == fifoSize {
+		f.reset()
+	}
+	f.buf[(f.read+f.count)%fifoSize] = val
+	f.count++
+}
+
+func (f *fifo) reset() {
+	f.read, f.count = 0, 0
+}
+
+// latch pops the next sample. The last sample is kept if the FIFO is empty.
+func (f *fifo) latch() {
+	if f.count == 0 {
+		return
+	}
+	f.sample = f.buf[f.read]
+	f.read = (f.read + 1) % fifoSize
+	f.count--
+}
+
+// TimerOverflow latches the samples of the FIFOs driven by the timer, which has overflowed n times.
+//
+// It returns which FIFOs request DMA.
+func (a *APU) TimerOverflow(timer, n int) (dma [2]bool) {
+	if n > fifoSize {
+		n = fifoSize
+	}
+
+	cnth := uint16(a.Load32(SOUNDCNT_H))
+	changed := false
+	for ch, bit := range [2]uint{soundATimer, soundBTimer} {
+		if int(cnth>>bit)&1 != timer {
+			continue
+		}
+
+		f := &a.fifos[ch]
+		prev := f.sample
+		for i := 0; i < n; i++ {
+			f.latch()
+		}
+		changed = changed || f.sample != prev
+		dma[ch] = f.count <= fifoDMAThreshold
+	}
+
+	if changed {
+		a.updateOutput(a.time)
+	}
+	return dma
+}
+
+// writeFIFO handles a byte written into FIFO_A or FIFO_B
+func (a *APU) writeFIFO(ofs uint32, val byte) {
+	ch := 0
+	if ofs >= FIFO_B {
+		ch = 1
+	}
+	a.fifos[ch].write(int8(val))
+}
@@ -0,0 +1,108 @@
+package apu
+
+import "testing"
+
+func TestFIFORing(t *testing.T) {
+	a := New(0)
+	a.Store16(SOUNDCNT_H, 0x0300) // A: timer 0, B: timer 1 (both off)
+
+	// 28 bytes, then drain 20 and refill across the end of the buffer
+	for i := 0; i < 28; i++ {
+		a.Store8(FIFO_A+uint32(i%4), byte(i))
+	}
+	for i := 0; i < 20; i++ {
+		a.TimerOverflow(0, 1)
+		if got := a.fifos[0].sample; got != int8(i) {
+			t.Fatalf("sample %d = %d", i, got)
+		}
+	}
+	for i := 28; i < 48; i++ {
+		a.Store8(FIFO_A+uint32(i%4), byte(i))
+	}
+	for i := 20; i < 48; i++ {
+		a.TimerOverflow(0, 1)
+		if got := a.fifos[0].sample; got != int8(i) {
+			t.Fatalf("sample %d = %d", i, got)
+		}
+	}
+
+	// the last sample is kept while empty
+	a.TimerOverflow(0, 1)
+	if got := a.fifos[0].sample; got != 47 {
+		t.Errorf("sample of empty FIFO = %d, want 47", got)
+	}
+
+	// FIFO B isn't driven by timer 0
+	if a.fifos[1].sample != 0 {
+		t.Errorf("FIFO B sample = %d", a.fifos[1].sample)
+	}
+}
+
+func TestFIFOOverflowAndReset(t *testing.T) {
+	a := New(0)
+	for i := 0; i < 32; i++ {
+		a.Store8(FIFO_B+uint32(i%4), 1)
+	}
+	if a.fifos[1].count != 32 {
+		t.Fatalf("count = %d, want 32", a.fifos[1].count)
+	}
+
+	// writing into the full FIFO resets it
+	a.Store8(FIFO_B, 2)
+	if a.fifos[1].count != 1 {
+		t.Errorf("count after overflow = %d, want 1", a.fifos[1].count)
+	}
+
+	a.Store16(SOUNDCNT_H, 0x8000)
+	if a.fifos[1].count != 0 {
+		t.Errorf("count after reset = %d, want 0", a.fifos[1].count)
+	}
+	if cnth := a.Load32(SOUNDCNT_H) & 0xffff; cnth != 0 {
+		t.Errorf("SOUNDCNT_H = %#x, reset bits must read 0", cnth)
+	}
+}
+
+func TestFIFODMARequest(t *testing.T) {
+	a := New(0)
+	a.Store16(SOUNDCNT_H, 0x4000) // B: timer 1
+	for i := 0; i < 5; i++ {
+		a.Store32(FIFO_A, 0)
+	}
+
+	// DMA is requested when 16 bytes or less are left
+	for n := 19; n >= 16; n-- {
+		dma := a.TimerOverflow(0, 1)
+		if dma[0] != (n <= 16) || dma[1] {
+			t.Errorf("dma = %v with %d bytes", dma, n)
+		}
+	}
+	if dma := a.TimerOverflow(1, 1); dma[0] || !dma[1] {
+		t.Errorf("dma = %v on timer 1, want B only", dma)
+	}
+}
+
+func TestSoundBias(t *testing.T) {
+	tests := []struct {
+		sample     int32
+		level      int32
+		resolution uint32
+		want       int32
+	}{
+		{0, 0x200, 0, 0},
+		{0x1ff, 0x200, 0, 0x1fe << 6},
+		{-0x300, 0x200, 0, -0x200 << 6},
+		{0x7, 0x200, 3, 0},
+		{0x10, 0x200, 3, 0x10 << 6},
+		{-0x10, 0, 0, 0}, // clipped at 0 without bias
+	}
+	for _, tt := range tests {
+		if got := biased(tt.sample, tt.level, tt.resolution); got != tt.want {
+			t.Errorf("biased(%#x, %#x, %d) = %#x, want %#x", tt.sample, tt.level, tt.resolution, got, tt.want)
+		}
+	}
+
+	a := New(0)
+	if bias := a.Load32(SOUNDBIAS) & 0xffff; bias != 0x200 {
+		t.Errorf("SOUNDBIAS = %#x, want 0x200", bias)
+	}
+}
@@ -0,0 +1,609 @@
+package apu
+
+// PSG is the 4 sound channels of Game Boy (2 square, wave and noise).
+//
+// Each channel has a frequency timer clocked by CPU cycles, and the frame sequencer clocks
+// length counters (256Hz), frequency sweep (128Hz) and envelopes (64Hz) at 512Hz.
+
+const (
+	// SEQUENCER_CYCLES is CPU cycles of a frame sequencer step (512Hz)
+	SEQUENCER_CYCLES = CPU_FREQ_HZ / 512
+
+	// amplitude of a channel at volume 15
+	psgAmplitude = 8
+)
+
+var dutyTable = [4][8]bool{
+	{false, false, false, false, false, false, false, true}, // 12.5%
+	{true, false, false, false, false, false, false, true},  // 25%
+	{true, false, false, false, false, true, true, true},    // 50%
+	{false, true, true, true, true, true, true, false},      // 75%
+}
+
+// lengthCounter disables the channel when it reaches 0
+type lengthCounter struct {
+	counter uint16
+	max     uint16
+	enabled bool
+}
+
+func (l *lengthCounter) load(n uint16) {
+	l.counter = l.max - n
+}
+
+// clock returns false when the channel must be disabled
+func (l *lengthCounter) clock() bool {
+	if l.enabled && l.counter > 0 {
+		l.counter--
+		return l.counter != 0
+	}
+	return true
+}
+
+// envelope changes the volume of square and noise channels
+type envelope struct {
+	// register (NRx2)
+	initial byte
+	up      bool
+	period  byte
+
+	volume  byte
+	timer   byte
+	running bool
+}
+
+// dac reports whether the DAC of the channel is on. The channel can't be enabled if it's off.
+func (e *envelope) dac() bool {
+	return e.initial != 0 || e.up
+}
+
+// write updates the register. If the channel is playing, the volume changes by "zombie mode" of the hardware.
+func (e *envelope) write(val byte, playing bool) {
+	if playing {
+		if e.period == 0 && e.running {
+			e.volume++
+		} else if !e.up {
+			e.volume += 2
+		}
+		if e.up != (val&0x8 != 0) {
+			e.volume = 16 - e.volume
+		}
+		e.volume &= 0xf
+	}
+
+	e.initial, e.up, e.period = val>>4, val&0x8 != 0, val&0x7
+}
+
+func (e *envelope) trigger() {
+	e.volume = e.initial
+	e.timer = e.period
+	if e.timer == 0 {
+		e.timer = 8
+	}
+	e.running = true
+}
+
+func (e *envelope) clock() {
+	if e.timer > 0 {
+		e.timer--
+	}
+	if e.timer != 0 {
+		return
+	}
+
+	e.timer = e.period
+	if e.timer == 0 {
+		e.timer = 8
+	}
+	if e.period == 0 || !e.running {
+		return
+	}
+
+	switch {
+	case e.up && e.volume < 15:
+		e.volume++
+	case !e.up && e.volume > 0:
+		e.volume--
+	default:
+		e.running = false
+	}
+}
+
+// sweep changes the frequency of square channel 1
+type sweep struct {
+	// register (SOUND1CNT_L)
+	period, shift byte
+	negate        bool
+
+	enabled bool
+	timer   byte
+	shadow  uint16
+
+	// negate mode has been used since the last trigger
+	negated bool
+}
+
+// calc returns the next frequency. It is over 2047 on overflow.
+func (s *sweep) calc() uint16 {
+	delta := s.shadow >> s.shift
+	if s.negate {
+		s.negated = true
+		return s.shadow - delta
+	}
+	return s.shadow + delta
+}
+
+// square is sound channel 1 and 2
+type square struct {
+	on     bool
+	length lengthCounter
+	env    envelope
+	sweep  sweep
+
+	duty  byte
+	freq  uint16
+	timer int32
+	step8 byte // position in the duty cycle
+}
+
+func (c *square) period() int32 {
+	return 16 * (2048 - int32(c.freq))
+}
+
+// trigger restarts the channel. It returns false if the channel can't start.
+func (c *square) trigger(sweep bool) bool {
+	c.on = c.env.dac()
+	c.timer = c.period()
+	c.env.trigger()
+
+	if sweep {
+		s := &c.sweep
+		s.shadow, s.negated = c.freq, false
+		s.timer = s.period
+		if s.timer == 0 {
+			s.timer = 8
+		}
+		s.enabled = s.period != 0 || s.shift != 0
+		if s.shift != 0 && s.calc() > 2047 {
+			c.on = false
+		}
+	}
+	return c.on
+}
+
+// clockSweep returns the new frequency, or -1 if it isn't changed.
+func (c *square) clockSweep() int {
+	s := &c.sweep
+	if s.timer > 0 {
+		s.timer--
+	}
+	if s.timer != 0 {
+		return -1
+	}
+
+	s.timer = s.period
+	if s.timer == 0 {
+		s.timer = 8
+	}
+	if !s.enabled || s.period == 0 {
+		return -1
+	}
+
+	freq := s.calc()
+	if freq > 2047 {
+		c.on = false
+		return -1
+	}
+	if s.shift == 0 {
+		return -1
+	}
+
+	s.shadow, c.freq = freq, freq
+
+	// overflow check with the new frequency
+	if s.calc() > 2047 {
+		c.on = false
+	}
+	return int(freq)
+}
+
+func (c *square) output() int32 {
+	v := int32(c.env.volume) * psgAmplitude
+	if dutyTable[c.duty][c.step8] {
+		return v
+	}
+	return -v
+}
+
+// step advances the waveform when the frequency timer reaches 0
+func (c *square) step() {
+	c.timer += c.period()
+	c.step8 = (c.step8 + 1) & 7
+}
+
+// wave is sound channel 3
+type wave struct {
+	on     bool
+	dac    bool
+	length lengthCounter
+
+	// 64 digits using both banks
+	twoBanks bool
+	bank     byte
+	volume   byte
+	force75  bool
+
+	freq  uint16
+	timer int32
+	pos   byte
+
+	// sample is the digit being played. It is read from ram on each step.
+	sample byte
+	ram    *[0x20]byte
+}
+
+func (c *wave) period() int32 {
+	return 8 * (2048 - int32(c.freq))
+}
+
+func (c *wave) trigger() bool {
+	c.on = c.dac
+	c.timer = c.period()
+	c.pos = 0
+	return c.on
+}
+
+// digit returns the 4bit sample being played. The upper 4 bits of a byte are played first.
+func (c *wave) digit() byte {
+	pos := uint32(c.pos)
+	if c.twoBanks {
+		pos = (uint32(c.bank)*32 + pos) & 63
+	} else {
+		pos = uint32(c.bank)*32 + pos&31
+	}
+
+	b := c.ram[pos/2]
+	if pos&1 == 0 {
+		return b >> 4
+	}
+	return b & 0xf
+}
+
+func (c *wave) output() int32 {
+	v := (int32(c.sample) - 8) * 2 * psgAmplitude
+	switch {
+	case c.force75:
+		return v * 3 / 4
+	case c.volume == 0:
+		return 0
+	}
+	return v >> (c.volume - 1)
+}
+
+func (c *wave) step() {
+	c.timer += c.period()
+
+	digits := byte(32)
+	if c.twoBanks {
+		digits = 64
+	}
+	c.pos = (c.pos + 1) % digits
+	c.sample = c.digit()
+}
+
+// noise is sound channel 4
+type noise struct {
+	on     bool
+	length lengthCounter
+	env    envelope
+
+	divisor byte
+	shift   byte
+	narrow  bool // 7bit LFSR
+
+	lfsr  uint16
+	timer int32
+}
+
+func (c *noise) period() int32 {
+	d := int32(c.divisor) * 16
+	if d == 0 {
+		d = 8
+	}
+	return 4 * (d << c.shift)
+}
+
+func (c *noise) trigger() bool {
+	c.on = c.env.dac()
+	c.timer = c.period()
+	c.lfsr = 0x7fff
+	c.env.trigger()
+	return c.on
+}
+
+func (c *noise) output() int32 {
+	v := int32(c.env.volume) * psgAmplitude
+	if c.lfsr&1 == 0 {
+		return v
+	}
+	return -v
+}
+
+func (c *noise) step() {
+	c.timer += c.period()
+
+	// shift 14 and 15 stop the clock
+	if c.shift >= 14 {
+		return
+	}
+	bit := (c.lfsr ^ c.lfsr>>1) & 1
+	c.lfsr = c.lfsr>>1 | bit<<14
+	if c.narrow {
+		c.lfsr = c.lfsr&^(1<<6) | bit<<6
+	}
+}
+
+// channel is a PSG channel driven by its frequency timer
+type channel interface {
+	playing() bool
+	output() int32
+
+	// cycles until the next step
+	next() int32
+	wait(cycles int32)
+	step()
+}
+
+func (c *square) playing() bool     { return c.on }
+func (c *square) next() int32       { return c.timer }
+func (c *square) wait(cycles int32) { c.timer -= cycles }
+func (c *wave) playing() bool       { return c.on }
+func (c *wave) next() int32         { return c.timer }
+func (c *wave) wait(cycles int32)   { c.timer -= cycles }
+func (c *noise) playing() bool      { return c.on }
+func (c *noise) next() int32        { return c.timer }
+func (c *noise) wait(cycles int32)  { c.timer -= cycles }
+
+// channels returns the PSG channels in the order of SOUNDCNT_L bits
+func (a *APU) channels() [4]channel {
+	return [4]channel{&a.squares[0], &a.squares[1], &a.wave, &a.noise}
+}
+
+func min32(a, b int32) int32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// resetPSG stops all channels and clears the PSG registers, as when the sound is powered off
+func (a *APU) resetPSG() {
+	for i := SOUND1CNT_L; i < SOUNDCNT_H; i++ {
+		a.buffer[i] = 0
+	}
+	a.squares = [2]square{}
+	a.wave = wave{}
+	a.noise = noise{}
+	a.squares[0].length.max, a.squares[1].length.max, a.noise.length.max = 64, 64, 64
+	a.wave.length.max = 256
+	a.wave.ram = &a.waveRAM
+	a.seqStep, a.seqCycles = 0, SEQUENCER_CYCLES
+	a.updateChannelStatus()
+}
+
+// updateChannelStatus shows which channels are playing in SOUNDCNT_X
+func (a *APU) updateChannelStatus() {
+	on := [4]bool{a.squares[0].on, a.squares[1].on, a.wave.on, a.noise.on}
+	cntx := a.buffer[SOUNDCNT_X] & 0xf0
+	for ch, b := range on {
+		if b {
+			cntx |= 1 << ch
+		}
+	}
+	a.buffer[SOUNDCNT_X] = cntx
+}
+
+// nextStepClocksLength reports whether the next frame sequencer step clocks length counters.
+//
+// Enabling a length counter in the other half clocks it once more.
+func (a *APU) nextStepClocksLength() bool {
+	return a.seqStep&1 == 0
+}
+
+// writePSG applies a byte written into a PSG register. old is the previous value of the byte.
+func (a *APU) writePSG(ofs uint32, old, val byte) {
+	sq0, sq1 := &a.squares[0], &a.squares[1]
+
+	switch ofs {
+	case SOUND1CNT_L:
+		s := &sq0.sweep
+		s.period, s.shift, s.negate = (val>>4)&7, val&7, val&0x8 != 0
+
+		// leaving negate mode after a calculation with it disables the channel
+		if s.negated && !s.negate {
+			sq0.on = false
+		}
+
+	case SOUND1CNT_H, SOUND2CNT_L:
+		c := &a.squares[(ofs-SOUND1CNT_H)/(SOUND2CNT_L-SOUND1CNT_H)]
+		c.duty = val >> 6
+		c.length.load(uint16(val & 0x3f))
+	case SOUND1CNT_H + 1, SOUND2CNT_L + 1:
+		c := &a.squares[(ofs-SOUND1CNT_H-1)/(SOUND2CNT_L-SOUND1CNT_H)]
+		c.env.write(val, c.on)
+		if !c.env.dac() {
+			c.on = false
+		}
+
+	case SOUND1CNT_X:
+		sq0.freq = sq0.freq&0x700 | uint16(val)
+	case SOUND2CNT_H:
+		sq1.freq = sq1.freq&0x700 | uint16(val)
+	case SOUND1CNT_X + 1, SOUND2CNT_H + 1:
+		ch := 0
+		if ofs == SOUND2CNT_H+1 {
+			ch = 1
+		}
+		c := &a.squares[ch]
+		c.freq = c.freq&0xff | uint16(val&7)<<8
+		trigger := val&0x80 != 0
+		if a.writeLengthEnable(&c.length, val, trigger) {
+			c.on = false
+		}
+		if trigger {
+			c.trigger(ch == 0)
+			a.reloadLength(&c.length)
+		}
+
+	case SOUND3CNT_L:
+		c := &a.wave
+		c.twoBanks, c.bank, c.dac = val&0x20 != 0, (val>>6)&1, val&0x80 != 0
+		if !c.dac {
+			c.on = false
+		}
+	case SOUND3CNT_H:
+		a.wave.length.load(uint16(val))
+	case SOUND3CNT_H + 1:
+		a.wave.volume, a.wave.force75 = (val>>5)&3, val&0x80 != 0
+	case SOUND3CNT_X:
+		a.wave.freq = a.wave.freq&0x700 | uint16(val)
+	case SOUND3CNT_X + 1:
+		c := &a.wave
+		c.freq = c.freq&0xff | uint16(val&7)<<8
+		trigger := val&0x80 != 0
+		if a.writeLengthEnable(&c.length, val, trigger) {
+			c.on = false
+		}
+		if trigger {
+			c.trigger()
+			a.reloadLength(&c.length)
+		}
+
+	case SOUND4CNT_L:
+		a.noise.length.load(uint16(val & 0x3f))
+	case SOUND4CNT_L + 1:
+		c := &a.noise
+		c.env.write(val, c.on)
+		if !c.env.dac() {
+			c.on = false
+		}
+	case SOUND4CNT_H:
+		c := &a.noise
+		c.divisor, c.narrow, c.shift = val&7, val&0x8 != 0, val>>4
+	case SOUND4CNT_H + 1:
+		c := &a.noise
+		trigger := val&0x80 != 0
+		if a.writeLengthEnable(&c.length, val, trigger) {
+			c.on = false
+		}
+		if trigger {
+			c.trigger()
+			a.reloadLength(&c.length)
+		}
+
+	case SOUNDCNT_X:
+		if old&0x80 != 0 && val&0x80 == 0 {
+			a.resetPSG()
+		}
+	}
+
+	a.updateChannelStatus()
+	a.updateLevels()
+}
+
+// writeLengthEnable updates the length enable bit (bit 6). It returns true if the channel must be disabled.
+func (a *APU) writeLengthEnable(l *lengthCounter, val byte, trigger bool) bool {
+	was := l.enabled
+	l.enabled = val&0x40 != 0
+	if was || !l.enabled || a.nextStepClocksLength() || l.counter == 0 {
+		return false
+	}
+
+	// extra clock
+	l.counter--
+	return l.counter == 0 && !trigger
+}
+
+// reloadLength fills the length counter on trigger if it is 0
+func (a *APU) reloadLength(l *lengthCounter) {
+	if l.counter != 0 {
+		return
+	}
+	l.counter = l.max
+	if l.enabled && !a.nextStepClocksLength() {
+		l.counter--
+	}
+}
+
+// clockSequencer runs a frame sequencer step
+func (a *APU) clockSequencer() {
+	step := a.seqStep
+	a.seqStep = (a.seqStep + 1) & 7
+
+	if step&1 == 0 {
+		for i := range a.squares {
+			if !a.squares[i].length.clock() {
+				a.squares[i].on = false
+			}
+		}
+		if !a.wave.length.clock() {
+			a.wave.on = false
+		}
+		if !a.noise.length.clock() {
+			a.noise.on = false
+		}
+	}
+
+	if step == 2 || step == 6 {
+		c := &a.squares[0]
+		if freq := c.clockSweep(); freq >= 0 {
+			// the new frequency is visible in the register
+			a.buffer[SOUND1CNT_X] = byte(freq)
+			a.buffer[SOUND1CNT_X+1] = a.buffer[SOUND1CNT_X+1]&^7 | byte(freq>>8)
+		}
+	}
+
+	if step == 7 {
+		a.squares[0].env.clock()
+		a.squares[1].env.clock()
+		a.noise.env.clock()
+	}
+
+	a.updateChannelStatus()
+	a.updateLevels()
+}
+
+// runPSG advances the channels by the cycles. Changes of the output are added into the blip buffer at the exact cycle.
+func (a *APU) runPSG(cycles int32) {
+	chans := a.channels()
+	for cycles > 0 {
+		n := min32(cycles, a.seqCycles)
+		for ch, c := range chans {
+			a.runChannel(ch, c, n)
+		}
+
+		a.time += n
+		cycles -= n
+		a.seqCycles -= n
+		if a.seqCycles == 0 {
+			a.seqCycles = SEQUENCER_CYCLES
+			a.clockSequencer()
+		}
+	}
+}
+
+func (a *APU) runChannel(ch int, c channel, cycles int32) {
+	if !c.playing() {
+		return
+	}
+
+	t := int32(0)
+	for t+c.next() <= cycles {
+		n := c.next()
+		t += n
+		c.wait(n)
+		c.step()
+		a.setLevel(ch, c.output(), a.time+t)
+	}
+	c.wait(cycles - t)
+}
@@ -0,0 +1,142 @@
+package apu
+
+import "testing"
+
+func newPSG() *APU {
+	a := New(0)
+	a.Store8(SOUNDCNT_X, 0x80)
+	return a
+}
+
+// step runs the PSG until the frame sequencer has run n steps
+func (a *APU) step(n int) {
+	for i := 0; i < n; i++ {
+		a.runPSG(a.seqCycles)
+	}
+}
+
+func (a *APU) playing(ch int) bool {
+	return a.buffer[SOUNDCNT_X]&(1<<ch) != 0
+}
+
+func TestSquarePitch(t *testing.T) {
+	a := newPSG()
+	a.Store8(SOUND2CNT_L, 0x80) // 50% duty
+	a.Store8(SOUND2CNT_L+1, 0xf0)
+
+	// 131072 / (2048 - 1920) = 1024Hz
+	a.Store8(SOUND2CNT_H, 1920&0xff)
+	a.Store8(SOUND2CNT_H+1, 0x80|1920>>8)
+
+	edges, prev := 0, int32(0)
+	for i := 0; i < CPU_FREQ_HZ/SAMP_CYCLES; i++ {
+		a.runPSG(SAMP_CYCLES)
+		out := a.levels[1]
+		if prev < 0 && out > 0 {
+			edges++
+		}
+		prev = out
+	}
+	if edges < 1023 || edges > 1024 {
+		t.Errorf("square channel 2 has %d cycles per second, want 1024", edges)
+	}
+}
+
+func TestSweepOverflow(t *testing.T) {
+	// overflow check on trigger
+	a := newPSG()
+	a.Store8(SOUND1CNT_H+1, 0xf0)
+	a.Store8(SOUND1CNT_L, 0x11)
+	a.Store16(SOUND1CNT_X, 0x8000|0x700)
+	if a.playing(0) {
+		t.Errorf("channel 1 is playing after trigger with overflow")
+	}
+
+	// the second calculation after the update overflows
+	a = newPSG()
+	a.Store8(SOUND1CNT_H+1, 0xf0)
+	a.Store8(SOUND1CNT_L, 0x11)
+	a.Store16(SOUND1CNT_X, 0x8000|0x400)
+	if !a.playing(0) {
+		t.Fatalf("channel 1 isn't playing after trigger")
+	}
+	a.step(3)
+	if freq := a.Load32(SOUND1CNT_X) & 0x7ff; freq != 0x600 {
+		t.Errorf("frequency is %#x after sweep, want 0x600", freq)
+	}
+	if a.playing(0) {
+		t.Errorf("channel 1 is playing after sweep overflow")
+	}
+}
+
+func TestSweepNegateExit(t *testing.T) {
+	a := newPSG()
+	a.Store8(SOUND1CNT_H+1, 0xf0)
+	a.Store8(SOUND1CNT_L, 0x19)
+	a.Store16(SOUND1CNT_X, 0x8000|0x400)
+	if !a.playing(0) {
+		t.Fatalf("channel 1 isn't playing after trigger")
+	}
+	a.Store8(SOUND1CNT_L, 0x11)
+	if a.playing(0) {
+		t.Errorf("channel 1 is playing after leaving negate mode")
+	}
+}
+
+func TestEnvelopeZombieMode(t *testing.T) {
+	a := newPSG()
+	a.Store8(SOUND2CNT_L+1, 0x08)
+	a.Store8(SOUND2CNT_H+1, 0x80)
+	for want := byte(1); want <= 3; want++ {
+		a.Store8(SOUND2CNT_L+1, 0x08)
+		if v := a.squares[1].env.volume; v != want {
+			t.Errorf("volume = %d, want %d", v, want)
+		}
+	}
+
+	// the DAC is off
+	a.Store8(SOUND2CNT_L+1, 0x00)
+	if a.playing(1) {
+		t.Errorf("channel 2 is playing with DAC off")
+	}
+}
+
+func TestLengthExtraClock(t *testing.T) {
+	a := newPSG()
+	a.Store8(SOUND2CNT_L, 63)
+	a.Store8(SOUND2CNT_L+1, 0xf0)
+	a.Store8(SOUND2CNT_H+1, 0x80)
+	a.step(1)
+	if !a.playing(1) {
+		t.Fatalf("channel 2 isn't playing")
+	}
+
+	// enabling length in the first half of a length period clocks it once more
+	a.Store8(SOUND2CNT_H+1, 0x40)
+	if a.playing(1) {
+		t.Errorf("channel 2 is playing after the extra length clock")
+	}
+
+	// trigger with length 0 loads 63 instead of 64
+	a.Store8(SOUND2CNT_H+1, 0xc0)
+	if !a.playing(1) {
+		t.Fatalf("channel 2 isn't playing after trigger")
+	}
+	if c := a.squares[1].length.counter; c != 63 {
+		t.Errorf("length counter = %d, want 63", c)
+	}
+}
+
+func TestWaveLength(t *testing.T) {
+	a := newPSG()
+	a.Store8(SOUND3CNT_L, 0x80)
+	a.Store8(SOUND3CNT_H, 0xff) // length 1
+	a.Store8(SOUND3CNT_X+1, 0xc0)
+	if !a.playing(2) {
+		t.Fatalf("channel 3 isn't playing")
+	}
+	a.step(1)
+	if a.playing(2) {
+		t.Errorf("channel 3 is playing after length expired")
+	}
+}
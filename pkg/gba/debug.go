@@ -32,7 +32,7 @@ func (g *GBA) breakpoint() {
 func (g *GBA) printInst(inst uint32) {
 	if inst != 0 {
 		mode := map[bool]string{true: "THUMB", false: "ARM"}[g.Reg.GetCPSRFlag(flagT)]
-		fmt.Printf("%s pc, inst, cycle: 0x%04x, 0x%04x, %d:%d\n", mode, g.inst.loc, inst, g.video.RenderPath.Vcount, g.cycle)
+		fmt.Printf("%s pc, inst, cycle: 0x%04x, 0x%04x, %d:%d\n", mode, g.inst.loc, inst, g.video.VCount(), g.scheduler.now)
 	}
 }
 
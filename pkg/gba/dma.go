@@ -1,7 +1,6 @@
 package gba
 
 import (
-	"github.com/pokemium/magia/pkg/gba/apu"
 	"github.com/pokemium/magia/pkg/util"
 )
 
@@ -18,10 +17,26 @@ type DMA struct {
 	io                  [12]byte
 	src, dst            uint32
 	count, defaultCount int
+
+	// address and word count masks (DMA0 is internal memory only, only DMA3 can access GamePak as destination)
+	srcMask, dstMask, countMask uint32
+
+	// true: the channel is triggered and waits for the bus
+	active bool
+
+	// the last value DMA read (returned when DMA reads invalid memory)
+	latch uint32
 }
 
+const dmaNone = 4
+
 func NewDMA() [4]*DMA {
-	return [4]*DMA{{defaultCount: 0x4000}, {defaultCount: 0x4000}, {defaultCount: 0x4000}, {defaultCount: 0x10000}}
+	return [4]*DMA{
+		{defaultCount: 0x4000, srcMask: 0x07ff_ffff, dstMask: 0x07ff_ffff, countMask: 0x3fff},
+		{defaultCount: 0x4000, srcMask: 0x0fff_ffff, dstMask: 0x07ff_ffff, countMask: 0x3fff},
+		{defaultCount: 0x4000, srcMask: 0x0fff_ffff, dstMask: 0x07ff_ffff, countMask: 0x3fff},
+		{defaultCount: 0x10000, srcMask: 0x0fff_ffff, dstMask: 0x0fff_ffff, countMask: 0xffff},
+	}
 }
 func (ch *DMA) cnt() uint32 { return util.LE32(ch.io[8:]) }
 func (ch *DMA) setCnt(v uint32) {
@@ -39,7 +54,7 @@ func (ch *DMA) set(ofs uint32, b byte) bool {
 	if ofs == 11 {
 		turnon := !util.Bit(old, 7) && util.Bit(b, 7)
 		if turnon {
-			ch.src, ch.dst = util.LE32(ch.io[0:]), util.LE32(ch.io[4:])
+			ch.src, ch.dst = util.LE32(ch.io[0:])&ch.srcMask, util.LE32(ch.io[4:])&ch.dstMask
 			ch.count = ch.wordCount()
 			switch ch.size() {
 			case 32:
@@ -68,6 +83,11 @@ func (ch *DMA) dstCnt() int64 {
 }
 func (ch *DMA) dstReload() bool { return (ch.cnt()>>(16+5))&0b11 == 3 }
 func (ch *DMA) srcCnt() int64 {
+	// GamePak source is always incremented
+	if isGamePak(ch.src) {
+		return int64(ch.size()) / 8
+	}
+
 	switch (ch.cnt() >> (16 + 7)) & 0b11 {
 	case 0:
 		return int64(ch.size()) / 8
@@ -84,41 +104,149 @@ func (ch *DMA) irq() bool         { return util.Bit(ch.cnt(), 16+14) }
 func (ch *DMA) enabled() bool     { return util.Bit(ch.cnt(), 16+15) }
 func (ch *DMA) disable()          { ch.setCnt(ch.cnt() & 0x7fff_ffff) }
 func (ch *DMA) wordCount() int {
-	wordCount := ch.cnt() & 0xffff
+	wordCount := ch.cnt() & ch.countMask
 	if wordCount == 0 {
 		return ch.defaultCount
 	}
 	return int(wordCount)
 }
 
+// dmaTransfer triggers the channels whose start timing is t
 func (g *GBA) dmaTransfer(t dmaTiming) {
-	for i, ch := range g.dma {
-		if !ch.enabled() || ch.timing() != t {
-			continue
+	for _, ch := range g.dma {
+		if ch.enabled() && ch.timing() == t {
+			ch.active = true
 		}
+	}
+	g.dmaRun()
+}
 
-		size := ch.size()
-		srcInc, dstInc := ch.srcCnt(), ch.dstCnt()
-		for ch.count > 0 {
-			g._setRAM(ch.dst, g._getRAM(ch.src), size/8)
-
-			ch.dst, ch.src = uint32(int64(ch.dst)+dstInc), uint32(int64(ch.src)+srcInc)
-			ch.count--
+// dmaRun runs the triggered channels in priority order (DMA0 is the highest).
+//
+// While a channel is running, the CPU is stalled and only higher priority channels can interrupt it.
+func (g *GBA) dmaRun() {
+	for {
+		next := dmaNone
+		for i := 0; i < g.dmaRunning; i++ {
+			if g.dma[i].active {
+				next = i
+				break
+			}
+		}
+		if next == dmaNone {
+			return
 		}
 
-		if ch.irq() {
-			g.triggerIRQ(irqDMA0 + IRQID(i))
+		prev := g.dmaRunning
+		g.dmaRunning = next
+		if g.dma[next].timing() == dmaSpecial && (next == 1 || next == 2) {
+			g.dmaFifo(next)
+		} else {
+			g.dmaChannel(next)
 		}
+		g.dmaRunning = prev
+	}
+}
 
-		if ch.repeat() {
-			ch.count = ch.wordCount()
-			if ch.dstReload() {
-				ch.dst = util.LE32(ch.io[4:])
+// dmaChannel transfers all units of channel i.
+//
+// It takes 2N + 2(n-1)S + xI cycles, and 1 more cycle if it stops a halfword fetch of the prefetch unit.
+func (g *GBA) dmaChannel(i int) {
+	ch := g.dma[i]
+
+	// DMA takes GamePak bus from the prefetch unit
+	romSrc, romDst := isGamePak(ch.src), isGamePak(ch.dst)
+	penalty := 0
+	if romSrc || romDst {
+		penalty = g.prefetch.flush()
+	}
+
+	internal := 2
+	if romSrc && romDst {
+		internal = 4
+	}
+	g.timer(internal + penalty)
+
+	size := ch.size()
+	seq := false
+	for ch.count > 0 {
+		g.timer(g.waitBus(ch.src, size, seq) + g.waitBus(ch.dst, size, seq))
+		g._setRAM(ch.dst, ch.read(g, size), size/8)
+
+		srcInc, dstInc := ch.srcCnt(), ch.dstCnt()
+		ch.dst, ch.src = uint32(int64(ch.dst)+dstInc)&ch.dstMask, uint32(int64(ch.src)+srcInc)&ch.srcMask
+		ch.count--
+		seq = true
+
+		// higher priority channels can be triggered by events while this channel is running
+		if ch.count > 0 && g.dmaEvents() {
+			if !ch.enabled() {
+				break
 			}
-		} else {
-			ch.disable()
 		}
 	}
+
+	ch.active = false
+	if ch.count > 0 {
+		return
+	}
+
+	if ch.irq() {
+		g.triggerIRQ(irqDMA0 + IRQID(i))
+	}
+
+	if ch.repeat() && ch.timing() != dmaImmediate {
+		ch.count = ch.wordCount()
+		if ch.dstReload() {
+			ch.dst = util.LE32(ch.io[4:]) & ch.dstMask
+		}
+	} else {
+		ch.disable()
+	}
+}
+
+// dmaVideoCapture runs DMA3 video capture mode (DMA3 special timing).
+//
+// It is started when VCOUNT=2 and repeated each scanline like HBlank DMA, then it gets stopped when VCOUNT=162.
+func (g *GBA) dmaVideoCapture(vcount uint16) {
+	ch := g.dma[3]
+	if !ch.enabled() || ch.timing() != dmaSpecial {
+		return
+	}
+
+	switch {
+	case vcount >= 2 && vcount < 162:
+		ch.active = true
+		g.dmaRun()
+	case vcount == 162:
+		ch.disable()
+	}
+}
+
+// read returns the value at src or DMA latch value if src is invalid memory (BIOS or unused area)
+func (ch *DMA) read(g *GBA, size int) uint32 {
+	if ch.src < 0x0200_0000 {
+		return ch.latch
+	}
+
+	val := g._getRAM(ch.src)
+	if size == 16 {
+		val = (val & 0xffff) * 0x1_0001
+	}
+	ch.latch = val
+	return val
+}
+
+// dmaEvents runs the events that have come during DMA, and returns true if some event was processed
+func (g *GBA) dmaEvents() bool {
+	if g.scheduler.now < g.scheduler.next() {
+		return false
+	}
+
+	for id, at := g.scheduler.pop(); id != noEvent; id, at = g.scheduler.pop() {
+		g.dispatch(id, at)
+	}
+	return true
 }
 
 // Receive 4 x 32bit (16 bytes) per DMA
@@ -126,27 +254,29 @@ func (g *GBA) dmaTransferFifo(ch int) {
 	if !g.apu.IsSoundMasterEnable() || !g.dma[ch].enabled() || g.dma[ch].timing() != dmaSpecial {
 		return
 	}
+	g.dma[ch].active = true
+}
 
-	cnt := g.dma[ch].cnt()
-	for i := 0; i < 4; i++ { // 32bit × 4 = 4 words
-		val := g._getRAM(g.dma[ch].src)
-		g._setRAM(g.dma[ch].dst, val, 4)
+func (g *GBA) dmaFifo(i int) {
+	ch := g.dma[i]
+	ch.active = false
 
-		if ch == 1 {
-			apu.FifoACopy(val)
-		} else {
-			apu.FifoBCopy(val)
-		}
+	g.timer(2)
+	for j := 0; j < 4; j++ { // 32bit × 4 = 4 words
+		g.timer(g.waitBus(ch.src, 32, j > 0) + g.waitBus(ch.dst, 32, j > 0))
+		val := ch.read(g, 32)
+		g._setRAM(ch.dst, val, 4)
 
-		switch (cnt >> (16 + 7)) & 0b11 {
+		switch (ch.cnt() >> (16 + 7)) & 0b11 {
 		case 0:
-			g.dma[ch].src += 4
+			ch.src += 4
 		case 1:
-			g.dma[ch].src -= 4
+			ch.src -= 4
 		}
+		ch.src &= ch.srcMask
 	}
 
-	if g.dma[ch].irq() {
-		g.triggerIRQ(irqDMA0 + IRQID(ch))
+	if ch.irq() {
+		g.triggerIRQ(irqDMA0 + IRQID(i))
 	}
 }
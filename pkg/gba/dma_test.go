@@ -0,0 +1,229 @@
+package gba
+
+import (
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+// DMAxCNT_H bits
+const (
+	dmaCntSrcFixed = 0x0100
+	dmaCntRepeat   = 0x0200
+	dmaCnt32bit    = 0x0400
+	dmaCntVBlank   = 0x1000
+	dmaCntHBlank   = 0x2000
+	dmaCntSpecial  = 0x3000
+	dmaCntEnable   = 0x8000
+)
+
+// setDMA writes DMAxSAD, DMAxDAD and DMAxCNT of channel i
+func setDMA(g *GBA, i int, sad, dad uint32, count, control uint16) {
+	base := ram.DMA0SAD + uint32(i)*12
+	g._setRAM(base, sad, 4)
+	g._setRAM(base+4, dad, 4)
+	g._setRAM(base+8, uint32(count)|uint32(control)<<16, 4)
+}
+
+// runDMA runs the channels started immediately by setDMA, and returns the cycles they take
+func runDMA(g *GBA) int64 {
+	g.scheduler.cancel(evDMA)
+	start := g.cycles()
+	g.dmaTransfer(dmaImmediate)
+	return g.cycles() - start
+}
+
+func TestDMAMasks(t *testing.T) {
+	tests := []struct {
+		ch               int
+		sad, dad         uint32
+		count            uint16
+		wantSrc, wantDst uint32
+		wantCount        int
+	}{
+		// DMA0 reads and writes internal memory only
+		{0, 0x0800_0010, 0x0e00_0020, 1, 0x0000_0010, 0x0600_0020, 1},
+		// DMA1 and DMA2 can read GamePak
+		{1, 0x0800_0010, 0x0e00_0020, 1, 0x0800_0010, 0x0600_0020, 1},
+		{2, 0xf800_0010, 0x0300_0020, 1, 0x0800_0010, 0x0300_0020, 1},
+		// DMA3 can also write GamePak (SRAM, flash)
+		{3, 0xf800_0010, 0xfe00_0020, 1, 0x0800_0010, 0x0e00_0020, 1},
+
+		// word count: 14bit for DMA0-2 and 16bit for DMA3, 0 is the maximum
+		{0, 0x0200_0000, 0x0300_0000, 0, 0x0200_0000, 0x0300_0000, 0x4000},
+		{2, 0x0200_0000, 0x0300_0000, 0xffff, 0x0200_0000, 0x0300_0000, 0x3fff},
+		{3, 0x0200_0000, 0x0300_0000, 0, 0x0200_0000, 0x0300_0000, 0x10000},
+		{3, 0x0200_0000, 0x0300_0000, 0xffff, 0x0200_0000, 0x0300_0000, 0xffff},
+	}
+
+	for _, tt := range tests {
+		g := newTestGBA()
+		setDMA(g, tt.ch, tt.sad, tt.dad, tt.count, dmaCntEnable|dmaCntVBlank)
+		ch := g.dma[tt.ch]
+		if ch.src != tt.wantSrc || ch.dst != tt.wantDst || ch.count != tt.wantCount {
+			t.Errorf("DMA%d SAD=0x%08x DAD=0x%08x CNT=0x%04x: got src 0x%08x, dst 0x%08x, count 0x%x, want 0x%08x, 0x%08x, 0x%x",
+				tt.ch, tt.sad, tt.dad, tt.count, ch.src, ch.dst, ch.count, tt.wantSrc, tt.wantDst, tt.wantCount)
+		}
+	}
+}
+
+// TestDMAPriority runs a long DMA, and triggers another channel by HBlank in the middle of it.
+// The HBlank channel writes a marker into the last source word of the long one, so the marker is copied only if it interrupts the long one.
+func TestDMAPriority(t *testing.T) {
+	const n = 0x100
+	tests := []struct {
+		name          string
+		long, hblank  int
+		wantPreempted bool
+	}{
+		{"DMA0 interrupts DMA3", 3, 0, true},
+		{"DMA1 interrupts DMA2", 2, 1, true},
+		{"DMA3 waits for DMA0", 0, 3, false},
+		{"DMA2 waits for DMA1", 1, 2, false},
+	}
+
+	for _, tt := range tests {
+		g := newTestGBA()
+		for i := uint32(0); i < n; i++ {
+			g._setRAM(0x0200_0000+4*i, 0x100+i, 4)
+		}
+		g._setRAM(0x0300_0000, 0xdead_beef, 4)
+
+		setDMA(g, tt.hblank, 0x0300_0000, 0x0200_0000+4*(n-1), 1, dmaCntEnable|dmaCntHBlank|dmaCnt32bit|dmaCntSrcFixed)
+		setDMA(g, tt.long, 0x0200_0000, 0x0201_0000, n, dmaCntEnable|dmaCnt32bit)
+		g.scheduler.scheduleAt(evHBlank, g.cycles()+100)
+		runDMA(g)
+
+		if got := g._getRAM(0x0201_0000); got != 0x100 {
+			t.Errorf("%s: first word is 0x%08x", tt.name, got)
+		}
+		last := g._getRAM(0x0201_0000 + 4*(n-1))
+		if preempted := last == 0xdead_beef; preempted != tt.wantPreempted {
+			t.Errorf("%s: last word is 0x%08x", tt.name, last)
+		}
+		if g.dma[tt.long].enabled() || g.dma[tt.hblank].enabled() {
+			t.Errorf("%s: channels should be finished", tt.name)
+		}
+		if g.dmaRunning != dmaNone {
+			t.Errorf("%s: DMA%d is left running", tt.name, g.dmaRunning)
+		}
+	}
+}
+
+// TestDMAOpenBus checks that DMA from BIOS or unused memory writes the last value the channel read
+func TestDMAOpenBus(t *testing.T) {
+	g := newTestGBA()
+	g._setRAM(0x0200_0000, 0x1234, 2)
+	g._setRAM(0x0200_0004, 0x89ab_cdef, 4)
+
+	tests := []struct {
+		ch      int
+		src     uint32
+		control uint16
+		want    uint32
+	}{
+		{3, 0x0200_0000, 0, 0x1234},                // a halfword is latched on both halves
+		{3, 0x0000_0000, dmaCnt32bit, 0x1234_1234}, // BIOS
+		{3, 0x0200_0004, dmaCnt32bit, 0x89ab_cdef},
+		{3, 0x0100_0000, dmaCnt32bit, 0x89ab_cdef}, // unused
+		{3, 0x0000_0000, 0, 0xcdef},
+		{1, 0x0000_0000, dmaCnt32bit, 0}, // each channel has its own latch
+	}
+
+	for i, tt := range tests {
+		dst := 0x0300_0000 + uint32(i)*4
+		setDMA(g, tt.ch, tt.src, dst, 1, dmaCntEnable|tt.control)
+		runDMA(g)
+
+		got := g._getRAM(dst)
+		if tt.control&dmaCnt32bit == 0 {
+			got &= 0xffff
+		}
+		if got != tt.want {
+			t.Errorf("DMA%d from 0x%08x: got 0x%08x, want 0x%08x", tt.ch, tt.src, got, tt.want)
+		}
+	}
+}
+
+// TestDMACycles checks that DMA takes 2N + 2(n-1)S + xI cycles
+func TestDMACycles(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst uint32
+		n        uint16
+		control  uint16
+		want     int64
+	}{
+		// IWRAM: N = S = 1, 2 internal cycles
+		{"IWRAM 16bit x1", 0x0300_0000, 0x0300_1000, 1, 0, 2 + 2},
+		{"IWRAM 32bit x8", 0x0300_0000, 0x0300_1000, 8, dmaCnt32bit, 2 + 2*8},
+		// EWRAM: 3 cycles per halfword
+		{"EWRAM 16bit x4", 0x0200_0000, 0x0201_0000, 4, 0, 2 + (3+3)*4},
+		{"EWRAM 32bit x4", 0x0200_0000, 0x0201_0000, 4, dmaCnt32bit, 2 + (6+6)*4},
+		// ROM (WAITCNT=0): 5 cycles for N, 3 cycles for S
+		{"ROM 16bit x4", 0x0800_0000, 0x0300_0000, 4, 0, 2 + (5 + 1) + (3+1)*3},
+		{"ROM 32bit x4", 0x0800_0000, 0x0300_0000, 4, dmaCnt32bit, 2 + (5 + 3 + 1) + (3+3+1)*3},
+	}
+
+	for _, tt := range tests {
+		g := newTestGBA()
+		setDMA(g, 3, tt.src, tt.dst, tt.n, dmaCntEnable|tt.control)
+		if got := runDMA(g); got != tt.want {
+			t.Errorf("%s: got %d cycles, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestDMAVideoCapture runs a frame with DMA3 in video capture mode, and checks that it transfers on lines 2-161 and stops itself on line 162
+func TestDMAVideoCapture(t *testing.T) {
+	g := newLoopGBA()
+	setDMA(g, 3, 0x0200_0000, 0x0300_0000, 1, dmaCntEnable|dmaCntSpecial|dmaCntRepeat)
+	ch := g.dma[3]
+
+	lines, dst := []uint16{}, ch.dst
+	for g.scheduler.now < totalScanlines*cyclesScanline {
+		g.halt = true
+		g.run()
+		if ch.dst != dst {
+			lines, dst = append(lines, g.video.VCount()), ch.dst
+		}
+	}
+
+	if len(lines) != 160 || lines[0] != 2 || lines[len(lines)-1] != 161 {
+		t.Errorf("transfers on lines %v, want 160 lines from 2 to 161", lines)
+	}
+	if ch.enabled() {
+		t.Errorf("video capture should be stopped on line 162")
+	}
+}
+
+// TestDMAStartByCPU enables DMA from the CPU, and checks that the transfer starts 2 cycles after the write, before the next store
+func TestDMAStartByCPU(t *testing.T) {
+	g := newARMGBA(storeProgram(
+		[2]uint32{0x0300_0000, 0x1111_1111},
+		[2]uint32{ram.DMA3SAD, 0x0300_0000},
+		[2]uint32{ram.DMA3SAD + 4, 0x0300_0100},
+		[2]uint32{ram.DMA3SAD + 8, 1 | (dmaCntEnable|dmaCnt32bit)<<16},
+		[2]uint32{0x0300_0000, 0x2222_2222},
+	))
+
+	// the instruction which writes DMA3CNT
+	const str = 0x0800_0000 + (3*3+2)*4
+	stepUntil(g, func() bool { return g.pipe.inst[0].loc == str })
+	before := g.scheduler.now
+	stepUntil(g, func() bool { return g.pipe.inst[0].loc != str })
+	ev := g.scheduler.events[evDMA]
+	if !ev.active || ev.at <= before+2 || ev.at > g.scheduler.now+2 {
+		t.Errorf("DMA is scheduled at cycle %d, want 2 cycles after the write in cycles %d-%d", ev.at, before, g.scheduler.now)
+	}
+
+	for g.dma[3].enabled() {
+		g.run()
+	}
+	if at := g.scheduler.now; at > ev.at+cyclesARMMax+int64(2+2*2) {
+		t.Errorf("DMA finishes at cycle %d, but it should start at %d", at, ev.at)
+	}
+	if got := g._getRAM(0x0300_0100); got != 0x1111_1111 {
+		t.Errorf("DMA should copy the value before the next store, got 0x%08x", got)
+	}
+}
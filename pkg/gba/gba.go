@@ -2,11 +2,13 @@ package gba
 
 import (
 	"fmt"
+	"image"
 	"os"
 
 	"github.com/pokemium/magia/pkg/gba/apu"
 	"github.com/pokemium/magia/pkg/gba/cart"
 	"github.com/pokemium/magia/pkg/gba/ram"
+	"github.com/pokemium/magia/pkg/gba/sio"
 	"github.com/pokemium/magia/pkg/gba/timer"
 	"github.com/pokemium/magia/pkg/gba/video"
 	"github.com/pokemium/magia/pkg/util"
@@ -49,15 +51,38 @@ type GBA struct {
 	CartHeader *cart.Header
 	RAM        ram.RAM
 	inst       Inst
-	cycle      int
+	scheduler  Scheduler
+	frameDone  bool
+
+	// an instruction is being executed, and its cycles are accumulated until it ends
+	inExec            bool
+	accumulatedCycles int
+
 	Frame      uint
 	halt       bool
+	stop       bool
 	pipe       Pipe
 	timers     timer.Timers
 	dma        [4]*DMA
+	dmaRunning int
+	prefetch   Prefetch
 	joypad     Joypad
+	inputLine  int
 	DoSav      bool
 	apu        *apu.APU
+	sio        *sio.SIO
+
+	// the timestamp the APU has been run until
+	apuSynced int64
+
+	// pixel-accurate mode draws scanlines in chunks so that mid-scanline register writes take effect
+	pixelAccurate bool
+	lineStart     int64
+
+	ghosting video.Ghosting
+
+	// the last frame finished by Update, returned by Draw
+	screen []byte
 }
 
 type Pipe struct {
@@ -70,8 +95,8 @@ type Inst struct {
 	loc  uint32
 }
 
-// New GBA
-func New(src []byte, soundBuf *[]byte, isDebug bool, mute bool) *GBA {
+// New GBA. Sound is generated at sampleRate Hz (0: apu.DefaultSampleRate).
+func New(src []byte, sampleRate int, isDebug bool, mute bool) *GBA {
 	debug = isDebug
 	g := &GBA{
 		Reg:        *NewReg(),
@@ -79,10 +104,15 @@ func New(src []byte, soundBuf *[]byte, isDebug bool, mute bool) *GBA {
 		CartHeader: cart.New(src),
 		RAM:        *ram.New(src),
 		dma:        NewDMA(),
-		apu:        apu.New(),
+		dmaRunning: dmaNone,
+		apu:        apu.New(sampleRate),
+		sio:        sio.New(),
 		timers:     timer.New(),
+		joypad:     Joypad{Input: [4]byte{0xff, 0x03}}, // no keys are pressed
+		inputLine:  video.VERTICAL_PIXELS,
 	}
 	g._setRAM(ram.KEYINPUT, uint32(0x3ff), 2)
+	g.initScheduler()
 	return g
 }
 
@@ -91,31 +121,6 @@ func (g *GBA) Exit(s string) {
 	os.Exit(0)
 }
 
-var inExec = false
-var accumulatedCycles = 0
-
-func (g *GBA) exec(cycles int) {
-	if g.halt {
-		tmp := g.cycle
-		g.timer(cycles)
-		g.cycle = tmp
-		return
-	}
-
-	for g.cycle < cycles {
-		inExec = true
-		g.step()
-		inExec = false
-		if g.halt {
-			g.timer(cycles - g.cycle)
-		} else {
-			g.timer(accumulatedCycles)
-			accumulatedCycles = 0
-		}
-	}
-	g.cycle -= cycles
-}
-
 var counter = 0
 
 func (g *GBA) step() {
@@ -175,75 +180,43 @@ func (g *GBA) exception(addr uint32, mode Mode) {
 
 // Update GBA by 1 frame
 func (g *GBA) Update() {
-	g.video.RenderPath.Vcount = 0
-
-	// line 0~159
-	for y := 0; y < 160; y++ {
-		g.scanline()
-	}
-
-	// VBlank
-	dispstat := uint16(g._getRAM(ram.DISPSTAT))
-	if util.Bit(dispstat, 3) {
-		g.triggerIRQ(irqVBlank)
-	}
-
-	// line 160~226
-	g.video.SetVBlank(true)
-	g.dmaTransfer(dmaVBlank)
-	for y := 0; y < 67; y++ {
-		g.scanline()
+	g.frameDone = false
+	for !g.frameDone {
+		g.run()
 	}
-	g.video.SetVBlank(false) // clear on 227
-
-	// line 227
-	g.scanline()
 
+	g.finishFrame()
 	g.video.RenderPath.StartDraw()
 
-	if g.Frame%2 == 0 {
-		g.joypad.Read()
-	}
-
-	apu.SoundBufferWrap()
 	g.Frame++
 
+	g.syncAPU()
 	g.apu.Play()
 }
 
-func (g *GBA) scanline() {
-	dispstat := uint16(g._getRAM(ram.DISPSTAT))
-	vCount, lyc := byte(g.video.RenderPath.Vcount), byte(g._getRAM(ram.DISPSTAT+1))
-	if vCount == lyc {
-		if util.Bit(dispstat, 5) {
-			g.triggerIRQ(irqVCount)
-		}
-	}
-
-	g.exec(1006)
-
-	// HBlank
-	if !g.video.VBlank() {
-		if util.Bit(dispstat, 4) {
-			g.triggerIRQ(irqHBlank)
-		}
+// finishFrame blends the drawn frame with the previous frames, once per frame however often Draw is called
+func (g *GBA) finishFrame() {
+	frame := g.ghosting.Apply(g.video.RenderPath.FinishDraw())
+	if g.screen == nil {
+		g.screen = make([]byte, len(frame))
 	}
+	copy(g.screen, frame)
+}
 
-	g.video.SetHBlank(true)
-	g.dmaTransfer(dmaHBlank)
-	g.exec(1232 - 1006)
-	g.apu.SoundClock(1232)
-	g.video.SetHBlank(false)
-
-	vcount := g.video.RenderPath.Vcount
-	if vcount < video.VERTICAL_PIXELS {
-		g.video.RenderPath.DrawScanline(vcount)
+// Draw returns the GBA screen of the last frame run by Update
+func (g *GBA) Draw() []byte {
+	if g.screen == nil {
+		g.finishFrame()
 	}
-	g.video.RenderPath.Vcount++ // increment vcount
+	return g.screen
 }
 
-// Draw GBA screen by 1 frame
-func (g *GBA) Draw() []byte { return g.video.RenderPath.FinishDraw() }
+// Screenshot returns the frame returned by Draw
+func (g *GBA) Screenshot() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, video.HORIZONTAL_PIXELS, video.VERTICAL_PIXELS))
+	copy(img.Pix, g.Draw())
+	return img
+}
 
 func (g *GBA) checkIRQ() {
 	cond1 := !g.GetCPSRFlag(flagI)
@@ -260,6 +233,13 @@ func (g *GBA) triggerIRQ(irq IRQID) {
 	iack = iack | (1 << irq)
 	g.RAM.IO[ram.IOOffset(ram.IF)], g.RAM.IO[ram.IOOffset(ram.IF+1)] = byte(iack), byte(iack>>8)
 
+	if g.stop {
+		// only Keypad, Serial and Game Pak interrupts wake up the GBA from STOP mode
+		if irq != irqKEY && irq != irqSerial && irq != irqGamePak {
+			return
+		}
+		g.stop = false
+	}
 	g.halt = false
 	g.checkIRQ()
 }
@@ -269,23 +249,23 @@ func (g *GBA) pipelining() {
 	g.R[15] = util.Align2(g.R[15])
 	if t {
 		g.pipe.inst[0] = Inst{
-			inst: uint32(g.getRAM16(g.R[15], false)),
+			inst: uint32(g.fetch16(g.R[15], false)),
 			loc:  g.R[15],
 		}
 		g.R[15] += 2
 		g.pipe.inst[1] = Inst{
-			inst: uint32(g.getRAM16(g.R[15], true)),
+			inst: uint32(g.fetch16(g.R[15], true)),
 			loc:  g.R[15],
 		}
 		g.R[15] += 2
 	} else {
 		g.pipe.inst[0] = Inst{
-			inst: g.getRAM32(g.R[15], false),
+			inst: g.fetch32(g.R[15], false),
 			loc:  g.R[15],
 		}
 		g.R[15] += 4
 		g.pipe.inst[1] = Inst{
-			inst: g.getRAM32(g.R[15], true),
+			inst: g.fetch32(g.R[15], true),
 			loc:  g.R[15],
 		}
 		g.R[15] += 4
@@ -361,32 +341,155 @@ func (g *GBA) interwork() {
 	g.pipelining()
 }
 
+// timer advances the cycle timestamp by c
 func (g *GBA) timer(c int) {
-	if inExec {
-		accumulatedCycles += c
+	if g.inExec {
+		g.prefetch.tick(c)
+		g.accumulatedCycles += c
 		return
 	}
-	if c == 0 {
-		return
+	g.scheduler.now += int64(c)
+}
+
+// cycles returns the current timestamp including the cycles of the instruction being executed
+func (g *GBA) cycles() int64 {
+	if g.inExec {
+		return g.scheduler.now + int64(g.accumulatedCycles)
 	}
+	return g.scheduler.now
+}
 
-	g.cycle += c
-	if timer.Enable == 0 {
-		return
+// updateTimers handles timer overflows until now and schedules the next overflow
+func (g *GBA) updateTimers() {
+	if g.timers.Enabled() {
+		irqs := g.timers.Update(g.cycles(), g.timerOverflow)
+		for i, irq := range irqs {
+			if irq {
+				g.triggerIRQ(irqTimer0 + IRQID(i))
+			}
+		}
 	}
-	irqs := g.timers.Tick(c, uint16(g.apu.Load32(apu.SOUNDCNT_H)), func(ch int) { g.dmaTransferFifo(ch) })
-	for i, irq := range irqs {
-		if irq {
-			g.triggerIRQ(irqTimer0 + IRQID(i))
+	g.scheduleTimer()
+	g.dmaRun()
+}
+
+// timerOverflow feeds Direct Sound with the samples on the overflows of timer 0 and 1
+func (g *GBA) timerOverflow(ch, n int) {
+	g.syncAPU()
+	dma := g.apu.TimerOverflow(ch, n)
+	for i, req := range dma {
+		if req {
+			g.dmaTransferFifo(i + 1)
 		}
 	}
 }
 
+// syncAPU runs the APU until now, so that sound register writes and FIFO samples take effect at the exact cycle
+func (g *GBA) syncAPU() {
+	now := g.cycles()
+	if now > g.apuSynced {
+		g.apu.SoundClock(uint32(now - g.apuSynced))
+		g.apuSynced = now
+	}
+}
+
 func (g *GBA) SetJoypadHandler(h [10](func() bool)) {
 	hp := [10]*func() bool{&h[0], &h[1], &h[2], &h[3], &h[4], &h[5], &h[6], &h[7], &h[8], &h[9]}
 	g.joypad.SetHandler(hp)
 }
 
-func (g *GBA) SetAudioBuffer(s []byte) {
-	g.apu.SetBuffer(s)
+// SetInputScanline sets the scanline (0-227) where the keys are read every frame. The default is 160, the start of VBlank.
+func (g *GBA) SetInputScanline(line int) {
+	if line >= 0 && line < totalScanlines {
+		g.inputLine = line
+	}
+}
+
+// SetPixelAccurate enables pixel-accurate (mid-scanline) rendering
+func (g *GBA) SetPixelAccurate(b bool) {
+	g.pixelAccurate = b
+}
+
+// Renderer returns the PPU backend
+func (g *GBA) Renderer() video.Renderer { return g.video.RenderPath }
+
+// SetRenderer plugs another PPU backend into the video unit
+func (g *GBA) SetRenderer(r video.Renderer) error {
+	return g.video.SetRenderer(r)
+}
+
+// LayerMask returns the layers hidden by SetLayerMask
+func (g *GBA) LayerMask() video.LayerMask {
+	if r, ok := g.video.RenderPath.(video.LayerMasker); ok {
+		return r.LayerMask()
+	}
+	return 0
+}
+
+// SetLayerMask hides BG0-3, OBJ, windows or blending regardless of DISPCNT.
+//
+// It does nothing if the renderer doesn't support it.
+func (g *GBA) SetLayerMask(m video.LayerMask) {
+	if r, ok := g.video.RenderPath.(video.LayerMasker); ok {
+		r.SetLayerMask(m)
+	}
+}
+
+// ColorProfile returns the color correction set by SetColorProfile
+func (g *GBA) ColorProfile() video.ColorProfile {
+	if r, ok := g.video.RenderPath.(video.ColorCorrector); ok {
+		return r.ColorProfile()
+	}
+	return video.ColorRaw
+}
+
+// SetColorProfile changes how the colors of GBA are shown on the screen.
+//
+// It does nothing if the renderer doesn't support it.
+func (g *GBA) SetColorProfile(c video.ColorProfile) {
+	if r, ok := g.video.RenderPath.(video.ColorCorrector); ok {
+		r.SetColorProfile(c)
+	}
+}
+
+// SetGhosting blends each frame with the previous frames like the slow GBA LCD.
+//
+// persistence is used only by GhostingDecay.
+func (g *GBA) SetGhosting(mode video.GhostingMode, persistence float64) {
+	g.ghosting.Mode, g.ghosting.Persistence = mode, persistence
+}
+
+// SetAudioSink sets where the sound samples go. Samples are pushed once per frame at SampleRate.
+func (g *GBA) SetAudioSink(s apu.AudioSink) {
+	g.apu.SetSink(s)
+}
+
+// SampleRate returns the sample rate of the sound given to New
+func (g *GBA) SampleRate() int {
+	return g.apu.SampleRate()
+}
+
+// SetChannelMute silences a sound channel
+func (g *GBA) SetChannelMute(c apu.Channel, mute bool) {
+	g.apu.SetMute(c, mute)
+}
+
+// ChannelMuted reports whether the channel is muted by SetChannelMute
+func (g *GBA) ChannelMuted(c apu.Channel) bool {
+	return g.apu.Muted(c)
+}
+
+// SetChannelSolo plays only the soloed sound channels
+func (g *GBA) SetChannelSolo(c apu.Channel, solo bool) {
+	g.apu.SetSolo(c, solo)
+}
+
+// ChannelSolo reports whether the channel is soloed by SetChannelSolo
+func (g *GBA) ChannelSolo(c apu.Channel) bool {
+	return g.apu.Solo(c)
+}
+
+// SetChannelSink sets where the samples of a sound channel alone go. nil stops it.
+func (g *GBA) SetChannelSink(c apu.Channel, s apu.AudioSink) {
+	g.apu.SetChannelSink(c, s)
 }
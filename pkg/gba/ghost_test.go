@@ -0,0 +1,36 @@
+package gba
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+	"github.com/pokemium/magia/pkg/gba/video"
+)
+
+// TestGhostingOncePerFrame checks that drawing a frame many times doesn't blend it again
+func TestGhostingOncePerFrame(t *testing.T) {
+	g := newLoopGBA()
+	g.SetGhosting(video.GhostingMix, 0)
+
+	g._setRAM(ram.DISPCNT, 0, 2)
+	g._setRAM(0x0500_0000, 0x7fff, 2) // white backdrop
+	g.Update()
+	g._setRAM(0x0500_0000, 0x0000, 2) // black backdrop
+	g.Update()
+
+	want := append([]byte{}, g.Draw()...)
+	if want[0] == 0 || want[0] == 0xff {
+		t.Fatalf("frame isn't blended: %v", want[:4])
+	}
+	for i := 0; i < 3; i++ {
+		if got := g.Draw(); !bytes.Equal(got, want) {
+			t.Fatalf("Draw %d blends the frame again: %v, want %v", i+2, got[:4], want[:4])
+		}
+	}
+
+	g.Update()
+	if got := g.Draw(); got[0] != 0 {
+		t.Errorf("the next frame should be blended with the black frame: %v", got[:4])
+	}
+}
@@ -27,17 +27,13 @@ func (g *GBA) _getRAM(addr uint32) uint32 {
 	case isDMA3IO(addr):
 		return g.dma[3].get(addr - ram.DMA3SAD)
 	case timer.IsTimerIO(addr):
-		return g.timers.GetIO(addr - 0x0400_0100)
-	case addr == ram.KEYINPUT || addr == ram.KEYINPUT+1:
+		return g.timers.GetIO(addr-0x0400_0100, g.cycles())
+	case isSIOIO(addr):
+		return g.sio.Load32(addr - ram.SIODATA32)
+	case addr >= ram.KEYINPUT && addr < ram.KEYCNT+2:
 		return util.LE32(g.joypad.Input[addr-ram.KEYINPUT:])
-	case ram.Palette(addr):
-		return g.video.RenderPath.Palette.Load32(addr)
-	case ram.VRAM(addr):
-		offset := ram.VRAMOffset(addr)
-		return g.video.RenderPath.VRAM.LoadU32(offset)
-	case ram.OAM(addr):
-		offset := ram.OAMOffset(addr)
-		return g.video.RenderPath.OAM.LoadU32(offset)
+	case ram.Palette(addr), ram.VRAM(addr), ram.OAM(addr):
+		return g.video.RenderPath.Load32(addr)
 	default:
 		value := g.RAM.Get(addr)
 		if ram.BIOS(addr) {
@@ -50,8 +46,21 @@ func (g *GBA) _getRAM(addr uint32) uint32 {
 		return value
 	}
 }
+
+// fetch32 fetches ARM opcode
+func (g *GBA) fetch32(addr uint32, s bool) uint32 {
+	g.timer(g.waitFetch(addr, 32, s))
+	return g._getRAM(addr & ^uint32(3))
+}
+
+// fetch16 fetches THUMB opcode
+func (g *GBA) fetch16(addr uint32, s bool) uint32 {
+	g.timer(g.waitFetch(addr, 16, s))
+	return g._getRAM(addr) & 0x0000_ffff
+}
+
 func (g *GBA) getRAM32(addr uint32, s bool) uint32 {
-	g.timer(g.waitBus(addr, 32, s))
+	g.timer(g.waitData(addr, 32, s))
 	val := g._getRAM(addr & ^uint32(3))
 
 	if addr&3 > 0 { // https://github.com/jsmolka/gba-tests/blob/a6447c5404c8fc2898ddc51f438271f832083b7e/thumb/memory.asm#L72
@@ -61,30 +70,30 @@ func (g *GBA) getRAM32(addr uint32, s bool) uint32 {
 }
 
 func (g *GBA) getRAM16(addr uint32, s bool) uint32 {
-	g.timer(g.waitBus(addr, 16, s))
+	g.timer(g.waitData(addr, 16, s))
 	val := g._getRAM(addr)
 	return val & 0x0000_ffff
 }
 
 func (g *GBA) getRAM8(addr uint32, s bool) byte {
-	g.timer(g.waitBus(addr, 8, s))
+	g.timer(g.waitData(addr, 8, s))
 	return byte(g._getRAM(addr))
 }
 
 func (g *GBA) setRAM32(addr, value uint32, s bool) {
 	addr = util.Align4(addr)
-	g.timer(g.waitBus(addr, 32, s))
+	g.timer(g.waitData(addr, 32, s))
 	g._setRAM(addr, value, 4)
 }
 
 func (g *GBA) setRAM16(addr uint32, value uint16, s bool) {
 	addr = util.Align2(addr)
-	g.timer(g.waitBus(addr, 16, s))
+	g.timer(g.waitData(addr, 16, s))
 	g._setRAM(addr, uint32(value), 2)
 }
 
 func (g *GBA) setRAM8(addr uint32, b byte, s bool) {
-	g.timer(g.waitBus(addr, 8, s))
+	g.timer(g.waitData(addr, 8, s))
 	g._setRAM(addr, uint32(b), 1)
 }
 
@@ -100,6 +109,7 @@ func (g *GBA) _setRAM(addr uint32, val uint32, width int) {
 
 	switch {
 	case (addr >= 0x0400_0000) && (addr < 0x0400_0000+0x60):
+		g.catchUpVideo()
 		switch width {
 		case 1:
 			g.video.Set8(addr, byte(val))
@@ -109,66 +119,55 @@ func (g *GBA) _setRAM(addr uint32, val uint32, width int) {
 			g.video.Set32(addr, val)
 		}
 
-	case g.in(addr, ram.SOUND1CNT_L, ram.SOUNDCNT_H): // sound io
-		if util.Bit(byte(g.apu.Load32(apu.SOUNDCNT_X)), 7) {
-			for i := uint32(0); i < uint32(width); i++ {
-				g.apu.Store8(addr+i-ram.SOUND1CNT_L, byte(val>>(8*i)))
-			}
-		}
-
-	case addr == ram.SOUNDCNT_X:
-		old := byte(g.apu.Load32(apu.SOUNDCNT_X))
-		old = (old & 0xf) | (byte(val) & 0xf0)
-		g.apu.Store8(apu.SOUNDCNT_X, old)
-		if !util.Bit(byte(val), 7) {
-			for i := uint32(0x4000060); i <= 0x4000081; i++ {
-				g.apu.Store8(i-0x4000060, 0)
-			}
-			g.apu.Store8(apu.SOUNDCNT_X, 0)
-		}
-
-	case g.in(addr, ram.WAVE_RAM, ram.WAVE_RAM+0xf): // wave ram
-		if width == 2 {
-			g.apu.Store16(addr-ram.SOUND1CNT_L, uint16(val))
-		}
+	case g.in(addr, ram.SOUND1CNT_L, ram.FIFO_B+3): // sound io
+		g.setSoundIO(addr, val, width)
 
 	case isDMA0IO(addr):
 		for i := uint32(0); i < uint32(width); i++ {
 			if g.dma[0].set(addr-0x0400_00b0+i, byte(val>>(8*i))) {
-				g.dmaTransfer(dmaImmediate)
+				g.schedule(evDMA, 2)
 			}
 		}
 
 	case isDMA1IO(addr):
 		for i := uint32(0); i < uint32(width); i++ {
 			if g.dma[1].set(addr-0x0400_00bc+i, byte(val>>(8*i))) {
-				g.dmaTransfer(dmaImmediate)
+				g.schedule(evDMA, 2)
 			}
 		}
 
 	case isDMA2IO(addr):
 		for i := uint32(0); i < uint32(width); i++ {
 			if g.dma[2].set(addr-0x0400_00c8+i, byte(val>>(8*i))) {
-				g.dmaTransfer(dmaImmediate)
+				g.schedule(evDMA, 2)
 			}
 		}
 
 	case isDMA3IO(addr):
 		for i := uint32(0); i < uint32(width); i++ {
 			if g.dma[3].set(addr-0x0400_00d4+i, byte(val>>(8*i))) {
-				g.dmaTransfer(dmaImmediate)
+				g.schedule(evDMA, 2)
 			}
 		}
 
 	case timer.IsTimerIO(addr):
+		g.updateTimers()
 		for i := uint32(0); i < uint32(width); i++ {
-			g.timers.SetIO(addr-0x0400_0100+i, byte(val>>(8*i)))
+			g.timers.SetIO(addr-0x0400_0100+i, byte(val>>(8*i)), g.cycles())
 		}
+		g.scheduleTimer()
 
-	case addr == ram.KEYCNT:
+	case isSIOIO(addr):
+		g.setSerialIO(addr, val, width)
+
+	case addr >= ram.KEYINPUT && addr < ram.KEYCNT+2:
+		// KEYINPUT is read-only, but a word write there reaches KEYCNT
 		for i := uint32(0); i < uint32(width); i++ {
-			g.joypad.Input[2+i] = byte(val >> (8 * i))
+			if addr+i >= ram.KEYCNT {
+				g.joypad.Input[addr+i-ram.KEYINPUT] = byte(val >> (8 * i))
+			}
 		}
+		g.checkKeyIRQ()
 
 	case addr == ram.IE:
 		for i := uint32(0); i < uint32(width); i++ {
@@ -186,34 +185,23 @@ func (g *GBA) _setRAM(addr uint32, val uint32, width int) {
 		g.RAM.Set8(addr, byte(val)&0b1)
 		g.checkIRQ()
 
-	case addr == ram.HALTCNT:
-		g.halt = true
-
-	case ram.Palette(addr):
-		ofs := ram.PaletteOffset(addr)
-		switch width {
-		case 2:
-			g.video.RenderPath.Palette.Store16(ofs, uint16(val))
-		case 4:
-			g.video.RenderPath.Palette.Store32(ofs, val)
+	case addr == ram.WAITCNT || addr == ram.WAITCNT+1:
+		for i := uint32(0); i < uint32(width); i++ {
+			g.RAM.Set8(addr+i, byte(val>>(8*i)))
 		}
+		g.prefetch.enabled = util.Bit(g._getRAM(ram.WAITCNT), 14)
 
-	case ram.VRAM(addr):
-		ofs := ram.VRAMOffset(addr)
-		switch width {
-		case 2:
-			g.video.RenderPath.VRAM.Store16(ofs, uint16(val))
-		case 4:
-			g.video.RenderPath.VRAM.Store32(ofs, val)
-		}
+	case addr == ram.HALTCNT:
+		// bit 7: STOP mode
+		g.halt, g.stop = true, util.Bit(byte(val), 7)
 
-	case ram.OAM(addr):
-		ofs := ram.OAMOffset(addr)
+	case ram.Palette(addr), ram.VRAM(addr), ram.OAM(addr):
+		g.catchUpVideo()
 		switch width {
 		case 2:
-			g.video.RenderPath.OAM.Store16(ofs, uint16(val))
+			g.video.RenderPath.Store16(addr, uint16(val))
 		case 4:
-			g.video.RenderPath.OAM.Store32(ofs, val)
+			g.video.RenderPath.Store32(addr, val)
 		}
 
 	default:
@@ -225,3 +213,17 @@ func (g *GBA) _setRAM(addr uint32, val uint32, width int) {
 		}
 	}
 }
+
+// setSoundIO writes sound registers, wave RAM and FIFOs byte by byte
+func (g *GBA) setSoundIO(addr uint32, val uint32, width int) {
+	g.syncAPU()
+	for i := uint32(0); i < uint32(width); i++ {
+		ofs := addr + i - ram.SOUND1CNT_L
+
+		// PSG registers are read-only while the sound is off
+		if ofs < apu.SOUNDCNT_H && !g.apu.IsSoundMasterEnable() {
+			continue
+		}
+		g.apu.Store8(ofs, byte(val>>(8*i)))
+	}
+}
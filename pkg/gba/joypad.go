@@ -26,7 +26,9 @@ func (j *Joypad) SetHandler(h [10](*func() bool)) {
 	j.handler = h
 }
 
-func (j *Joypad) Read() {
+// Read updates KEYINPUT with the handlers, and returns true if it is changed
+func (j *Joypad) Read() bool {
+	prev := [2]byte{j.Input[0], j.Input[1]}
 	j.Input[0] = util.SetBit8(j.Input[0], A, !wrapHandler(j.handler[A]))
 	j.Input[0] = util.SetBit8(j.Input[0], B, !wrapHandler(j.handler[B]))
 	j.Input[0] = util.SetBit8(j.Input[0], Select, !wrapHandler(j.handler[Select]))
@@ -57,6 +59,43 @@ func (j *Joypad) Read() {
 	}
 	j.Input[1] = util.SetBit8(j.Input[1], R, !wrapHandler(j.handler[R+8]))
 	j.Input[1] = util.SetBit8(j.Input[1], L, !wrapHandler(j.handler[L+8]))
+	return prev != [2]byte{j.Input[0], j.Input[1]}
+}
+
+// KEYCNT bits
+const (
+	keyIRQEnable = 14
+	keyIRQAnd    = 15
+)
+
+// irq returns true if the keys selected by KEYCNT request the key interrupt.
+//
+// In OR mode any of the keys is pressed, and in AND mode all of them are pressed.
+func (j *Joypad) irq() bool {
+	cnt := uint16(j.Input[2]) | uint16(j.Input[3])<<8
+	if !util.Bit(cnt, keyIRQEnable) {
+		return false
+	}
+	selected := cnt & 0x3ff
+	pressed := ^(uint16(j.Input[0]) | uint16(j.Input[1])<<8) & 0x3ff
+	if util.Bit(cnt, keyIRQAnd) {
+		return selected != 0 && pressed&selected == selected
+	}
+	return pressed&selected != 0
+}
+
+// pollInput reads the keys, and checks the key interrupt if they are changed
+func (g *GBA) pollInput() {
+	if g.joypad.Read() {
+		g.checkKeyIRQ()
+	}
+}
+
+// checkKeyIRQ requests the key interrupt if KEYCNT condition is met
+func (g *GBA) checkKeyIRQ() {
+	if g.joypad.irq() {
+		g.triggerIRQ(irqKEY)
+	}
 }
 
 func wrapHandler(h *func() bool) bool {
@@ -0,0 +1,104 @@
+package gba
+
+import (
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+// press returns KEYINPUT with the keys (bit numbers of KEYINPUT) pressed
+func press(keys ...int) [2]byte {
+	in := uint16(0x3ff)
+	for _, k := range keys {
+		in &^= 1 << k
+	}
+	return [2]byte{byte(in), byte(in >> 8)}
+}
+
+func TestKeyIRQCondition(t *testing.T) {
+	tests := []struct {
+		name   string
+		keycnt uint16
+		input  [2]byte
+		want   bool
+	}{
+		{"disabled", 0x0003, press(A), false},
+		{"OR none pressed", 0x4003, press(), false},
+		{"OR one pressed", 0x4003, press(B), true},
+		{"OR other key", 0x4003, press(Start), false},
+		{"OR L", 0x4200, press(L + 8), true},
+		{"AND one of two", 0xc003, press(A), false},
+		{"AND both", 0xc003, press(A, B), true},
+		{"AND both and more", 0xc003, press(A, B, Up), true},
+		{"AND no keys selected", 0xc000, press(A), false},
+	}
+
+	for _, tt := range tests {
+		j := Joypad{Input: [4]byte{tt.input[0], tt.input[1], byte(tt.keycnt), byte(tt.keycnt >> 8)}}
+		if got := j.irq(); got != tt.want {
+			t.Errorf("%s: KEYCNT 0x%04x: got %v, want %v", tt.name, tt.keycnt, got, tt.want)
+		}
+	}
+}
+
+// TestKeyIRQByKEYCNTWrite checks that writing KEYCNT while the keys are held requests the interrupt, whatever the width is
+func TestKeyIRQByKEYCNTWrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(g *GBA)
+	}{
+		{"strh KEYCNT", func(g *GBA) { g._setRAM(ram.KEYCNT, 0x4001, 2) }},
+		{"strb KEYCNT, KEYCNT+1", func(g *GBA) {
+			g._setRAM(ram.KEYCNT, 0x01, 1)
+			g._setRAM(ram.KEYCNT+1, 0x40, 1)
+		}},
+		{"str KEYINPUT", func(g *GBA) { g._setRAM(ram.KEYINPUT, 0x4001_0000, 4) }},
+	}
+
+	for _, tt := range tests {
+		g := newLoopGBA()
+		in := press(A)
+		g.joypad.Input[0], g.joypad.Input[1] = in[0], in[1]
+
+		tt.write(g)
+		if got := uint16(g._getRAM(ram.KEYCNT)); got != 0x4001 {
+			t.Errorf("%s: KEYCNT is 0x%04x", tt.name, got)
+		}
+		if got := uint16(g._getRAM(ram.KEYINPUT)); got != 0x3fe {
+			t.Errorf("%s: KEYINPUT is written: 0x%04x", tt.name, got)
+		}
+		if g._getRAM(ram.IF)&(1<<irqKEY) == 0 {
+			t.Errorf("%s: key interrupt isn't requested", tt.name)
+		}
+	}
+}
+
+func TestStopWakeup(t *testing.T) {
+	g := newLoopGBA()
+	pressed := false
+	handler := func() bool { return pressed }
+	g.joypad.SetHandler([10](*func() bool){A: &handler})
+	g._setRAM(ram.KEYCNT, 0x4001, 2)
+	g._setRAM(ram.HALTCNT, 0x80, 1)
+
+	// STOP mode ignores interrupts other than Keypad, Serial and Game Pak
+	g.triggerIRQ(irqVBlank)
+	g.triggerIRQ(irqTimer0)
+	if !g.halt || !g.stop {
+		t.Fatalf("VBlank and Timer interrupts shouldn't wake up the GBA from STOP mode")
+	}
+	if g._getRAM(ram.IF)&(1<<irqVBlank) == 0 {
+		t.Errorf("VBlank interrupt should be requested in STOP mode")
+	}
+
+	g.pollInput()
+	if !g.stop {
+		t.Fatalf("GBA shouldn't wake up without keys")
+	}
+
+	pressed = true
+	g.pollInput()
+	if g.halt || g.stop {
+		t.Errorf("key interrupt should wake up the GBA from STOP mode")
+	}
+}
@@ -0,0 +1,122 @@
+package gba
+
+import (
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+const prefetchSize = 8 // halfwords
+
+// Prefetch represents GamePak prefetch buffer (WAITCNT bit14)
+//
+// While the CPU is busy with internal cycles or non-GamePak accesses, the buffer fetches up to 8 halfwords of ROM sequentially.
+type Prefetch struct {
+	// WAITCNT bit14, cached when WAITCNT is written
+	enabled bool
+
+	active bool
+
+	// ROM address of the oldest halfword in the buffer
+	base uint32
+
+	// number of halfwords in the buffer (0-8)
+	count int
+
+	// cycles spent on the halfword currently being fetched
+	//
+	// negative value means the prefetch waits for the current opcode fetch
+	progress int
+
+	// cycles needed to fetch a halfword (= S cycle of the region)
+	cost int
+}
+
+func (g *GBA) prefetchEnabled() bool {
+	return g.prefetch.enabled
+}
+
+func isGamePak(addr uint32) bool {
+	return ram.GamePak0(addr) || ram.GamePak1(addr) || ram.GamePak2(addr)
+}
+
+// restart prefetching from addr after `delay` cycles
+func (p *Prefetch) restart(addr uint32, cost, delay int) {
+	p.active, p.base, p.count, p.progress, p.cost = true, addr, 0, -delay, cost
+}
+
+// flush stops prefetching and returns penalty cycles.
+//
+// If a halfword fetch is in progress, data access to GamePak waits 1 more cycle.
+func (p *Prefetch) flush() int {
+	penalty := 0
+	if p.active && p.count < prefetchSize && p.progress > 0 {
+		penalty = 1
+	}
+	p.active, p.count, p.progress = false, 0, 0
+	return penalty
+}
+
+// tick runs prefetch unit while GamePak bus is free
+func (p *Prefetch) tick(cycles int) {
+	if !p.active || p.cost == 0 {
+		return
+	}
+
+	for cycles > 0 && p.count < prefetchSize {
+		rest := p.cost - p.progress
+		if cycles < rest {
+			p.progress += cycles
+			return
+		}
+		cycles -= rest
+		p.progress = 0
+		p.count++
+	}
+}
+
+// consume returns the cycles needed to read `n` halfwords at addr from the buffer.
+//
+// If the buffer doesn't have the halfwords, ok is false.
+func (p *Prefetch) consume(addr uint32, n int) (cycles int, ok bool) {
+	if !p.active || addr != p.base {
+		return 0, false
+	}
+
+	cycles = n
+	if p.count < n {
+		// the CPU waits for the halfword that is being fetched now
+		if n-p.count > 1 {
+			return 0, false
+		}
+		cycles += p.cost - p.progress - 1
+		p.progress = 0
+		p.count++
+	}
+
+	p.count -= n
+	p.base += uint32(n * 2)
+	return cycles, true
+}
+
+// waitFetch returns the cycles of opcode fetch
+func (g *GBA) waitFetch(addr uint32, size int, s bool) int {
+	if !isGamePak(addr) || !g.prefetchEnabled() {
+		g.prefetch.active = false
+		return g.waitBus(addr, size, s)
+	}
+
+	if cycles, ok := g.prefetch.consume(addr, size/16); ok {
+		return cycles
+	}
+
+	cycles := g.waitBus(addr, size, s)
+	g.prefetch.restart(addr+uint32(size/8), g.cycleS(addr), cycles)
+	return cycles
+}
+
+// waitData returns the cycles of data access
+func (g *GBA) waitData(addr uint32, size int, s bool) int {
+	if isGamePak(addr) {
+		return g.waitBus(addr, size, s) + g.prefetch.flush()
+	}
+	return g.waitBus(addr, size, s)
+}
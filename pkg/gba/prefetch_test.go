@@ -0,0 +1,91 @@
+package gba
+
+import (
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+func newTestGBA() *GBA {
+	return New(make([]byte, 0x1000), 0, false, true)
+}
+
+// newLoopGBA returns a GBA whose game loops at the ROM entry point, and touches neither the screen nor the IO
+func newLoopGBA() *GBA {
+	rom := make([]byte, 0x1000)
+	copy(rom, []byte{0xfe, 0xff, 0xff, 0xea}) // b .
+	g := New(rom, 0, false, true)
+	g.Reset()
+	g.R[15] = 0x0800_0000
+	g.pipelining()
+	return g
+}
+
+func TestPrefetchBuffer(t *testing.T) {
+	p := Prefetch{}
+	p.restart(0x0800_0002, 3, 0)
+	p.tick(7) // 2 halfwords, and 1 cycle of the 3rd
+
+	if cycles, ok := p.consume(0x0800_0002, 1); !ok || cycles != 1 {
+		t.Errorf("buffered halfword: expected 1 cycle, got %d (%v)", cycles, ok)
+	}
+	if _, ok := p.consume(0x0800_0008, 1); ok {
+		t.Errorf("non-sequential address must miss")
+	}
+	if cycles, ok := p.consume(0x0800_0004, 1); !ok || cycles != 1 {
+		t.Errorf("buffered halfword: expected 1 cycle, got %d (%v)", cycles, ok)
+	}
+	// the 3rd halfword is being fetched: the CPU waits for the rest
+	if cycles, ok := p.consume(0x0800_0006, 1); !ok || cycles != 2 {
+		t.Errorf("halfword in progress: expected 2 cycles, got %d (%v)", cycles, ok)
+	}
+	if _, ok := p.consume(0x0800_0008, 2); ok {
+		t.Errorf("halfwords not fetched yet must miss")
+	}
+
+	p.tick(1)
+	if penalty := p.flush(); penalty != 1 {
+		t.Errorf("flush during a fetch should cost 1 cycle, got %d", penalty)
+	}
+	if penalty := p.flush(); penalty != 0 {
+		t.Errorf("flush of inactive buffer should be free, got %d", penalty)
+	}
+}
+
+func TestPrefetchWAITCNT(t *testing.T) {
+	g := newTestGBA()
+	g._setRAM(ram.WAITCNT+1, 0x40, 1)
+	if !g.prefetchEnabled() {
+		t.Errorf("WAITCNT bit14 should enable prefetch")
+	}
+	g._setRAM(ram.WAITCNT, 0x0000, 2)
+	if g.prefetchEnabled() {
+		t.Errorf("WAITCNT bit14 should disable prefetch")
+	}
+}
+
+// dmaCost runs DMA3 from ROM to EWRAM and returns its cycles
+func dmaCost(g *GBA, units int) int64 {
+	g._setRAM(ram.DMA3SAD, 0x0800_0000, 4)
+	g._setRAM(ram.DMA3SAD+4, 0x0200_0000, 4)
+	g._setRAM(ram.DMA3SAD+8, uint32(units)|0x8000<<16, 4)
+	start := g.cycles()
+	g.dma[3].active = true
+	g.dmaRun()
+	return g.cycles() - start
+}
+
+func TestDMAPrefetchConflict(t *testing.T) {
+	g := newTestGBA()
+	base := dmaCost(g, 4)
+
+	// DMA takes the bus in the middle of a halfword fetch
+	g.prefetch.restart(0x0800_0100, 3, 0)
+	g.prefetch.tick(1)
+	if got := dmaCost(g, 4); got != base+1 {
+		t.Errorf("DMA during prefetch: expected %d cycles, got %d", base+1, got)
+	}
+	if g.prefetch.active {
+		t.Errorf("DMA should stop prefetch")
+	}
+}
@@ -56,6 +56,14 @@ const (
 	TM3CNT = base + 0x10c
 )
 
+// Serial Communication
+const (
+	SIODATA32 = base + 0x120
+	SIOCNT    = base + 0x128
+	SIODATA8  = base + 0x12a
+	RCNT      = base + 0x134
+)
+
 // Keypad Input
 const (
 	KEYINPUT = base + 0x130
@@ -0,0 +1,231 @@
+package gba
+
+import (
+	"github.com/pokemium/magia/pkg/gba/apu"
+	"github.com/pokemium/magia/pkg/gba/ram"
+	"github.com/pokemium/magia/pkg/gba/video"
+	"github.com/pokemium/magia/pkg/util"
+)
+
+type EventID int
+
+const (
+	evHDraw EventID = iota // start of scanline
+	evHBlank
+	evTimer
+	evDMA
+	evAudio
+	evSerial
+	eventCount
+)
+
+const noEvent EventID = -1
+
+const (
+	cyclesHDraw    = 1006
+	cyclesScanline = 1232
+	totalScanlines = 228
+	lastVBlankLine = 227
+	cyclesPerDot   = 4
+	never          = 1 << 62
+)
+
+type Event struct {
+	at     int64 // cycle timestamp
+	active bool
+}
+
+// Scheduler holds the cycle timestamp and upcoming events.
+//
+// Each event has only one slot, so scheduling an event again overwrites the previous one.
+type Scheduler struct {
+	now    int64
+	events [eventCount]Event
+}
+
+// schedule event `after` cycles later than the scheduler's timestamp.
+//
+// The timestamp lags the CPU while an instruction is executed, so the CPU schedules events with GBA.schedule.
+func (s *Scheduler) schedule(id EventID, after int) {
+	s.events[id] = Event{at: s.now + int64(after), active: true}
+}
+
+// scheduleAt schedules event at the timestamp `at`
+//
+// Periodic events use this to avoid drifting when the CPU overshoots the event.
+func (s *Scheduler) scheduleAt(id EventID, at int64) {
+	s.events[id] = Event{at: at, active: true}
+}
+
+func (s *Scheduler) cancel(id EventID) { s.events[id].active = false }
+
+// next returns the timestamp of the upcoming event
+func (s *Scheduler) next() int64 {
+	next := int64(never)
+	for _, ev := range s.events {
+		if ev.active && ev.at < next {
+			next = ev.at
+		}
+	}
+	return next
+}
+
+// pop returns the earliest event that has already come and its timestamp, or noEvent
+func (s *Scheduler) pop() (EventID, int64) {
+	id, at := noEvent, s.now+1
+	for i, ev := range s.events {
+		if ev.active && ev.at < at {
+			id, at = EventID(i), ev.at
+		}
+	}
+	if id != noEvent {
+		s.events[id].active = false
+	}
+	return id, at
+}
+
+// schedule event `after` cycles later than now, including the cycles of the instruction being executed
+func (g *GBA) schedule(id EventID, after int) {
+	g.scheduler.scheduleAt(id, g.cycles()+int64(after))
+}
+
+func (g *GBA) initScheduler() {
+	g.schedule(evHBlank, cyclesHDraw)
+	g.schedule(evHDraw, cyclesScanline)
+	g.schedule(evAudio, apu.SAMP_CYCLES)
+}
+
+// run CPU until the next event and process the events.
+//
+// The next event is checked after each instruction, because the instruction may schedule an earlier one.
+func (g *GBA) run() {
+	for {
+		next := g.scheduler.next()
+		if g.scheduler.now >= next {
+			break
+		}
+		if g.halt {
+			g.timer(int(next - g.scheduler.now))
+			break
+		}
+
+		g.inExec = true
+		g.step()
+		g.inExec = false
+		g.timer(g.accumulatedCycles)
+		g.accumulatedCycles = 0
+	}
+
+	for id, at := g.scheduler.pop(); id != noEvent; id, at = g.scheduler.pop() {
+		g.dispatch(id, at)
+	}
+}
+
+func (g *GBA) dispatch(id EventID, at int64) {
+	switch id {
+	case evHDraw:
+		g.hdraw(at)
+	case evHBlank:
+		g.hblank()
+	case evTimer:
+		g.updateTimers()
+	case evDMA:
+		g.dmaTransfer(dmaImmediate)
+	case evAudio:
+		g.syncAPU()
+		g.scheduler.scheduleAt(evAudio, at+apu.SAMP_CYCLES)
+	case evSerial:
+		g.serialDone()
+	}
+}
+
+// hdraw is called at the start of each scanline
+func (g *GBA) hdraw(at int64) {
+	g.scheduler.scheduleAt(evHBlank, at+cyclesHDraw)
+	g.scheduler.scheduleAt(evHDraw, at+cyclesScanline)
+
+	g.video.SetHBlank(false)
+	vcount := g.video.VCount() + 1
+	if vcount == totalScanlines {
+		vcount = 0
+		g.frameDone = true
+	}
+	g.video.SetVCount(vcount)
+
+	g.lineStart = at
+	g.pollSerial()
+	if int(vcount) == g.inputLine {
+		g.pollInput()
+	}
+	if r, ok := g.chunkRenderer(); ok && vcount < video.VERTICAL_PIXELS {
+		r.BeginScanline(vcount)
+	}
+
+	switch vcount {
+	case video.VERTICAL_PIXELS:
+		g.video.SetVBlank(true)
+		if util.Bit(uint16(g._getRAM(ram.DISPSTAT)), 3) {
+			g.triggerIRQ(irqVBlank)
+		}
+		g.dmaTransfer(dmaVBlank)
+	case lastVBlankLine:
+		g.video.SetVBlank(false) // clear on 227
+	}
+
+	dispstat := uint16(g._getRAM(ram.DISPSTAT))
+	vCount, lyc := byte(vcount), byte(g._getRAM(ram.DISPSTAT+1))
+	g.video.SetVCounter(vCount == lyc)
+	if vCount == lyc && util.Bit(dispstat, 5) {
+		g.triggerIRQ(irqVCount)
+	}
+}
+
+// hblank is called when the LCD finishes drawing the scanline
+func (g *GBA) hblank() {
+	vcount := g.video.VCount()
+	if vcount < video.VERTICAL_PIXELS {
+		if r, ok := g.chunkRenderer(); ok {
+			r.EndScanline()
+		} else {
+			g.video.RenderPath.DrawScanline(vcount)
+		}
+	}
+
+	if !g.video.VBlank() && util.Bit(uint16(g._getRAM(ram.DISPSTAT)), 4) {
+		g.triggerIRQ(irqHBlank)
+	}
+	g.video.SetHBlank(true)
+	g.dmaTransfer(dmaHBlank)
+	g.dmaVideoCapture(vcount)
+}
+
+// scheduleTimer schedules the next timer overflow so that the CPU stops there exactly.
+func (g *GBA) scheduleTimer() {
+	if next := g.timers.NextOverflow(g.cycles()); next > 0 {
+		g.scheduler.scheduleAt(evTimer, g.cycles()+int64(next))
+		return
+	}
+	g.scheduler.cancel(evTimer)
+}
+
+// catchUpVideo draws the current scanline until the dot the LCD is drawing now.
+//
+// It is called before LCD registers, palette, VRAM and OAM are written in pixel-accurate mode.
+func (g *GBA) catchUpVideo() {
+	r, ok := g.chunkRenderer()
+	if !ok || g.video.VCount() >= video.VERTICAL_PIXELS || g.video.HBlank() {
+		return
+	}
+
+	dot := (g.cycles() - g.lineStart) / cyclesPerDot
+	r.DrawScanlineTo(uint32(dot))
+}
+
+// chunkRenderer returns the renderer if pixel-accurate mode is on and the renderer supports it.
+func (g *GBA) chunkRenderer() (video.ChunkRenderer, bool) {
+	if !g.pixelAccurate {
+		return nil, false
+	}
+	r, ok := g.video.RenderPath.(video.ChunkRenderer)
+	return r, ok
+}
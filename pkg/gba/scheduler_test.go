@@ -0,0 +1,188 @@
+package gba
+
+import (
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+	"github.com/pokemium/magia/pkg/gba/timer"
+)
+
+// cyclesARMMax is more than the cycles of the ARM instructions in the test programs running on ROM
+const cyclesARMMax = 16
+
+func TestSchedulerOrder(t *testing.T) {
+	s := Scheduler{}
+	s.schedule(evTimer, 30)
+	s.schedule(evDMA, 10)
+	s.schedule(evSerial, 20)
+	s.schedule(evAudio, 100)
+
+	if next := s.next(); next != 10 {
+		t.Fatalf("next: got %d, want 10", next)
+	}
+	if id, _ := s.pop(); id != noEvent {
+		t.Fatalf("event %d is popped before it comes", id)
+	}
+
+	s.now = 50
+	want := []struct {
+		id EventID
+		at int64
+	}{{evDMA, 10}, {evSerial, 20}, {evTimer, 30}}
+	for _, w := range want {
+		if id, at := s.pop(); id != w.id || at != w.at {
+			t.Errorf("pop: got event %d at %d, want event %d at %d", id, at, w.id, w.at)
+		}
+	}
+	if id, _ := s.pop(); id != noEvent {
+		t.Errorf("event %d is popped before it comes", id)
+	}
+	if next := s.next(); next != 100 {
+		t.Errorf("next: got %d, want 100", next)
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	s := Scheduler{}
+	s.schedule(evTimer, 100)
+	s.schedule(evTimer, 40) // overwrites the slot
+	s.scheduleAt(evDMA, 60)
+	s.cancel(evDMA)
+
+	if next := s.next(); next != 40 {
+		t.Fatalf("next: got %d, want 40", next)
+	}
+	s.now = 200
+	if id, at := s.pop(); id != evTimer || at != 40 {
+		t.Errorf("pop: got event %d at %d, want the rescheduled timer at 40", id, at)
+	}
+	if id, at := s.pop(); id != noEvent {
+		t.Errorf("event %d at %d is popped twice or after cancel", id, at)
+	}
+	if next := s.next(); next != never {
+		t.Errorf("no event should be left, next is %d", next)
+	}
+}
+
+// nextIRQ runs the halted CPU until the interrupt is requested, and returns the timestamp.
+//
+// The halted CPU jumps to each event exactly, so the timestamp is the cycle the event is dispatched at.
+func nextIRQ(t *testing.T, g *GBA, irq IRQID) int64 {
+	t.Helper()
+	g._setRAM(ram.IF, 0xffff, 2)
+	for g.scheduler.now < 2*totalScanlines*cyclesScanline {
+		g.halt = true
+		g.run()
+		if g._getRAM(ram.IF)&(1<<irq) != 0 {
+			return g.scheduler.now
+		}
+	}
+	t.Fatalf("IRQ %s isn't requested", irq2str[irq])
+	return 0
+}
+
+func TestVideoIRQTiming(t *testing.T) {
+	const lyc = 2
+	g := newLoopGBA()
+	g._setRAM(ram.DISPSTAT, 0x38|lyc<<8, 2) // VBlank, HBlank and VCount IRQ
+
+	if at := nextIRQ(t, g, irqHBlank); at != cyclesHDraw {
+		t.Errorf("HBlank of line 0: got cycle %d, want %d", at, cyclesHDraw)
+	}
+	if at := nextIRQ(t, g, irqHBlank); at != cyclesScanline+cyclesHDraw {
+		t.Errorf("HBlank of line 1: got cycle %d, want %d", at, cyclesScanline+cyclesHDraw)
+	}
+	if at := nextIRQ(t, g, irqVCount); at != lyc*cyclesScanline {
+		t.Errorf("VCount: got cycle %d, want %d", at, lyc*cyclesScanline)
+	}
+	if at := nextIRQ(t, g, irqVBlank); at != 160*cyclesScanline {
+		t.Errorf("VBlank: got cycle %d, want %d", at, 160*cyclesScanline)
+	}
+	if vcount := g.video.VCount(); vcount != 160 {
+		t.Errorf("VCount at VBlank: got %d, want 160", vcount)
+	}
+
+	frame := int64(totalScanlines * cyclesScanline)
+	if at := nextIRQ(t, g, irqVCount); at != frame+lyc*cyclesScanline {
+		t.Errorf("VCount of the next frame: got cycle %d, want %d", at, frame+lyc*cyclesScanline)
+	}
+}
+
+// storeProgram returns ARM code which stores each value at each address with `str`, and then loops.
+//
+//	ldr r0, =addr
+//	ldr r1, =value
+//	str r1, [r0]
+//	...
+//	b .
+func storeProgram(stores ...[2]uint32) []uint32 {
+	pool := 3*len(stores) + 1
+	code := make([]uint32, 0, pool+2*len(stores))
+	for i := range stores {
+		for rd := uint32(0); rd < 2; rd++ {
+			pc := uint32(len(code))*4 + 8
+			ofs := uint32(pool+2*i+int(rd))*4 - pc
+			code = append(code, 0xe59f_0000|rd<<12|ofs) // ldr rd, [pc, #ofs]
+		}
+		code = append(code, 0xe580_1000) // str r1, [r0]
+	}
+	code = append(code, 0xeaff_fffe) // b .
+	for _, st := range stores {
+		code = append(code, st[0], st[1])
+	}
+	return code
+}
+
+// newARMGBA returns a GBA which runs the ARM code at the ROM entry point
+func newARMGBA(code []uint32) *GBA {
+	rom := make([]byte, 0x1000)
+	for i, c := range code {
+		rom[i*4], rom[i*4+1], rom[i*4+2], rom[i*4+3] = byte(c), byte(c>>8), byte(c>>16), byte(c>>24)
+	}
+	g := New(rom, 0, false, true)
+	g.Reset()
+	g.R[15] = 0x0800_0000
+	g.pipelining()
+	g.pipe.ok = false // the first instruction isn't a branch
+	return g
+}
+
+// runUntilIRQ runs the CPU until the interrupt is requested, and returns the timestamp
+func runUntilIRQ(t *testing.T, g *GBA, irq IRQID) int64 {
+	t.Helper()
+	for g.scheduler.now < totalScanlines*cyclesScanline {
+		g.run()
+		if g._getRAM(ram.IF)&(1<<irq) != 0 {
+			return g.scheduler.now
+		}
+	}
+	t.Fatalf("IRQ %s isn't requested", irq2str[irq])
+	return 0
+}
+
+// stepUntil runs instructions without processing events until cond is true, and returns the timestamp.
+// The instruction to be executed next is g.pipe.inst[0].
+func stepUntil(g *GBA, cond func() bool) int64 {
+	for !cond() {
+		g.inExec = true
+		g.step()
+		g.inExec = false
+		g.timer(g.accumulatedCycles)
+		g.accumulatedCycles = 0
+	}
+	return g.scheduler.now
+}
+
+// TestEventScheduledByCPU checks that an event scheduled by an instruction stops the CPU at its own time, not at the event which was the next one before
+func TestEventScheduledByCPU(t *testing.T) {
+	g := newARMGBA(storeProgram([2]uint32{ram.TM0CNT, 0x00c0_fff0})) // timer 0: IRQ, 16 cycles to overflow
+
+	// the str instruction writes TM0CNT a few cycles after this, and the CPU may run over the event by an instruction
+	written := stepUntil(g, func() bool { return g.pipe.inst[0].loc == 0x0800_0008 })
+	overflow := written + timer.StartDelay + 16
+
+	at := runUntilIRQ(t, g, irqTimer0)
+	if at < overflow-cyclesARMMax || at >= overflow+cyclesARMMax {
+		t.Errorf("timer IRQ is requested at cycle %d, want about %d", at, overflow)
+	}
+}
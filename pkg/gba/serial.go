@@ -0,0 +1,69 @@
+package gba
+
+import (
+	"github.com/pokemium/magia/pkg/gba/ram"
+	"github.com/pokemium/magia/pkg/gba/sio"
+)
+
+// isSIOIO returns true if addr is for the serial registers. KEYINPUT and KEYCNT in the middle aren't.
+func isSIOIO(addr uint32) bool {
+	if addr >= ram.KEYINPUT && addr < ram.RCNT {
+		return false
+	}
+	return addr >= ram.SIODATA32 && addr < ram.SIODATA32+sio.Size
+}
+
+// setSerialIO writes the serial registers by halfword, and schedules the end of a started transfer
+func (g *GBA) setSerialIO(addr uint32, val uint32, width int) {
+	ofs, cycles := addr-ram.SIODATA32, 0
+	switch width {
+	case 1:
+		cycles = g.sio.Store8(ofs, byte(val))
+	case 2:
+		cycles = g.sio.Store16(ofs, uint16(val))
+	case 4:
+		cycles = g.sio.Store16(ofs, uint16(val)) + g.sio.Store16(ofs+2, uint16(val>>16))
+	}
+	if cycles > 0 {
+		g.schedule(evSerial, cycles)
+	}
+}
+
+// serialDone finishes the transfer started by this GBA
+func (g *GBA) serialDone() {
+	if g.sio.Finish() {
+		g.triggerIRQ(irqSerial)
+	}
+}
+
+// pollSerial handles the transfers from the linked GBAs. It is called every scanline.
+func (g *GBA) pollSerial() {
+	if g.sio.Poll() {
+		g.triggerIRQ(irqSerial)
+	}
+}
+
+// SetLink connects the serial port to other GBAs (see sio.NewHub, sio.ListenTCP and sio.DialTCP). nil disconnects it.
+func (g *GBA) SetLink(t sio.Transport) {
+	g.sio.SetTransport(t)
+}
+
+// Link returns the transport given to SetLink
+func (g *GBA) Link() sio.Transport {
+	return g.sio.Transport()
+}
+
+// LinkError returns the last error of the link cable, and clears it
+func (g *GBA) LinkError() error {
+	return g.sio.Err()
+}
+
+// SetJOYDevice connects a JOY Bus device such as a GameCube (see sio.DialDolphin). nil disconnects it.
+func (g *GBA) SetJOYDevice(d sio.JOYDevice) {
+	g.sio.SetJOYDevice(d)
+}
+
+// JOYDevice returns the device given to SetJOYDevice
+func (g *GBA) JOYDevice() sio.JOYDevice {
+	return g.sio.JOYDevice()
+}
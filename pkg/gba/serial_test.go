@@ -0,0 +1,83 @@
+package gba
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+	"github.com/pokemium/magia/pkg/gba/sio"
+)
+
+// TestLinkTwoGBAs runs two GBAs linked by a hub at the same time, and transfers in Multiplayer mode
+func TestLinkTwoGBAs(t *testing.T) {
+	hub := sio.NewHub()
+	gbas := [2]*GBA{newLoopGBA(), newLoopGBA()}
+	for i, g := range gbas {
+		tr, err := hub.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.SetLink(tr)
+		g._setRAM(ram.RCNT, 0, 2)
+		g._setRAM(ram.SIOCNT, 0x6003, 2) // Multiplayer, 115200bps, IRQ
+		g._setRAM(ram.SIODATA8, uint32(0x1000+i), 2)
+	}
+	parent, child := gbas[0], gbas[1]
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				child.Update()
+			}
+		}
+	}()
+
+	parent.Update()
+	parent._setRAM(ram.SIOCNT, 0x6083, 2)
+	// the parent doesn't wait for the child, and finishes the transfer on a later scanline
+	deadline := time.Now().Add(5 * time.Second)
+	for parent._getRAM(ram.SIOCNT)&0x80 != 0 && time.Now().Before(deadline) {
+		parent.Update()
+	}
+	parent.Update()
+	close(stop)
+	<-stopped
+	child.Update() // receive the transfer finished at the end of the parent's frame
+
+	for i, g := range gbas {
+		multi := [2]uint32{g._getRAM(ram.SIODATA32) & 0xffff, g._getRAM(ram.SIODATA32+2) & 0xffff}
+		if multi != [2]uint32{0x1000, 0x1001} {
+			t.Errorf("player %d: SIOMULTI0-1 = %04x, want [1000 1001]", i, multi)
+		}
+		if cnt := g._getRAM(ram.SIOCNT); cnt&0x80 != 0 {
+			t.Errorf("player %d: transfer isn't finished, SIOCNT 0x%04x", i, cnt)
+		}
+	}
+}
+
+// TestSerialIRQByCPU starts a Normal 8bit transfer from the CPU, and checks that it finishes 8 bits at 256KHz after the write
+func TestSerialIRQByCPU(t *testing.T) {
+	g := newARMGBA(storeProgram(
+		[2]uint32{ram.RCNT, 0},
+		[2]uint32{ram.SIOCNT, 0x4081}, // Normal 8bit, internal clock 256KHz, IRQ, start
+	))
+
+	// the instruction which writes SIOCNT
+	const str = 0x0800_0000 + (3*2-1)*4
+	stepUntil(g, func() bool { return g.pipe.inst[0].loc == str })
+	before := g.scheduler.now
+	stepUntil(g, func() bool { return g.pipe.inst[0].loc != str })
+	ev := g.scheduler.events[evSerial]
+	if !ev.active || ev.at <= before+8*64 || ev.at > g.scheduler.now+8*64 {
+		t.Errorf("transfer finishes at cycle %d, want 512 cycles after the write in cycles %d-%d", ev.at, before, g.scheduler.now)
+	}
+
+	if at := runUntilIRQ(t, g, irqSerial); at < ev.at || at >= ev.at+cyclesARMMax {
+		t.Errorf("serial IRQ is requested at cycle %d, want about %d", at, ev.at)
+	}
+}
@@ -0,0 +1,83 @@
+package sio
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Dolphin (GameCube emulator) links GBAs over TCP with its "GBA (TCP)" controller. Dolphin listens, and the GBA emulator connects to two ports.
+//
+// The data port carries the JOY Bus commands: 1 byte, or 5 bytes for JOYWrite. The GBA answers each command with the reply.
+// The clock port carries the timestamps of Dolphin (4 bytes each), which are only read here.
+const (
+	DolphinDataPort  = 0xd6ba
+	DolphinClockPort = 0xc10c
+)
+
+// dolphinCommands is the number of commands waiting for the emulation
+const dolphinCommands = 64
+
+type dolphin struct {
+	data, clock net.Conn
+	commands    chan []byte
+}
+
+// DialDolphin connects to Dolphin at host (e.g. "127.0.0.1") as a JOY Bus device.
+func DialDolphin(host string) (JOYDevice, error) {
+	return DialDolphinAddr(net.JoinHostPort(host, fmt.Sprint(DolphinDataPort)), net.JoinHostPort(host, fmt.Sprint(DolphinClockPort)))
+}
+
+// DialDolphinAddr is DialDolphin with the data and clock addresses.
+func DialDolphinAddr(dataAddr, clockAddr string) (JOYDevice, error) {
+	clock, err := net.Dial("tcp", clockAddr)
+	if err != nil {
+		return nil, err
+	}
+	data, err := net.Dial("tcp", dataAddr)
+	if err != nil {
+		clock.Close()
+		return nil, err
+	}
+
+	d := &dolphin{data: data, clock: clock, commands: make(chan []byte, dolphinCommands)}
+	go d.readCommands()
+	go io.Copy(io.Discard, clock)
+	return d, nil
+}
+
+func (d *dolphin) readCommands() {
+	defer close(d.commands)
+	for {
+		cmd := make([]byte, 1, 5)
+		if _, err := io.ReadFull(d.data, cmd); err != nil {
+			return
+		}
+		if cmd[0] == JOYWrite {
+			cmd = cmd[:5]
+			if _, err := io.ReadFull(d.data, cmd[1:]); err != nil {
+				return
+			}
+		}
+		d.commands <- cmd
+	}
+}
+
+func (d *dolphin) Command() ([]byte, bool) {
+	select {
+	case cmd, ok := <-d.commands:
+		return cmd, ok
+	default:
+		return nil, false
+	}
+}
+
+func (d *dolphin) Reply(b []byte) error {
+	_, err := d.data.Write(b)
+	return err
+}
+
+func (d *dolphin) Close() error {
+	d.clock.Close()
+	return d.data.Close()
+}
@@ -0,0 +1,131 @@
+package sio
+
+import (
+	"github.com/pokemium/magia/pkg/util"
+)
+
+// JOY Bus register offsets from 0x0400_0120
+const (
+	JOYCNT    = 0x20
+	JOY_RECV  = 0x30
+	JOY_TRANS = 0x34
+	JOYSTAT   = 0x38
+)
+
+// JOY Bus commands sent by the device (e.g. GameCube)
+const (
+	JOYStatus = 0x00
+	JOYRead   = 0x14 // GBA -> device
+	JOYWrite  = 0x15 // device -> GBA
+	JOYReset  = 0xff
+)
+
+// JOYCNT bits
+const (
+	joyCntReset    = 0
+	joyCntReceived = 1
+	joyCntSent     = 2
+	joyCntIRQ      = 6
+)
+
+// JOYSTAT bits
+const (
+	joyStatReceive = 1
+	joyStatSend    = 3
+)
+
+// JOYDevice is the master of the JOY Bus, such as a GameCube. The GBA answers its commands in JOY Bus mode.
+type JOYDevice interface {
+	// Command returns the next command from the device without blocking. JOYWrite has 4 data bytes after the command.
+	Command() ([]byte, bool)
+
+	// Reply sends the answer to the command
+	Reply(b []byte) error
+
+	Close() error
+}
+
+// SetJOYDevice connects the device to the JOY Bus. nil disconnects it.
+func (s *SIO) SetJOYDevice(d JOYDevice) {
+	s.joy = d
+}
+
+// JOYDevice returns the device given to SetJOYDevice
+func (s *SIO) JOYDevice() JOYDevice { return s.joy }
+
+// storeJOY writes a byte of the JOY Bus registers
+func (s *SIO) storeJOY(ofs uint32, b byte) {
+	switch ofs {
+	case JOYCNT:
+		// the flags are acknowledged by writing 1
+		cnt := s.regs[JOYCNT] &^ (b & 0b111)
+		s.regs[JOYCNT] = cnt&0b111 | b&(1<<joyCntIRQ)
+	case JOY_RECV, JOY_RECV + 1, JOY_RECV + 2, JOY_RECV + 3, JOYSTAT + 1:
+		// read-only
+	case JOY_TRANS + 2, JOY_TRANS + 3:
+		s.regs[ofs] = b
+		s.regs[JOYSTAT] = util.SetBit8(s.regs[JOYSTAT], joyStatSend, true)
+	case JOYSTAT:
+		s.regs[ofs] = s.regs[ofs]&^0x30 | b&0x30
+	default:
+		s.regs[ofs] = b
+	}
+}
+
+// isJOYRegister returns true if ofs is a JOY Bus register
+func isJOYRegister(ofs uint32) bool {
+	return ofs >= JOYCNT
+}
+
+// pollJOY answers the commands of the JOY Bus device, and returns true if they request Serial IRQ.
+func (s *SIO) pollJOY() (irq bool) {
+	if s.joy == nil {
+		return false
+	}
+	for {
+		cmd, ok := s.joy.Command()
+		if !ok {
+			return irq
+		}
+		if s.Mode() != ModeJOYBus || len(cmd) == 0 {
+			// the GBA doesn't answer out of JOY Bus mode
+			continue
+		}
+
+		reply, req := s.joyCommand(cmd)
+		irq = irq || req
+		if reply != nil {
+			s.joy.Reply(reply)
+		}
+	}
+}
+
+// joyCommand handles a command and returns the reply
+func (s *SIO) joyCommand(cmd []byte) (reply []byte, irq bool) {
+	irqEnable := util.Bit(s.regs[JOYCNT], joyCntIRQ)
+
+	switch cmd[0] {
+	case JOYReset:
+		s.regs[JOYCNT] = util.SetBit8(s.regs[JOYCNT], joyCntReset, true)
+		return []byte{0x00, 0x04, s.regs[JOYSTAT]}, irqEnable
+
+	case JOYStatus:
+		return []byte{0x00, 0x04, s.regs[JOYSTAT]}, false
+
+	case JOYRead:
+		s.regs[JOYSTAT] = util.SetBit8(s.regs[JOYSTAT], joyStatSend, false)
+		s.regs[JOYCNT] = util.SetBit8(s.regs[JOYCNT], joyCntSent, true)
+		reply = append([]byte{}, s.regs[JOY_TRANS:JOY_TRANS+4]...)
+		return append(reply, s.regs[JOYSTAT]), irqEnable
+
+	case JOYWrite:
+		if len(cmd) < 5 {
+			return nil, false
+		}
+		copy(s.regs[JOY_RECV:JOY_RECV+4], cmd[1:5])
+		s.regs[JOYSTAT] = util.SetBit8(s.regs[JOYSTAT], joyStatReceive, true)
+		s.regs[JOYCNT] = util.SetBit8(s.regs[JOYCNT], joyCntReceived, true)
+		return []byte{s.regs[JOYSTAT]}, irqEnable
+	}
+	return nil, false
+}
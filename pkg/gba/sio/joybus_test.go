@@ -0,0 +1,173 @@
+package sio
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// scriptDevice sends the commands in order and records the replies
+type scriptDevice struct {
+	commands [][]byte
+	replies  [][]byte
+}
+
+func (d *scriptDevice) Command() ([]byte, bool) {
+	if len(d.commands) == 0 {
+		return nil, false
+	}
+	cmd := d.commands[0]
+	d.commands = d.commands[1:]
+	return cmd, true
+}
+
+func (d *scriptDevice) Reply(b []byte) error {
+	d.replies = append(d.replies, append([]byte{}, b...))
+	return nil
+}
+
+func (d *scriptDevice) Close() error { return nil }
+
+func TestJOYBus(t *testing.T) {
+	s := New()
+	d := &scriptDevice{}
+	s.SetJOYDevice(d)
+
+	// out of JOY Bus mode, the GBA doesn't answer
+	d.commands = [][]byte{{JOYStatus}}
+	s.Poll()
+	if len(d.replies) != 0 {
+		t.Fatalf("unexpected reply out of JOY Bus mode")
+	}
+
+	s.Store16(RCNT, 0xc000)
+	s.Store16(JOYCNT, 1<<joyCntIRQ)
+	s.Store16(JOYSTAT, 0x10)
+	s.Store16(JOY_TRANS, 0x5678)
+	s.Store16(JOY_TRANS+2, 0x1234)
+	if load16(s, JOYSTAT) != 0x18 {
+		t.Errorf("JOYSTAT should have send flag, got 0x%02x", load16(s, JOYSTAT))
+	}
+
+	d.commands = [][]byte{{JOYReset}, {JOYRead}, {JOYWrite, 0xef, 0xcd, 0xab, 0x89}, {JOYStatus}}
+	if !s.Poll() {
+		t.Errorf("commands should request IRQ")
+	}
+	expected := [][]byte{
+		{0x00, 0x04, 0x18},
+		{0x78, 0x56, 0x34, 0x12, 0x10},
+		{0x12},
+		{0x00, 0x04, 0x12},
+	}
+	if len(d.replies) != len(expected) {
+		t.Fatalf("expected %d replies, got %d", len(expected), len(d.replies))
+	}
+	for i, e := range expected {
+		if !bytes.Equal(d.replies[i], e) {
+			t.Errorf("reply %d: expected % x, got % x", i, e, d.replies[i])
+		}
+	}
+
+	if cnt := load16(s, JOYCNT); cnt != 0x47 {
+		t.Errorf("JOYCNT should have reset, received and sent flags, got 0x%02x", cnt)
+	}
+	if got := s.Load32(JOY_RECV); got != 0x89abcdef {
+		t.Errorf("JOY_RECV: got 0x%08x", got)
+	}
+	if load16(s, JOYSTAT)&0x02 != 0 {
+		t.Errorf("reading JOY_RECV should clear the receive flag")
+	}
+
+	s.Store16(JOYCNT, 0x47)
+	if cnt := load16(s, JOYCNT); cnt != 0x40 {
+		t.Errorf("writing 1 should acknowledge the flags, got 0x%02x", cnt)
+	}
+}
+
+// TestDolphin plays Dolphin with a fake server
+func TestDolphin(t *testing.T) {
+	dataLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataLn.Close()
+	clockLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clockLn.Close()
+
+	accepted := make(chan net.Conn, 2)
+	for _, ln := range []net.Listener{clockLn, dataLn} {
+		go func(ln net.Listener) {
+			c, err := ln.Accept()
+			if err == nil {
+				accepted <- c
+			}
+		}(ln)
+	}
+
+	d, err := DialDolphinAddr(dataLn.Addr().String(), clockLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	var data net.Conn
+	for i := 0; i < 2; i++ {
+		c := <-accepted
+		defer c.Close()
+		if c.LocalAddr().String() == dataLn.Addr().String() {
+			data = c
+		} else {
+			c.Write([]byte{0, 0, 0x10, 0}) // clock is ignored
+		}
+	}
+
+	s := New()
+	s.SetJOYDevice(d)
+	s.Store16(RCNT, 0xc000)
+	s.Store16(JOY_TRANS, 0xbeef)
+	s.Store16(JOY_TRANS+2, 0xdead)
+
+	exchange := func(cmd, expected []byte) {
+		if _, err := data.Write(cmd); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, len(expected))
+		done := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(data, reply)
+			done <- err
+		}()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s.Poll()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(reply, expected) {
+					t.Errorf("command % x: expected % x, got % x", cmd, expected, reply)
+				}
+				return
+			default:
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("no reply to % x", cmd)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	exchange([]byte{JOYStatus}, []byte{0x00, 0x04, 0x08})
+	exchange([]byte{JOYRead}, []byte{0xef, 0xbe, 0xad, 0xde, 0x00})
+	exchange([]byte{JOYWrite, 1, 2, 3, 4}, []byte{0x02})
+	if got := s.Load32(JOY_RECV); got != 0x04030201 {
+		t.Errorf("JOY_RECV: got 0x%08x", got)
+	}
+}
@@ -0,0 +1,588 @@
+// Package sio emulates the serial port (link cable) of GBA.
+//
+// The registers are at 0x0400_0120-0x0400_015b except KEYINPUT and KEYCNT. Offsets in this package are from 0x0400_0120.
+//
+// Other GBAs are reached through a Transport. Each GBA sends its data registers to the others when they are written.
+// Transfers are run in lockstep: the GBA which starts a transfer asks the others for their data registers, and finishes
+// the transfer when their replies arrive. The emulation never blocks for them: the transfer keeps running, and Poll
+// (called every scanline) finishes it when the replies have arrived, or without them after giveUpTimeout.
+//
+// In JOY Bus mode, the GBA answers the commands of a JOYDevice such as a GameCube instead.
+package sio
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pokemium/magia/pkg/util"
+)
+
+// Register offsets from 0x0400_0120
+const (
+	SIODATA32   = 0x00
+	SIOMULTI0   = 0x00
+	SIOMULTI1   = 0x02
+	SIOMULTI2   = 0x04
+	SIOMULTI3   = 0x06
+	SIOCNT      = 0x08
+	SIODATA8    = 0x0a
+	SIOMLT_SEND = 0x0a
+	RCNT        = 0x14
+
+	// Size is the size of the register area
+	Size = 0x3c
+)
+
+// MaxPlayers is the number of GBAs which can be linked in Multiplayer mode
+const MaxPlayers = 4
+
+const cpuClock = 16 * 1024 * 1024
+
+// giveUpTimeout is how long a transfer waits for the data of the others before it finishes without them
+const giveUpTimeout = 500 * time.Millisecond
+
+// Mode is selected by RCNT and SIOCNT
+type Mode byte
+
+const (
+	ModeNormal8 Mode = iota
+	ModeNormal32
+	ModeMultiplayer
+	ModeUART
+	ModeGeneralPurpose
+	ModeJOYBus
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeNormal8:
+		return "Normal 8bit"
+	case ModeNormal32:
+		return "Normal 32bit"
+	case ModeMultiplayer:
+		return "Multiplayer"
+	case ModeUART:
+		return "UART"
+	case ModeGeneralPurpose:
+		return "General-Purpose"
+	case ModeJOYBus:
+		return "JOY Bus"
+	}
+	return "unknown"
+}
+
+// SIOCNT bits
+const (
+	cntInternalClock = 0  // Normal
+	cntFastClock     = 1  // Normal: 2MHz
+	cntChild         = 2  // Multiplayer: SI terminal
+	cntReady         = 3  // Multiplayer: SD terminal (all GBAs are ready)
+	cntError         = 6  // Multiplayer, UART
+	cntStart         = 7  // Normal, Multiplayer: start / busy
+	cntUARTSendFull  = 4  // UART
+	cntUARTRecvEmpty = 5  // UART
+	cntUARTFIFO      = 8  // UART
+	cntUARTSend      = 10 // UART: send enable
+	cntUARTRecv      = 11 // UART: receive enable
+	cntIRQ           = 14
+)
+
+// RCNT bits in General-Purpose mode
+const (
+	rcntSI    = 2
+	rcntSIIRQ = 8
+)
+
+// baud rates of Multiplayer and UART mode
+var bauds = [4]int{9600, 38400, 57600, 115200}
+
+// uartFIFOSize is the size of the receive FIFO of UART mode (1 without FIFO)
+const uartFIFOSize = 4
+
+// SIO is the serial port
+type SIO struct {
+	regs [Size]byte
+	link Transport
+
+	// the data registers of the other GBAs (index: player)
+	peers [MaxPlayers]peer
+
+	// a transfer started by this GBA is running until Finish
+	busy bool
+
+	// the GBAs which have replied to the transfer started by this GBA (index: player)
+	replied [MaxPlayers]bool
+
+	// the transfer is waiting for the replies of the others after Finish, until deadline
+	waiting  bool
+	need     int
+	deadline time.Time
+	giveUp   time.Duration
+
+	// the last error of the link, cleared by Err
+	err error
+
+	// received bytes of UART mode
+	rx []byte
+
+	joy JOYDevice
+}
+
+type peer struct {
+	present bool
+	data32  uint32
+	send    uint16
+	gp      byte
+}
+
+func New() *SIO {
+	s := &SIO{giveUp: giveUpTimeout}
+	s.Reset()
+	return s
+}
+
+// Reset initializes the registers. The transport is kept.
+func (s *SIO) Reset() {
+	s.regs = [Size]byte{}
+	s.busy, s.waiting, s.rx = false, false, nil
+	s.set16(RCNT, 0x8000)
+}
+
+// SetTransport links the serial port with other GBAs. nil disconnects it.
+func (s *SIO) SetTransport(t Transport) {
+	s.link = t
+	s.peers = [MaxPlayers]peer{}
+	if t != nil {
+		s.publish()
+	}
+}
+
+// Transport returns the transport given to SetTransport
+func (s *SIO) Transport() Transport { return s.link }
+
+// Err returns the last error of the link, such as a failed send or a GBA which doesn't reply, and clears it
+func (s *SIO) Err() error {
+	err := s.err
+	s.err = nil
+	return err
+}
+
+func (s *SIO) u16(ofs uint32) uint16 {
+	return uint16(s.regs[ofs]) | uint16(s.regs[ofs+1])<<8
+}
+
+func (s *SIO) set16(ofs uint32, v uint16) {
+	s.regs[ofs], s.regs[ofs+1] = byte(v), byte(v>>8)
+}
+
+func (s *SIO) u32(ofs uint32) uint32 {
+	return uint32(s.u16(ofs)) | uint32(s.u16(ofs+2))<<16
+}
+
+func (s *SIO) set32(ofs uint32, v uint32) {
+	s.set16(ofs, uint16(v))
+	s.set16(ofs+2, uint16(v>>16))
+}
+
+// Mode returns the current communication mode
+func (s *SIO) Mode() Mode {
+	rcnt := s.u16(RCNT)
+	if util.Bit(rcnt, 15) {
+		if util.Bit(rcnt, 14) {
+			return ModeJOYBus
+		}
+		return ModeGeneralPurpose
+	}
+	return Mode(s.u16(SIOCNT) >> 12 & 0b11)
+}
+
+// id returns the player number of this GBA
+func (s *SIO) id() int {
+	if s.link == nil {
+		return 0
+	}
+	return s.link.ID()
+}
+
+// players returns the number of the linked GBAs including this one
+func (s *SIO) players() int {
+	if s.link == nil {
+		return 1
+	}
+	return s.link.Players()
+}
+
+// Load32 reads the registers at ofs.
+//
+// Reading SIODATA8 in UART mode pops the received byte.
+func (s *SIO) Load32(ofs uint32) uint32 {
+	if ofs >= Size {
+		return 0
+	}
+
+	switch s.Mode() {
+	case ModeMultiplayer:
+		cnt := s.u16(SIOCNT)
+		cnt = util.SetBit16(cnt, cntChild, s.id() != 0)
+		cnt = util.SetBit16(cnt, cntReady, s.players() > 1)
+		s.set16(SIOCNT, cnt)
+	case ModeUART:
+		cnt := s.u16(SIOCNT)
+		cnt = util.SetBit16(cnt, cntUARTSendFull, s.busy)
+		cnt = util.SetBit16(cnt, cntUARTRecvEmpty, len(s.rx) == 0)
+		s.set16(SIOCNT, cnt)
+		if ofs == SIODATA8 && len(s.rx) > 0 {
+			s.regs[SIODATA8] = s.rx[0]
+			s.rx = s.rx[1:]
+		}
+	case ModeGeneralPurpose:
+		s.set16(RCNT, s.u16(RCNT)&^0xf|uint16(s.gpInput()))
+	}
+
+	val := uint32(0)
+	for i := uint32(0); i < 4 && ofs+i < Size; i++ {
+		val |= uint32(s.regs[ofs+i]) << (8 * i)
+	}
+
+	// reading JOY_RECV_H clears the receive flag
+	if ofs <= JOY_RECV+2 && JOY_RECV+2 < ofs+4 {
+		s.regs[JOYSTAT] = util.SetBit8(s.regs[JOYSTAT], joyStatReceive, false)
+	}
+	return val
+}
+
+// Store8 writes a byte of the registers at ofs.
+//
+// If it starts a transfer of this GBA, it returns the cycles until the transfer finishes, and Finish must be called then.
+func (s *SIO) Store8(ofs uint32, b byte) (cycles int) {
+	if ofs >= Size {
+		return 0
+	}
+
+	switch {
+	case isJOYRegister(ofs):
+		s.storeJOY(ofs, b)
+		return 0
+	}
+
+	switch ofs {
+	case SIOCNT:
+		return s.writeCnt(uint16(b) | uint16(s.regs[SIOCNT+1])<<8)
+	case SIOCNT + 1:
+		return s.writeCnt(uint16(s.regs[SIOCNT]) | uint16(b)<<8)
+	case SIODATA8:
+		s.regs[ofs] = b
+		if s.Mode() == ModeUART {
+			return s.sendUART(b)
+		}
+		s.publish()
+	case RCNT:
+		s.regs[ofs] = b
+		if s.Mode() == ModeGeneralPurpose {
+			s.publish()
+		}
+	default:
+		s.regs[ofs] = b
+		if ofs < SIOCNT || ofs == SIODATA8+1 {
+			s.publish()
+		}
+	}
+	return 0
+}
+
+// Store16 writes a halfword of the registers at ofs. SIOCNT is written at once, so that the mode and the start bit are set together.
+func (s *SIO) Store16(ofs uint32, val uint16) (cycles int) {
+	if ofs == SIOCNT {
+		return s.writeCnt(val)
+	}
+	return s.Store8(ofs, byte(val)) + s.Store8(ofs+1, byte(val>>8))
+}
+
+// writeCnt writes SIOCNT and starts a transfer
+func (s *SIO) writeCnt(val uint16) int {
+	old := s.u16(SIOCNT)
+	switch s.Mode() {
+	case ModeMultiplayer:
+		// SI, SD and ID are read-only
+		val = val&^0x3c | old&0x3c
+		if s.busy {
+			val |= 1 << cntStart
+		}
+	case ModeUART:
+		val = val&^0x30 | old&0x30
+	}
+	s.set16(SIOCNT, val)
+
+	start := util.Bit(val, cntStart) && !util.Bit(old, cntStart) && !s.busy
+	if !start {
+		return 0
+	}
+
+	switch s.Mode() {
+	case ModeNormal8, ModeNormal32:
+		s.publish()
+		if !util.Bit(val, cntInternalClock) {
+			// external clock: wait for the transfer of the other GBA
+			return 0
+		}
+		bits, cyclesPerBit := 8, 64 // 256KHz
+		if s.Mode() == ModeNormal32 {
+			bits = 32
+		}
+		if util.Bit(val, cntFastClock) {
+			cyclesPerBit = 8 // 2MHz
+		}
+		s.busy = true
+		s.start()
+		return bits * cyclesPerBit
+
+	case ModeMultiplayer:
+		if s.id() != 0 {
+			// only the parent starts a transfer
+			s.set16(SIOCNT, util.SetBit16(val, cntStart, false))
+			return 0
+		}
+		s.busy = true
+		s.start()
+
+		// start bit, 16 data bits and stop bit of each GBA
+		return cpuClock / bauds[val&0b11] * 18 * s.players()
+	}
+	return 0
+}
+
+func (s *SIO) sendUART(b byte) int {
+	cnt := s.u16(SIOCNT)
+	if !util.Bit(cnt, cntUARTSend) || s.busy {
+		return 0
+	}
+	s.send(Message{Type: MessageUART, Data: [MaxPlayers]uint32{uint32(b)}})
+	s.busy = true
+
+	// start bit, 8 data bits and stop bit
+	return cpuClock / bauds[cnt&0b11] * 10
+}
+
+// start asks the other GBAs for their data registers at the start of a transfer
+func (s *SIO) start() {
+	s.replied = [MaxPlayers]bool{}
+	s.send(Message{Type: MessageStart, Mode: s.Mode()})
+}
+
+func (s *SIO) replies() int {
+	n := 0
+	for _, r := range s.replied {
+		if r {
+			n++
+		}
+	}
+	return n
+}
+
+// Finish finishes the transfer started by Store8, and returns true if it requests Serial IRQ.
+//
+// In Normal and Multiplayer mode, it needs the data of the other GBAs. It doesn't wait for them:
+// if they haven't arrived yet, the transfer keeps running and Poll finishes it later.
+func (s *SIO) Finish() (irq bool) {
+	if !s.busy || s.waiting {
+		return false
+	}
+
+	s.need = 0
+	switch s.Mode() {
+	case ModeNormal8, ModeNormal32:
+		if s.players() > 1 {
+			s.need = 1
+		}
+	case ModeMultiplayer:
+		s.need = s.players() - 1
+	}
+	if s.link == nil || s.need == 0 {
+		return s.complete()
+	}
+	s.waiting, s.deadline = true, time.Now().Add(s.giveUp)
+	return s.Poll()
+}
+
+// finishWaiting finishes the waiting transfer when the replies have arrived or the deadline has passed
+func (s *SIO) finishWaiting() (irq bool) {
+	if !s.waiting {
+		return false
+	}
+	if s.replies() < s.need {
+		if time.Now().Before(s.deadline) {
+			return false
+		}
+		s.err = fmt.Errorf("%d of %d GBAs didn't reply to the transfer in %s", s.need-s.replies(), s.need, s.giveUp)
+	}
+	s.waiting = false
+	return s.complete()
+}
+
+// complete sets the received data and finishes the transfer
+func (s *SIO) complete() (irq bool) {
+	s.busy = false
+	cnt := s.u16(SIOCNT)
+
+	switch s.Mode() {
+	case ModeNormal8, ModeNormal32:
+		out := Message{Type: MessageTransfer, Mode: s.Mode(), Data: [MaxPlayers]uint32{s.u32(SIODATA32), uint32(s.u16(SIODATA8))}}
+		if p, ok := s.firstPeer(); ok {
+			s.receiveNormal(p.data32, p.send)
+		}
+		s.send(out)
+
+	case ModeMultiplayer:
+		// the GBAs which don't reply send nothing
+		data := [MaxPlayers]uint32{uint32(s.u16(SIOMLT_SEND)), 0xffff, 0xffff, 0xffff}
+		for i := 1; i < MaxPlayers; i++ {
+			if s.replied[i] {
+				data[i] = uint32(s.peers[i].send)
+			}
+		}
+		s.setMulti(data)
+		cnt = s.u16(SIOCNT) &^ 0x30 // ID 0
+		s.send(Message{Type: MessageTransfer, Mode: ModeMultiplayer, Data: data})
+
+	case ModeUART:
+		// the send buffer is empty again
+	default:
+		return false
+	}
+
+	s.set16(SIOCNT, util.SetBit16(cnt, cntStart, false))
+	return util.Bit(cnt, cntIRQ)
+}
+
+// firstPeer returns the data of the GBA on the other side in Normal mode
+func (s *SIO) firstPeer() (peer, bool) {
+	for i, p := range s.peers {
+		if i != s.id() && p.present {
+			return p, true
+		}
+	}
+	return peer{}, false
+}
+
+func (s *SIO) receiveNormal(data32 uint32, data8 uint16) {
+	if s.Mode() == ModeNormal32 {
+		s.set32(SIODATA32, data32)
+	} else {
+		s.regs[SIODATA8] = byte(data8)
+	}
+}
+
+func (s *SIO) setMulti(data [MaxPlayers]uint32) {
+	for i, d := range data {
+		s.set16(SIOMULTI0+uint32(i)*2, uint16(d))
+	}
+}
+
+// Poll handles the messages from the other GBAs and the commands of the JOY Bus device, and returns true if they request Serial IRQ.
+// It also finishes the transfer which Finish has left waiting for the others.
+func (s *SIO) Poll() (irq bool) {
+	irq = s.pollJOY()
+	for s.link != nil {
+		m, ok := s.link.Receive()
+		if !ok {
+			break
+		}
+		if s.receive(m) {
+			irq = true
+		}
+	}
+	return s.finishWaiting() || irq
+}
+
+func (s *SIO) receive(m Message) bool {
+	if m.From < 0 || m.From >= MaxPlayers || m.From == s.id() {
+		return false
+	}
+	p := &s.peers[m.From]
+	cnt := s.u16(SIOCNT)
+
+	switch m.Type {
+	case MessageStart:
+		s.send(Message{Type: MessageReply, Data: s.dataRegisters()})
+
+	case MessageData, MessageReply:
+		if m.Type == MessageReply {
+			s.replied[m.From] = true
+		}
+		prev := s.gpInput()
+		p.present = true
+		p.data32, p.send, p.gp = m.Data[0], uint16(m.Data[1]), byte(m.Data[2])
+		if s.Mode() == ModeGeneralPurpose && util.Bit(s.u16(RCNT), rcntSIIRQ) {
+			// IRQ when SI changes from high to low
+			return util.Bit(prev, rcntSI) && !util.Bit(s.gpInput(), rcntSI)
+		}
+
+	case MessageTransfer:
+		p.present = true
+		switch {
+		case m.Mode == ModeMultiplayer && s.Mode() == ModeMultiplayer:
+			data := m.Data
+			data[s.id()] = uint32(s.u16(SIOMLT_SEND))
+			s.setMulti(data)
+			cnt = cnt&^0x30 | uint16(s.id())<<4
+		case m.Mode == s.Mode() && (m.Mode == ModeNormal8 || m.Mode == ModeNormal32):
+			if !util.Bit(cnt, cntStart) || util.Bit(cnt, cntInternalClock) {
+				return false
+			}
+			s.receiveNormal(m.Data[0], uint16(m.Data[1]))
+		default:
+			return false
+		}
+		s.set16(SIOCNT, util.SetBit16(cnt, cntStart, false))
+		return util.Bit(cnt, cntIRQ)
+
+	case MessageUART:
+		if s.Mode() != ModeUART || !util.Bit(cnt, cntUARTRecv) {
+			return false
+		}
+		size := 1
+		if util.Bit(cnt, cntUARTFIFO) {
+			size = uartFIFOSize
+		}
+		if len(s.rx) >= size {
+			s.set16(SIOCNT, util.SetBit16(cnt, cntError, true))
+			return util.Bit(cnt, cntIRQ)
+		}
+		s.rx = append(s.rx, byte(m.Data[0]))
+		return util.Bit(cnt, cntIRQ)
+
+	}
+	return false
+}
+
+// gpInput returns SC, SD, SI and SO of General-Purpose mode. The inputs are pulled up unless the other GBA drives them.
+func (s *SIO) gpInput() byte {
+	rcnt := s.u16(RCNT)
+	out := byte(rcnt>>4) & 0xf
+	in := byte(0xf)
+	if p, ok := s.firstPeer(); ok {
+		dir := p.gp >> 4
+		in = p.gp&dir | ^dir&0xf
+	}
+	return (byte(rcnt)&out | in&^out) & 0xf
+}
+
+// publish sends the data registers to the other GBAs
+func (s *SIO) publish() {
+	s.send(Message{Type: MessageData, Data: s.dataRegisters()})
+}
+
+// dataRegisters returns Data of MessageData
+func (s *SIO) dataRegisters() [MaxPlayers]uint32 {
+	return [MaxPlayers]uint32{s.u32(SIODATA32), uint32(s.u16(SIODATA8)), uint32(s.regs[RCNT])}
+}
+
+func (s *SIO) send(m Message) {
+	if s.link == nil {
+		return
+	}
+	m.From = s.id()
+	if err := s.link.Send(m); err != nil {
+		s.err = err
+	}
+}
@@ -0,0 +1,409 @@
+package sio
+
+import (
+	"testing"
+	"time"
+)
+
+func load16(s *SIO, ofs uint32) uint16 {
+	return uint16(s.Load32(ofs))
+}
+
+// link connects n serial ports with a hub
+func link(t *testing.T, n int) []*SIO {
+	h := NewHub()
+	ports := make([]*SIO, n)
+	for i := range ports {
+		tr, err := h.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = New()
+		ports[i].SetTransport(tr)
+	}
+	return ports
+}
+
+func pollAll(ports []*SIO) []bool {
+	irq := make([]bool, len(ports))
+	for i, s := range ports {
+		irq[i] = s.Poll()
+	}
+	return irq
+}
+
+// answer polls the ports in the background, so that they reply to the transfer started by another port.
+// The returned function stops polling, and returns whether each port has requested IRQ.
+func answer(ports []*SIO) func() []bool {
+	stop, done := make(chan struct{}), make(chan []bool)
+	go func() {
+		irq := make([]bool, len(ports))
+		for {
+			select {
+			case <-stop:
+				for i, p := range pollAll(ports) {
+					irq[i] = irq[i] || p
+				}
+				done <- irq
+				return
+			default:
+			}
+			for i, p := range pollAll(ports) {
+				irq[i] = irq[i] || p
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	return func() []bool {
+		close(stop)
+		return <-done
+	}
+}
+
+// finish finishes the transfer started by s, polling s until the replies arrive, and returns whether it requests IRQ
+func finish(t *testing.T, s *SIO) bool {
+	t.Helper()
+	irq := s.Finish()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.waiting {
+		if time.Now().After(deadline) {
+			t.Fatal("transfer doesn't finish")
+		}
+		time.Sleep(100 * time.Microsecond)
+		irq = s.Poll() || irq
+	}
+	return irq
+}
+
+func TestMultiplayer(t *testing.T) {
+	ports := link(t, 3)
+	for i, s := range ports {
+		s.Store16(RCNT, 0)
+		s.Store16(SIOCNT, 0x6003) // Multiplayer, 115200bps, IRQ
+		s.Store16(SIOMLT_SEND, uint16(0x1000+i))
+	}
+	pollAll(ports)
+
+	parent, child := ports[0], ports[1]
+	if cnt := load16(parent, SIOCNT); cnt&0xc != 0x8 {
+		t.Errorf("parent should be SI=0 and SD=1, got SIOCNT 0x%04x", cnt)
+	}
+	if cnt := load16(child, SIOCNT); cnt&0x4 == 0 {
+		t.Errorf("child should be SI=1, got SIOCNT 0x%04x", cnt)
+	}
+
+	if cycles := child.Store16(SIOCNT, 0x6083); cycles != 0 || load16(child, SIOCNT)&0x80 != 0 {
+		t.Errorf("child must not start a transfer")
+	}
+	cycles := parent.Store16(SIOCNT, 0x6083)
+	if cycles == 0 || load16(parent, SIOCNT)&0x80 == 0 {
+		t.Fatalf("parent should start a transfer")
+	}
+	stop := answer(ports[1:])
+	if !finish(t, parent) {
+		t.Errorf("parent should request IRQ")
+	}
+	if err := parent.Err(); err != nil {
+		t.Errorf("unexpected link error: %s", err)
+	}
+
+	expected := []uint16{0x1000, 0x1001, 0x1002, 0xffff}
+	irq := append([]bool{false}, stop()...)
+	for i, s := range ports {
+		for p, e := range expected {
+			if got := load16(s, SIOMULTI0+uint32(p)*2); got != e {
+				t.Errorf("player %d: SIOMULTI%d expected 0x%04x, got 0x%04x", i, p, e, got)
+			}
+		}
+		if cnt := load16(s, SIOCNT); cnt&0x80 != 0 || int(cnt>>4&3) != i {
+			t.Errorf("player %d: unexpected SIOCNT 0x%04x", i, cnt)
+		}
+		if i > 0 && !irq[i] {
+			t.Errorf("player %d should request IRQ", i)
+		}
+	}
+}
+
+// TestMultiplayerLockstep checks that the parent gets the data written by the child after the transfer is started
+func TestMultiplayerLockstep(t *testing.T) {
+	ports := link(t, 2)
+	for _, s := range ports {
+		s.Store16(RCNT, 0)
+		s.Store16(SIOCNT, 0x6003)
+		s.Store16(SIOMLT_SEND, 0x1111)
+	}
+	parent, child := ports[0], ports[1]
+	pollAll(ports)
+
+	parent.Store16(SIOCNT, 0x6083)
+	child.Store16(SIOMLT_SEND, 0x2222) // the parent hasn't received this yet
+	stop := answer([]*SIO{child})
+	finish(t, parent)
+	stop()
+	if got := load16(parent, SIOMULTI1); got != 0x2222 {
+		t.Errorf("parent should receive the data at the start of the transfer, got 0x%04x", got)
+	}
+}
+
+func TestMultiplayerTimeout(t *testing.T) {
+	ports := link(t, 2)
+	for _, s := range ports {
+		s.Store16(RCNT, 0)
+		s.Store16(SIOCNT, 0x6003)
+		s.Store16(SIOMLT_SEND, 0x1234)
+	}
+	parent := ports[0]
+	parent.giveUp = 10 * time.Millisecond
+	parent.Poll()
+
+	// the child doesn't poll
+	parent.Store16(SIOCNT, 0x6083)
+	if parent.Finish() {
+		t.Errorf("transfer shouldn't finish without the reply of the child")
+	}
+	if load16(parent, SIOCNT)&0x80 == 0 {
+		t.Fatalf("transfer should keep running while the child doesn't reply")
+	}
+	if parent.Poll() || parent.Err() != nil {
+		t.Errorf("transfer shouldn't give up before the deadline")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !parent.Poll() {
+		t.Errorf("parent should request IRQ when it gives up")
+	}
+	if parent.Err() == nil {
+		t.Errorf("parent should report the child which doesn't reply")
+	}
+	if parent.Err() != nil {
+		t.Errorf("Err should clear the error")
+	}
+	if load16(parent, SIOCNT)&0x80 != 0 {
+		t.Errorf("transfer should be finished")
+	}
+	if got := load16(parent, SIOMULTI1); got != 0xffff {
+		t.Errorf("SIOMULTI1 of the child which doesn't reply should be 0xffff, got 0x%04x", got)
+	}
+}
+
+// TestMultiplayerLate checks that Finish doesn't wait for the child, and Poll finishes the transfer when it replies
+func TestMultiplayerLate(t *testing.T) {
+	ports := link(t, 2)
+	for i, s := range ports {
+		s.Store16(RCNT, 0)
+		s.Store16(SIOCNT, 0x6003)
+		s.Store16(SIOMLT_SEND, uint16(0x1000+i))
+	}
+	parent, child := ports[0], ports[1]
+	pollAll(ports)
+
+	parent.Store16(SIOCNT, 0x6083)
+	if parent.Finish() {
+		t.Errorf("transfer shouldn't finish without the reply of the child")
+	}
+	if parent.Poll() {
+		t.Errorf("transfer shouldn't finish before the child polls")
+	}
+
+	child.Poll() // reply
+	if !parent.Poll() {
+		t.Errorf("parent should request IRQ when the reply arrives")
+	}
+	if err := parent.Err(); err != nil {
+		t.Errorf("unexpected link error: %s", err)
+	}
+	if got := load16(parent, SIOMULTI1); got != 0x1001 {
+		t.Errorf("SIOMULTI1 expected 0x1001, got 0x%04x", got)
+	}
+	if load16(parent, SIOCNT)&0x80 != 0 {
+		t.Errorf("transfer should be finished")
+	}
+}
+
+func TestMultiplayerAlone(t *testing.T) {
+	s := New()
+	s.Store16(RCNT, 0)
+	s.Store16(SIOMLT_SEND, 0x1234)
+	if cycles := s.Store16(SIOCNT, 0x2083); cycles == 0 {
+		t.Fatalf("transfer should start")
+	}
+	s.Finish()
+	if load16(s, SIOMULTI0) != 0x1234 || load16(s, SIOMULTI1) != 0xffff {
+		t.Errorf("unexpected SIOMULTI 0x%04x 0x%04x", load16(s, SIOMULTI0), load16(s, SIOMULTI1))
+	}
+	if load16(s, SIOCNT)&0x8 != 0 {
+		t.Errorf("SD should be low without other GBAs")
+	}
+}
+
+func TestNormal32(t *testing.T) {
+	ports := link(t, 2)
+	master, slave := ports[0], ports[1]
+	for _, s := range ports {
+		s.Store16(RCNT, 0)
+	}
+	master.Store16(SIODATA32, 0x5678)
+	master.Store16(SIODATA32+2, 0x1234)
+	slave.Store16(SIODATA32, 0xcdef)
+	slave.Store16(SIODATA32+2, 0x89ab)
+	slave.Store16(SIOCNT, 0x5080) // 32bit, external clock, IRQ, start
+	pollAll(ports)
+
+	cycles := master.Store16(SIOCNT, 0x5081) // internal clock
+	if cycles != 32*64 {
+		t.Errorf("expected %d cycles at 256KHz, got %d", 32*64, cycles)
+	}
+	stop := answer([]*SIO{slave})
+	if !finish(t, master) {
+		t.Errorf("master should request IRQ")
+	}
+	if !stop()[0] {
+		t.Errorf("slave should request IRQ")
+	}
+
+	if got := master.Load32(SIODATA32); got != 0x89abcdef {
+		t.Errorf("master received 0x%08x", got)
+	}
+	if got := slave.Load32(SIODATA32); got != 0x12345678 {
+		t.Errorf("slave received 0x%08x", got)
+	}
+	if load16(slave, SIOCNT)&0x80 != 0 || load16(master, SIOCNT)&0x80 != 0 {
+		t.Errorf("start bits should be cleared")
+	}
+}
+
+func TestUART(t *testing.T) {
+	ports := link(t, 2)
+	a, b := ports[0], ports[1]
+	for _, s := range ports {
+		s.Store16(RCNT, 0)
+		s.Store16(SIOCNT, 0x7d03) // UART, FIFO, send, receive, IRQ
+	}
+
+	for _, c := range []byte("hi") {
+		if cycles := a.Store8(SIODATA8, c); cycles == 0 {
+			t.Fatalf("send should start")
+		}
+		if load16(a, SIOCNT)&0x10 == 0 {
+			t.Errorf("send should be full")
+		}
+		a.Finish()
+	}
+	if load16(b, SIOCNT)&0x20 == 0 {
+		t.Errorf("receive should be empty before poll")
+	}
+	if !b.Poll() {
+		t.Errorf("receive should request IRQ")
+	}
+	got := []byte{byte(b.Load32(SIODATA8)), byte(b.Load32(SIODATA8))}
+	if string(got) != "hi" {
+		t.Errorf("received %q", got)
+	}
+	if load16(b, SIOCNT)&0x20 == 0 {
+		t.Errorf("receive should be empty")
+	}
+}
+
+// TestUARTPollCnt receives with the usual loop which reads SIOCNT until a byte arrives, and then reads SIODATA8
+func TestUARTPollCnt(t *testing.T) {
+	ports := link(t, 2)
+	a, b := ports[0], ports[1]
+	for _, s := range ports {
+		s.Store16(RCNT, 0)
+		s.Store16(SIOCNT, 0x7d03)
+	}
+	for _, c := range []byte("hi") {
+		a.Store8(SIODATA8, c)
+		a.Finish()
+	}
+	b.Poll()
+
+	got := []byte{}
+	for i := 0; i < 2; i++ {
+		if load16(b, SIOCNT)&0x20 != 0 {
+			t.Fatalf("receive shouldn't be empty before byte %d", i)
+		}
+		got = append(got, byte(b.Load32(SIODATA8)))
+	}
+	if string(got) != "hi" {
+		t.Errorf("received %q", got)
+	}
+	if load16(b, SIOCNT)&0x20 == 0 {
+		t.Errorf("receive should be empty")
+	}
+}
+
+func TestGeneralPurpose(t *testing.T) {
+	ports := link(t, 2)
+	a, b := ports[0], ports[1]
+	a.Store16(RCNT, 0x8000|0x40|0x04) // SI output high
+	b.Store16(RCNT, 0x8000|0x100)     // all inputs, SI IRQ
+	pollAll(ports)
+	if got := load16(b, RCNT) & 0xf; got != 0xf {
+		t.Errorf("inputs should be high, got 0x%x", got)
+	}
+
+	a.Store16(RCNT, 0x8000|0x40) // SI output low
+	if !b.Poll() {
+		t.Errorf("SI falling edge should request IRQ")
+	}
+	if got := load16(b, RCNT) & 0xf; got != 0xb {
+		t.Errorf("SI should be low, got 0x%x", got)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	host, err := ListenTCP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	child, err := DialTCP(host.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer child.Close()
+	if child.ID() != 1 {
+		t.Errorf("child should be player 1, got %d", child.ID())
+	}
+
+	ports := []*SIO{New(), New()}
+	ports[0].SetTransport(host)
+	ports[1].SetTransport(child)
+	for i, s := range ports {
+		s.Store16(RCNT, 0)
+		s.Store16(SIOCNT, 0x6003)
+		s.Store16(SIOMLT_SEND, uint16(0xa0+i))
+	}
+
+	// wait for the data of the child
+	deadline := time.Now().Add(5 * time.Second)
+	for !ports[0].peers[1].present || ports[0].peers[1].send != 0xa1 {
+		if time.Now().After(deadline) {
+			t.Fatal("data of the child doesn't arrive")
+		}
+		ports[0].Poll()
+		time.Sleep(time.Millisecond)
+	}
+	if host.Players() != 2 {
+		t.Errorf("expected 2 players, got %d", host.Players())
+	}
+
+	ports[0].Store16(SIOCNT, 0x6083)
+	stop := answer(ports[1:])
+	finish(t, ports[0])
+	stop()
+	if err := ports[0].Err(); err != nil {
+		t.Errorf("unexpected link error: %s", err)
+	}
+	for load16(ports[1], SIOMULTI0) != 0xa0 {
+		if time.Now().After(deadline) {
+			t.Fatal("transfer doesn't arrive")
+		}
+		ports[1].Poll()
+		time.Sleep(time.Millisecond)
+	}
+	if load16(ports[1], SIOMULTI1) != 0xa1 || load16(ports[0], SIOMULTI1) != 0xa1 {
+		t.Errorf("unexpected SIOMULTI1")
+	}
+}
@@ -0,0 +1,307 @@
+package sio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The TCP link is a star: the host is the parent (player 0) and relays the messages of each child to the others.
+//
+// Each message is 20 bytes: type, sender, mode, reserved and 4 data words in little endian.
+// The host sends hello (the player number and the number of players) to a new child, and the number of players to all when it changes.
+
+const messageSize = 20
+
+const (
+	messageHello MessageType = 0x80 + iota
+	messagePlayers
+)
+
+// helloTimeout is how long a child waits for hello after connecting
+const helloTimeout = 5 * time.Second
+
+func writeMessage(w io.Writer, m Message) error {
+	b := [messageSize]byte{byte(m.Type), byte(m.From), byte(m.Mode)}
+	for i, d := range m.Data {
+		binary.LittleEndian.PutUint32(b[4+4*i:], d)
+	}
+	_, err := w.Write(b[:])
+	return err
+}
+
+func readMessage(r io.Reader) (Message, error) {
+	b := [messageSize]byte{}
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return Message{}, err
+	}
+	m := Message{Type: MessageType(b[0]), From: int(b[1]), Mode: Mode(b[2])}
+	for i := range m.Data {
+		m.Data[i] = binary.LittleEndian.Uint32(b[4+4*i:])
+	}
+	return m, nil
+}
+
+// tcpConn writes the messages into a connection on its own goroutine, so that Send doesn't wait for the network
+type tcpConn struct {
+	conn net.Conn
+	out  chan Message
+
+	mu     sync.Mutex
+	err    error // the first write error
+	closed bool
+}
+
+func newTCPConn(conn net.Conn) *tcpConn {
+	c := &tcpConn{conn: conn, out: make(chan Message, inboxSize)}
+	go c.writeLoop()
+	return c
+}
+
+func (c *tcpConn) writeLoop() {
+	for m := range c.out {
+		if err := writeMessage(c.conn, m); err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// write queues the message. It returns the error of the previous writes, or ErrFull if the connection can't keep up.
+func (c *tcpConn) write(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.closed {
+		return net.ErrClosed
+	}
+	select {
+	case c.out <- m:
+		return nil
+	default:
+		return ErrFull
+	}
+}
+
+func (c *tcpConn) close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.out)
+	}
+	c.mu.Unlock()
+	return c.conn.Close()
+}
+
+// TCPHost is the parent of a TCP link. Up to 3 children connect to it with DialTCP.
+type TCPHost struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	children [MaxPlayers]*tcpConn // index: player number (1-3)
+	inbox    chan Message
+}
+
+// ListenTCP starts the parent of a TCP link at addr (e.g. "127.0.0.1:5738").
+func ListenTCP(addr string) (*TCPHost, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	h := &TCPHost{ln: ln, inbox: make(chan Message, inboxSize)}
+	go h.accept()
+	return h, nil
+}
+
+// Addr returns the address the host listens on
+func (h *TCPHost) Addr() net.Addr { return h.ln.Addr() }
+
+func (h *TCPHost) accept() {
+	for {
+		conn, err := h.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		h.mu.Lock()
+		id := 0
+		for i := 1; i < MaxPlayers; i++ {
+			if h.children[i] == nil {
+				id = i
+				break
+			}
+		}
+		if id == 0 {
+			h.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		// hello goes first, before the messages relayed to the child
+		if err := writeMessage(conn, Message{Type: messageHello, Data: [MaxPlayers]uint32{uint32(id), uint32(h.players() + 1)}}); err != nil {
+			h.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		c := newTCPConn(conn)
+		h.children[id] = c
+		h.mu.Unlock()
+		h.broadcastPlayers()
+		go h.read(id, c)
+	}
+}
+
+// read relays the messages of the child
+func (h *TCPHost) read(id int, c *tcpConn) {
+	for {
+		m, err := readMessage(c.conn)
+		if err != nil {
+			h.remove(id, c)
+			return
+		}
+		m.From = id
+		deliver(h.inbox, m)
+		h.relay(m, id)
+	}
+}
+
+func (h *TCPHost) remove(id int, c *tcpConn) {
+	c.close()
+	h.mu.Lock()
+	removed := h.children[id] == c
+	if removed {
+		h.children[id] = nil
+	}
+	h.mu.Unlock()
+	if removed {
+		h.broadcastPlayers()
+	}
+}
+
+// relay sends the message to the children except the one
+func (h *TCPHost) relay(m Message, except int) error {
+	h.mu.Lock()
+	children := h.children
+	h.mu.Unlock()
+
+	var err error
+	for i, c := range children {
+		if c != nil && i != except {
+			if werr := c.write(m); err == nil {
+				err = werr
+			}
+		}
+	}
+	return err
+}
+
+func (h *TCPHost) broadcastPlayers() {
+	h.mu.Lock()
+	players := h.players()
+	h.mu.Unlock()
+	h.relay(Message{Type: messagePlayers, Data: [MaxPlayers]uint32{uint32(players)}}, 0)
+}
+
+// players must be called with mu locked
+func (h *TCPHost) players() int {
+	n := 1
+	for _, c := range h.children {
+		if c != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (h *TCPHost) ID() int { return 0 }
+
+func (h *TCPHost) Players() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.players()
+}
+
+func (h *TCPHost) Send(m Message) error {
+	return h.relay(m, 0)
+}
+
+func (h *TCPHost) Receive() (Message, bool) {
+	return receive(h.inbox)
+}
+
+// Close stops listening and disconnects the children
+func (h *TCPHost) Close() error {
+	err := h.ln.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, c := range h.children {
+		if c != nil {
+			c.close()
+			h.children[i] = nil
+		}
+	}
+	return err
+}
+
+// tcpChild is a child of a TCP link
+type tcpChild struct {
+	*tcpConn
+	id      int
+	players int32
+	inbox   chan Message
+}
+
+// DialTCP connects to the parent of a TCP link started by ListenTCP.
+func DialTCP(addr string) (Transport, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	m, err := readMessage(conn)
+	if err == nil && m.Type != messageHello {
+		err = fmt.Errorf("unexpected message 0x%02x instead of hello", m.Type)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to join the link: %w", err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &tcpChild{tcpConn: newTCPConn(conn), id: int(m.Data[0]), players: int32(m.Data[1]), inbox: make(chan Message, inboxSize)}
+	go c.read()
+	return c, nil
+}
+
+func (c *tcpChild) read() {
+	for {
+		m, err := readMessage(c.conn)
+		if err != nil {
+			atomic.StoreInt32(&c.players, 1)
+			return
+		}
+		if m.Type == messagePlayers {
+			atomic.StoreInt32(&c.players, int32(m.Data[0]))
+			continue
+		}
+		deliver(c.inbox, m)
+	}
+}
+
+func (c *tcpChild) ID() int { return c.id }
+
+func (c *tcpChild) Players() int { return int(atomic.LoadInt32(&c.players)) }
+
+func (c *tcpChild) Send(m Message) error { return c.write(m) }
+
+func (c *tcpChild) Receive() (Message, bool) { return receive(c.inbox) }
+
+func (c *tcpChild) Close() error { return c.close() }
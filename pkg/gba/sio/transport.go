@@ -0,0 +1,143 @@
+package sio
+
+import (
+	"errors"
+	"sync"
+)
+
+// MessageType is the kind of a message between serial ports
+type MessageType byte
+
+const (
+	// MessageData tells the data registers (Data[0]: SIODATA32, Data[1]: SIOMLT_SEND/SIODATA8, Data[2]: RCNT)
+	MessageData MessageType = iota
+
+	// MessageTransfer tells that a transfer of Mode is finished by From.
+	// Data is SIOMULTI0-3 in Multiplayer mode, and the same as MessageData in Normal mode.
+	MessageTransfer
+
+	// MessageUART sends a byte (Data[0]) in UART mode
+	MessageUART
+
+	// MessageStart tells that a transfer of Mode is started by From. The others answer with MessageReply.
+	MessageStart
+
+	// MessageReply answers MessageStart with the data registers at the start of the transfer (the same as MessageData)
+	MessageReply
+)
+
+// Message is sent between serial ports
+type Message struct {
+	Type MessageType
+
+	// From is the player number of the sender
+	From int
+	Mode Mode
+	Data [MaxPlayers]uint32
+}
+
+// Transport connects a serial port with the others.
+//
+// Send delivers the message to every other port in order. Send and Receive must not block, because they are called by the emulation.
+type Transport interface {
+	// ID is the player number of this port (0: parent)
+	ID() int
+
+	// Players is the number of the connected ports including this one
+	Players() int
+
+	Send(m Message) error
+	Receive() (Message, bool)
+
+	Close() error
+}
+
+var ErrFull = errors.New("link is full")
+
+// inboxSize is the number of messages a port can hold. Messages to a port which doesn't receive them are dropped.
+const inboxSize = 1024
+
+// Hub links serial ports in the same process
+type Hub struct {
+	mu    sync.Mutex
+	ports [MaxPlayers]*hubPort
+}
+
+func NewHub() *Hub { return &Hub{} }
+
+// Connect returns a port of the hub. The player number is the lowest one which isn't used.
+func (h *Hub) Connect() (Transport, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, p := range h.ports {
+		if p == nil {
+			h.ports[i] = &hubPort{hub: h, id: i, inbox: make(chan Message, inboxSize)}
+			return h.ports[i], nil
+		}
+	}
+	return nil, ErrFull
+}
+
+type hubPort struct {
+	hub   *Hub
+	id    int
+	inbox chan Message
+}
+
+func (p *hubPort) ID() int { return p.id }
+
+func (p *hubPort) Players() int {
+	p.hub.mu.Lock()
+	defer p.hub.mu.Unlock()
+	n := 0
+	for _, q := range p.hub.ports {
+		if q != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (p *hubPort) Send(m Message) error {
+	p.hub.mu.Lock()
+	defer p.hub.mu.Unlock()
+	var err error
+	for _, q := range p.hub.ports {
+		if q != nil && q != p && !deliver(q.inbox, m) {
+			err = ErrFull
+		}
+	}
+	return err
+}
+
+func (p *hubPort) Receive() (Message, bool) {
+	return receive(p.inbox)
+}
+
+func (p *hubPort) Close() error {
+	p.hub.mu.Lock()
+	defer p.hub.mu.Unlock()
+	if p.hub.ports[p.id] == p {
+		p.hub.ports[p.id] = nil
+	}
+	return nil
+}
+
+// deliver puts the message into the inbox without blocking, and returns false if the inbox is full
+func deliver(inbox chan Message, m Message) bool {
+	select {
+	case inbox <- m:
+		return true
+	default:
+		return false
+	}
+}
+
+func receive(inbox chan Message) (Message, bool) {
+	select {
+	case m := <-inbox:
+		return m, true
+	default:
+		return Message{}, false
+	}
+}
@@ -1,50 +1,85 @@
 package timer
 
 import (
-	"github.com/pokemium/magia/pkg/gba/apu"
 	"github.com/pokemium/magia/pkg/util"
 )
 
-const (
-	SoundATimer = 10
-	SoundBTimer = 14
-)
-
-var Enable byte = 0
+// StartDelay is the cycles between enabling a timer and the timer starting to count.
+const StartDelay = 2
 
 type Timers [4]*Timer
 
 func New() Timers { return Timers{&Timer{}, &Timer{}, &Timer{}, &Timer{}} }
 
+// Enabled returns true if any timer is running
+func (ts *Timers) Enabled() bool {
+	for _, t := range ts {
+		if t.enable() {
+			return true
+		}
+	}
+	return false
+}
+
+// Timer is computed lazily from the cycle timestamp.
+//
+// Count is the counter value at `last`. The prescaler increments the counter at origin + k * prescaler (k >= 1).
 type Timer struct {
 	Count   uint16
-	Next    int // if this value is 0, count up timer.Count
 	Reload  uint16
 	Control byte
+
+	// the timestamp when Count was updated last
+	last int64
+
+	// the timestamp when the prescaler started
+	origin int64
 }
 
 func (t *Timer) cascade() bool { return util.Bit(t.Control, 2) }
 func (t *Timer) irq() bool     { return util.Bit(t.Control, 6) }
 func (t *Timer) enable() bool  { return util.Bit(t.Control, 7) }
-func (t *Timer) increment(inc int) bool {
-	previous := t.Count
-	t.Count += uint16(inc)
-	return t.Count < previous // if overflow occurs
+func (t *Timer) shift() byte   { return clockShift[t.Control&0b11] }
+
+// add increments the counter by inc and returns how many times it overflowed.
+//
+// On overflow, the counter is reloaded with Reload.
+func (t *Timer) add(inc int) int {
+	v := int(t.Count) + inc
+	if v < 0x10000 {
+		t.Count = uint16(v)
+		return 0
+	}
+
+	v -= 0x10000
+	period := 0x10000 - int(t.Reload)
+	t.Count = t.Reload + uint16(v%period)
+	return 1 + v/period
 }
-func (t *Timer) overflow() bool {
-	t.Count += t.Reload
-	return t.irq()
+
+// ticks returns how many times the prescaler ticks between `last` and now
+func (t *Timer) ticks(now int64) int {
+	from := t.last
+	if from < t.origin {
+		from = t.origin
+	}
+	if now <= from {
+		return 0
+	}
+	return int((now-t.origin)>>t.shift() - (from-t.origin)>>t.shift())
 }
 
 // IsIO returns true if addr is for Timer IO register.
 func IsTimerIO(addr uint32) bool { return (addr >= 0x0400_0100) && (addr < 0x0400_0110) }
-func (ts *Timers) GetIO(offset uint32) uint32 {
+
+// GetIO returns timer IO register value at the timestamp now.
+func (ts *Timers) GetIO(offset uint32, now int64) uint32 {
 	idx, ofs := offset/4, offset%4
 	switch ofs {
 	case 0:
-		return uint32(ts[idx].Control)<<16 | uint32(ts[idx].Count)
+		return uint32(ts[idx].Control)<<16 | uint32(ts.peek(int(idx), now))
 	case 1:
-		return uint32(ts[idx].Count >> 8)
+		return uint32(ts.peek(int(idx), now) >> 8)
 	case 2:
 		return uint32(ts[idx].Control)
 	case 3:
@@ -53,72 +88,116 @@ func (ts *Timers) GetIO(offset uint32) uint32 {
 	return 0
 }
 
-func (ts *Timers) SetIO(offset uint32, b byte) {
+// SetIO writes timer IO register at the timestamp now.
+//
+// Timers must be updated to now before calling this.
+func (ts *Timers) SetIO(offset uint32, b byte, now int64) {
 	idx, ofs := offset/4, offset%4
+	t := ts[idx]
 	switch ofs {
 	case 0:
-		ts[idx].Reload = (ts[idx].Reload & 0xff00) | uint16(b)
+		t.Reload = (t.Reload & 0xff00) | uint16(b)
 	case 1:
-		ts[idx].Reload = (ts[idx].Reload & 0xff) | (uint16(b) << 8)
+		t.Reload = (t.Reload & 0xff) | (uint16(b) << 8)
 	case 2:
-		if util.Bit(b, 7) {
-			Enable |= (1 << idx)
-		} else {
-			Enable &= ^(1 << idx)
-		}
-		previous := util.Bit(ts[idx].Control, 7)
-		ts[idx].Control = b
-		// The reload value is copied into the counter when the timer start bit becomes changed from 0 to 1.
-		if !previous && util.Bit(b, 7) {
-			ts[idx].Count = ts[idx].Reload
-			ts[idx].Next = 0
+		previous, prescaler := t.enable(), t.Control&0b11
+		t.Control = b
+		t.last = now
+
+		switch {
+		case !previous && t.enable():
+			// The reload value is copied into the counter when the timer start bit becomes changed from 0 to 1.
+			t.Count = t.Reload
+			t.origin = now + StartDelay
+		case previous && t.enable() && b&0b11 != prescaler:
+			// The prescaler runs off the system clock, so the new frequency keeps its phase.
+			// Writes which keep the frequency (e.g. toggling IRQ) don't touch the phase set at the start.
+			t.origin = now &^ (1<<t.shift() - 1)
 		}
 	}
 }
 
 var clockShift = [4]byte{0, 6, 8, 10}
 
-func (ts *Timers) Tick(cycles int, cnth uint16, dma func(ch int)) [4]bool {
-	overflow, irq := false, [4]bool{}
+// Update advances timers to the timestamp now and handles overflows.
+//
+// overflow is called with the timer and the number of overflows, which drive Direct Sound. It returns which timers request IRQ.
+func (ts *Timers) Update(now int64, overflow func(ch, n int)) [4]bool {
+	overflows, irq := 0, [4]bool{}
 	for i := 0; i < 4; i++ {
-		if !ts[i].enable() {
-			overflow = false
+		t := ts[i]
+		inc := 0
+		switch {
+		case !t.enable():
+			overflows = 0
 			continue
+		case i > 0 && t.cascade():
+			inc = overflows
+		default:
+			inc = t.ticks(now)
 		}
+		t.last = now
 
-		inc := 0
-		if i > 0 && ts[i].cascade() {
-			if overflow {
-				inc = 1
-			}
-		} else {
-			ts[i].Next += cycles
-			inc = ts[i].Next >> clockShift[ts[i].Control&0b11]
-			ts[i].Next -= (inc << clockShift[ts[i].Control&0b11])
+		overflows = t.add(inc)
+		if overflows == 0 {
+			continue
 		}
 
-		if inc > 0 {
-			overflow = ts[i].increment(inc)
-			if overflow {
-				if (cnth>>SoundATimer)&0b1 == uint16(i) {
-					apu.FifoALoad()
-					if apu.FifoALen <= 0x10 {
-						dma(1)
-					}
-				}
-				if (cnth>>SoundBTimer)&0b1 == uint16(i) {
-					apu.FifoBLoad()
-					if apu.FifoBLen <= 0x10 {
-						dma(2)
-					}
-				}
-
-				if ts[i].overflow() {
-					irq[i] = true
-				}
-			}
+		if overflow != nil && i < 2 {
+			overflow(i, overflows)
+		}
+
+		if t.irq() {
+			irq[i] = true
 		}
 	}
 
 	return irq
 }
+
+// peek returns the counter value of timer idx at the timestamp now without updating timers.
+//
+// Only the timer and the lower timers driving it by count-up are copied.
+func (ts *Timers) peek(idx int, now int64) uint16 {
+	first := idx
+	for first > 0 && ts[first].enable() && ts[first].cascade() {
+		first--
+	}
+
+	var tmp [4]Timer
+	for i := first; i <= idx; i++ {
+		tmp[i] = *ts[i]
+	}
+	view := Timers{&tmp[0], &tmp[1], &tmp[2], &tmp[3]}
+	view.Update(now, nil)
+	return tmp[idx].Count
+}
+
+// NextOverflow returns the cycles from now until the first overflow of the prescaler-driven timers.
+//
+// If no timer is running, this returns 0.
+func (ts *Timers) NextOverflow(now int64) int {
+	next := 0
+	for i, t := range ts {
+		if !t.enable() || (i > 0 && t.cascade()) {
+			continue
+		}
+
+		// the timestamp when the counter reaches 0x10000
+		inc := int64(0x10000 - int(t.Count))
+		from := t.last
+		if from < t.origin {
+			from = t.origin
+		}
+		at := t.origin + (((from-t.origin)>>t.shift())+inc)<<t.shift()
+
+		c := int(at - now)
+		if c <= 0 {
+			c = 1
+		}
+		if next == 0 || c < next {
+			next = c
+		}
+	}
+	return next
+}
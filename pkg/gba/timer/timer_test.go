@@ -0,0 +1,176 @@
+package timer
+
+import "testing"
+
+const (
+	tmCntL = 0
+	tmCntH = 2
+)
+
+// start timer idx with reload value and control at the timestamp now
+func start(ts *Timers, idx uint32, reload uint16, control byte, now int64) {
+	ts.SetIO(idx*4+tmCntL, byte(reload), now)
+	ts.SetIO(idx*4+tmCntL+1, byte(reload>>8), now)
+	ts.SetIO(idx*4+tmCntH, control, now)
+}
+
+func count(ts *Timers, idx uint32, now int64) uint16 {
+	return uint16(ts.GetIO(idx*4+tmCntL, now))
+}
+
+func TestPrescaler(t *testing.T) {
+	tests := []struct {
+		control byte
+		cycles  int64
+		want    uint16
+	}{
+		{0x80, 1, 0},
+		{0x80, StartDelay, 0},
+		{0x80, StartDelay + 1, 1},
+		{0x80, StartDelay + 100, 100},
+		{0x81, StartDelay + 63, 0},
+		{0x81, StartDelay + 64, 1},
+		{0x81, StartDelay + 64*10 + 5, 10},
+		{0x82, StartDelay + 256*3, 3},
+		{0x83, StartDelay + 1024*2 - 1, 1},
+	}
+
+	for _, tt := range tests {
+		ts := New()
+		start(&ts, 0, 0, tt.control, 100)
+		if got := count(&ts, 0, 100+tt.cycles); got != tt.want {
+			t.Errorf("control=0x%02x cycles=%d: got %d, want %d", tt.control, tt.cycles, got, tt.want)
+		}
+	}
+}
+
+func TestReadIsExactWithoutUpdate(t *testing.T) {
+	ts := New()
+	start(&ts, 0, 0xff00, 0x80, 0)
+
+	// Reading must not advance the timer
+	for now := int64(StartDelay); now < StartDelay+0x80; now++ {
+		want := 0xff00 + uint16(now-StartDelay)
+		if got := count(&ts, 0, now); got != want {
+			t.Fatalf("cycle %d: got 0x%04x, want 0x%04x", now, got, want)
+		}
+	}
+	if ts[0].Count != 0xff00 {
+		t.Errorf("GetIO updates Count: 0x%04x", ts[0].Count)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	ts := New()
+	start(&ts, 0, 0xfff0, 0xc0, 0) // IRQ enable
+
+	next := ts.NextOverflow(0)
+	if want := StartDelay + 0x10; next != want {
+		t.Fatalf("NextOverflow: got %d, want %d", next, want)
+	}
+
+	irq := ts.Update(int64(next-1), nil)
+	if irq[0] {
+		t.Errorf("overflow occurs 1 cycle early")
+	}
+
+	irq = ts.Update(int64(next), nil)
+	if !irq[0] {
+		t.Errorf("overflow doesn't occur")
+	}
+	if ts[0].Count != 0xfff0 {
+		t.Errorf("counter isn't reloaded: 0x%04x", ts[0].Count)
+	}
+
+	// Next overflow is one period later
+	if got := ts.NextOverflow(int64(next)); got != 0x10 {
+		t.Errorf("NextOverflow after reload: got %d, want %d", got, 0x10)
+	}
+}
+
+func TestReloadWriteWhileRunning(t *testing.T) {
+	ts := New()
+	start(&ts, 0, 0xfff0, 0x80, 0)
+
+	// Writing reload value doesn't change the counter until the next overflow
+	ts.Update(StartDelay+4, nil)
+	ts.SetIO(tmCntL, 0x00, StartDelay+4)
+	ts.SetIO(tmCntL+1, 0x80, StartDelay+4)
+	if got := count(&ts, 0, StartDelay+4); got != 0xfff4 {
+		t.Errorf("counter is changed by reload write: 0x%04x", got)
+	}
+
+	ts.Update(StartDelay+0x10, nil)
+	if ts[0].Count != 0x8000 {
+		t.Errorf("new reload value isn't used: 0x%04x", ts[0].Count)
+	}
+}
+
+func TestPrescalerChangeWhileRunning(t *testing.T) {
+	ts := New()
+	start(&ts, 0, 0, 0x80, 0)
+
+	ts.Update(StartDelay+10, nil)
+	ts.SetIO(tmCntH, 0x81, StartDelay+10)
+
+	// The prescaler runs off the system clock, so the next tick is at cycle 64, not 64 cycles after the write
+	if got := count(&ts, 0, 63); got != 10 {
+		t.Errorf("got %d, want 10", got)
+	}
+	if got := count(&ts, 0, 64); got != 11 {
+		t.Errorf("got %d, want 11", got)
+	}
+	if got := count(&ts, 0, 128); got != 12 {
+		t.Errorf("got %d, want 12", got)
+	}
+}
+
+func TestControlWriteKeepsPhase(t *testing.T) {
+	ts := New()
+	start(&ts, 0, 0, 0x83, 0)
+	start(&ts, 1, 0, 0x83, 0)
+
+	// Toggling IRQ of a running timer keeps the frequency, so it must not realign the prescaler
+	ts.Update(1500, nil)
+	ts.SetIO(1*4+tmCntH, 0xc3, 1500)
+
+	for _, now := range []int64{1024 + StartDelay, 2048, 2048 + StartDelay, 4096 + StartDelay} {
+		if a, b := count(&ts, 0, now), count(&ts, 1, now); a != b {
+			t.Errorf("cycle %d: timer 0 is %d, but timer 1 is %d", now, a, b)
+		}
+	}
+}
+
+func TestCascade(t *testing.T) {
+	ts := New()
+	start(&ts, 1, 0, 0x84, 0)      // count-up
+	start(&ts, 0, 0xffff, 0x80, 0) // overflow every cycle
+
+	ts.Update(StartDelay+5, nil)
+	if ts[1].Count != 5 {
+		t.Errorf("count-up timer counts multiple overflows: got %d, want 5", ts[1].Count)
+	}
+	if got := count(&ts, 1, StartDelay+8); got != 8 {
+		t.Errorf("count-up timer read: got %d, want 8", got)
+	}
+}
+
+func TestCascadeWithDisabledTimer(t *testing.T) {
+	ts := New()
+	start(&ts, 0, 0xffff, 0x80, 0)
+	start(&ts, 2, 0, 0x84, 0) // timer1 is disabled, so timer2 never counts
+
+	ts.Update(StartDelay+100, nil)
+	if ts[2].Count != 0 {
+		t.Errorf("count-up timer counts with disabled lower timer: %d", ts[2].Count)
+	}
+}
+
+func TestTimer0IgnoresCascade(t *testing.T) {
+	ts := New()
+	start(&ts, 0, 0, 0x84, 0)
+
+	if got := count(&ts, 0, StartDelay+7); got != 7 {
+		t.Errorf("timer0 count-up bit isn't ignored: got %d, want 7", got)
+	}
+}
@@ -0,0 +1,36 @@
+package gba
+
+import (
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+	"github.com/pokemium/magia/pkg/gba/timer"
+)
+
+// TestTimerIRQByCPU starts timers from the CPU, and checks that the overflow IRQ is requested at the exact cycle
+func TestTimerIRQByCPU(t *testing.T) {
+	tests := []struct {
+		name   string
+		stores [][2]uint32 // the last store starts the timer which requests the IRQ
+		irq    IRQID
+		cycles int64 // from the last write to the overflow, after StartDelay
+	}{
+		{"F/1", [][2]uint32{{ram.TM0CNT, 0x00c0_fff0}}, irqTimer0, 16},
+		{"F/64", [][2]uint32{{ram.TM0CNT + 4, 0x00c1_fffe}}, irqTimer1, 2 * 64},
+		{"F/256", [][2]uint32{{ram.TM0CNT + 8, 0x00c2_ffff}}, irqTimer2, 256},
+		{"count-up", [][2]uint32{{ram.TM0CNT + 4, 0x00c4_ffff}, {ram.TM0CNT, 0x0080_fff0}}, irqTimer1, 16},
+		{"restart", [][2]uint32{{ram.TM0CNT, 0x00c0_0000}, {ram.TM0CNT, 0}, {ram.TM0CNT, 0x00c0_ffe0}}, irqTimer0, 32},
+	}
+
+	for _, tt := range tests {
+		g := newARMGBA(storeProgram(tt.stores...))
+		str := uint32(0x0800_0000 + (3*len(tt.stores)-1)*4)
+		before := stepUntil(g, func() bool { return g.pipe.inst[0].loc == str })
+
+		// the str instruction writes the timer, and the IRQ is requested at the end of the instruction running at the overflow
+		min := before + timer.StartDelay + tt.cycles
+		if at := runUntilIRQ(t, g, tt.irq); at < min || at >= min+2*cyclesARMMax {
+			t.Errorf("%s: IRQ is requested at cycle %d, want %d + the cycles of 2 instructions at most", tt.name, at, min)
+		}
+	}
+}
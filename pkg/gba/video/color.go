@@ -0,0 +1,159 @@
+package video
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// ColorProfile converts BGR555 colors into RGB for the screen.
+//
+// Games were made for the dark LCD of GBA, so they look washed out with raw colors on modern displays.
+type ColorProfile int
+
+const (
+	// ColorRaw expands 5bit channels into 8bit without correction
+	ColorRaw ColorProfile = iota
+	// ColorGBA is the LCD of the original GBA (AGB-001)
+	ColorGBA
+	// ColorSP is the backlit LCD of GBA SP (AGS-101)
+	ColorSP
+	// ColorGBPlayer is Game Boy Player on a TV
+	ColorGBPlayer
+	colorProfileCount
+)
+
+var colorProfileNames = [...]string{"raw", "gba", "sp", "gbp"}
+
+func (c ColorProfile) String() string {
+	if c < 0 || c >= colorProfileCount {
+		return fmt.Sprintf("ColorProfile(%d)", int(c))
+	}
+	return colorProfileNames[c]
+}
+
+// ColorProfileNames returns the names accepted by ParseColorProfile
+func ColorProfileNames() []string {
+	return colorProfileNames[:]
+}
+
+func ParseColorProfile(name string) (ColorProfile, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range colorProfileNames {
+		if n == name {
+			return ColorProfile(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown color profile %q (available: %s)", name, strings.Join(colorProfileNames[:], ", "))
+}
+
+// colorCorrection is the LCD model of a profile
+//
+// Colors are linearized with gamma, scaled by lum, mixed by matrix (rows are output R, G, B) and encoded with displayGamma.
+// The values are from the color correction shaders by Pokefan531.
+type colorCorrection struct {
+	gamma, lum float64
+	matrix     [3][3]float64
+}
+
+const displayGamma = 2.2
+
+var colorCorrections = [colorProfileCount]colorCorrection{
+	ColorGBA: {
+		gamma: 2.2 + 0.5,
+		lum:   0.94,
+		matrix: [3][3]float64{
+			{0.82, 0.24, -0.06},
+			{0.125, 0.665, 0.21},
+			{0.195, 0.075, 0.73},
+		},
+	},
+	ColorSP: {
+		gamma: 2.2,
+		lum:   0.935,
+		matrix: [3][3]float64{
+			{0.86, 0.19, -0.05},
+			{0.11, 0.66, 0.23},
+			{0.1325, 0.02, 0.8475},
+		},
+	},
+	ColorGBPlayer: {
+		gamma: 2.2,
+		lum:   1,
+		matrix: [3][3]float64{
+			{0.9, 0.125, -0.025},
+			{0.05, 0.9, 0.05},
+			{0.05, 0.075, 0.875},
+		},
+	},
+}
+
+// colorTable is RGB of every BGR555 color
+type colorTable [0x8000][3]byte
+
+var (
+	colorTables    [colorProfileCount]*colorTable
+	colorTableOnce [colorProfileCount]sync.Once
+)
+
+// lookupColorTable returns the table of the profile. Tables are built on the first use and shared by all renderers.
+func lookupColorTable(c ColorProfile) *colorTable {
+	if c < 0 || c >= colorProfileCount {
+		c = ColorRaw
+	}
+	colorTableOnce[c].Do(func() {
+		colorTables[c] = buildColorTable(c)
+	})
+	return colorTables[c]
+}
+
+func buildColorTable(c ColorProfile) *colorTable {
+	t := &colorTable{}
+	if c == ColorRaw {
+		for i := range t {
+			r, g, b := uint16(i)&0x1f, (uint16(i)>>5)&0x1f, (uint16(i)>>10)&0x1f
+			t[i] = [3]byte{expand5(r), expand5(g), expand5(b)}
+		}
+		return t
+	}
+
+	cc := colorCorrections[c]
+	var linear [32]float64
+	for v := range linear {
+		linear[v] = math.Pow(float64(v)/31, cc.gamma) * cc.lum
+	}
+
+	for i := range t {
+		in := [3]float64{linear[i&0x1f], linear[(i>>5)&0x1f], linear[(i>>10)&0x1f]}
+		for ch, row := range cc.matrix {
+			v := row[0]*in[0] + row[1]*in[1] + row[2]*in[2]
+			v = math.Pow(math.Min(math.Max(v, 0), 1), 1/displayGamma)
+			t[i][ch] = byte(math.Round(v * 255))
+		}
+	}
+	return t
+}
+
+// expand5 converts 5bit channel into 8bit so that 0x1f becomes 0xff
+func expand5(v uint16) byte {
+	return byte(v<<3 | v>>2)
+}
+
+// ColorCorrector is a renderer that supports ColorProfile
+type ColorCorrector interface {
+	ColorProfile() ColorProfile
+	SetColorProfile(c ColorProfile)
+}
+
+func (s *SoftwareRenderer) ColorProfile() ColorProfile { return s.Palette.profile }
+
+// SetColorProfile changes the colors from the next scanline drawn.
+func (s *SoftwareRenderer) SetColorProfile(c ColorProfile) { s.Palette.setColorProfile(c) }
+
+func (p *ParallelRenderer) ColorProfile() ColorProfile { return p.front.ColorProfile() }
+
+func (p *ParallelRenderer) SetColorProfile(c ColorProfile) {
+	p.front.SetColorProfile(c)
+	p.state.profile = c
+}
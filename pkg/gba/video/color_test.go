@@ -0,0 +1,55 @@
+package video
+
+import "testing"
+
+func TestRawColor(t *testing.T) {
+	p := NewPalette()
+	tests := []struct {
+		color uint16
+		want  [3]byte
+	}{
+		{0x0000, [3]byte{0, 0, 0}},
+		{0x7fff, [3]byte{0xff, 0xff, 0xff}},
+		{0x001f, [3]byte{0xff, 0, 0}},
+		{0x03e0, [3]byte{0, 0xff, 0}},
+		{0x7c00, [3]byte{0, 0, 0xff}},
+		{0x0010 | 0x0001<<5 | 0x000f<<10, [3]byte{0x84, 0x08, 0x7b}},
+	}
+
+	for _, tt := range tests {
+		if got := p.convert16To32(tt.color); got != tt.want {
+			t.Errorf("convert16To32(%04x) = %v, want %v", tt.color, got, tt.want)
+		}
+	}
+}
+
+func TestColorProfiles(t *testing.T) {
+	for c := ColorProfile(0); c < colorProfileCount; c++ {
+		p := NewPalette()
+		p.setColorProfile(c)
+
+		if got := p.convert16To32(0); got != [3]byte{0, 0, 0} {
+			t.Errorf("%s: black = %v", c, got)
+		}
+		for _, v := range p.convert16To32(0x7fff) {
+			if v < 0xf0 {
+				t.Errorf("%s: white = %v", c, p.convert16To32(0x7fff))
+				break
+			}
+		}
+
+		// corrected colors are less saturated than raw
+		red := p.convert16To32(0x001f)
+		if c != ColorRaw && (red[1] == 0 || red[2] == 0) {
+			t.Errorf("%s: red = %v, want mixed channels", c, red)
+		}
+
+		if got, err := ParseColorProfile(c.String()); err != nil || got != c {
+			t.Errorf("ParseColorProfile(%q) = %v, %v", c.String(), got, err)
+		}
+	}
+
+	if _, err := ParseColorProfile("sepia"); err == nil {
+		t.Error("ParseColorProfile(sepia) must fail")
+	}
+}
@@ -0,0 +1,111 @@
+package video
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GhostingMode is the model of the slow response of the GBA LCD.
+//
+// Some games flicker sprites every frame for transparency and motion blur, and they look right only with ghosting.
+type GhostingMode int
+
+const (
+	// GhostingOff shows frames as they are
+	GhostingOff GhostingMode = iota
+	// GhostingMix shows the average of the current and previous frame
+	GhostingMix
+	// GhostingDecay fades the previous frames out exponentially
+	GhostingDecay
+	ghostingModeCount
+)
+
+var ghostingModeNames = [...]string{"off", "mix", "decay"}
+
+func (m GhostingMode) String() string {
+	if m < 0 || m >= ghostingModeCount {
+		return fmt.Sprintf("GhostingMode(%d)", int(m))
+	}
+	return ghostingModeNames[m]
+}
+
+// GhostingModeNames returns the names accepted by ParseGhostingMode
+func GhostingModeNames() []string {
+	return ghostingModeNames[:]
+}
+
+func ParseGhostingMode(name string) (GhostingMode, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, n := range ghostingModeNames {
+		if n == name {
+			return GhostingMode(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ghosting mode %q (available: %s)", name, strings.Join(ghostingModeNames[:], ", "))
+}
+
+// DefaultPersistence is the weight of the previous frames in GhostingDecay
+const DefaultPersistence = 0.5
+
+// Ghosting blends each frame from FinishDraw with the previous frames.
+type Ghosting struct {
+	Mode GhostingMode
+
+	// Persistence is the weight of the previous frames in GhostingDecay (0: no ghosting, 1: never changes)
+	Persistence float64
+
+	prev  ImageData // previous frame for GhostingMix
+	acc   []float32 // blended frames for GhostingDecay
+	out   ImageData
+	valid bool
+}
+
+// Apply returns the frame blended with the previous frames.
+//
+// frame isn't modified, and the returned image is reused on the next call.
+func (g *Ghosting) Apply(frame ImageData) ImageData {
+	if g.Mode == GhostingOff {
+		g.valid = false
+		return frame
+	}
+
+	if len(g.out) != len(frame) {
+		g.prev, g.acc, g.out = make(ImageData, len(frame)), make([]float32, len(frame)), make(ImageData, len(frame))
+		g.valid = false
+	}
+
+	// the first frame has nothing to blend with
+	if !g.valid {
+		copy(g.prev, frame)
+		for i, v := range frame {
+			g.acc[i] = float32(v)
+		}
+		g.valid = true
+	}
+
+	switch g.Mode {
+	case GhostingMix:
+		for i := 0; i < len(frame); i += 4 {
+			for c := i; c < i+3; c++ {
+				g.out[c] = byte((uint16(frame[c]) + uint16(g.prev[c]) + 1) / 2)
+			}
+			g.out[i+3] = frame[i+3]
+		}
+		copy(g.prev, frame)
+	case GhostingDecay:
+		k := float32(g.Persistence)
+		if k < 0 {
+			k = 0
+		} else if k > 1 {
+			k = 1
+		}
+		for i := 0; i < len(frame); i += 4 {
+			for c := i; c < i+3; c++ {
+				g.acc[c] = float32(frame[c])*(1-k) + g.acc[c]*k
+				g.out[c] = byte(g.acc[c] + 0.5)
+			}
+			g.out[i+3] = frame[i+3]
+		}
+	}
+	return g.out
+}
@@ -0,0 +1,31 @@
+package video
+
+import "testing"
+
+func TestGhosting(t *testing.T) {
+	frame := func(v byte) ImageData {
+		return ImageData{v, v, v, 0xff}
+	}
+
+	tests := []struct {
+		mode        GhostingMode
+		persistence float64
+		frames      []byte
+		want        []byte
+	}{
+		{GhostingOff, 0, []byte{0, 200, 0}, []byte{0, 200, 0}},
+		{GhostingMix, 0, []byte{0, 200, 0, 0}, []byte{0, 100, 100, 0}},
+		{GhostingDecay, 0.5, []byte{0, 200, 0, 0}, []byte{0, 100, 50, 25}},
+		{GhostingDecay, 0, []byte{0, 200, 0}, []byte{0, 200, 0}},
+	}
+
+	for _, tt := range tests {
+		g := &Ghosting{Mode: tt.mode, Persistence: tt.persistence}
+		for i, v := range tt.frames {
+			got := g.Apply(frame(v))
+			if got[0] != tt.want[i] || got[1] != tt.want[i] || got[2] != tt.want[i] || got[3] != 0xff {
+				t.Errorf("%s %v: frame %d = %v, want %d", tt.mode, tt.persistence, i, got, tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package video
+
+import "fmt"
+
+// BGInfo is the decoded state of a BG layer for debug tools
+type BGInfo struct {
+	Enabled  bool
+	Priority int
+
+	// byte offsets in VRAM
+	CharBase, ScreenBase uint32
+
+	Color256, Mosaic bool
+
+	// true: Wraparound (affine BGs only)
+	Wrap bool
+
+	// BGnCNT's bit14-15
+	Size uint32
+
+	HOffset, VOffset uint16
+
+	// reference point and rotation/scaling parameters (affine BGs only)
+	RefX, RefY     float64
+	PA, PB, PC, PD float64
+}
+
+// BG returns the state of BG i (0-3)
+func (s *SoftwareRenderer) BG(i int) BGInfo {
+	bg := s.bg[i]
+	return BGInfo{
+		Enabled:    bg.enabled,
+		Priority:   bg.priority,
+		CharBase:   bg.charBase,
+		ScreenBase: bg.screenBase,
+		Color256:   bg.color256 > 0,
+		Mosaic:     bg.mosaic,
+		Wrap:       bg.overflow,
+		Size:       bg.size,
+		HOffset:    bg.x,
+		VOffset:    bg.y,
+		RefX:       bg.refx,
+		RefY:       bg.refy,
+		PA:         bg.dx,
+		PB:         bg.dmx,
+		PC:         bg.dy,
+		PD:         bg.dmy,
+	}
+}
+
+// BGMode returns the current BG Mode (0-5)
+func (s *SoftwareRenderer) BGMode() int { return int(s.bgMode) }
+
+// FrameSelect returns true if Frame 1 is displayed in BG Mode 4, 5
+func (s *SoftwareRenderer) FrameSelect() bool { return s.displayFrameSelect }
+
+// ObjCharacterMapping returns true if OBJ tiles are mapped one dimensionally
+func (s *SoftwareRenderer) ObjCharacterMapping() bool { return s.objCharacterMapping }
+
+// OBJ Mode (OAM atr0's bit10-11)
+const (
+	ObjNormal = iota
+	ObjSemiTransparent
+	ObjWindow
+)
+
+// ObjInfo is the decoded attributes of an OBJ for debug tools
+type ObjInfo struct {
+	Index int
+
+	// x is 0-511, y is 0-255
+	X, Y uint16
+
+	Width, Height uint16
+
+	Affine, DoubleSize, Disabled bool
+	Mode                         int
+	Mosaic, Color256             bool
+	HFlip, VFlip                 bool
+	Priority                     int
+
+	// tile number (0-1023)
+	Tile uint32
+
+	// palette bank (0-15) for 16 colors
+	Palette int
+
+	// rotation/scaling parameter group (0-31) and its matrix
+	AffineParam int
+	Matrix      Scalerot
+}
+
+// Obj returns the attributes of OBJ i (0-127)
+func (o *OAM) Obj(i int) ObjInfo {
+	obj := o.objs[i]
+	return ObjInfo{
+		Index:       i,
+		X:           obj.x,
+		Y:           obj.y,
+		Width:       obj.cachedWidth,
+		Height:      obj.cachedHeight,
+		Affine:      obj.scalerot,
+		DoubleSize:  obj.doublesize,
+		Disabled:    obj.disable,
+		Mode:        int(obj.mode >> 4),
+		Mosaic:      obj.mosaic,
+		Color256:    obj.color256,
+		HFlip:       obj.hflip,
+		VFlip:       obj.vflip,
+		Priority:    obj.priority,
+		Tile:        obj.tileBase,
+		Palette:     int(obj.palette >> 4),
+		AffineParam: int(obj.scalerotParam),
+		Matrix:      o.scalerot[obj.scalerotParam],
+	}
+}
+
+func (o ObjInfo) String() string {
+	mode := [4]string{"normal", "semi", "window", "prohibited"}[o.Mode&3]
+	colors := "16"
+	if o.Color256 {
+		colors = "256"
+	}
+
+	str := fmt.Sprintf("OBJ%03d x:%3d y:%3d %2dx%-2d tile:%4d pal:%2d prio:%d colors:%s mode:%s", o.Index, o.X, o.Y, o.Width, o.Height, o.Tile, o.Palette, o.Priority, colors, mode)
+	switch {
+	case o.Affine:
+		str += fmt.Sprintf(" affine:%d %v", o.AffineParam, o.Matrix)
+		if o.DoubleSize {
+			str += " double"
+		}
+	case o.Disabled:
+		str += " disabled"
+	default:
+		if o.HFlip {
+			str += " hflip"
+		}
+		if o.VFlip {
+			str += " vflip"
+		}
+	}
+	if o.Mosaic {
+		str += " mosaic"
+	}
+	return str
+}
@@ -78,6 +78,10 @@ func (o *Obj) drawScanlineNormal(backing *Backing, y uint32, yOff int32, start,
 	totalWidth := o.cachedWidth
 	underflow, offset := uint16(0), uint16(0)
 	if o.x < HORIZONTAL_PIXELS {
+		if o.x >= end {
+			// OBJ starts after the range (e.g. window)
+			return
+		}
 		underflow, offset = 0, o.x
 		if o.x < start {
 			underflow = start - o.x
@@ -94,6 +98,10 @@ func (o *Obj) drawScanlineNormal(backing *Backing, y uint32, yOff int32, start,
 			totalWidth = end
 		}
 	}
+	if underflow >= o.cachedWidth {
+		// OBJ ends before the range
+		return
+	}
 
 	localY := uint32(int32(y) - yOff)
 	if o.vflip {
@@ -183,6 +191,9 @@ func (o *Obj) drawScanlineAffine(backing *Backing, y uint16, yOff int32, start,
 
 	underflow, offset := uint16(0), uint16(0)
 	if o.x < HORIZONTAL_PIXELS {
+		if o.x >= end {
+			return
+		}
 		if o.x < start {
 			underflow = start - o.x
 			offset = start
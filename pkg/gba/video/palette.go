@@ -22,6 +22,9 @@ type Palette struct {
 	blendY            float64
 
 	mode PaletteMode
+
+	profile ColorProfile
+	table   *colorTable
 }
 
 func (p *Palette) String() string {
@@ -44,6 +47,7 @@ func NewPalette() *Palette {
 		adjustedColors:    adjustedColors,
 		passthroughColors: passthroughColors,
 		blendY:            1,
+		table:             lookupColorTable(ColorRaw),
 	}
 }
 
@@ -82,11 +86,12 @@ func (p *Palette) Store32(offset uint32, value uint32) {
 func (p *Palette) invalidatePage(addr uint32) { return }
 
 func (p *Palette) convert16To32(value uint16) [3]byte {
-	r := (value & 0x001f) << 3
-	g := (value & 0x03e0) >> 2
-	b := (value & 0x7c00) >> 7
+	return p.table[value&0x7fff]
+}
 
-	return [3]byte{byte(r), byte(g), byte(b)}
+func (p *Palette) setColorProfile(c ColorProfile) {
+	p.profile = c
+	p.table = lookupColorTable(c)
 }
 
 func (p *Palette) mix(aWeight float64, aColor uint16, bWeight float64, bColor uint16) uint16 {
@@ -0,0 +1,295 @@
+package video
+
+import (
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+// lcdRegisters is the number of halfword LCD registers given to WriteRegister (0x0400_0000-0x0400_005f)
+const lcdRegisters = 0x30
+
+const (
+	vramPageSize = 0x400 // bytes
+	vramPages    = 0x18000 / vramPageSize
+)
+
+// vramPage is an immutable copy of 1KB of VRAM
+type vramPage [vramPageSize / 2]uint16
+
+type vramSnapshot [vramPages]*vramPage
+
+// paletteSnapshot is an immutable copy of BG and OBJ palettes
+type paletteSnapshot [2][0x100]uint16
+
+// oamSnapshot is an immutable copy of OAM and the decoded OBJ attributes
+type oamSnapshot struct {
+	raw      [0x200]uint16
+	objs     [128]Obj
+	scalerot [32]Scalerot
+}
+
+// lineState is the PPU state at the start of a scanline.
+//
+// Memory snapshots are shared by the scanlines until palette, VRAM or OAM is written. Only the written VRAM pages are copied.
+type lineState struct {
+	y uint16
+
+	// the last values given to WriteRegister, and which of them are written
+	regs    [lcdRegisters]uint32
+	written uint64
+
+	// internal reference points of BG2 and BG3
+	sx, sy [2]float64
+
+	mask    LayerMask
+	profile ColorProfile
+
+	vram    *vramSnapshot
+	palette *paletteSnapshot
+	oam     *oamSnapshot
+}
+
+// ParallelRenderer renders scanlines on a worker pool.
+//
+// Each scanline is sent with a snapshot of the PPU state to one worker, which applies the differences from the last scanline it drew.
+// Workers never see the writes themselves, so the cost of the state doesn't grow with the number of workers.
+//
+// Scanlines are drawn at once, so mid-scanline rendering isn't supported.
+type ParallelRenderer struct {
+	// front receives all writes and serves reads and save states
+	front *SoftwareRenderer
+
+	jobs []chan *lineState
+	wg   sync.WaitGroup
+
+	// state of the next scanline, and the memory written since its snapshots
+	state        lineState
+	dirtyPages   [vramPages]bool
+	vramDirty    bool
+	paletteDirty bool
+	oamDirty     bool
+
+	pixelData ImageData
+}
+
+// NewParallelRenderer starts n workers. If n < 1, it starts one worker per CPU.
+func NewParallelRenderer(n int) *ParallelRenderer {
+	if n < 1 {
+		n = runtime.NumCPU()
+	}
+
+	p := &ParallelRenderer{
+		front:     NewSoftwareRenderer(),
+		pixelData: make(ImageData, HORIZONTAL_PIXELS*VERTICAL_PIXELS*4),
+	}
+	p.state.vram = &vramSnapshot{}
+	zero := &vramPage{}
+	for i := range p.state.vram {
+		p.state.vram[i] = zero
+	}
+	p.state.palette = p.snapshotPalette()
+	p.state.oam = p.snapshotOAM()
+
+	for i := 0; i < n; i++ {
+		w := &lineWorker{r: NewSoftwareRenderer(), applied: p.state}
+		w.r.setBacking(p.pixelData)
+		ch := make(chan *lineState, VERTICAL_PIXELS)
+		p.jobs = append(p.jobs, ch)
+		go p.work(w, ch)
+	}
+	return p
+}
+
+// lineWorker draws scanlines with its own renderer
+type lineWorker struct {
+	r *SoftwareRenderer
+
+	// the state of the renderer
+	applied lineState
+}
+
+func (p *ParallelRenderer) work(w *lineWorker, ch chan *lineState) {
+	for st := range ch {
+		w.apply(st)
+		w.r.DrawScanline(st.y)
+		p.wg.Done()
+	}
+}
+
+// apply brings the renderer to the state of the scanline
+func (w *lineWorker) apply(st *lineState) {
+	r, prev := w.r, &w.applied
+
+	if st.vram != prev.vram {
+		for i, page := range st.vram {
+			if page != prev.vram[i] {
+				copy(r.VRAM.vram[i*len(page):], page[:])
+			}
+		}
+	}
+	if st.palette != prev.palette {
+		for i := range st.palette {
+			for j, c := range st.palette[i] {
+				if c != prev.palette[i][j] {
+					r.Palette.Store16(uint32(i*0x200+j*2), c)
+				}
+			}
+		}
+	}
+	if st.oam != prev.oam {
+		copy(r.OAM.oam, st.oam.raw[:])
+		for i, obj := range r.OAM.objs {
+			*obj = st.oam.objs[i]
+			obj.oam = r.OAM
+		}
+		r.OAM.scalerot = st.oam.scalerot
+	}
+
+	if st.mask != prev.mask {
+		r.SetLayerMask(st.mask)
+	}
+	if st.profile != prev.profile {
+		r.SetColorProfile(st.profile)
+	}
+	for i, v := range st.regs {
+		bit := uint64(1) << i
+		if st.written&bit != 0 && (prev.written&bit == 0 || v != prev.regs[i]) {
+			r.WriteRegister(ram.DISPCNT+uint32(i)*2, v)
+		}
+	}
+
+	// after the registers, because writing BG2X-BG3Y resets them
+	for i, bg := range r.bg[2:] {
+		bg.sx, bg.sy = st.sx[i], st.sy[i]
+	}
+
+	w.applied = *st
+}
+
+// Close stops the workers. The renderer can't be used after this.
+func (p *ParallelRenderer) Close() {
+	p.wg.Wait()
+	for _, ch := range p.jobs {
+		close(ch)
+	}
+}
+
+// Front returns the renderer that holds the latest registers and video memory.
+//
+// It never draws, so it is only for inspection.
+func (p *ParallelRenderer) Front() *SoftwareRenderer { return p.front }
+
+func (p *ParallelRenderer) WriteRegister(addr uint32, value uint32) {
+	p.front.WriteRegister(addr, value)
+	if i := (addr - ram.DISPCNT) / 2; i < lcdRegisters {
+		p.state.regs[i] = value
+		p.state.written |= 1 << i
+	}
+}
+
+func (p *ParallelRenderer) Load32(addr uint32) uint32 { return p.front.Load32(addr) }
+
+func (p *ParallelRenderer) Store16(addr uint32, value uint16) {
+	p.front.Store16(addr, value)
+	p.touch(addr)
+}
+
+func (p *ParallelRenderer) Store32(addr uint32, value uint32) {
+	p.front.Store32(addr, value)
+	p.touch(addr)
+}
+
+// touch marks the memory at addr as written
+func (p *ParallelRenderer) touch(addr uint32) {
+	switch {
+	case ram.Palette(addr):
+		p.paletteDirty = true
+	case ram.VRAM(addr):
+		p.dirtyPages[ram.VRAMOffset(addr)/vramPageSize] = true
+		p.vramDirty = true
+	case ram.OAM(addr):
+		p.oamDirty = true
+	}
+}
+
+// snapshotMemory replaces the snapshots of the written memory
+func (p *ParallelRenderer) snapshotMemory() {
+	if p.vramDirty {
+		vram := *p.state.vram
+		for i, dirty := range p.dirtyPages {
+			if dirty {
+				page := &vramPage{}
+				copy(page[:], p.front.VRAM.vram[i*len(page):])
+				vram[i] = page
+				p.dirtyPages[i] = false
+			}
+		}
+		p.state.vram, p.vramDirty = &vram, false
+	}
+	if p.paletteDirty {
+		p.state.palette, p.paletteDirty = p.snapshotPalette(), false
+	}
+	if p.oamDirty {
+		p.state.oam, p.oamDirty = p.snapshotOAM(), false
+	}
+}
+
+func (p *ParallelRenderer) snapshotPalette() *paletteSnapshot {
+	s := &paletteSnapshot{}
+	copy(s[0][:], p.front.Palette.colors[0])
+	copy(s[1][:], p.front.Palette.colors[1])
+	return s
+}
+
+func (p *ParallelRenderer) snapshotOAM() *oamSnapshot {
+	o := p.front.OAM
+	s := &oamSnapshot{scalerot: o.scalerot}
+	copy(s.raw[:], o.oam)
+	for i, obj := range o.objs {
+		s.objs[i] = *obj
+	}
+	return s
+}
+
+// DrawScanline sends scanline y with the current state to a worker and returns without waiting for it.
+func (p *ParallelRenderer) DrawScanline(y uint16) {
+	p.snapshotMemory()
+	st := p.state
+	st.y = y
+	for i, bg := range p.front.bg[2:] {
+		st.sx[i], st.sy[i] = bg.sx, bg.sy
+	}
+	if !p.front.forcedBlank {
+		p.front.advanceAffine()
+	}
+
+	p.wg.Add(1)
+	p.jobs[int(y)%len(p.jobs)] <- &st
+}
+
+func (p *ParallelRenderer) StartDraw() {}
+
+// FinishDraw waits for all the scanlines sent so far.
+func (p *ParallelRenderer) FinishDraw() ImageData {
+	p.front.FinishDraw()
+	p.wg.Wait()
+	return p.pixelData
+}
+
+func (p *ParallelRenderer) SaveState(w io.Writer) error { return p.front.SaveState(w) }
+
+// LoadState loads video memory into the front renderer, and the next scanline takes snapshots of all of it.
+func (p *ParallelRenderer) LoadState(r io.Reader) error {
+	if err := p.front.LoadState(r); err != nil {
+		return err
+	}
+
+	for i := range p.dirtyPages {
+		p.dirtyPages[i] = true
+	}
+	p.vramDirty, p.paletteDirty, p.oamDirty = true, true, true
+	return nil
+}
@@ -0,0 +1,144 @@
+package video
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+var testRegisters = []uint32{
+	ram.BG0CNT, ram.BG1CNT, ram.BG2CNT, ram.BG3CNT,
+	ram.BG0HOFS, ram.BG0VOFS, ram.BG1HOFS, ram.BG1VOFS,
+	ram.BG2HOFS, ram.BG2VOFS, ram.BG3HOFS, ram.BG3VOFS,
+	ram.BG2PA, ram.BG2PB, ram.BG2PC, ram.BG2PD,
+	ram.BG3PA, ram.BG3PB, ram.BG3PC, ram.BG3PD,
+	ram.WIN0H, ram.WIN1H, ram.WIN0V, ram.WIN1V, ram.WININ, ram.WINOUT,
+	ram.BLDCNT, ram.BLDALPHA, ram.BLDY, ram.MOSAIC,
+}
+
+// writeRandom writes the same random register and memory values into all renderers
+func writeRandom(rng *rand.Rand, rs []Renderer, registers, halfwords int) {
+	write := func(addr, value uint32) {
+		for _, r := range rs {
+			r.WriteRegister(addr, value)
+		}
+	}
+	store := func(addr uint32, value uint16) {
+		for _, r := range rs {
+			r.Store16(addr, value)
+		}
+	}
+
+	for i := 0; i < registers; i++ {
+		switch n := rng.Intn(len(testRegisters) + 4); {
+		case n < len(testRegisters):
+			write(testRegisters[n], uint32(rng.Intn(0x10000)))
+		case n == len(testRegisters):
+			// forced blank is rare
+			dispcnt := uint32(rng.Intn(6)) | uint32(rng.Intn(0x100))<<8 | uint32(rng.Intn(8))<<4
+			if rng.Intn(16) == 0 {
+				dispcnt |= 0x80
+			}
+			write(ram.DISPCNT, dispcnt)
+		default:
+			refs := []uint32{ram.BG2X, ram.BG2Y, ram.BG3X, ram.BG3Y}
+			write(refs[rng.Intn(len(refs))], uint32(rng.Intn(0x1000_0000)))
+		}
+	}
+
+	for i := 0; i < halfwords; i++ {
+		value := uint16(rng.Intn(0x10000))
+		switch rng.Intn(3) {
+		case 0:
+			store(0x0500_0000+uint32(rng.Intn(0x200))*2, value)
+		case 1:
+			store(0x0600_0000+uint32(rng.Intn(0xc000))*2, value)
+		case 2:
+			ofs := uint32(rng.Intn(0x200)) * 2
+			switch ofs % 8 {
+			case 0:
+				// no OBJ mosaic, prohibited mode and shape
+				value &= 0xaeff
+			case 4:
+				// keep OBJ tiles in VRAM
+				value &= 0xf1ff
+			}
+			store(0x0700_0000+ofs, value)
+		}
+	}
+}
+
+func TestParallelRendererMatchesSoftwareRenderer(t *testing.T) {
+	single := NewSoftwareRenderer()
+	parallel := NewParallelRenderer(4)
+	defer parallel.Close()
+	rs := []Renderer{single, parallel}
+
+	rng := rand.New(rand.NewSource(1))
+	writeRandom(rng, rs, 64, 0x10000)
+
+	for frame := 0; frame < 8; frame++ {
+		mask := LayerMask(rng.Intn(int(HideBlend) << 1))
+		profile := ColorProfile(rng.Intn(int(colorProfileCount)))
+		for _, r := range rs {
+			r.(LayerMasker).SetLayerMask(mask)
+			r.(ColorCorrector).SetColorProfile(profile)
+			r.StartDraw()
+		}
+
+		for y := uint16(0); y < VERTICAL_PIXELS; y++ {
+			if rng.Intn(4) == 0 {
+				writeRandom(rng, rs, 4, 16)
+			}
+			for _, r := range rs {
+				r.DrawScanline(y)
+			}
+		}
+
+		want, got := single.FinishDraw(), parallel.FinishDraw()
+		for y := 0; y < VERTICAL_PIXELS; y++ {
+			row := want[y*HORIZONTAL_PIXELS*4 : (y+1)*HORIZONTAL_PIXELS*4]
+			if !bytes.Equal(row, got[y*HORIZONTAL_PIXELS*4:(y+1)*HORIZONTAL_PIXELS*4]) {
+				t.Fatalf("frame %d: scanline %d differs", frame, y)
+			}
+		}
+
+		// VBlank
+		writeRandom(rng, rs, 16, 0x400)
+	}
+}
+
+// benchmarkFrames draws frames with a few register and memory writes on each scanline
+func benchmarkFrames(b *testing.B, r Renderer) {
+	rng := rand.New(rand.NewSource(1))
+	rs := []Renderer{r}
+	writeRandom(rng, rs, 64, 0x10000)
+	r.WriteRegister(ram.DISPCNT, 0x1f40) // mode 0, all BGs and OBJ
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.StartDraw()
+		for y := uint16(0); y < VERTICAL_PIXELS; y++ {
+			writeRandom(rng, rs, 0, 2) // e.g. HBlank DMA
+			r.DrawScanline(y)
+		}
+		r.FinishDraw()
+		writeRandom(rng, rs, 0, 0x200) // VBlank updates
+	}
+}
+
+func BenchmarkSoftwareRenderer(b *testing.B) {
+	benchmarkFrames(b, NewSoftwareRenderer())
+}
+
+func BenchmarkParallelRenderer(b *testing.B) {
+	for _, n := range []int{2, 4, 8} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			p := NewParallelRenderer(n)
+			defer p.Close()
+			benchmarkFrames(b, p)
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package video
 
 import (
+	"encoding/binary"
+	"io"
 	"math"
 	"sort"
 
+	"github.com/pokemium/magia/pkg/gba/ram"
 	"github.com/pokemium/magia/pkg/util"
 )
 
@@ -117,11 +120,25 @@ type SoftwareRenderer struct {
 	bgModes      [6](func(backing *Backing, bg *BGLayer, start uint32, end uint32))
 	objwinActive bool
 	drawLayers   Layers
+	// BG priority or layer enable bits are written, so drawLayers must be sorted before drawing
+	layersDirty  bool
 	alphaEnabled bool
 	scanline     Backing
 
 	sharedMap SharedMap
 	pixelData ImageData
+
+	// pixels [rangeStart, rangeEnd) of the scanline are being drawn
+	rangeStart, rangeEnd uint32
+
+	// mid-scanline rendering has drawn pixels [0, drawnX) of the current scanline
+	drawnX uint32
+
+	// layers hidden regardless of DISPCNT and BLDCNT
+	layerMask LayerMask
+
+	// DISPCNT and BLDCNT written by the game
+	dispcnt, bldcnt uint16
 }
 
 func NewSoftwareRenderer() *SoftwareRenderer {
@@ -136,6 +153,7 @@ func NewSoftwareRenderer() *SoftwareRenderer {
 		objMosaicX:  1,
 		objMosaicY:  1,
 		Vcount:      0,
+		dispcnt:     0x80,
 	}
 	s.drawBackdrop = NewBackdrop(s)
 
@@ -193,6 +211,7 @@ func NewSoftwareRenderer() *SoftwareRenderer {
 		s.objwinLayer,
 		s.drawBackdrop,
 	}
+	s.layersDirty = true
 
 	s.scanline = Backing{
 		color:   make([]uint16, HORIZONTAL_PIXELS),
@@ -216,8 +235,70 @@ func (s *SoftwareRenderer) setBacking(backing ImageData) {
 	}
 }
 
+// WriteRegister applies LCD IO register write
+func (s *SoftwareRenderer) WriteRegister(addr uint32, value uint32) {
+	val := uint16(value)
+	switch addr {
+	case ram.DISPCNT:
+		s.writeDisplayControl(val)
+	case ram.BG0CNT, ram.BG1CNT, ram.BG2CNT, ram.BG3CNT:
+		s.writeBackgroundControl(uint16((addr-ram.BG0CNT)/2), val)
+	case ram.BG0HOFS, ram.BG1HOFS, ram.BG2HOFS, ram.BG3HOFS:
+		s.writeBackgroundHOffset(uint16((addr-ram.BG0HOFS)/4), val)
+	case ram.BG0VOFS, ram.BG1VOFS, ram.BG2VOFS, ram.BG3VOFS:
+		s.writeBackgroundVOffset(uint16((addr-ram.BG0VOFS)/4), val)
+	case ram.BG2X:
+		s.writeBackgroundRefX(2, value)
+	case ram.BG2Y:
+		s.writeBackgroundRefY(2, value)
+	case ram.BG3X:
+		s.writeBackgroundRefX(3, value)
+	case ram.BG3Y:
+		s.writeBackgroundRefY(3, value)
+	case ram.BG2PA:
+		s.writeBackgroundParamA(2, val)
+	case ram.BG2PB:
+		s.writeBackgroundParamB(2, val)
+	case ram.BG2PC:
+		s.writeBackgroundParamC(2, val)
+	case ram.BG2PD:
+		s.writeBackgroundParamD(2, val)
+	case ram.BG3PA:
+		s.writeBackgroundParamA(3, val)
+	case ram.BG3PB:
+		s.writeBackgroundParamB(3, val)
+	case ram.BG3PC:
+		s.writeBackgroundParamC(3, val)
+	case ram.BG3PD:
+		s.writeBackgroundParamD(3, val)
+	case ram.WIN0H:
+		s.writeWin0H(val)
+	case ram.WIN1H:
+		s.writeWin1H(val)
+	case ram.WIN0V:
+		s.writeWin0V(val)
+	case ram.WIN1V:
+		s.writeWin1V(val)
+	case ram.WININ:
+		s.writeWinIn(val)
+	case ram.WINOUT:
+		s.writeWinOut(val)
+	case ram.BLDCNT:
+		s.writeBlendControl(val)
+	case ram.BLDALPHA:
+		s.writeBlendAlpha(val)
+	case ram.BLDY:
+		s.writeBlendY(val)
+	case ram.MOSAIC:
+		s.writeMosaic(val)
+	}
+}
+
 // DISPCNT
 func (s *SoftwareRenderer) writeDisplayControl(value uint16) {
+	s.dispcnt = value
+	value &^= s.layerMask.displayControlMask()
+
 	s.bgMode = value & 0b0111
 	s.displayFrameSelect = util.Bit(value, 4)
 	s.hblankIntervalFree = util.Bit(value, 5)
@@ -228,10 +309,11 @@ func (s *SoftwareRenderer) writeDisplayControl(value uint16) {
 	s.bg[1].enabled = util.Bit(value, 9)
 	s.bg[2].enabled = util.Bit(value, 10)
 	s.bg[3].enabled = util.Bit(value, 11)
-	s.objLayers[0].enabled = util.Bit(value, 12)
-	s.objLayers[1].enabled = util.Bit(value, 12)
-	s.objLayers[2].enabled = util.Bit(value, 12)
-	s.objLayers[3].enabled = util.Bit(value, 12)
+	objEnabled := util.Bit(value, 12) && s.layerMask&HideOBJ == 0
+	s.objLayers[0].enabled = objEnabled
+	s.objLayers[1].enabled = objEnabled
+	s.objLayers[2].enabled = objEnabled
+	s.objLayers[3].enabled = objEnabled
 
 	s.win0 = util.Bit(value, 13)
 	s.win1 = util.Bit(value, 14)
@@ -264,16 +346,16 @@ func (s *SoftwareRenderer) writeBackgroundControl(bg, value uint16) {
 	bgData.charBase = (uint32(value) & 0x000c) << 12
 	bgData.mosaic = util.Bit(value, 6)
 
+	// the bit is kept in any BG Mode, so BG2 and BG3 use it when they become text BGs in BG Mode 0.
+	// Affine BGs ignore it, because they are always 256-color.
 	bgData.color256 &= ^uint16(0x0080)
-	if bg < 2 || s.bgMode == 0 {
-		bgData.color256 |= value & 0x0080
-	}
+	bgData.color256 |= value & 0x0080
 
 	bgData.screenBase = (uint32(value) & 0x1f00) * 8
 	bgData.overflow = util.Bit(value, 13)
 	bgData.size = (uint32(value) & 0xc000) >> 14
 
-	sort.Sort(&s.drawLayers)
+	s.layersDirty = true
 }
 
 // BGnHOFS
@@ -360,6 +442,11 @@ func (s *SoftwareRenderer) writeWinOut(value uint16) {
 }
 
 func (s *SoftwareRenderer) writeBlendControl(value uint16) {
+	s.bldcnt = value
+	if s.layerMask&HideBlend != 0 {
+		value = 0
+	}
+
 	s.target1[0] = util.BoolToU8(util.Bit(value, 0)) * TARGET1_MASK
 	s.target1[1] = util.BoolToU8(util.Bit(value, 1)) * TARGET1_MASK
 	s.target1[2] = util.BoolToU8(util.Bit(value, 2)) * TARGET1_MASK
@@ -451,7 +538,7 @@ func (s *SoftwareRenderer) resetLayers() {
 		s.bg[3].enabled = false
 	}
 
-	sort.Sort(&s.drawLayers)
+	s.layersDirty = true
 }
 
 // accessMapMode0 fetch tile info from BG map
@@ -789,18 +876,100 @@ func (s *SoftwareRenderer) DrawScanline(y uint16) {
 	s.prepareScanline(backing)
 	s.Vcount = y
 
+	s.drawLayersRange(backing, y, 0, HORIZONTAL_PIXELS)
+	s.advanceAffine()
+	s.finishScanline(backing, 0, HORIZONTAL_PIXELS)
+}
+
+// BeginScanline starts mid-scanline rendering.
+//
+// The scanline is drawn in chunks by DrawScanlineTo, so register writes during HDraw take effect from the right pixel.
+func (s *SoftwareRenderer) BeginScanline(y uint16) {
+	s.Vcount = y
+	s.drawnX = 0
+	s.prepareScanline(&s.scanline)
+}
+
+// DrawScanlineTo draws the current scanline until x (exclusive) with the current registers.
+func (s *SoftwareRenderer) DrawScanlineTo(x uint32) {
+	if x > HORIZONTAL_PIXELS {
+		x = HORIZONTAL_PIXELS
+	}
+	if x <= s.drawnX {
+		return
+	}
+
+	start := s.drawnX
+	s.drawnX = x
+	if s.forcedBlank {
+		xx := (uint32(s.Vcount)*HORIZONTAL_PIXELS + start) * 4
+		for i := start; i < x; i++ {
+			s.pixelData[xx], s.pixelData[xx+1], s.pixelData[xx+2] = 0xff, 0xff, 0xff
+			xx += 4
+		}
+		return
+	}
+
+	s.drawLayersRange(&s.scanline, s.Vcount, start, x)
+	s.finishScanline(&s.scanline, start, x)
+}
+
+// EndScanline draws the rest of the current scanline
+func (s *SoftwareRenderer) EndScanline() {
+	s.DrawScanlineTo(HORIZONTAL_PIXELS)
+	if !s.forcedBlank {
+		s.advanceAffine()
+	}
+}
+
+// drawLayer draws layer in [start, end) clipped by the range being drawn now
+func (s *SoftwareRenderer) drawLayer(layer Layer, backing *Backing, start, end uint32) {
+	if start < s.rangeStart {
+		start = s.rangeStart
+	}
+	if end > s.rangeEnd {
+		end = s.rangeEnd
+	}
+	if start < end {
+		layer.drawScanline(backing, start, end)
+	}
+}
+
+// advanceAffine moves the reference point of the enabled affine BGs to the next scanline
+func (s *SoftwareRenderer) advanceAffine() {
+	for _, l := range s.bg {
+		if l.Enabled() {
+			l.sx += l.dmx
+			l.sy += l.dmy
+		}
+	}
+}
+
+// drawLayersRange draws all layers on pixels [rangeStart, rangeEnd) of scanline y
+//
+// Layers are sorted here, so that writes between the chunks of a scanline reorder the layers for the rest of it.
+func (s *SoftwareRenderer) drawLayersRange(backing *Backing, y uint16, rangeStart, rangeEnd uint32) {
+	s.rangeStart, s.rangeEnd = rangeStart, rangeEnd
+	if s.layersDirty {
+		sort.Sort(&s.drawLayers)
+		s.layersDirty = false
+	}
+
 	for i := 0; i < len(s.drawLayers); i++ {
 		layer := s.drawLayers[i]
 		idx := layer.Index()
 		if !layer.Enabled() {
 			continue
 		}
+		if _, ok := layer.(*BGLayer); ok && s.layerMask.hidesBG(idx) {
+			continue
+		}
 
 		s.objwinActive = false
 		if !s.win0 && !s.win1 && !s.objwin {
 			// no window
 			s.setBlendEnabled(idx, s.target1[idx] > 0, s.blendMode)
-			layer.drawScanline(backing, 0, HORIZONTAL_PIXELS)
+			s.drawLayer(layer, backing, 0, HORIZONTAL_PIXELS)
 		} else {
 			// use window
 			firstStart, firstEnd := uint16(0), uint16(HORIZONTAL_PIXELS)
@@ -810,7 +979,7 @@ func (s *SoftwareRenderer) DrawScanline(y uint16) {
 				// inner window0
 				if s.windows[0].enabled[idx] {
 					s.setBlendEnabled(idx, s.windows[0].special && s.target1[idx] > 0, s.blendMode)
-					layer.drawScanline(backing, uint32(s.win0Left), uint32(s.win0Right))
+					s.drawLayer(layer, backing, uint32(s.win0Left), uint32(s.win0Right))
 				}
 
 				firstStart = uint16(math.Max(float64(firstStart), float64(s.win0Left)))
@@ -826,10 +995,10 @@ func (s *SoftwareRenderer) DrawScanline(y uint16) {
 
 					if !s.windows[0].enabled[idx] && (s.win1Left < firstStart || s.win1Right < lastStart) {
 						// We've been cut in two by window 0!
-						layer.drawScanline(backing, uint32(s.win1Left), uint32(firstStart))
-						layer.drawScanline(backing, uint32(lastEnd), uint32(s.win1Right))
+						s.drawLayer(layer, backing, uint32(s.win1Left), uint32(firstStart))
+						s.drawLayer(layer, backing, uint32(lastEnd), uint32(s.win1Right))
 					} else {
-						layer.drawScanline(backing, uint32(s.win1Left), uint32(s.win1Right))
+						s.drawLayer(layer, backing, uint32(s.win1Left), uint32(s.win1Right))
 					}
 				}
 
@@ -846,41 +1015,32 @@ func (s *SoftwareRenderer) DrawScanline(y uint16) {
 				s.setBlendEnabled(idx, s.windows[2].special && s.target1[idx] > 0, s.blendMode) // Window 3 handled in pushPixel
 
 				if firstEnd > lastStart {
-					layer.drawScanline(backing, 0, HORIZONTAL_PIXELS)
+					s.drawLayer(layer, backing, 0, HORIZONTAL_PIXELS)
 				} else {
 					if firstEnd != 0 {
-						layer.drawScanline(backing, 0, uint32(firstEnd))
+						s.drawLayer(layer, backing, 0, uint32(firstEnd))
 					}
 					if lastStart < HORIZONTAL_PIXELS {
-						layer.drawScanline(backing, uint32(lastStart), HORIZONTAL_PIXELS)
+						s.drawLayer(layer, backing, uint32(lastStart), HORIZONTAL_PIXELS)
 					}
 					if lastEnd < firstStart {
-						layer.drawScanline(backing, uint32(lastEnd), uint32(firstStart))
+						s.drawLayer(layer, backing, uint32(lastEnd), uint32(firstStart))
 					}
 				}
 			}
 
 			s.setBlendEnabled(LAYER_BACKDROP, (s.target1[LAYER_BACKDROP] > 0 && s.windows[2].special), s.blendMode)
 		}
-
-		if l, ok := layer.(*BGLayer); ok {
-			if l.bg {
-				l.sx += l.dmx
-				l.sy += l.dmy
-			}
-		}
 	}
-
-	s.finishScanline(backing)
 }
 
-// Push backing data into Screen buffer
-func (s *SoftwareRenderer) finishScanline(backing *Backing) {
+// Push backing data on [start, end) into Screen buffer
+func (s *SoftwareRenderer) finishScanline(backing *Backing, start, end uint32) {
 	bd := s.Palette.accessColor(LAYER_BACKDROP, 0)
-	xx := uint32(s.Vcount) * HORIZONTAL_PIXELS * 4
+	xx := (uint32(s.Vcount)*HORIZONTAL_PIXELS + start) * 4
 	isTarget2 := s.target2[LAYER_BACKDROP] > 0
 
-	for x := 0; x < HORIZONTAL_PIXELS; x++ {
+	for x := start; x < end; x++ {
 		sharedColor := [3]byte{}
 		if (backing.stencil[x] & WRITTEN_MASK) > 0 {
 			color := backing.color[x]
@@ -908,3 +1068,79 @@ func (s *SoftwareRenderer) FinishDraw() ImageData {
 	s.bg[3].sy = s.bg[3].refy
 	return s.pixelData
 }
+
+// Load32 reads palette, VRAM or OAM
+func (s *SoftwareRenderer) Load32(addr uint32) uint32 {
+	switch {
+	case ram.Palette(addr):
+		return s.Palette.Load32(ram.PaletteOffset(addr))
+	case ram.VRAM(addr):
+		return s.VRAM.LoadU32(ram.VRAMOffset(addr))
+	case ram.OAM(addr):
+		return s.OAM.LoadU32(ram.OAMOffset(addr))
+	}
+	return 0
+}
+
+// Store16 writes palette, VRAM or OAM
+func (s *SoftwareRenderer) Store16(addr uint32, value uint16) {
+	switch {
+	case ram.Palette(addr):
+		s.Palette.Store16(ram.PaletteOffset(addr), value)
+	case ram.VRAM(addr):
+		s.VRAM.Store16(ram.VRAMOffset(addr), value)
+	case ram.OAM(addr):
+		s.OAM.Store16(ram.OAMOffset(addr), value)
+	}
+}
+
+// Store32 writes palette, VRAM or OAM
+func (s *SoftwareRenderer) Store32(addr uint32, value uint32) {
+	switch {
+	case ram.Palette(addr):
+		s.Palette.Store32(ram.PaletteOffset(addr), value)
+	case ram.VRAM(addr):
+		s.VRAM.Store32(ram.VRAMOffset(addr), value)
+	case ram.OAM(addr):
+		s.OAM.Store32(ram.OAMOffset(addr), value)
+	}
+}
+
+// video memory regions in the order of the state
+var stateRegions = [3]struct{ base, size uint32 }{
+	{0x0500_0000, 0x400},   // Palette
+	{0x0600_0000, 0x18000}, // VRAM
+	{0x0700_0000, 0x400},   // OAM
+}
+
+// SaveState writes palette, VRAM and OAM.
+//
+// LCD registers are owned by Video, so they aren't included.
+func (s *SoftwareRenderer) SaveState(w io.Writer) error {
+	for _, r := range stateRegions {
+		buf := make([]uint16, r.size/2)
+		for i := range buf {
+			buf[i] = uint16(s.Load32(r.base + uint32(i)*2))
+		}
+		if err := binary.Write(w, binary.LittleEndian, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadState reads the state written by SaveState.
+//
+// Memory is restored through Store16, so OAM's decoded attributes are rebuilt too.
+func (s *SoftwareRenderer) LoadState(r io.Reader) error {
+	for _, region := range stateRegions {
+		buf := make([]uint16, region.size/2)
+		if err := binary.Read(r, binary.LittleEndian, buf); err != nil {
+			return err
+		}
+		for i, v := range buf {
+			s.Store16(region.base+uint32(i)*2, v)
+		}
+	}
+	return nil
+}
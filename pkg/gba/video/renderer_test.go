@@ -0,0 +1,141 @@
+package video
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+// newTwoBGRenderer draws BG0 in palette color 1 and BG1 in palette color 2 over the whole screen
+func newTwoBGRenderer() *SoftwareRenderer {
+	r := NewSoftwareRenderer()
+	r.Store16(0x0500_0002, 0x001f)
+	r.Store16(0x0500_0004, 0x03e0)
+	for i := uint32(0); i < 16; i++ {
+		r.Store16(0x0600_0020+i*2, 0x1111) // tile 1
+		r.Store16(0x0600_0040+i*2, 0x2222) // tile 2
+	}
+	for i := uint32(0); i < 32*32; i++ {
+		r.Store16(0x0600_4000+i*2, 1) // BG0 map at screen block 8
+		r.Store16(0x0600_4800+i*2, 2) // BG1 map at screen block 9
+	}
+	return r
+}
+
+type registerWrite struct {
+	addr, value uint32
+}
+
+func writeRegisters(r Renderer, writes []registerWrite) {
+	for _, w := range writes {
+		r.WriteRegister(w.addr, w.value)
+	}
+}
+
+func scanline(r Renderer, y int) []byte {
+	frame := r.FinishDraw()
+	return append([]byte{}, frame[y*HORIZONTAL_PIXELS*4:(y+1)*HORIZONTAL_PIXELS*4]...)
+}
+
+// TestMidScanlineLayerOrder compares a scanline split by register writes with the two halves drawn separately
+func TestMidScanlineLayerOrder(t *testing.T) {
+	base := []registerWrite{
+		{ram.DISPCNT, 0x0300},
+		{ram.BG0CNT, 0x0800},
+		{ram.BG1CNT, 0x0901},
+	}
+	tests := []struct {
+		name   string
+		change []registerWrite
+	}{
+		{"BG0 priority", []registerWrite{{ram.BG0CNT, 0x0802}}},
+		{"swap priorities", []registerWrite{{ram.BG0CNT, 0x0801}, {ram.BG1CNT, 0x0900}}},
+		{"BG0 disable", []registerWrite{{ram.DISPCNT, 0x0200}}},
+	}
+
+	const y, split = 10, 100
+	for _, tt := range tests {
+		before := newTwoBGRenderer()
+		writeRegisters(before, base)
+		before.DrawScanline(y)
+		want := scanline(before, y)
+
+		after := newTwoBGRenderer()
+		writeRegisters(after, base)
+		writeRegisters(after, tt.change)
+		after.DrawScanline(y)
+		wantAfter := scanline(after, y)
+		if bytes.Equal(want, wantAfter) {
+			t.Fatalf("%s: the change doesn't change the scanline", tt.name)
+		}
+		copy(want[split*4:], wantAfter[split*4:])
+
+		r := newTwoBGRenderer()
+		writeRegisters(r, base)
+		r.BeginScanline(y)
+		r.DrawScanlineTo(split)
+		writeRegisters(r, tt.change)
+		r.EndScanline()
+		if got := scanline(r, y); !bytes.Equal(got, want) {
+			for x := 0; x < HORIZONTAL_PIXELS; x++ {
+				if !bytes.Equal(got[x*4:x*4+4], want[x*4:x*4+4]) {
+					t.Errorf("%s: pixel %d differs: got % x, want % x", tt.name, x, got[x*4:x*4+4], want[x*4:x*4+4])
+					break
+				}
+			}
+		}
+	}
+}
+
+// TestBGColor256 checks the color mode of BG2 and BG3 whatever the order of DISPCNT and BGnCNT writes is
+func TestBGColor256(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []registerWrite
+		bg     int
+		want   bool
+	}{
+		{"affine BG2 in mode 1", []registerWrite{{ram.DISPCNT, 1}, {ram.BG2CNT, 0}}, 2, true},
+		{"affine BG3 in mode 2", []registerWrite{{ram.DISPCNT, 2}, {ram.BG3CNT, 0}}, 3, true},
+		{"BG2CNT in mode 1, then mode 0", []registerWrite{{ram.DISPCNT, 1}, {ram.BG2CNT, 0x0080}, {ram.DISPCNT, 0}}, 2, true},
+		{"BG3CNT in mode 2, then mode 0", []registerWrite{{ram.DISPCNT, 2}, {ram.BG3CNT, 0x0080}, {ram.DISPCNT, 0}}, 3, true},
+		{"16-color BG2 after mode 1", []registerWrite{{ram.BG2CNT, 0}, {ram.DISPCNT, 1}, {ram.DISPCNT, 0}}, 2, false},
+		{"16-color BG3 after mode 2", []registerWrite{{ram.DISPCNT, 2}, {ram.BG3CNT, 0}, {ram.DISPCNT, 0}}, 3, false},
+	}
+
+	for _, tt := range tests {
+		r := NewSoftwareRenderer()
+		writeRegisters(r, tt.writes)
+		if got := r.BG(tt.bg).Color256; got != tt.want {
+			t.Errorf("%s: BG%d 256-color is %v, want %v", tt.name, tt.bg, got, tt.want)
+		}
+	}
+}
+
+// TestHiddenAffineBG checks that hiding an affine BG for a few scanlines doesn't stop its reference point
+func TestHiddenAffineBG(t *testing.T) {
+	setup := []registerWrite{
+		{ram.DISPCNT, 0x0401}, // BG Mode 1, BG2
+		{ram.BG2PB, 0x0040},
+		{ram.BG2PD, 0x0100},
+	}
+	want, r := NewSoftwareRenderer(), NewSoftwareRenderer()
+	writeRegisters(want, setup)
+	writeRegisters(r, setup)
+
+	for y := uint16(0); y < 10; y++ {
+		r.SetLayerMask(0)
+		if y >= 2 && y < 6 {
+			r.SetLayerMask(HideBG2)
+		}
+		want.DrawScanline(y)
+		r.DrawScanline(y)
+	}
+	if got, w := r.bg[2], want.bg[2]; got.sx != w.sx || got.sy != w.sy {
+		t.Errorf("reference point is (%v, %v), want (%v, %v)", got.sx, got.sy, w.sx, w.sy)
+	}
+	if !r.BG(2).Enabled {
+		t.Errorf("BG2 enabled by the game should stay enabled while it is hidden")
+	}
+}
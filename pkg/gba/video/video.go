@@ -1,6 +1,9 @@
 package video
 
 import (
+	"bytes"
+	"io"
+
 	"github.com/pokemium/magia/pkg/gba/ram"
 	"github.com/pokemium/magia/pkg/util"
 )
@@ -10,7 +13,7 @@ const DISPSTAT_MASK = 0xff38
 func (v *Video) Load32(addr uint32) uint32 {
 	switch addr {
 	case ram.VCOUNT:
-		return uint32(v.RenderPath.Vcount)
+		return uint32(v.vcount)
 	}
 	return util.LE32(v.IO[ram.IOOffset(addr):])
 }
@@ -35,101 +38,30 @@ func (v *Video) Set8(addr uint32, val byte) {
 
 func (v *Video) Set16(addr uint32, val uint16) {
 	switch addr {
-	case ram.DISPCNT:
-		v.RenderPath.writeDisplayControl(val)
 	case ram.DISPSTAT:
 		val &= DISPSTAT_MASK
-	case ram.BG0CNT:
-		val &= 0xdfff
-		v.RenderPath.writeBackgroundControl(0, val)
-	case ram.BG1CNT:
+	case ram.BG0CNT, ram.BG1CNT:
 		val &= 0xdfff
-		v.RenderPath.writeBackgroundControl(1, val)
-	case ram.BG2CNT:
-		v.RenderPath.writeBackgroundControl(2, val)
-	case ram.BG3CNT:
-		v.RenderPath.writeBackgroundControl(3, val)
-	case ram.BG0HOFS:
-		v.RenderPath.writeBackgroundHOffset(0, val)
-	case ram.BG0VOFS:
-		v.RenderPath.writeBackgroundVOffset(0, val)
-	case ram.BG1HOFS:
-		v.RenderPath.writeBackgroundHOffset(1, val)
-	case ram.BG1VOFS:
-		v.RenderPath.writeBackgroundVOffset(1, val)
-	case ram.BG2HOFS:
-		v.RenderPath.writeBackgroundHOffset(2, val)
-	case ram.BG2VOFS:
-		v.RenderPath.writeBackgroundVOffset(2, val)
-	case ram.BG3HOFS:
-		v.RenderPath.writeBackgroundHOffset(3, val)
-	case ram.BG3VOFS:
-		v.RenderPath.writeBackgroundVOffset(3, val)
-	case ram.BG2X:
-		upper := util.LE16(v.IO[ram.IOOffset(addr)+2:])
-		v.RenderPath.writeBackgroundRefX(2, uint32(upper)<<16|uint32(val))
-	case ram.BG2X + 2:
-		lower := util.LE16(v.IO[ram.IOOffset(addr)-2:])
-		v.RenderPath.writeBackgroundRefX(2, uint32(val)<<16|uint32(lower))
-	case ram.BG2Y:
-		upper := util.LE16(v.IO[ram.IOOffset(addr)+2:])
-		v.RenderPath.writeBackgroundRefY(2, uint32(upper)<<16|uint32(val))
-	case ram.BG2Y + 2:
-		lower := util.LE16(v.IO[ram.IOOffset(addr)-2:])
-		v.RenderPath.writeBackgroundRefY(2, uint32(val)<<16|uint32(lower))
-	case ram.BG2PA:
-		v.RenderPath.writeBackgroundParamA(2, val)
-	case ram.BG2PB:
-		v.RenderPath.writeBackgroundParamB(2, val)
-	case ram.BG2PC:
-		v.RenderPath.writeBackgroundParamC(2, val)
-	case ram.BG2PD:
-		v.RenderPath.writeBackgroundParamD(2, val)
-	case ram.BG3X:
-		upper := util.LE16(v.IO[ram.IOOffset(addr)+2:])
-		v.RenderPath.writeBackgroundRefX(3, uint32(upper)<<16|uint32(val))
-	case ram.BG3X + 2:
-		lower := util.LE16(v.IO[ram.IOOffset(addr)-2:])
-		v.RenderPath.writeBackgroundRefX(3, uint32(val)<<16|uint32(lower))
-	case ram.BG3Y:
+	case ram.BG2X, ram.BG2Y, ram.BG3X, ram.BG3Y:
 		upper := util.LE16(v.IO[ram.IOOffset(addr)+2:])
-		v.RenderPath.writeBackgroundRefY(3, uint32(upper)<<16|uint32(val))
-	case ram.BG3Y + 2:
+		v.RenderPath.WriteRegister(addr, uint32(upper)<<16|uint32(val))
+	case ram.BG2X + 2, ram.BG2Y + 2, ram.BG3X + 2, ram.BG3Y + 2:
 		lower := util.LE16(v.IO[ram.IOOffset(addr)-2:])
-		v.RenderPath.writeBackgroundRefY(3, uint32(val)<<16|uint32(lower))
-	case ram.BG3PA:
-		v.RenderPath.writeBackgroundParamA(3, val)
-	case ram.BG3PB:
-		v.RenderPath.writeBackgroundParamB(3, val)
-	case ram.BG3PC:
-		v.RenderPath.writeBackgroundParamC(3, val)
-	case ram.BG3PD:
-		v.RenderPath.writeBackgroundParamD(3, val)
-	case ram.WIN0H:
-		v.RenderPath.writeWin0H(val)
-	case ram.WIN1H:
-		v.RenderPath.writeWin1H(val)
-	case ram.WIN0V:
-		v.RenderPath.writeWin0V(val)
-	case ram.WIN1V:
-		v.RenderPath.writeWin1V(val)
-	case ram.WININ:
+		v.RenderPath.WriteRegister(addr-2, uint32(val)<<16|uint32(lower))
+	case ram.WININ, ram.WINOUT:
 		val &= 0x3f3f
-		v.RenderPath.writeWinIn(val)
-	case ram.WINOUT:
-		val &= 0x3f3f
-		v.RenderPath.writeWinOut(val)
 	case ram.BLDCNT:
 		val &= 0x7fff
-		v.RenderPath.writeBlendControl(val)
 	case ram.BLDALPHA:
 		val &= 0x1f1f
-		v.RenderPath.writeBlendAlpha(val)
 	case ram.BLDY:
 		val &= 0x001f
-		v.RenderPath.writeBlendY(val)
-	case ram.MOSAIC:
-		v.RenderPath.writeMosaic(val)
+	}
+
+	switch addr {
+	case ram.DISPSTAT, ram.BG2X, ram.BG2Y, ram.BG3X, ram.BG3Y, ram.BG2X + 2, ram.BG2Y + 2, ram.BG3X + 2, ram.BG3Y + 2:
+	default:
+		v.RenderPath.WriteRegister(addr, uint32(val))
 	}
 
 	ofs := ram.IOOffset(addr)
@@ -139,18 +71,9 @@ func (v *Video) Set16(addr uint32, val uint16) {
 
 func (v *Video) Set32(addr uint32, val uint32) {
 	switch addr {
-	case ram.BG2X:
-		val &= 0x0fff_ffff
-		v.RenderPath.writeBackgroundRefX(2, val)
-	case ram.BG2Y:
-		val &= 0x0fff_ffff
-		v.RenderPath.writeBackgroundRefY(2, val)
-	case ram.BG3X:
-		val &= 0x0fff_ffff
-		v.RenderPath.writeBackgroundRefX(3, val)
-	case ram.BG3Y:
+	case ram.BG2X, ram.BG2Y, ram.BG3X, ram.BG3Y:
 		val &= 0x0fff_ffff
-		v.RenderPath.writeBackgroundRefY(3, val)
+		v.RenderPath.WriteRegister(addr, val)
 	default:
 		v.Set16(addr, uint16(val))
 		v.Set16(addr+2, uint16(val>>16))
@@ -163,9 +86,40 @@ func (v *Video) Set32(addr uint32, val uint32) {
 	v.IO[ofs+3] = byte(val >> 24)
 }
 
+// Renderer draws the screen from LCD registers, palette, VRAM and OAM.
+//
+// Alternative PPU backends implement this and are plugged into Video.
+type Renderer interface {
+	// WriteRegister is called when LCD IO register is written.
+	//
+	// addr is the address of the register. BGnX and BGnY receive the whole 28bit value, others receive 16bit value.
+	WriteRegister(addr uint32, value uint32)
+
+	// Load32 and Store16/32 access palette, VRAM and OAM by bus address
+	Load32(addr uint32) uint32
+	Store16(addr uint32, value uint16)
+	Store32(addr uint32, value uint32)
+
+	DrawScanline(y uint16)
+	StartDraw()
+	FinishDraw() ImageData
+
+	SaveState(w io.Writer) error
+	LoadState(r io.Reader) error
+}
+
+// ChunkRenderer can draw a scanline in chunks for pixel-accurate mode
+type ChunkRenderer interface {
+	Renderer
+	BeginScanline(y uint16)
+	DrawScanlineTo(x uint32)
+	EndScanline()
+}
+
 type Video struct {
 	IO         [96]byte
-	RenderPath *SoftwareRenderer
+	RenderPath Renderer
+	vcount     uint16
 }
 
 func NewVideo() *Video {
@@ -174,11 +128,47 @@ func NewVideo() *Video {
 	}
 }
 
+// SetRenderer swaps the renderer.
+//
+// Video memory and LCD registers are copied into the new renderer, so it starts with the current state.
+func (v *Video) SetRenderer(r Renderer) error {
+	var buf bytes.Buffer
+	if err := v.RenderPath.SaveState(&buf); err != nil {
+		return err
+	}
+	if err := r.LoadState(&buf); err != nil {
+		return err
+	}
+
+	v.RenderPath = r
+	for ofs := uint32(0); ofs < uint32(len(v.IO)); ofs += 2 {
+		addr := ram.DISPCNT + ofs
+		switch addr {
+		case ram.DISPSTAT, ram.VCOUNT, ram.BG2X + 2, ram.BG2Y + 2, ram.BG3X + 2, ram.BG3Y + 2:
+			continue
+		case ram.BG2X, ram.BG2Y, ram.BG3X, ram.BG3Y:
+			r.WriteRegister(addr, util.LE32(v.IO[ofs:]))
+		default:
+			r.WriteRegister(addr, uint32(util.LE16(v.IO[ofs:])))
+		}
+	}
+	return nil
+}
+
+// VCount returns the scanline number the LCD is drawing (0-227)
+func (v *Video) VCount() uint16     { return v.vcount }
+func (v *Video) SetVCount(y uint16) { v.vcount = y }
+
 // VBlank returns true if in VBlank
 func (v *Video) VBlank() bool {
 	return util.Bit(uint16(v.IO[ram.IOOffset(ram.DISPSTAT)]), 0)
 }
 
+// HBlank returns true if in HBlank
+func (v *Video) HBlank() bool {
+	return util.Bit(uint16(v.IO[ram.IOOffset(ram.DISPSTAT)]), 1)
+}
+
 func (v *Video) SetVBlank(b bool) {
 	if b {
 		v.IO[ram.IOOffset(ram.DISPSTAT)] = v.IO[ram.IOOffset(ram.DISPSTAT)] | 0b0000_0001
@@ -0,0 +1,56 @@
+package m4a
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Export writes the songs into dir as song-NNN.mid, and the samples of their voicegroups as sample-XXXXXXXX.wav (by address).
+//
+// The list of the songs is written into songs.txt. A song whose MIDI or samples can't be decoded is listed with the error.
+func (e *Engine) Export(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	lines := []string{}
+	written := map[uint32]bool{}
+	for i, s := range e.Songs {
+		line := s.String()
+		if err := writeFile(filepath.Join(dir, fmt.Sprintf("song-%03d.mid", i)), func(w io.Writer) error { return e.WriteMIDI(w, i) }); err != nil {
+			line += " (" + err.Error() + ")"
+		}
+
+		samples, err := e.Samples(i)
+		if err != nil {
+			line += " (samples: " + err.Error() + ")"
+		}
+		lines = append(lines, line)
+		for _, smp := range samples {
+			if written[smp.Addr] {
+				continue
+			}
+			written[smp.Addr] = true
+			if err := writeFile(filepath.Join(dir, fmt.Sprintf("sample-%08x.wav", smp.Addr)), smp.WriteWAV); err != nil {
+				return err
+			}
+		}
+	}
+	return os.WriteFile(filepath.Join(dir, "songs.txt"), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := write(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,217 @@
+// Package m4a finds the songs of Nintendo's MusicPlayer2000 (M4A, also known as Sappy) sound engine in a ROM.
+//
+// Most commercial GBA games use this engine. The songs can be exported as MIDI, their voicegroup samples as WAV,
+// and a song can be started in the running game by writing the music player structures in RAM.
+package m4a
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+// ID_NUMBER is the ident of SoundInfo and MusicPlayerInfo while the engine is idle ("Smsh")
+const ID_NUMBER = 0x68736d53
+
+var ErrNotFound = errors.New("M4A sound engine isn't found")
+
+// Engine is the sound engine found in a ROM. Addresses are GBA addresses (0x08xxxxxx).
+type Engine struct {
+	// SoundMain is the main routine of the engine. It is 0 if the signature isn't found.
+	SoundMain uint32
+
+	// SelectSong is m4aSongNumStart, which refers to the tables
+	SelectSong uint32
+
+	// SongTable is the table of songs (header pointer, music player, 8 bytes each)
+	SongTable uint32
+
+	// PlayerTable is the table of music players (MusicPlayerInfo, tracks, track count, 12 bytes each)
+	PlayerTable uint32
+
+	Songs []Song
+
+	rom rom
+}
+
+// Song is an entry of the song table
+type Song struct {
+	Index  int
+	Header uint32
+
+	// Player is the music player that plays the song
+	Player uint16
+
+	Priority   byte
+	Reverb     byte
+	Voicegroup uint32
+
+	// Tracks are the addresses of the track data
+	Tracks []uint32
+}
+
+func (s Song) String() string {
+	return fmt.Sprintf("song %d: header 0x%08x, player %d, %d tracks, voicegroup 0x%08x, priority %d", s.Index, s.Header, s.Player, len(s.Tracks), s.Voicegroup, s.Priority)
+}
+
+// rom is GamePak0 starting at 0x08000000
+type rom []byte
+
+func (r rom) valid(addr uint32, size int) bool {
+	return ram.GamePak0(addr) && int(ram.GamePak0Offset(addr))+size <= len(r)
+}
+
+func (r rom) u8(addr uint32) (byte, bool) {
+	if !r.valid(addr, 1) {
+		return 0, false
+	}
+	return r[ram.GamePak0Offset(addr)], true
+}
+
+func (r rom) u16(addr uint32) (uint16, bool) {
+	if !r.valid(addr, 2) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint16(r[ram.GamePak0Offset(addr):]), true
+}
+
+func (r rom) u32(addr uint32) (uint32, bool) {
+	if !r.valid(addr, 4) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(r[ram.GamePak0Offset(addr):]), true
+}
+
+// soundMainSignature is the start of SoundMain in THUMB. -1 matches any byte (PC-relative offsets).
+//
+//	ldr r0, =SOUND_INFO_PTR
+//	ldr r0, [r0]
+//	ldr r2, =ID_NUMBER
+//	ldr r3, [r0, #o_SoundInfo_ident]
+//	cmp r2, r3
+//	beq SoundMain_1
+//	bx lr
+//	SoundMain_1: adds r3, #1
+//	str r3, [r0, #o_SoundInfo_ident]
+//	push {r4-r7, lr}
+var soundMainSignature = []int{
+	-1, 0x48, 0x00, 0x68, -1, 0x4a, 0x03, 0x68, 0x9a, 0x42, -1, 0xd0,
+	0x70, 0x47, 0x01, 0x33, 0x03, 0x60, 0xf0, 0xb5,
+}
+
+// selectSongSignature is m4aSongNumStart. The song table pointer is 40 bytes after the start, and the music player table is 36 bytes after.
+var selectSongSignature = []byte{
+	0x00, 0xb5, 0x00, 0x04, 0x07, 0x4a, 0x08, 0x49, 0x40, 0x0b, 0x40, 0x18, 0x83, 0x88, 0x59, 0x00,
+	0xc9, 0x18, 0x89, 0x00, 0x89, 0x18, 0x0a, 0x68, 0x01, 0x68, 0x10, 0x1c, 0x00, 0xf0,
+}
+
+const (
+	selectSongPlayerTable = 36
+	selectSongSongTable   = 40
+)
+
+// Detect scans the ROM for the engine and reads the song table.
+func Detect(src []byte) (*Engine, error) {
+	e := &Engine{rom: rom(src)}
+	e.SoundMain = e.findSoundMain()
+
+	ofs := bytes.Index(src, selectSongSignature)
+	for ofs >= 0 && ofs%2 != 0 {
+		next := bytes.Index(src[ofs+1:], selectSongSignature)
+		if next < 0 {
+			ofs = -1
+			break
+		}
+		ofs += 1 + next
+	}
+	if ofs < 0 {
+		if e.SoundMain != 0 {
+			return nil, fmt.Errorf("SoundMain is at 0x%08x, but the song table isn't found", e.SoundMain)
+		}
+		return nil, ErrNotFound
+	}
+
+	e.SelectSong = 0x0800_0000 + uint32(ofs)
+	songs, ok1 := e.rom.u32(e.SelectSong + selectSongSongTable)
+	players, ok2 := e.rom.u32(e.SelectSong + selectSongPlayerTable)
+	if !ok1 || !ok2 || !e.rom.valid(songs, 8) {
+		return nil, fmt.Errorf("invalid song table pointer after m4aSongNumStart at 0x%08x", e.SelectSong)
+	}
+	e.SongTable, e.PlayerTable = songs, players
+
+	for i := 0; ; i++ {
+		s, ok := e.readSong(i)
+		if !ok {
+			break
+		}
+		e.Songs = append(e.Songs, s)
+	}
+	return e, nil
+}
+
+func (e *Engine) findSoundMain() uint32 {
+	r := e.rom
+	for ofs := 0; ofs+len(soundMainSignature) <= len(r); ofs += 2 {
+		if !matchSignature(r[ofs:], soundMainSignature) {
+			continue
+		}
+
+		// ldr r2, =ID_NUMBER
+		addr := 0x0800_0000 + uint32(ofs)
+		pc := (addr + 4 + 4) &^ 3
+		if id, ok := r.u32(pc + uint32(r[ofs+4])*4); ok && id == ID_NUMBER {
+			return addr
+		}
+	}
+	return 0
+}
+
+func matchSignature(b []byte, sig []int) bool {
+	for i, s := range sig {
+		if s >= 0 && b[i] != byte(s) {
+			return false
+		}
+	}
+	return true
+}
+
+// maxTracks is the number of tracks a music player can have
+const maxTracks = 16
+
+// readSong reads the song i of the table. It returns false at the end of the table.
+func (e *Engine) readSong(i int) (Song, bool) {
+	entry := e.SongTable + uint32(i)*8
+	header, ok1 := e.rom.u32(entry)
+	player, ok2 := e.rom.u16(entry + 4)
+	if !ok1 || !ok2 || !e.rom.valid(header, 8) || player >= 32 {
+		return Song{}, false
+	}
+
+	trackCount, _ := e.rom.u8(header)
+	priority, _ := e.rom.u8(header + 2)
+	reverb, _ := e.rom.u8(header + 3)
+	voicegroup, _ := e.rom.u32(header + 4)
+	if trackCount > maxTracks || (trackCount > 0 && !e.rom.valid(voicegroup, 12)) {
+		return Song{}, false
+	}
+
+	s := Song{
+		Index:      i,
+		Header:     header,
+		Player:     player,
+		Priority:   priority,
+		Reverb:     reverb,
+		Voicegroup: voicegroup,
+	}
+	for t := uint32(0); t < uint32(trackCount); t++ {
+		track, ok := e.rom.u32(header + 8 + t*4)
+		if !ok || !e.rom.valid(track, 1) {
+			return Song{}, false
+		}
+		s.Tracks = append(s.Tracks, track)
+	}
+	return s, true
+}
@@ -0,0 +1,287 @@
+package m4a
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testSoundMain  = 0x100
+	testSelectSong = 0x200
+	testSongTable  = 0x1000
+	testPlayers    = 0x1100
+	testHeader     = 0x2000
+	testTrack      = 0x2100
+	testVoicegroup = 0x3000
+	testWave       = 0x4000
+)
+
+// testROM has a song with a track and a sample
+func testROM() []byte {
+	rom := make([]byte, 0x8000)
+	put32 := func(ofs int, v uint32) { binary.LittleEndian.PutUint32(rom[ofs:], v) }
+
+	for i, b := range soundMainSignature {
+		if b >= 0 {
+			rom[testSoundMain+i] = byte(b)
+		}
+	}
+	rom[testSoundMain+4] = 4 // ldr r2, [pc, #16]
+	put32(testSoundMain+0x18, ID_NUMBER)
+
+	copy(rom[testSelectSong:], selectSongSignature)
+	put32(testSelectSong+selectSongPlayerTable, 0x0800_0000+testPlayers)
+	put32(testSelectSong+selectSongSongTable, 0x0800_0000+testSongTable)
+
+	put32(testSongTable, 0x0800_0000+testHeader)
+	binary.LittleEndian.PutUint16(rom[testSongTable+4:], 1)
+
+	rom[testHeader] = 1   // tracks
+	rom[testHeader+2] = 5 // priority
+	put32(testHeader+4, 0x0800_0000+testVoicegroup)
+	put32(testHeader+8, 0x0800_0000+testTrack)
+
+	copy(rom[testTrack:], []byte{
+		0xbb, 60, // TEMPO 120
+		0xbd, 0, // VOICE 0
+		0xbe, 100, // VOL 100
+		0xe7, 60, 100, // N24 Cn3 v100
+		0x98,     // W24
+		62,       // N24 Dn3 (running status)
+		0x98,     // W24
+		0xcf, 64, // TIE En3
+		0x98,             // W24
+		0xce,             // EOT
+		0xb2, 0, 0, 0, 0, // GOTO VOL
+	})
+	put32(testTrack+17, 0x0800_0000+testTrack+4)
+
+	put32(testVoicegroup+4, 0x0800_0000+testWave)
+	binary.LittleEndian.PutUint16(rom[testWave+2:], waveLoop)
+	put32(testWave+4, 13379*1024)
+	put32(testWave+8, 2)
+	put32(testWave+12, 5)
+	copy(rom[testWave+16:], []byte{0, 0x40, 0x7f, 0xc0, 0x80})
+	return rom
+}
+
+func TestDetect(t *testing.T) {
+	e, err := Detect(testROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.SoundMain != 0x0800_0000+testSoundMain {
+		t.Errorf("SoundMain: expected 0x%08x, got 0x%08x", 0x0800_0000+testSoundMain, e.SoundMain)
+	}
+	if e.SongTable != 0x0800_0000+testSongTable || e.PlayerTable != 0x0800_0000+testPlayers {
+		t.Errorf("tables: got 0x%08x 0x%08x", e.SongTable, e.PlayerTable)
+	}
+	if len(e.Songs) != 1 {
+		t.Fatalf("expected 1 song, got %d", len(e.Songs))
+	}
+	s := e.Songs[0]
+	if s.Player != 1 || s.Priority != 5 || s.Voicegroup != 0x0800_0000+testVoicegroup || len(s.Tracks) != 1 {
+		t.Errorf("unexpected song: %s", s)
+	}
+
+	if _, err := Detect(make([]byte, 0x1000)); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDecodeTrack(t *testing.T) {
+	e, err := Detect(testROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := e.DecodeTrack(e.Songs[0].Tracks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Event{
+		{Tick: 0, Type: EventTempo, Value: 120},
+		{Tick: 0, Type: EventVoice},
+		{Tick: 0, Type: EventVolume, Value: 100},
+		{Tick: 0, Type: EventNote, Key: 60, Velocity: 100, Length: 24},
+		{Tick: 24, Type: EventNote, Key: 62, Velocity: 100, Length: 24},
+		{Tick: 48, Type: EventTie, Key: 64, Velocity: 100},
+		{Tick: 72, Type: EventEOT, Key: 64},
+		{Tick: 0, Type: EventLoop},
+		{Tick: 72, Type: EventEnd},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("event %d: expected %+v, got %+v", i, expected[i], events[i])
+		}
+	}
+}
+
+func TestWriteMIDI(t *testing.T) {
+	e, err := Detect(testROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := e.WriteMIDI(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	if string(b[:4]) != "MThd" || binary.BigEndian.Uint16(b[10:]) != 2 || binary.BigEndian.Uint16(b[12:]) != TicksPerBeat {
+		t.Errorf("unexpected header % x", b[:14])
+	}
+	if bytes.Count(b, []byte("MTrk")) != 2 {
+		t.Errorf("expected 2 tracks")
+	}
+	// 120 BPM = 500000us per beat
+	if !bytes.Contains(b, []byte{0xff, 0x51, 3, 0x07, 0xa1, 0x20}) {
+		t.Errorf("tempo isn't found")
+	}
+	if !bytes.Contains(b, []byte("loopStart")) || !bytes.Contains(b, []byte("loopEnd")) {
+		t.Errorf("loop markers aren't found")
+	}
+	// first note: on at 0, off at 24 (delta 0 after the previous event, then 24)
+	if !bytes.Contains(b, []byte{0x00, 0x90, 60, 100, 0x18, 0x80, 60, 0}) {
+		t.Errorf("first note isn't found")
+	}
+
+	if err := e.WriteMIDI(buf, 1); err == nil {
+		t.Errorf("expected error for a song that doesn't exist")
+	}
+}
+
+func TestSamples(t *testing.T) {
+	e, err := Detect(testROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples, err := e.Samples(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(samples))
+	}
+	s := samples[0]
+	if s.Addr != 0x0800_0000+testWave || s.Rate != 13379 || !s.Loop || s.LoopStart != 2 || len(s.Data) != 5 {
+		t.Errorf("unexpected sample %+v", s)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := s.WriteWAV(buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	if string(b[:4]) != "RIFF" || int(binary.LittleEndian.Uint32(b[4:]))+8 != len(b) {
+		t.Errorf("unexpected RIFF size")
+	}
+	if binary.LittleEndian.Uint32(b[24:]) != 13379 {
+		t.Errorf("unexpected sample rate %d", binary.LittleEndian.Uint32(b[24:]))
+	}
+	if !bytes.Equal(b[44:49], []byte{0x80, 0xc0, 0xff, 0x40, 0x00}) {
+		t.Errorf("unexpected data % x", b[44:49])
+	}
+	if !bytes.Contains(b, []byte("smpl")) {
+		t.Errorf("loop isn't written")
+	}
+}
+
+// testMemory is EWRAM only
+type testMemory []byte
+
+func (m testMemory) Get(addr uint32) uint32 {
+	return binary.LittleEndian.Uint32(m[addr-0x0200_0000:])
+}
+
+func (m testMemory) Set8(addr uint32, b byte) {
+	m[addr-0x0200_0000] = b
+}
+
+func TestPlay(t *testing.T) {
+	rom := testROM()
+	const (
+		info   = 0x0200_0100
+		tracks = 0x0200_0200
+		ch     = 0x0200_0400
+	)
+	binary.LittleEndian.PutUint32(rom[testPlayers+12:], info)
+	binary.LittleEndian.PutUint32(rom[testPlayers+16:], tracks)
+	e, err := Detect(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make(testMemory, 0x1000)
+	set32(mem, info+mpIdent, ID_NUMBER)
+	set32(mem, info+mpTracks, tracks)
+	mem.Set8(info+mpTrackCount, 2)
+	set16(mem, info+mpTempoD, 75)
+	for i := uint32(0); i < 2; i++ {
+		mem.Set8(tracks+i*trackSize+trackFlags, trackExist)
+	}
+	set32(mem, tracks+trackSize+trackChan, ch)
+	mem.Set8(ch+chanStatus, 0x83)
+	set32(mem, ch+chanTrack, tracks+trackSize)
+
+	if err := e.Play(mem, 0); err != nil {
+		t.Fatal(err)
+	}
+	if mem.Get(info+mpSongHeader) != 0x0800_0000+testHeader || mem.Get(info+mpTone) != 0x0800_0000+testVoicegroup {
+		t.Errorf("song isn't set")
+	}
+	if mem.Get(info+mpIdent) != ID_NUMBER || mem.Get(info+mpTempoD)&0xffff != 150 || mem[info+mpPriority-0x0200_0000] != 5 {
+		t.Errorf("player isn't reset")
+	}
+	if mem.Get(tracks+trackCmdPtr) != 0x0800_0000+testTrack || mem[tracks-0x0200_0000] != trackExist|trackStart {
+		t.Errorf("track 0 isn't started")
+	}
+	if mem[tracks+trackSize-0x0200_0000] != 0 || mem.Get(tracks+trackSize+trackChan) != 0 {
+		t.Errorf("track 1 isn't stopped")
+	}
+	if mem[ch-0x0200_0000] != 0 || mem.Get(ch+chanTrack) != 0 {
+		t.Errorf("channel of track 1 isn't released")
+	}
+
+	set32(mem, info+mpIdent, ID_NUMBER+1)
+	if err := e.Play(mem, 0); err == nil {
+		t.Errorf("expected error while the player is busy")
+	}
+}
+
+func TestExport(t *testing.T) {
+	e, err := Detect(testROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a song whose track pointer is outside ROM can't be decoded
+	broken := e.Songs[0]
+	broken.Tracks = []uint32{0x0900_0000}
+	e.Songs = append(e.Songs, broken)
+
+	dir := t.TempDir()
+	if err := e.Export(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"song-000.mid", fmt.Sprintf("sample-%08x.wav", 0x0800_0000+testWave)} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s isn't written: %s", name, err)
+		}
+	}
+	list, err := os.ReadFile(filepath.Join(dir, "songs.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(list)), "\n")
+	if len(lines) != 2 || strings.Contains(lines[0], "(") || !strings.Contains(lines[1], "(") {
+		t.Errorf("unexpected songs.txt:\n%s", list)
+	}
+}
@@ -0,0 +1,160 @@
+package m4a
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// WriteMIDI writes the song n as a standard MIDI file (format 1).
+//
+// Track 0 has the tempo and the loop markers ("loopStart", "loopEnd"), followed by a track for each song track.
+// MIDI channel 10 is skipped because it is drums on General MIDI, and the programs are the voicegroup instruments.
+func (e *Engine) WriteMIDI(w io.Writer, n int) error {
+	if n < 0 || n >= len(e.Songs) {
+		return fmt.Errorf("song %d doesn't exist (%d songs)", n, len(e.Songs))
+	}
+	s := e.Songs[n]
+
+	conductor := []midiEvent{}
+	tracks := [][]midiEvent{}
+	loop, end := -1, 0
+	for i, addr := range s.Tracks {
+		events, err := e.DecodeTrack(addr)
+		if err != nil {
+			return fmt.Errorf("track %d: %w", i, err)
+		}
+
+		ch := byte(i)
+		if ch >= 9 {
+			ch++
+		}
+		ch &= 0xf
+
+		t := []midiEvent{}
+		for _, ev := range events {
+			switch ev.Type {
+			case EventTempo:
+				if ev.Value == 0 {
+					continue
+				}
+				us := 60_000_000 / ev.Value
+				conductor = append(conductor, midiEvent{ev.Tick, 1, []byte{0xff, 0x51, 3, byte(us >> 16), byte(us >> 8), byte(us)}})
+			case EventLoop:
+				if loop < 0 || ev.Tick < loop {
+					loop = ev.Tick
+				}
+			case EventEnd:
+				if ev.Tick > end {
+					end = ev.Tick
+				}
+			default:
+				t = append(t, channelEvents(ev, ch)...)
+			}
+		}
+		tracks = append(tracks, t)
+	}
+	if loop >= 0 {
+		conductor = append(conductor, metaText(loop, 0x06, "loopStart"), metaText(end, 0x06, "loopEnd"))
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("MThd")
+	binary.Write(buf, binary.BigEndian, uint32(6))
+	binary.Write(buf, binary.BigEndian, []uint16{1, uint16(len(tracks) + 1), TicksPerBeat})
+	writeTrack(buf, conductor)
+	for _, t := range tracks {
+		writeTrack(buf, t)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type midiEvent struct {
+	tick int
+
+	// order sorts the events at the same tick: note off (0) comes before the others (1)
+	order int
+	data  []byte
+}
+
+func metaText(tick int, kind byte, text string) midiEvent {
+	data := append([]byte{0xff, kind}, vlq(len(text))...)
+	return midiEvent{tick, 1, append(data, text...)}
+}
+
+// channelEvents converts a track event into MIDI events on the channel
+func channelEvents(ev Event, ch byte) []midiEvent {
+	on := func(tick int, data ...byte) midiEvent { return midiEvent{tick, 1, data} }
+	switch ev.Type {
+	case EventNote:
+		return []midiEvent{
+			on(ev.Tick, 0x90|ch, ev.Key, velocity(ev.Velocity)),
+			{ev.Tick + ev.Length, 0, []byte{0x80 | ch, ev.Key, 0}},
+		}
+	case EventTie:
+		return []midiEvent{on(ev.Tick, 0x90|ch, ev.Key, velocity(ev.Velocity))}
+	case EventEOT:
+		return []midiEvent{{ev.Tick, 0, []byte{0x80 | ch, ev.Key, 0}}}
+	case EventVoice:
+		return []midiEvent{on(ev.Tick, 0xc0|ch, byte(ev.Value&0x7f))}
+	case EventVolume:
+		return []midiEvent{on(ev.Tick, 0xb0|ch, 7, byte(ev.Value&0x7f))}
+	case EventPan:
+		return []midiEvent{on(ev.Tick, 0xb0|ch, 10, byte(ev.Value&0x7f))}
+	case EventMod:
+		return []midiEvent{on(ev.Tick, 0xb0|ch, 1, byte(ev.Value&0x7f))}
+	case EventBend:
+		v := (ev.Value + 64) << 7
+		return []midiEvent{on(ev.Tick, 0xe0|ch, byte(v&0x7f), byte(v>>7&0x7f))}
+	case EventBendRange:
+		// RPN 0 (pitch bend sensitivity)
+		return []midiEvent{
+			on(ev.Tick, 0xb0|ch, 101, 0),
+			on(ev.Tick, 0xb0|ch, 100, 0),
+			on(ev.Tick, 0xb0|ch, 6, byte(ev.Value&0x7f)),
+		}
+	}
+	return nil
+}
+
+// velocity keeps a note with velocity 0 from being note off
+func velocity(v byte) byte {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
+
+func writeTrack(buf *bytes.Buffer, events []midiEvent) {
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].tick != events[j].tick {
+			return events[i].tick < events[j].tick
+		}
+		return events[i].order < events[j].order
+	})
+
+	data := []byte{}
+	tick := 0
+	for _, ev := range events {
+		data = append(data, vlq(ev.tick-tick)...)
+		data = append(data, ev.data...)
+		tick = ev.tick
+	}
+	data = append(data, 0, 0xff, 0x2f, 0) // end of track
+
+	buf.WriteString("MTrk")
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+}
+
+// vlq encodes n as a variable-length quantity
+func vlq(n int) []byte {
+	b := []byte{byte(n & 0x7f)}
+	for n >>= 7; n > 0; n >>= 7 {
+		b = append([]byte{byte(n&0x7f) | 0x80}, b...)
+	}
+	return b
+}
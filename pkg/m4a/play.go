@@ -0,0 +1,129 @@
+package m4a
+
+import (
+	"fmt"
+
+	"github.com/pokemium/magia/pkg/gba/ram"
+)
+
+// Memory is the memory of the running game. *ram.RAM implements it.
+type Memory interface {
+	Get(addr uint32) uint32
+	Set8(addr uint32, b byte)
+}
+
+// MusicPlayerInfo
+const (
+	mpSongHeader = 0x00
+	mpStatus     = 0x04
+	mpTrackCount = 0x08
+	mpPriority   = 0x09
+	mpClock      = 0x0c
+	mpTempoD     = 0x1c
+	mpTempoU     = 0x1e
+	mpTempoI     = 0x20
+	mpTempoC     = 0x22
+	mpFadeOI     = 0x24
+	mpTracks     = 0x2c
+	mpTone       = 0x30
+	mpIdent      = 0x34
+)
+
+// MusicPlayerTrack
+const (
+	trackSize   = 0x50
+	trackFlags  = 0x00
+	trackChan   = 0x20
+	trackCmdPtr = 0x40
+
+	trackExist = 0x80
+	trackStart = 0x40
+)
+
+// SoundChannel
+const (
+	chanStatus = 0x00
+	chanTrack  = 0x2c
+	chanNext   = 0x34
+
+	// maxChannels stops following a broken channel list
+	maxChannels = 32
+)
+
+// Play starts the song n in the running game, like m4aSongNumStart.
+//
+// The song is written into its music player in RAM, and the engine of the game plays it from the next frame.
+// The priority of the playing song is ignored, and the reverb of the song header isn't applied.
+func (e *Engine) Play(mem Memory, n int) error {
+	if n < 0 || n >= len(e.Songs) {
+		return fmt.Errorf("song %d doesn't exist (%d songs)", n, len(e.Songs))
+	}
+	s := e.Songs[n]
+
+	info, _ := e.rom.u32(e.PlayerTable + uint32(s.Player)*12)
+	if !wram(info) {
+		return fmt.Errorf("music player %d isn't in RAM (0x%08x)", s.Player, info)
+	}
+	if id := mem.Get(info + mpIdent); id != ID_NUMBER {
+		return fmt.Errorf("music player %d isn't ready (ident 0x%08x)", s.Player, id)
+	}
+
+	// the engine skips the player while the ident is changed (MPlayStart)
+	set32(mem, info+mpIdent, ID_NUMBER+1)
+	defer set32(mem, info+mpIdent, ID_NUMBER)
+
+	set32(mem, info+mpStatus, 0)
+	set32(mem, info+mpSongHeader, s.Header)
+	set32(mem, info+mpTone, s.Voicegroup)
+	mem.Set8(info+mpPriority, s.Priority)
+	set32(mem, info+mpClock, 0)
+	set16(mem, info+mpTempoD, 150)
+	set16(mem, info+mpTempoI, 150)
+	set16(mem, info+mpTempoU, 0x100)
+	set16(mem, info+mpTempoC, 0)
+	set16(mem, info+mpFadeOI, 0)
+
+	tracks := mem.Get(info + mpTracks)
+	count := int(mem.Get(info+mpTrackCount) & 0xff)
+	if !wram(tracks) {
+		return fmt.Errorf("tracks of music player %d aren't in RAM (0x%08x)", s.Player, tracks)
+	}
+	for i := 0; i < count; i++ {
+		t := tracks + uint32(i)*trackSize
+		stopTrack(mem, t)
+		if i < len(s.Tracks) {
+			mem.Set8(t+trackFlags, trackExist|trackStart)
+			set32(mem, t+trackCmdPtr, s.Tracks[i])
+		} else {
+			mem.Set8(t+trackFlags, 0)
+		}
+	}
+	return nil
+}
+
+// stopTrack releases the sound channels of the track (TrackStop)
+func stopTrack(mem Memory, track uint32) {
+	if mem.Get(track+trackFlags)&trackExist != 0 {
+		ch := mem.Get(track + trackChan)
+		for i := 0; i < maxChannels && wram(ch); i++ {
+			mem.Set8(ch+chanStatus, 0)
+			set32(mem, ch+chanTrack, 0)
+			ch = mem.Get(ch + chanNext)
+		}
+	}
+	set32(mem, track+trackChan, 0)
+}
+
+func wram(addr uint32) bool {
+	return ram.EWRAM(addr) || ram.IWRAM(addr)
+}
+
+func set16(mem Memory, addr uint32, val uint16) {
+	mem.Set8(addr, byte(val))
+	mem.Set8(addr+1, byte(val>>8))
+}
+
+func set32(mem Memory, addr uint32, val uint32) {
+	set16(mem, addr, uint16(val))
+	set16(mem, addr+2, uint16(val>>16))
+}
@@ -0,0 +1,325 @@
+package m4a
+
+import "fmt"
+
+// Ticks per quarter note. TEMPO is in half BPM, and the engine counts 24 ticks per beat at 150 tempoD.
+const TicksPerBeat = 24
+
+// Track commands
+const (
+	cmdWait   = 0x80 // 0x80-0xb0
+	cmdFine   = 0xb1
+	cmdGoto   = 0xb2
+	cmdPatt   = 0xb3
+	cmdPend   = 0xb4
+	cmdRept   = 0xb5
+	cmdMemacc = 0xb9
+	cmdPrio   = 0xba
+	cmdTempo  = 0xbb
+	cmdKeysh  = 0xbc
+	cmdVoice  = 0xbd
+	cmdVol    = 0xbe
+	cmdPan    = 0xbf
+	cmdBend   = 0xc0
+	cmdBendr  = 0xc1
+	cmdLfos   = 0xc2
+	cmdLfodl  = 0xc3
+	cmdMod    = 0xc4
+	cmdModt   = 0xc5
+	cmdTune   = 0xc8
+	cmdXcmd   = 0xcd
+	cmdEOT    = 0xce
+	cmdTie    = 0xcf
+	cmdNote   = 0xd0 // 0xd0-0xff
+)
+
+// lenTable converts the wait and note commands to ticks
+var lenTable = [...]byte{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24,
+	28, 30, 32, 36, 40, 42, 44, 48, 52, 54, 56, 60, 64, 66, 68, 72, 76, 78, 80, 84, 88, 90, 92, 96,
+}
+
+// EventType is the kind of a decoded track event
+type EventType int
+
+const (
+	EventNote      EventType = iota // Key, Velocity, Length
+	EventTie                        // Key, Velocity; lasts until EventEOT of the key
+	EventEOT                        // Key
+	EventTempo                      // Value: BPM
+	EventVoice                      // Value: instrument of the voicegroup
+	EventVolume                     // Value: 0-127
+	EventPan                        // Value: 0-127, 64 is center
+	EventBend                       // Value: -64-63
+	EventBendRange                  // Value: semitones
+	EventMod                        // Value: 0-127
+	EventLoop                       // the GOTO target at the end of the song
+	EventEnd                        // FINE or GOTO
+)
+
+// Event is a track event at Tick (from the start of the song)
+type Event struct {
+	Tick     int
+	Type     EventType
+	Key      byte
+	Velocity byte
+	Length   int
+	Value    int
+}
+
+// maxEvents stops decoding a broken track which never ends
+const maxEvents = 1 << 16
+
+// maxPattStack is the depth of PATT nesting of the engine
+const maxPattStack = 3
+
+// DecodeTrack decodes the track at addr until FINE or GOTO. The key shift (KEYSH) is applied to the keys.
+//
+// A GOTO back into the track adds EventLoop at the tick of the target, followed by EventEnd.
+func (e *Engine) DecodeTrack(addr uint32) ([]Event, error) {
+	d := decoder{rom: e.rom, pc: addr, key: 60, velocity: 127, visited: map[uint32]int{}}
+	for len(d.events) < maxEvents {
+		done, err := d.step()
+		if err != nil {
+			return d.events, err
+		}
+		if done {
+			return d.events, nil
+		}
+	}
+	return d.events, fmt.Errorf("track at 0x%08x has too many events", addr)
+}
+
+type decoder struct {
+	rom    rom
+	pc     uint32
+	tick   int
+	events []Event
+
+	// running status of the commands 0xbd-0xff
+	status byte
+
+	// sticky note parameters
+	key, velocity byte
+	keyShift      int
+
+	stack []uint32
+
+	// REPT counter
+	repeat int
+
+	// visited is the tick at each command address, for the loop of GOTO
+	visited map[uint32]int
+}
+
+func (d *decoder) byte() (byte, error) {
+	b, ok := d.rom.u8(d.pc)
+	if !ok {
+		return 0, fmt.Errorf("track reads out of ROM at 0x%08x", d.pc)
+	}
+	d.pc++
+	return b, nil
+}
+
+func (d *decoder) ptr() (uint32, error) {
+	p, ok := d.rom.u32(d.pc)
+	if !ok {
+		return 0, fmt.Errorf("track reads out of ROM at 0x%08x", d.pc)
+	}
+	d.pc += 4
+	return p, nil
+}
+
+// arg reads the optional argument of a note (0-127). Bytes with bit 7 are the next command.
+func (d *decoder) arg() (byte, bool) {
+	b, ok := d.rom.u8(d.pc)
+	if !ok || b >= 0x80 {
+		return 0, false
+	}
+	d.pc++
+	return b, true
+}
+
+func (d *decoder) add(ev Event) {
+	ev.Tick = d.tick
+	d.events = append(d.events, ev)
+}
+
+func (d *decoder) shifted(key byte) byte {
+	k := int(key) + d.keyShift
+	switch {
+	case k < 0:
+		k = 0
+	case k > 127:
+		k = 127
+	}
+	return byte(k)
+}
+
+// step decodes a command. It returns true at the end of the track.
+func (d *decoder) step() (bool, error) {
+	if _, ok := d.visited[d.pc]; !ok && len(d.stack) == 0 {
+		d.visited[d.pc] = d.tick
+	}
+
+	cmd, err := d.byte()
+	if err != nil {
+		return false, err
+	}
+	if cmd < 0x80 {
+		// running status: the byte is the first argument of the last command
+		if d.status == 0 {
+			return false, fmt.Errorf("track has an argument without command at 0x%08x", d.pc-1)
+		}
+		cmd = d.status
+		d.pc--
+	} else if cmd >= cmdVoice {
+		d.status = cmd
+	}
+
+	switch {
+	case cmd <= cmdWait+byte(len(lenTable)-1):
+		d.tick += int(lenTable[cmd-cmdWait])
+		return false, nil
+	case cmd >= cmdTie:
+		d.note(cmd)
+		return false, nil
+	}
+
+	switch cmd {
+	case cmdFine:
+		d.add(Event{Type: EventEnd})
+		return true, nil
+
+	case cmdGoto:
+		target, err := d.ptr()
+		if err != nil {
+			return false, err
+		}
+		if tick, ok := d.visited[target]; ok {
+			d.events = append(d.events, Event{Tick: tick, Type: EventLoop})
+		}
+		d.add(Event{Type: EventEnd})
+		return true, nil
+
+	case cmdPatt:
+		target, err := d.ptr()
+		if err != nil {
+			return false, err
+		}
+		if len(d.stack) >= maxPattStack {
+			return false, fmt.Errorf("track nests PATT too deep at 0x%08x", d.pc-5)
+		}
+		d.stack = append(d.stack, d.pc)
+		d.pc = target
+
+	case cmdPend:
+		if len(d.stack) > 0 {
+			d.pc = d.stack[len(d.stack)-1]
+			d.stack = d.stack[:len(d.stack)-1]
+		}
+
+	case cmdRept:
+		n, err := d.byte()
+		if err != nil {
+			return false, err
+		}
+		target, err := d.ptr()
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			// infinite repeat is a loop
+			if tick, ok := d.visited[target]; ok {
+				d.events = append(d.events, Event{Tick: tick, Type: EventLoop})
+			}
+			d.add(Event{Type: EventEnd})
+			return true, nil
+		}
+		d.repeat++
+		if d.repeat < int(n) {
+			d.pc = target
+		} else {
+			d.repeat = 0
+		}
+
+	case cmdMemacc:
+		d.pc += 3
+
+	case cmdPrio, cmdLfos, cmdLfodl, cmdModt, cmdTune:
+		d.pc++
+
+	case cmdTempo:
+		v, err := d.byte()
+		if err != nil {
+			return false, err
+		}
+		d.add(Event{Type: EventTempo, Value: int(v) * 2})
+
+	case cmdKeysh:
+		v, err := d.byte()
+		if err != nil {
+			return false, err
+		}
+		d.keyShift = int(int8(v))
+
+	case cmdVoice, cmdVol, cmdPan, cmdBend, cmdBendr, cmdMod:
+		v, err := d.byte()
+		if err != nil {
+			return false, err
+		}
+		d.control(cmd, v)
+
+	case cmdXcmd:
+		d.pc += 2
+
+	case cmdEOT:
+		if k, ok := d.arg(); ok {
+			d.key = k
+		}
+		d.add(Event{Type: EventEOT, Key: d.shifted(d.key)})
+
+	default:
+		return false, fmt.Errorf("unknown track command 0x%02x at 0x%08x", cmd, d.pc-1)
+	}
+	return false, nil
+}
+
+func (d *decoder) control(cmd, v byte) {
+	switch cmd {
+	case cmdVoice:
+		d.add(Event{Type: EventVoice, Value: int(v)})
+	case cmdVol:
+		d.add(Event{Type: EventVolume, Value: int(v)})
+	case cmdPan:
+		d.add(Event{Type: EventPan, Value: int(v)})
+	case cmdBend:
+		d.add(Event{Type: EventBend, Value: int(v) - 64})
+	case cmdBendr:
+		d.add(Event{Type: EventBendRange, Value: int(v)})
+	case cmdMod:
+		d.add(Event{Type: EventMod, Value: int(v)})
+	}
+}
+
+// note decodes TIE and the notes. The key and velocity are kept for the next notes, and the gate time is added to this note only.
+func (d *decoder) note(cmd byte) {
+	gate := 0
+	if k, ok := d.arg(); ok {
+		d.key = k
+		if v, ok := d.arg(); ok {
+			d.velocity = v
+			if cmd != cmdTie {
+				if g, ok := d.arg(); ok {
+					gate = int(g)
+				}
+			}
+		}
+	}
+
+	if cmd == cmdTie {
+		d.add(Event{Type: EventTie, Key: d.shifted(d.key), Velocity: d.velocity})
+		return
+	}
+	d.add(Event{Type: EventNote, Key: d.shifted(d.key), Velocity: d.velocity, Length: int(lenTable[cmd-cmdTie]) + gate})
+}
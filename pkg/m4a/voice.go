@@ -0,0 +1,157 @@
+package m4a
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ToneData types
+const (
+	voiceDirectSoundMask = 0xc7 // DirectSound when type&mask == 0
+	voiceKeySplit        = 0x40
+	voiceDrumKit         = 0x80
+)
+
+const (
+	toneDataSize = 12
+
+	// voicegroupSize is the number of instruments of a voicegroup, the range of VOICE and the keys of a drum kit
+	voicegroupSize = 128
+
+	waveDataHeaderSize = 16
+	waveLoop           = 0x4000
+
+	// maxSampleSize rejects a wrong pointer which isn't WaveData
+	maxSampleSize = 1 << 22
+)
+
+// Sample is a DirectSound sample (WaveData) of a voicegroup
+type Sample struct {
+	Addr uint32
+
+	// Rate is the sample rate when the sample is played at its base key (C5), in Hz
+	Rate float64
+
+	Loop      bool
+	LoopStart uint32
+
+	Data []int8
+}
+
+// Samples returns the DirectSound samples of the voicegroup of the song n, including those in key splits and drum kits.
+// The samples are sorted by address, and each one appears once.
+func (e *Engine) Samples(n int) ([]Sample, error) {
+	if n < 0 || n >= len(e.Songs) {
+		return nil, fmt.Errorf("song %d doesn't exist (%d songs)", n, len(e.Songs))
+	}
+
+	found := map[uint32]Sample{}
+	e.collectSamples(e.Songs[n].Voicegroup, 0, found)
+
+	samples := make([]Sample, 0, len(found))
+	for _, s := range found {
+		samples = append(samples, s)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Addr < samples[j].Addr })
+	return samples, nil
+}
+
+// collectSamples reads the instruments of the voicegroup. Key splits and drum kits are voicegroups in a voicegroup, and they aren't nested further.
+func (e *Engine) collectSamples(voicegroup uint32, depth int, found map[uint32]Sample) {
+	for i := uint32(0); i < voicegroupSize; i++ {
+		entry := voicegroup + i*toneDataSize
+		typ, ok1 := e.rom.u8(entry)
+		ptr, ok2 := e.rom.u32(entry + 4)
+		if !ok1 || !ok2 {
+			return
+		}
+
+		switch {
+		case typ&voiceDirectSoundMask == 0:
+			if _, ok := found[ptr]; ok {
+				continue
+			}
+			if s, ok := e.readSample(ptr); ok {
+				found[ptr] = s
+			}
+		case typ == voiceKeySplit || typ == voiceDrumKit:
+			if depth == 0 && e.rom.valid(ptr, toneDataSize) {
+				e.collectSamples(ptr, depth+1, found)
+			}
+		}
+	}
+}
+
+// readSample reads WaveData at addr
+func (e *Engine) readSample(addr uint32) (Sample, bool) {
+	typ, ok1 := e.rom.u16(addr)
+	status, ok2 := e.rom.u16(addr + 2)
+	freq, ok3 := e.rom.u32(addr + 4)
+	loopStart, ok4 := e.rom.u32(addr + 8)
+	size, ok5 := e.rom.u32(addr + 12)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || typ != 0 || size == 0 || size > maxSampleSize {
+		return Sample{}, false
+	}
+	if !e.rom.valid(addr+waveDataHeaderSize, int(size)) {
+		return Sample{}, false
+	}
+
+	ofs := addr + waveDataHeaderSize - 0x0800_0000
+	data := make([]int8, size)
+	for i, b := range e.rom[ofs : ofs+size] {
+		data[i] = int8(b)
+	}
+	return Sample{
+		Addr:      addr,
+		Rate:      float64(freq) / 1024,
+		Loop:      status&waveLoop != 0 && loopStart < size,
+		LoopStart: loopStart,
+		Data:      data,
+	}, true
+}
+
+// WriteWAV writes the sample as 8bit mono PCM. A looped sample has the loop in the "smpl" chunk.
+func (s Sample) WriteWAV(w io.Writer) error {
+	rate := uint32(s.Rate + 0.5)
+	if rate == 0 {
+		rate = 1
+	}
+	size := uint32(len(s.Data))
+
+	smpl := []byte{}
+	if s.Loop {
+		smpl = make([]byte, 8+36+24)
+		copy(smpl[0:], "smpl")
+		binary.LittleEndian.PutUint32(smpl[4:], 36+24)
+		binary.LittleEndian.PutUint32(smpl[16:], 1_000_000_000/rate) // sample period in ns
+		binary.LittleEndian.PutUint32(smpl[20:], 72)                 // base key: C5
+		binary.LittleEndian.PutUint32(smpl[36:], 1)                  // loops
+		binary.LittleEndian.PutUint32(smpl[52:], s.LoopStart)
+		binary.LittleEndian.PutUint32(smpl[56:], size-1)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("RIFF")
+	binary.Write(buf, binary.LittleEndian, uint32(4+24+8+size+size&1+uint32(len(smpl))))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(buf, binary.LittleEndian, uint32(16))
+	binary.Write(buf, binary.LittleEndian, []uint16{1, 1}) // PCM, mono
+	binary.Write(buf, binary.LittleEndian, []uint32{rate, rate})
+	binary.Write(buf, binary.LittleEndian, []uint16{1, 8})
+	buf.WriteString("data")
+	binary.Write(buf, binary.LittleEndian, size)
+	for _, b := range s.Data {
+		// 8bit WAV is unsigned
+		buf.WriteByte(byte(b) ^ 0x80)
+	}
+	if size&1 != 0 {
+		buf.WriteByte(0)
+	}
+	buf.Write(smpl)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -160,6 +160,14 @@ func SetBit32(val uint32, idx int, b bool) uint32 {
 	}
 	return val
 }
+func SetBit16(val uint16, idx int, b bool) uint16 {
+	if b {
+		val = val | (1 << idx)
+	} else {
+		val = val & ^(1 << idx)
+	}
+	return val
+}
 func SetBit8(val byte, idx int, b bool) byte {
 	if b {
 		val = val | (1 << idx)